@@ -0,0 +1,103 @@
+// Package handle parses the volume handles, or IDs, that the plug-in's
+// controller service gives the CO, and its node service receives, so both
+// understand the handles of every version.
+package handle
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Format is a format of volume handle
+type Format int
+
+const (
+	// Legacy handles are the ScaleIO volume ID alone
+	Legacy Format = iota
+
+	// Composite handles are the ScaleIO system ID and the volume ID,
+	// joined by a dash
+	Composite
+)
+
+// Formats are the formats of volume handle understood by Parse
+var Formats = []Format{Legacy, Composite}
+
+// String returns the format as written in errors
+func (f Format) String() string {
+	switch f {
+	case Legacy:
+		return "<volumeID>"
+	case Composite:
+		return "<systemID>-<volumeID>"
+	}
+	return fmt.Sprintf("Format(%d)", int(f))
+}
+
+// sioID matches a ScaleIO object ID
+const sioID = `[0-9A-Za-z]+`
+
+var patterns = map[Format]*regexp.Regexp{
+	Legacy:    regexp.MustCompile(`^(` + sioID + `)$`),
+	Composite: regexp.MustCompile(`^(` + sioID + `)-(` + sioID + `)$`),
+}
+
+// Handle is a parsed volume handle
+type Handle struct {
+	// SystemID is the ID of the ScaleIO system the volume is in, if the
+	// handle gives it
+	SystemID string
+
+	// VolumeID is the ScaleIO volume ID
+	VolumeID string
+
+	// Format is the format the handle was in
+	Format Format
+}
+
+// String returns the handle in its format
+func (h Handle) String() string {
+	if h.Format == Composite {
+		return h.SystemID + "-" + h.VolumeID
+	}
+	return h.VolumeID
+}
+
+// Error is returned for a handle in none of the formats tried
+type Error struct {
+	// Handle is the raw handle
+	Handle string
+
+	// Formats are the formats tried
+	Formats []Format
+}
+
+func (e *Error) Error() string {
+	formats := make([]string, len(e.Formats))
+	for i, f := range e.Formats {
+		formats[i] = f.String()
+	}
+	return fmt.Sprintf("volume handle %q is not in a format understood "+
+		"by this version of the plug-in: %s", e.Handle,
+		strings.Join(formats, ", "))
+}
+
+// Parse parses raw, trying each of formats, or every format in Formats if
+// none are given
+func Parse(raw string, formats ...Format) (Handle, error) {
+	if len(formats) == 0 {
+		formats = Formats
+	}
+	for _, f := range formats {
+		m := patterns[f].FindStringSubmatch(raw)
+		if m == nil {
+			continue
+		}
+		if f == Composite {
+			return Handle{SystemID: m[1], VolumeID: m[2], Format: f}, nil
+		}
+		return Handle{VolumeID: m[1], Format: f}, nil
+	}
+	return Handle{}, &Error{Handle: raw, Formats: formats}
+}
@@ -0,0 +1,51 @@
+package handle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	h, err := Parse("2a1b3c4d00000001")
+	assert.NoError(t, err)
+	assert.Equal(t, Handle{VolumeID: "2a1b3c4d00000001", Format: Legacy}, h)
+	assert.Equal(t, "2a1b3c4d00000001", h.String())
+
+	h, err = Parse("7ec27ef41b2e1d00-2a1b3c4d00000001")
+	assert.NoError(t, err)
+	assert.Equal(t, Handle{
+		SystemID: "7ec27ef41b2e1d00",
+		VolumeID: "2a1b3c4d00000001",
+		Format:   Composite,
+	}, h)
+	assert.Equal(t, "7ec27ef41b2e1d00-2a1b3c4d00000001", h.String())
+
+	for _, raw := range []string{
+		"",
+		"-2a1b3c4d00000001",
+		"7ec27ef41b2e1d00-",
+		"a-b-c",
+		"vol/1",
+	} {
+		_, err := Parse(raw)
+		if assert.IsType(t, &Error{}, err, raw) {
+			assert.Contains(t, err.Error(), "<volumeID>, <systemID>-<volumeID>")
+		}
+	}
+}
+
+// Handles made by one version are given to another during upgrades
+func TestParseAcrossVersions(t *testing.T) {
+	// old handles are understood by new code
+	h, err := Parse("2a1b3c4d00000001", Formats...)
+	assert.NoError(t, err)
+	assert.Equal(t, "2a1b3c4d00000001", h.VolumeID)
+
+	// new handles are refused explicitly by code understanding only the
+	// old ones
+	_, err = Parse("7ec27ef41b2e1d00-2a1b3c4d00000001", Legacy)
+	assert.EqualError(t, err, `volume handle "7ec27ef41b2e1d00-`+
+		`2a1b3c4d00000001" is not in a format understood by this version `+
+		`of the plug-in: <volumeID>`)
+}
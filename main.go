@@ -4,8 +4,14 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"os"
 
 	"github.com/rexray/gocsi"
+	"github.com/rexray/gocsi/utils"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 
 	"github.com/thecodeteam/csi-scaleio/provider"
 	"github.com/thecodeteam/csi-scaleio/service"
@@ -13,6 +19,17 @@ import (
 
 // main is ignored when this package is built as a go plug-in
 func main() {
+	// gRPC's own traces record every request, secrets included, and
+	// aren't served. This is set before gRPC is first used, as it is read
+	// by every client and server.
+	grpc.EnableTracing = false
+
+	if len(os.Args) > 1 {
+		if _, ok := service.Commands[os.Args[1]]; ok {
+			runCommand(os.Args[1], os.Args[2:])
+		}
+	}
+	removeStaleSock()
 	gocsi.Run(
 		context.Background(),
 		service.Name,
@@ -21,10 +38,66 @@ func main() {
 		provider.New())
 }
 
-const usage = `    X_CSI_SCALEIO_ENDPOINT
+// runCommand runs the subcommand name, such as "check", instead of serving
+// the plug-in, and exits non-zero if it fails
+func runCommand(name string, args []string) {
+	if err := service.RunCommand(
+		context.Background(), name, args, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s: %s\n", os.Args[0], name, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// removeStaleSock removes the unix socket at CSI_ENDPOINT if it was left
+// behind by an instance that didn't exit cleanly, as it would otherwise
+// prevent the plug-in from listening. A socket that accepts connections
+// belongs to a running instance and is left alone.
+func removeStaleSock() {
+	proto, addr, err := utils.GetCSIEndpoint()
+	if err != nil || proto != "unix" {
+		return
+	}
+	fi, err := os.Stat(addr)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	if c, err := net.Dial(proto, addr); err == nil {
+		c.Close()
+		return
+	}
+	if err := os.Remove(addr); err != nil {
+		log.WithError(err).WithField("path", addr).Warn(
+			"unable to remove stale sock file")
+		return
+	}
+	log.WithField("path", addr).Info("removed stale sock file")
+}
+
+const usage = `    X_CSI_SCALEIO_CONFIG_FILE
+        Specifies the path to a JSON or YAML configuration file. The keys in
+        the file stand in for the environment variables below, for example
+        endpoint for X_CSI_SCALEIO_ENDPOINT. Environment variables take
+        precedence over the values in the file.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_ENDPOINT
         Specifies the HTTP endpoint for the ScaleIO gateway. This parameter is
         required when running the Controller service.
 
+        The endpoint is given as https://<gateway host>[:<port>][/api]. A
+        missing scheme is taken to be https, a missing port to be 443, and
+        /api is added if missing. An endpoint that isn't of this form fails
+        the plugin at start-up.
+
+        A comma separated list of the endpoints of several gateways of the
+        same system may be given. Requests are made to one gateway until it
+        can't be reached, when the others are tried in order, logging in to
+        each as needed, and the first reached is used from then on. A
+        gateway that couldn't be reached is tried after the others for a
+        minute, so that requests don't flap between gateways.
+
         The default value is empty.
 
     X_CSI_SCALEIO_USER
@@ -52,8 +125,15 @@ const usage = `    X_CSI_SCALEIO_ENDPOINT
 
     X_CSI_SCALEIO_SDCGUID
         Specifies the GUID of the SDC. This is only used by the Node Service,
-        and removes a need for calling an external binary to retrieve the GUID.
-        If not set, the external binary will be invoked.
+        and removes a need for querying the SDC to retrieve the GUID.
+        If not set, the SDC kernel module will be queried.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_DRVCFG_PATH
+        Specifies the path to the SDC's drv_cfg binary. This is only used by
+        the Node Service. When set, drv_cfg is used to retrieve the GUID if
+        the SDC kernel module cannot be queried directly.
 
         The default value is empty.
 
@@ -61,4 +141,453 @@ const usage = `    X_CSI_SCALEIO_ENDPOINT
         Specifies whether thick provisiong should be used when creating volumes.
 
         The default value is false.
+
+    X_CSI_SCALEIO_AUTOPROBE
+        Specifies whether the SP should probe itself when it receives
+        requests before having been probed by the CO.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_SOCK_PERMS
+        Specifies the permissions, in octal, applied to CSI_ENDPOINT when it
+        is a unix socket.
+
+        The default value is empty, leaving the permissions unchanged.
+
+    X_CSI_SCALEIO_SOCK_OWNER
+        Specifies the owner, in the form user[:group], applied to
+        CSI_ENDPOINT when it is a unix socket. The user and group may be
+        names or numeric IDs.
+
+        The default value is empty, leaving the owner unchanged.
+
+    X_CSI_SCALEIO_SOCK_STRICT
+        Specifies whether failing to apply X_CSI_SCALEIO_SOCK_PERMS or
+        X_CSI_SCALEIO_SOCK_OWNER stops the SP from starting. Otherwise the
+        failure is only logged.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_METRICS_ADDR
+        Specifies the address, such as :9090, on which Prometheus metrics are
+        served at /metrics. Metrics are not collected when this is not set.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_HEALTH_ADDR
+        Specifies the address, such as :9808, on which HTTP liveness and
+        readiness checks are served at /healthz and /readyz. The readiness
+        check fails if the last probe failed, and probes the SP again if
+        the last probe is more than 30 seconds old.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_PROBE_CACHE_TTL
+        Specifies how long Probe reuses the result of a successful probe,
+        rather than probing again, which for the Controller Service
+        contacts the ScaleIO Gateway. The result of a failed probe is
+        reused for at most a second. 0 probes on every call.
+
+        The default value is 5s.
+
+    X_CSI_SCALEIO_LOG_FORMAT
+        Specifies the format of the log output, either text or json. Log
+        entries emitted while handling a request carry the request's ID,
+        and the ID of the volume concerned when there is one.
+
+        The default value is text.
+
+    X_CSI_SCALEIO_LOG_LEVEL
+        Specifies the level of the log output, one of error, warn, info,
+        debug or trace, which is the same as debug. At debug each request
+        and response is logged too. It takes precedence over
+        X_CSI_SCALEIO_DEBUG, and both take precedence over X_CSI_LOG_LEVEL.
+
+        The default value is info.
+
+    X_CSI_SCALEIO_DEBUG
+        A flag that sets the log level to debug, unless
+        X_CSI_SCALEIO_LOG_LEVEL is set, logging each request and response.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_RPC_TIMEOUTS
+        Specifies the deadlines applied to RPCs that arrive without one, as a
+        comma separated list of Method=duration pairs, for example
+        "CreateVolume=10m,Probe=10s". The method "default" sets the deadline
+        of RPCs not otherwise listed, and a duration of 0 disables the
+        deadline. RPCs that exceed their deadline fail with
+        DeadlineExceeded, and the mount, mkfs and other host tools they run
+        are killed.
+
+        By default CreateVolume and NodePublishVolume are allowed 5m, the
+        other volume RPCs 2m, probes and capability queries 30s, and all
+        other RPCs 1m.
+
+    X_CSI_SCALEIO_SHUTDOWN_TIMEOUT
+        Specifies how long a graceful stop, such as on SIGTERM, waits for
+        in-flight requests to finish. New requests are refused while
+        waiting. Requests still in flight when the timeout expires are
+        abandoned, and logged with the IDs of the volumes they concern.
+
+        The default value is 30s.
+
+    X_CSI_SCALEIO_ORPHAN_SCAN_INTERVAL
+        Specifies how often the controller looks for volumes mapped to SDCs
+        that are no longer registered with the system, such as those of
+        removed hosts. Each one found is logged.
+
+        Scans are disabled by default.
+
+    X_CSI_SCALEIO_ORPHAN_CLEANUP
+        A flag that enables unmapping the volumes found by orphan scans from
+        the missing SDCs. Each unmap is logged with the volume and SDC IDs.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_CLEANUP_DISCONNECTED
+        A flag that makes DeleteVolume unmap a volume whose only mappings
+        are to SDCs that are disconnected from the system, such as those
+        of deleted nodes, and then delete it. Each unmap is logged with
+        the SDC's ID and last reported state. Otherwise, and if any of the
+        SDCs is connected, deleting a mapped volume fails.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_KEEPALIVE_INTERVAL
+        Specifies how often the controller pings the ScaleIO Gateway, once
+        probed, so that its session doesn't expire while the plug-in is
+        idle. Pings are put off, up to 30m, while the gateway is down.
+
+        The default value is 0, which disables pings.
+
+    X_CSI_SCALEIO_PREFETCH
+        A flag that makes the controller, once first probed, fill its
+        caches of the storage pools and of the IDs of the SDCs registered
+        with the system in the background, so the first requests after a
+        restart don't each wait for the ScaleIO Gateway. Requests are
+        served meanwhile. Prefetching is abandoned after 30s, or when the
+        plug-in stops, and its outcome is logged.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_GATEWAY_DEBUG
+        A flag that enables logging each call the controller makes to the
+        ScaleIO Gateway, with the IDs and names it acts upon, its duration,
+        and its error, if any. Request and response bodies are never logged.
+        The latency and failures of gateway calls are recorded by the
+        metrics endpoint whether or not this is set.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_AUDIT_LOG
+        Specifies the file to which the Controller Service records each
+        volume it creates, deletes, maps and unmaps, as a JSON line with the
+        time, operation, volume, node, size, result and duration. The value
+        stdout writes the records to standard output. Credentials are never
+        recorded.
+
+        The default value is empty, which disables the audit log.
+
+    X_CSI_SCALEIO_AUDIT_LOG_MAX_SIZE
+        Specifies the size, in bytes, at which the audit log file is moved
+        aside to a file of the same name ending in .1, replacing any earlier
+        one, and a new file started.
+
+        The default value is 0, which never rotates the file.
+
+    X_CSI_SCALEIO_UNMAP_SETTLE_TIMEOUT
+        Specifies how long DeleteVolume waits for the ScaleIO Gateway to stop
+        reporting the mappings of a volume that was unpublished within that
+        time, before failing because the volume is in use. A value of 0
+        disables waiting.
+
+        The default value is 10s.
+
+    X_CSI_SCALEIO_MAPPING_CACHE_TTL
+        Specifies how long ControllerUnpublishVolume trusts that a volume
+        the Controller Service just read, mapped or unmapped is not mapped
+        to the node, and succeeds without reading the volume again, as when
+        the CO retries an unpublish that succeeded. A volume that may be
+        mapped to the node is always read. A value of 0 always reads the
+        volume.
+
+        The default value is 5s.
+
+    X_CSI_SCALEIO_STRICT_PARAMS
+        A flag that makes CreateVolume fail with InvalidArgument for a
+        parameter it doesn't accept, naming the closest one it does. When it
+        is false a warning is logged for each such parameter instead.
+        Parameters starting with csi.storage.k8s.io/ are always ignored.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_POOL_RESERVED_PERCENTAGE
+        Specifies the percentage of the raw capacity of each storage pool
+        that CreateVolume refuses to consume, failing with ResourceExhausted
+        when the pool's utilization, once the volume is created, would be
+        higher. Thin volumes only consume capacity as they are written, so
+        for them only the current utilization is checked. Pool statistics
+        are cached for 10s, shared with GetCapacity.
+
+        The default value is 0, which reserves nothing.
+
+    X_CSI_SCALEIO_NODE_ID_FALLBACK
+        Specifies the node ID the Node Service reports when the SDC GUID
+        can't be determined, either "ip", for the first global unicast
+        address of the node, or "hostname", for its host name. The
+        Controller Service looks up the SDC by GUID, IP address or name,
+        whichever the node ID is, so the SDC must be registered with that
+        address, or named after the host.
+
+        The default value is empty, which makes failing to determine the
+        GUID an error.
+
+    X_CSI_SCALEIO_NODE_ID_SDC_ID
+        A flag that enables reporting the ID of the local SDC in the node
+        ID, as GUID/ID, when the Node Service runs alongside the
+        Controller Service and has looked the SDC up. The Controller
+        Service then maps volumes to that SDC without looking it up by
+        GUID. Node IDs of just the GUID are still accepted, so only enable
+        this once every Controller Service understands both forms.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_SLOW_OPERATION_THRESHOLD
+        Specifies how long a request runs before a warning is logged with
+        its method and the ID of the volume it concerns, which helps find
+        requests that have stalled. A value of 0 disables the warning.
+
+        The default value is 5m.
+
+    X_CSI_SCALEIO_DEBUG_OPERATIONS
+        A flag that lists the requests in flight, with their methods, volume
+        IDs and start times, as JSON at /debug/operations on
+        X_CSI_SCALEIO_METRICS_ADDR. The number of requests in flight, and
+        the age of the oldest, are among the metrics whether or not this is
+        set.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_DEBUG_CONFIG
+        A flag that serves the configuration the plug-in is running with,
+        as it is logged at start-up and with secrets masked, as JSON at
+        /debug/config on X_CSI_SCALEIO_METRICS_ADDR.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_UNPUBLISH_CHECK
+        A flag that makes ControllerUnpublishVolume delay unmapping a volume
+        while the ScaleIO Gateway reports writes to it within the last few
+        seconds, as the node may still be unmounting it. The delay, the
+        writes seen, and whether the volume was unmapped anyway are logged.
+        Volumes mapped to several SDCs aren't checked, as the writes of each
+        SDC aren't reported separately.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_UNPUBLISH_CHECK_TIMEOUT
+        Specifies how long unmapping a volume that is still written to is
+        delayed, when X_CSI_SCALEIO_UNPUBLISH_CHECK is set, before it is
+        unmapped anyway.
+
+        The default value is 30s.
+
+    X_CSI_SCALEIO_ALLOW_VALIDATE_ONLY
+        A flag that makes CreateVolume accept the validateOnly parameter,
+        which checks the other parameters as creating a volume would, and
+        returns the volume without an ID, without creating it. When it is
+        false, requests with validateOnly fail with InvalidArgument.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_TRACE_ADDR
+        Specifies the address, such as :9809, on which traces of the
+        requests, with the ScaleIO Gateway calls each makes and how long
+        they took, are served at /debug/requests. A trace propagated by the
+        CO as a traceparent or uber-trace-id header is recorded with the
+        request. Parameters and secrets are never recorded. The traces hold
+        volume IDs and gateway errors, and are only served to requests from
+        localhost.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_PROFILES
+        Specifies the path of a JSON or YAML file of named profiles, each a
+        map of CreateVolume parameters, such as storagepool or iopsLimit.
+        A request's profile parameter selects one, whose parameters apply
+        where the request doesn't pass its own. An unknown profile fails
+        with InvalidArgument.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_SKIP_PRIVILEGE_CHECK
+        A flag that skips listing the storage pools when the Controller
+        Service is probed. The list checks that the ScaleIO user may manage
+        volumes, failing the probe with PermissionDenied when the gateway
+        refuses it. Set it for users deliberately restricted to what the
+        Node Service needs.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_SDC_ROOT
+        Specifies the path at which the host's root filesystem, or at least
+        its /dev, is mounted in the Node Service's container. The volumes
+        mapped to the SDC are then found in /dev/disk/by-id under it, and
+        are mounted from their devices under it, such as /host/dev/scinia.
+        This is only used by the Node Service.
+
+        The default value is empty, which is the same as /.
+
+    X_CSI_SCALEIO_POOL_PROVISIONING
+        Specifies the provisioning type of volumes created in each storage
+        pool, as a comma separated list of pool:type pairs, where type is
+        thick or thin, such as ssd:thin,hdd:thick. A volume's own
+        thickprovisioning parameter takes precedence, and pools that aren't
+        listed use X_CSI_SCALEIO_THICKPROVISIONING.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_STORAGE_POOL
+        Specifies the storage pool volumes are created in when their
+        parameters, including those of a profile, don't name one with the
+        storagepool parameter. When empty, the parameter is required.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_ALLOWED_POOLS
+        Specifies the storage pools volumes may be created in, as a comma
+        separated list of pools, each named alone or qualified by its
+        protection domain's name or ID as domain/pool, such as
+        ssd,pd1/hdd. CreateVolume and GetCapacity refuse other pools with
+        PermissionDenied before calling the gateway to create anything,
+        and ListVolumes lists only the volumes of the pools listed.
+
+        The default value is empty, which allows every pool.
+
+    X_CSI_SCALEIO_DELETE_RETENTION
+        Specifies how long deleted volumes are retained before they are
+        removed, such as 72h. DeleteVolume renames a volume to a tombstone,
+        del-<hex Unix time>-<volume ID>, instead of removing it, and the
+        Controller Service removes tombstones older than this in the
+        background. A retained volume is recovered by importing its
+        tombstone with the importVolumeName parameter. A value of 0 removes
+        volumes when they are deleted.
+
+        The default value is 0.
+
+    X_CSI_SCALEIO_ALLOW_HTTP
+        A flag that allows X_CSI_SCALEIO_ENDPOINT to use http rather than
+        https, such as for a gateway behind a local TLS proxy.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_THICK_FALLBACK
+        A flag that makes CreateVolume create a thin volume when a thick
+        one is requested in a storage pool without the capacity available
+        to allocate it, rather than failing with ResourceExhausted. The
+        volume's provisioning attribute is then thin-fallback, and a
+        warning is logged.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_STATS_ADDR
+        Specifies the address, such as :9810, on which the Controller
+        Service serves the statistics the ScaleIO Gateway reports for each
+        volume, as JSON at /volumes/<volume ID>/statistics: its read and
+        write IOPS and bandwidth, and its latencies where the gateway
+        reports them. Requests are refused until the controller has been
+        probed, and are made to the gateway one at a time.
+
+        The default value is empty, which serves no statistics.
+
+    X_CSI_SCALEIO_STATS_TOKEN
+        Specifies the token that requests for volume statistics must carry
+        as a bearer token in their Authorization header. It is required
+        when X_CSI_SCALEIO_STATS_ADDR is set. The address serves plain
+        HTTP, so the token is sent unencrypted, and the address should only
+        be reachable on a trusted network.
+
+        The default value is empty.
+
+    X_CSI_SCALEIO_SNAPSHOT_GROUPS
+        A flag that enables the Controller Service to also take snapshot
+        groups, the snapshots of several volumes at the same point in time,
+        on X_CSI_SCALEIO_STATS_ADDR, which it requires. A group is taken by
+        a POST to /snapshot-groups and listed at /snapshot-groups/<group
+        ID>, and ListVolumes gives each snapshot the attribute
+        snapshotGroupId. Each snapshot is a volume, deleted on its own by
+        DeleteVolume.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_DEFAULT_VOLUME_SIZE_GIB
+        Specifies the size, in GiB, of volumes created without a required
+        size. ScaleIO creates volumes in multiples of 8GiB, and the plug-in
+        refuses to start if the value is not a positive multiple of 8.
+
+        The default value is 16.
+
+    X_CSI_SCALEIO_ENFORCE_OWNERSHIP
+        A flag that marks the volumes the Controller Service creates or
+        imports as its own, by starting their names with "csi-", and makes
+        DeleteVolume refuse volumes without the mark with
+        PERMISSION_DENIED. Volumes created before the flag was set must be
+        imported to be deleted.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_LIST_OWNED_ONLY
+        A flag that makes ListVolumes list only the volumes marked as the
+        plug-in's own by X_CSI_SCALEIO_ENFORCE_OWNERSHIP.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_LIST_EXCLUDE_INCOMPLETE
+        A flag that makes ListVolumes leave out the volumes the ScaleIO
+        Gateway reports without their size or storage pool, as it does
+        volumes being deleted or in error. Otherwise they are listed with
+        the attribute state=incomplete. A warning is logged for each
+        either way.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_MAX_VOLUMES_PER_NODE
+        Specifies the maximum number of volumes that may be mapped to a
+        single SDC. The Controller Service refuses to publish a volume to an
+        SDC that has this many volumes mapped, and the Node Service warns
+        when the number of locally mapped volumes approaches this limit. A
+        value of 0 disables the limit.
+
+        The CSI v0.2 spec has no NodeGetInfo, so the limit isn't reported
+        to the CO, and its scheduler doesn't enforce it. Only the
+        Controller Service's refusal to publish does.
+
+        The default value is 8192.
+
+    X_CSI_SCALEIO_CLEANUP_ON_START
+        Specifies whether the Node Service should unmount private mounts,
+        within the private mount directory, whose volumes are no longer
+        mapped to the SDC when it starts. Mounts outside the private mount
+        directory are never touched.
+
+        The default value is true.
+
+    X_CSI_SCALEIO_FSCK
+        Specifies whether the Node Service should check a volume's
+        filesystem before it is first mounted on the node. ext filesystems
+        are checked with "fsck -a", or "fsck -n" when the volume is
+        read-only, and xfs filesystems with "xfs_repair -n". Publishing
+        fails if unrecoverable corruption is detected. Block volumes and
+        volumes already mounted on the node are not checked.
+
+        The default value is false.
+
+    X_CSI_SCALEIO_XFS_NOUUID
+        Specifies whether the Node Service should mount xfs filesystems with
+        the nouuid option. This allows a clone of an xfs volume to be
+        mounted on the same node as its parent, which would otherwise fail
+        due to the duplicate filesystem UUID.
+
+        The default value is true.
 `
@@ -1,36 +1,75 @@
 package provider
 
 import (
+	"context"
+
 	"github.com/rexray/gocsi"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/thecodeteam/csi-scaleio/service"
 )
 
 // New returns a new Mock Storage Plug-in Provider.
 func New() gocsi.StoragePluginProvider {
-	svc := service.New()
-	return &gocsi.StoragePlugin{
-		Controller:  svc,
-		Identity:    svc,
-		Node:        svc,
-		BeforeServe: svc.BeforeServe,
-
-		EnvVars: []string{
-			// Enable request validation
-			gocsi.EnvVarSpecReqValidation + "=true",
-
-			// Enable serial volume access
-			gocsi.EnvVarSerialVolAccess + "=true",
-
-			// Treat the following fields as required:
-			//    * ControllerPublishVolumeRequest.NodeId
-			//    * GetNodeIDResponse.NodeId
-			gocsi.EnvVarRequireNodeID + "=true",
-
-			// Treat the following fields as required:
-			//    * ControllerPublishVolumeResponse.PublishInfo
-			//    * NodePublishVolumeRequest.PublishInfo
-			gocsi.EnvVarRequirePubVolInfo + "=false",
+	return NewWithService(service.New())
+}
+
+// NewWithService returns a Storage Plug-in Provider serving svc
+func NewWithService(svc service.Service) gocsi.StoragePluginProvider {
+	return &plugin{
+		svc: svc,
+		StoragePlugin: &gocsi.StoragePlugin{
+			Controller:  svc,
+			Identity:    svc,
+			Node:        svc,
+			BeforeServe: svc.BeforeServe,
+
+			EnvVars: []string{
+				// Enable request validation
+				gocsi.EnvVarSpecReqValidation + "=true",
+
+				// Enable serial volume access
+				gocsi.EnvVarSerialVolAccess + "=true",
+
+				// Treat the following fields as required:
+				//    * ControllerPublishVolumeRequest.NodeId
+				//    * GetNodeIDResponse.NodeId
+				gocsi.EnvVarRequireNodeID + "=true",
+
+				// Treat the following fields as required:
+				//    * ControllerPublishVolumeResponse.PublishInfo
+				//    * NodePublishVolumeRequest.PublishInfo
+				gocsi.EnvVarRequirePubVolInfo + "=false",
+			},
 		},
 	}
 }
+
+// plugin stops the service's own servers along with the gRPC server
+type plugin struct {
+	*gocsi.StoragePlugin
+	svc service.Service
+}
+
+func (p *plugin) Stop(ctx context.Context) {
+	p.StoragePlugin.Stop(ctx)
+	p.shutdown(ctx)
+}
+
+// GracefulStop waits for in-flight requests to finish, up to the service's
+// shutdown timeout, before stopping the server. If requests remain the
+// server is stopped immediately.
+func (p *plugin) GracefulStop(ctx context.Context) {
+	if p.svc.Drain(ctx) {
+		p.StoragePlugin.GracefulStop(ctx)
+	} else {
+		p.StoragePlugin.Stop(ctx)
+	}
+	p.shutdown(ctx)
+}
+
+func (p *plugin) shutdown(ctx context.Context) {
+	if err := p.svc.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("error shutting down service")
+	}
+}
@@ -0,0 +1,524 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	csictx "github.com/rexray/gocsi/context"
+	sio "github.com/thecodeteam/goscaleio"
+	"github.com/thecodeteam/goscaleio/api"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"golang.org/x/net/context"
+)
+
+// ScaleIOAdmin is the subset of the ScaleIO Gateway API used by the
+// controller service. Methods that goscaleio provides on its client share
+// their signatures. Those goscaleio provides on systems, volumes, and
+// storage pools instead take the object they act upon.
+type ScaleIOAdmin interface {
+	// Authenticate logs in to the gateway
+	Authenticate(configConnect *sio.ConfigConnect) (sio.Cluster, error)
+
+	// GetToken returns the token of the current session, if any
+	GetToken() string
+
+	// GetVersion returns the version of the gateway
+	GetVersion() (string, error)
+
+	// FindSystem returns the system matching the given ID, name, or HREF
+	FindSystem(instanceID, name, href string) (*siotypes.System, error)
+
+	// GetSystemStatistics returns the statistics of a system
+	GetSystemStatistics(system *siotypes.System) (*siotypes.Statistics, error)
+
+	// FindSdc returns the SDC of a system whose field has the given value.
+	// GUIDs match whatever their case, or padding.
+	FindSdc(system *siotypes.System, field, value string) (*siotypes.Sdc, error)
+
+	// GetSdcs returns the SDCs of a system
+	GetSdcs(system *siotypes.System) ([]siotypes.Sdc, error)
+
+	// GetSdcVolumes returns the volumes mapped to the SDC with the given ID
+	GetSdcVolumes(sdcID string) ([]*siotypes.Volume, error)
+
+	// CreateVolume creates a volume in the named storage pool
+	CreateVolume(
+		volume *siotypes.VolumeParam,
+		storagePoolName string) (*siotypes.VolumeResp, error)
+
+	// GetVolume returns the volumes matching the given HREF, ID, or name,
+	// or every volume if none are given
+	GetVolume(
+		volumehref, volumeid, ancestorvolumeid, volumename string,
+		getSnapshots bool) ([]*siotypes.Volume, error)
+
+	// FindVolumeID returns the ID of the named volume
+	FindVolumeID(volumename string) (string, error)
+
+	// RemoveVolume removes a volume
+	RemoveVolume(volume *siotypes.Volume, removeMode string) error
+
+	// MapVolumeSdc maps a volume to an SDC
+	MapVolumeSdc(
+		volume *siotypes.Volume, param *siotypes.MapVolumeSdcParam) error
+
+	// UnmapVolumeSdc unmaps a volume from an SDC
+	UnmapVolumeSdc(
+		volume *siotypes.Volume, param *siotypes.UnmapVolumeSdcParam) error
+
+	// SetMappedSdcLimits sets the IOPS and bandwidth limits of the mapping
+	// of a volume to an SDC
+	SetMappedSdcLimits(
+		volume *siotypes.Volume,
+		param *siotypes.SetMappedSdcLimitsParam) error
+
+	// SetVolumeName renames a volume
+	SetVolumeName(volume *siotypes.Volume, newName string) error
+
+	// SetVolumeUseRmcache enables or disables the RAM read cache of a
+	// volume
+	SetVolumeUseRmcache(volume *siotypes.Volume, useRmcache bool) error
+
+	// SnapshotVolumes snapshots volumes of a system at the same point in
+	// time, as a single consistency group
+	SnapshotVolumes(
+		system *siotypes.System,
+		param *siotypes.SnapshotVolumesParam) (
+		*siotypes.SnapshotVolumesResp, error)
+
+	// FindStoragePool returns the storage pool matching the given ID,
+	// name, or HREF
+	FindStoragePool(id, name, href string) (*siotypes.StoragePool, error)
+
+	// GetProtectionDomain returns the protection domain with the given ID,
+	// whichever system it is in
+	GetProtectionDomain(id string) (*siotypes.ProtectionDomain, error)
+
+	// GetStoragePools returns every storage pool
+	GetStoragePools() ([]*siotypes.StoragePool, error)
+
+	// GetStoragePoolVolumes returns the volumes of a storage pool, other
+	// than snapshots
+	GetStoragePoolVolumes(
+		pool *siotypes.StoragePool) ([]*siotypes.Volume, error)
+
+	// GetStoragePoolStatistics returns the statistics of a storage pool
+	GetStoragePoolStatistics(
+		pool *siotypes.StoragePool) (*siotypes.Statistics, error)
+
+	// GetVolumeWriteBwc returns the writes made to a volume, by any SDC,
+	// over the last few seconds
+	GetVolumeWriteBwc(volume *siotypes.Volume) (*siotypes.BWC, error)
+
+	// GetVolumeBwcs returns the statistics of a volume that the gateway
+	// reports as bandwidth counters, keyed by their names, such as
+	// userDataReadBwc
+	GetVolumeBwcs(volume *siotypes.Volume) (map[string]siotypes.BWC, error)
+}
+
+// contextAdmin is implemented by a ScaleIOAdmin whose requests can be
+// canceled
+type contextAdmin interface {
+	// withContext returns a ScaleIOAdmin sharing this one's session whose
+	// requests that change the system are canceled along with ctx
+	withContext(ctx context.Context) ScaleIOAdmin
+}
+
+// adminContext returns admin bound to ctx if its requests can be canceled,
+// otherwise admin is returned
+func adminContext(ctx context.Context, admin ScaleIOAdmin) ScaleIOAdmin {
+	if a, ok := admin.(contextAdmin); ok {
+		return a.withContext(ctx)
+	}
+	return admin
+}
+
+// requestIDHeader is the header of the requests made to the gateway that
+// gives the ID of the CSI request they are made for
+const requestIDHeader = "X-Request-ID"
+
+// sioAdmin implements ScaleIOAdmin with a goscaleio client.
+//
+// goscaleio sends every request without a context, so calls that change
+// the system are made with api instead, which binds each request to ctx,
+// and gives the ID of the CSI request it is made for in requestIDHeader.
+// Those that only read the system still go through goscaleio and run to
+// completion, without the header.
+type sioAdmin struct {
+	*sio.Client
+
+	// api makes the gateway calls goscaleio has no method for, and those
+	// that must be canceled with ctx, using the session of the goscaleio
+	// client
+	api api.Client
+
+	// ctx is the context requests made with api are bound to
+	ctx context.Context
+
+	// login is kept to log in again when the session expires. It is
+	// shared with the copies bound to a context, which may be the ones
+	// that logged in.
+	login *sioLogin
+}
+
+// sioLogin is what a sioAdmin last logged in with
+type sioLogin struct {
+	sync.Mutex
+	configConnect *sio.ConfigConnect
+}
+
+// get returns what was last logged in with, if anything
+func (l *sioLogin) get() *sio.ConfigConnect {
+	l.Lock()
+	defer l.Unlock()
+	return l.configConnect
+}
+
+// NewScaleIOAdmin returns a ScaleIOAdmin for the gateway at endpoint, given
+// in any of the forms X_CSI_SCALEIO_ENDPOINT accepts, as the controller
+// service makes it. It must be authenticated before use. Tests use it to
+// inspect and clean up the volumes the plug-in manages.
+func NewScaleIOAdmin(endpoint string, insecure bool) (ScaleIOAdmin, error) {
+	endpoint, err := normalizeEndpoint(endpoint, true)
+	if err != nil {
+		return nil, err
+	}
+	return newSIOAdmin(endpoint, insecure)
+}
+
+// newSIOAdmin returns a ScaleIOAdmin for the gateway at endpoint
+func newSIOAdmin(endpoint string, insecure bool) (ScaleIOAdmin, error) {
+	c, err := sio.NewClientWithArgs(endpoint, "", insecure, true)
+	if err != nil {
+		return nil, err
+	}
+	a, err := newSIOAdminWithClient(c, endpoint, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// newSIOAdminWithClient returns a ScaleIOAdmin for the gateway at endpoint
+// that shares the session of c
+func newSIOAdminWithClient(
+	c *sio.Client, endpoint string, insecure bool) (*sioAdmin, error) {
+
+	ac, err := api.New(context.Background(), endpoint,
+		api.ClientOptions{Insecure: insecure, UseCerts: true}, false)
+	if err != nil {
+		return nil, err
+	}
+	return &sioAdmin{
+		Client: c,
+		api:    ac,
+		ctx:    context.Background(),
+		login:  &sioLogin{},
+	}, nil
+}
+
+// requestID adds the ID of the request a.ctx is bound to, if any, to
+// headers, so that the gateway's access log can be correlated with the
+// plug-in's
+func (a *sioAdmin) requestID(headers map[string]string) map[string]string {
+	id, ok := csictx.GetRequestID(a.ctx)
+	if !ok {
+		return headers
+	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers[requestIDHeader] = strconv.FormatUint(id, 10)
+	return headers
+}
+
+func (a *sioAdmin) withContext(ctx context.Context) ScaleIOAdmin {
+	c := *a
+	c.ctx = ctx
+	return &c
+}
+
+func (a *sioAdmin) Authenticate(
+	configConnect *sio.ConfigConnect) (sio.Cluster, error) {
+
+	a.login.Lock()
+	a.login.configConnect = configConnect
+	a.login.Unlock()
+	return a.Client.Authenticate(configConnect)
+}
+
+func (a *sioAdmin) GetVersion() (string, error) {
+	resp, err := a.api.DoAndGetResponseBody(
+		a.ctx, http.MethodGet, "/api/version", a.requestID(nil), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", a.api.ParseJSONError(resp)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(strings.TrimSpace(string(b)), `"`), nil
+}
+
+// post sends body to path with the goscaleio client's session, decoding
+// the response into resp if not nil, and logging in again if the session
+// has expired. The request is canceled along with a.ctx.
+func (a *sioAdmin) post(path string, body, resp interface{}) error {
+	return a.do(http.MethodPost, path, body, resp)
+}
+
+// get is post for the gateway resources goscaleio can't read
+func (a *sioAdmin) get(path string, resp interface{}) error {
+	return a.do(http.MethodGet, path, nil, resp)
+}
+
+func (a *sioAdmin) do(method, path string, body, resp interface{}) error {
+	headers := a.requestID(map[string]string{
+		api.HeaderKeyAccept:      api.HeaderValContentTypeJSON,
+		api.HeaderKeyContentType: api.HeaderValContentTypeJSON,
+	})
+
+	a.api.SetToken(a.Client.GetToken())
+	err := a.api.DoWithHeaders(a.ctx, method, path, headers, body, resp)
+	if e, ok := err.(*siotypes.Error); ok &&
+		e.HTTPStatusCode == http.StatusUnauthorized && a.login.get() != nil {
+
+		if _, err := a.Authenticate(a.login.get()); err != nil {
+			return fmt.Errorf("Error Authenticating: %s", err)
+		}
+		a.api.SetToken(a.Client.GetToken())
+		err = a.api.DoWithHeaders(a.ctx, method, path, headers, body, resp)
+	}
+	return err
+}
+
+func (a *sioAdmin) CreateVolume(
+	volume *siotypes.VolumeParam,
+	storagePoolName string) (*siotypes.VolumeResp, error) {
+
+	pool, err := a.Client.FindStoragePool("", storagePoolName, "")
+	if err != nil {
+		return nil, err
+	}
+	volume.StoragePoolID = pool.ID
+	volume.ProtectionDomainID = pool.ProtectionDomainID
+
+	resp := &siotypes.VolumeResp{}
+	if err := a.post("/api/types/Volume/instances", volume, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *sioAdmin) FindSystem(
+	instanceID, name, href string) (*siotypes.System, error) {
+
+	system, err := a.Client.FindSystem(instanceID, name, href)
+	if err != nil {
+		return nil, err
+	}
+	return system.System, nil
+}
+
+func (a *sioAdmin) GetSystemStatistics(
+	system *siotypes.System) (*siotypes.Statistics, error) {
+
+	s := sio.NewSystem(a.Client)
+	s.System = system
+	return s.GetStatistics()
+}
+
+func (a *sioAdmin) FindSdc(
+	system *siotypes.System, field, value string) (*siotypes.Sdc, error) {
+
+	// goscaleio only finds GUIDs of the same case, but lists every SDC to
+	// look for one either way
+	if field == "SdcGuid" {
+		sdcs, err := a.GetSdcs(system)
+		if err != nil {
+			return nil, err
+		}
+		for i := range sdcs {
+			if sameSDCGUID(sdcs[i].SdcGuid, value) {
+				return &sdcs[i], nil
+			}
+		}
+		return nil, errors.New(sioGatewaySdcNotFound)
+	}
+
+	s := sio.NewSystem(a.Client)
+	s.System = system
+	sdc, err := s.FindSdc(field, value)
+	if err != nil {
+		return nil, err
+	}
+	return sdc.Sdc, nil
+}
+
+func (a *sioAdmin) GetSdcVolumes(sdcID string) ([]*siotypes.Volume, error) {
+	return sio.NewSdc(a.Client, &siotypes.Sdc{
+		ID: sdcID,
+		Links: []*siotypes.Link{{
+			Rel:  "/api/Sdc/relationship/Volume",
+			HREF: fmt.Sprintf("/api/instances/Sdc::%s/relationships/Volume", sdcID),
+		}},
+	}).GetVolume()
+}
+
+func (a *sioAdmin) GetSdcs(system *siotypes.System) ([]siotypes.Sdc, error) {
+	s := sio.NewSystem(a.Client)
+	s.System = system
+	return s.GetSdc()
+}
+
+func (a *sioAdmin) RemoveVolume(
+	volume *siotypes.Volume, removeMode string) error {
+
+	return a.post(fmt.Sprintf(
+		"/api/instances/Volume::%s/action/removeVolume", volume.ID),
+		&siotypes.RemoveVolumeParam{RemoveMode: removeMode}, nil)
+}
+
+func (a *sioAdmin) MapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.MapVolumeSdcParam) error {
+
+	return a.post(fmt.Sprintf(
+		"/api/instances/Volume::%s/action/addMappedSdc", volume.ID),
+		param, nil)
+}
+
+func (a *sioAdmin) UnmapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.UnmapVolumeSdcParam) error {
+
+	return a.post(fmt.Sprintf(
+		"/api/instances/Volume::%s/action/removeMappedSdc", volume.ID),
+		param, nil)
+}
+
+func (a *sioAdmin) SetMappedSdcLimits(
+	volume *siotypes.Volume, param *siotypes.SetMappedSdcLimitsParam) error {
+
+	return a.post(fmt.Sprintf(
+		"/api/instances/Volume::%s/action/setMappedSdcLimits", volume.ID),
+		param, nil)
+}
+
+func (a *sioAdmin) SnapshotVolumes(
+	system *siotypes.System,
+	param *siotypes.SnapshotVolumesParam) (*siotypes.SnapshotVolumesResp, error) {
+
+	resp := &siotypes.SnapshotVolumesResp{}
+	if err := a.post(fmt.Sprintf(
+		"/api/instances/System::%s/action/snapshotVolumes", system.ID),
+		param, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (a *sioAdmin) GetProtectionDomain(
+	id string) (*siotypes.ProtectionDomain, error) {
+
+	pds, err := sio.NewSystem(a.Client).GetProtectionDomain(
+		"/api/instances/ProtectionDomain::" + id)
+	if err != nil {
+		return nil, err
+	}
+	return pds[0], nil
+}
+
+func (a *sioAdmin) GetStoragePools() ([]*siotypes.StoragePool, error) {
+	return a.Client.GetStoragePool("")
+}
+
+func (a *sioAdmin) GetStoragePoolVolumes(
+	pool *siotypes.StoragePool) ([]*siotypes.Volume, error) {
+
+	return sio.NewStoragePoolEx(a.Client, pool).GetVolume("", "", "", "", false)
+}
+
+func (a *sioAdmin) GetStoragePoolStatistics(
+	pool *siotypes.StoragePool) (*siotypes.Statistics, error) {
+
+	return sio.NewStoragePoolEx(a.Client, pool).GetStatistics()
+}
+
+// volumeStatistics is the part of the statistics of a volume that
+// siotypes.Statistics lacks
+type volumeStatistics struct {
+	UserDataWriteBwc siotypes.BWC `json:"userDataWriteBwc"`
+}
+
+func (a *sioAdmin) GetVolumeWriteBwc(
+	volume *siotypes.Volume) (*siotypes.BWC, error) {
+
+	stats := &volumeStatistics{}
+	if err := a.get(fmt.Sprintf(
+		"/api/instances/Volume::%s/relationships/Statistics", volume.ID),
+		stats); err != nil {
+		return nil, err
+	}
+	return &stats.UserDataWriteBwc, nil
+}
+
+func (a *sioAdmin) GetVolumeBwcs(
+	volume *siotypes.Volume) (map[string]siotypes.BWC, error) {
+
+	stats := map[string]json.RawMessage{}
+	if err := a.get(fmt.Sprintf(
+		"/api/instances/Volume::%s/relationships/Statistics", volume.ID),
+		&stats); err != nil {
+		return nil, err
+	}
+	bwcs := map[string]siotypes.BWC{}
+	for name, raw := range stats {
+		// the other statistics are counts, or lists of IDs
+		if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")) {
+			continue
+		}
+		var bwc siotypes.BWC
+		if err := json.Unmarshal(raw, &bwc); err == nil {
+			bwcs[name] = bwc
+		}
+	}
+	return bwcs, nil
+}
+
+// setVolumeUseRmcacheParam is the body of the setVolumeUseRmcache action
+type setVolumeUseRmcacheParam struct {
+	UseRmcache string `json:"useRmcache"`
+}
+
+func (a *sioAdmin) SetVolumeUseRmcache(
+	volume *siotypes.Volume, useRmcache bool) error {
+
+	return a.post(fmt.Sprintf(
+		"/api/instances/Volume::%s/action/setVolumeUseRmcache", volume.ID),
+		&setVolumeUseRmcacheParam{
+			UseRmcache: strconv.FormatBool(useRmcache),
+		}, nil)
+}
+
+// setVolumeNameParam is the body of the setVolumeName action
+type setVolumeNameParam struct {
+	NewName string `json:"newName"`
+}
+
+func (a *sioAdmin) SetVolumeName(
+	volume *siotypes.Volume, newName string) error {
+
+	return a.post(fmt.Sprintf(
+		"/api/instances/Volume::%s/action/setVolumeName", volume.ID),
+		&setVolumeNameParam{NewName: newName}, nil)
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	csictx "github.com/rexray/gocsi/context"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// auditStdout is the value of EnvAuditLog that writes the audit log to
+// stdout rather than to a file
+const auditStdout = "stdout"
+
+// auditOps are the operations recorded in the audit log, by the method
+// that performs them
+var auditOps = map[string]string{
+	"CreateVolume":              "create",
+	"DeleteVolume":              "delete",
+	"ControllerPublishVolume":   "map",
+	"ControllerUnpublishVolume": "unmap",
+}
+
+// auditRecord is a line of the audit log. Only the fields identifying the
+// volume and node are copied from requests, so secrets and credentials
+// never reach it.
+type auditRecord struct {
+	Time            time.Time `json:"time"`
+	Operation       string    `json:"operation"`
+	RequestID       uint64    `json:"reqID,omitempty"`
+	VolumeID        string    `json:"volumeID,omitempty"`
+	VolumeName      string    `json:"volumeName,omitempty"`
+	NodeID          string    `json:"nodeID,omitempty"`
+	SdcID           string    `json:"sdcID,omitempty"`
+	SizeBytes       int64     `json:"sizeBytes,omitempty"`
+	Result          string    `json:"result"`
+	Error           string    `json:"error,omitempty"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+// auditLog writes a JSON line for each volume lifecycle operation the
+// controller completes, successfully or not
+type auditLog struct {
+	sync.Mutex
+
+	w io.Writer
+
+	// path is the file written to, if not stdout. Once it reaches maxSize
+	// bytes it is moved aside to path.1, replacing any earlier one.
+	path    string
+	f       *os.File
+	size    int64
+	maxSize int64
+}
+
+// newAuditLog returns an audit log appending to the file at p, or writing
+// to stdout if p is auditStdout
+func newAuditLog(p string, maxSize int64) (*auditLog, error) {
+	if p == auditStdout {
+		return &auditLog{w: os.Stdout}, nil
+	}
+	a := &auditLog{path: p, maxSize: maxSize}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.f, a.w, a.size = f, f, fi.Size()
+	return nil
+}
+
+// rotate moves the file aside and starts a new one. The file is reopened
+// even if it couldn't be moved, so that records are still written.
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	err := os.Rename(a.path, a.path+".1")
+	if oerr := a.open(); oerr != nil {
+		a.f, a.w = nil, nil
+		return oerr
+	}
+	return err
+}
+
+// write appends rec to the log. Records are only written whole, but a
+// failure to write one doesn't fail the operation it records.
+func (a *auditLog) write(rec *auditRecord) {
+	if a == nil {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.WithError(err).Warn("unable to encode audit record")
+		return
+	}
+	b = append(b, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.f != nil && a.maxSize > 0 && a.size > 0 &&
+		a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.WithError(err).WithField("path", a.path).Warn(
+				"unable to rotate audit log")
+		}
+	}
+	if a.w == nil {
+		return
+	}
+	n, err := a.w.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.WithError(err).Warn("unable to write audit record")
+	}
+}
+
+// close closes the file written to, if any
+func (a *auditLog) close() error {
+	if a == nil {
+		return nil
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f, a.w = nil, nil
+	return err
+}
+
+// auditInterceptor records the outcome of each volume lifecycle operation
+func (s *service) auditInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	op, ok := auditOps[path.Base(info.FullMethod)]
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	start := time.Now()
+	rep, err := handler(ctx, req)
+
+	rec := &auditRecord{
+		Time:            start.UTC(),
+		Operation:       op,
+		Result:          "success",
+		DurationSeconds: time.Since(start).Seconds(),
+	}
+	if id, ok := csictx.GetRequestID(ctx); ok {
+		rec.RequestID = id
+	}
+	if err != nil {
+		rec.Result = "Unknown"
+		if st, ok := status.FromError(err); ok {
+			rec.Result = st.Code().String()
+		}
+		rec.Error = err.Error()
+	}
+	s.auditFields(rec, req, rep)
+	s.audit.write(rec)
+
+	return rep, err
+}
+
+// auditFields copies the volume and node an operation concerns to rec
+func (s *service) auditFields(rec *auditRecord, req, rep interface{}) {
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		rec.VolumeName = r.GetName()
+		if v, _ := strconv.ParseBool(
+			r.GetParameters()[KeyValidateOnly]); v {
+			rec.Operation = "validate"
+		}
+		rec.SizeBytes = r.GetCapacityRange().GetRequiredBytes()
+		if rep, ok := rep.(*csi.CreateVolumeResponse); ok && rep != nil {
+			rec.VolumeID = rep.GetVolume().GetId()
+			rec.SizeBytes = rep.GetVolume().GetCapacityBytes()
+		}
+	case *csi.DeleteVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+	case *csi.ControllerPublishVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.NodeID = r.GetNodeId()
+		rec.SdcID = s.cachedSDCID(r.GetNodeId())
+	case *csi.ControllerUnpublishVolumeRequest:
+		rec.VolumeID = r.GetVolumeId()
+		rec.NodeID = r.GetNodeId()
+		rec.SdcID = s.cachedSDCID(r.GetNodeId())
+	}
+}
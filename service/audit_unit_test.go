@@ -0,0 +1,195 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// readAudit returns the records of the audit log at p
+func readAudit(t *testing.T, p string) []auditRecord {
+	f, err := os.Open(p)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer f.Close()
+
+	var recs []auditRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec auditRecord
+		if assert.NoError(t, json.Unmarshal(sc.Bytes(), &rec), sc.Text()) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+func TestAuditInterceptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "audit.log")
+
+	ctx := context.Background()
+	s, fake := newFakeService()
+	sdc := fake.AddSdc("SDC-1")
+	s.audit, err = newAuditLog(p, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	call := func(method string, req interface{}) (interface{}, error) {
+		return s.auditInterceptor(ctx, req,
+			&grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/" + method},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				switch r := req.(type) {
+				case *csi.CreateVolumeRequest:
+					return s.CreateVolume(ctx, r)
+				case *csi.DeleteVolumeRequest:
+					return s.DeleteVolume(ctx, r)
+				case *csi.ControllerPublishVolumeRequest:
+					return s.ControllerPublishVolume(ctx, r)
+				case *csi.ControllerUnpublishVolumeRequest:
+					return s.ControllerUnpublishVolume(ctx, r)
+				}
+				return nil, nil
+			})
+	}
+
+	rep, err := call("CreateVolume", &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 8 << 30},
+		Parameters:    map[string]string{KeyStoragePool: "pool"},
+		ControllerCreateSecrets: map[string]string{
+			"password": "hunter2",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := rep.(*csi.CreateVolumeResponse).Volume.Id
+
+	_, err = call("ControllerPublishVolume", &csi.ControllerPublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   "sdc-1",
+		VolumeCapability: mountCap(
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	assert.NoError(t, err)
+	_, err = call("ControllerUnpublishVolume",
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+	assert.NoError(t, err)
+	_, err = call("DeleteVolume", &csi.DeleteVolumeRequest{VolumeId: id})
+	assert.NoError(t, err)
+	_, err = call("ControllerPublishVolume", &csi.ControllerPublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   "sdc-1",
+		VolumeCapability: mountCap(
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	})
+	assert.Error(t, err)
+
+	// other methods are not recorded
+	_, err = call("ListVolumes", &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.audit.close())
+	b, err := ioutil.ReadFile(p)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "hunter2")
+
+	recs := readAudit(t, p)
+	if !assert.Len(t, recs, 5) {
+		return
+	}
+	assert.Equal(t, "create", recs[0].Operation)
+	assert.Equal(t, "vol", recs[0].VolumeName)
+	assert.Equal(t, id, recs[0].VolumeID)
+	assert.Equal(t, int64(8<<30), recs[0].SizeBytes)
+	assert.Equal(t, "success", recs[0].Result)
+	assert.False(t, recs[0].Time.IsZero())
+
+	for i, op := range []string{"map", "unmap"} {
+		assert.Equal(t, op, recs[i+1].Operation)
+		assert.Equal(t, id, recs[i+1].VolumeID)
+		assert.Equal(t, "sdc-1", recs[i+1].NodeID)
+		assert.Equal(t, sdc, recs[i+1].SdcID)
+		assert.Equal(t, "success", recs[i+1].Result)
+	}
+	assert.Equal(t, "delete", recs[3].Operation)
+
+	assert.Equal(t, "map", recs[4].Operation)
+	assert.Equal(t, "NotFound", recs[4].Result)
+	assert.NotEmpty(t, recs[4].Error)
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "audit.log")
+
+	a, err := newAuditLog(p, 1024)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.close()
+
+	// records written concurrently are whole lines, and only the file and
+	// the one moved aside before it are kept
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a.write(&auditRecord{
+				Operation: "create",
+				VolumeID:  fmt.Sprintf("%016x", i),
+				Result:    "success",
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	fi, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.True(t, fi.Size() <= 1024)
+	recs := append(readAudit(t, p+".1"), readAudit(t, p)...)
+	assert.True(t, len(recs) < 50)
+	assert.NotEmpty(t, recs)
+	for _, rec := range recs {
+		assert.Equal(t, "create", rec.Operation)
+	}
+
+	// the log is appended to when reopened
+	assert.NoError(t, a.close())
+	n := len(readAudit(t, p))
+	a, err = newAuditLog(p, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer a.close()
+	a.write(&auditRecord{Operation: "delete", Result: "success"})
+	recs = readAudit(t, p)
+	if assert.Len(t, recs, n+1) {
+		assert.Equal(t, "delete", recs[n].Operation)
+	}
+
+	_, err = newAuditLog(filepath.Join(dir, "missing", "audit.log"), 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+)
+
+// controllerRPC is an RPC the controller service may advertise, with
+// whether it is enabled by the options the service runs with
+type controllerRPC struct {
+	rpc     csi.ControllerServiceCapability_RPC_Type
+	enabled func(Opts) bool
+}
+
+// controllerRPCs are the RPCs the controller service may advertise. An RPC
+// behind an option must be listed with it, so that the CO doesn't call it
+// when it would be refused.
+var controllerRPCs = []controllerRPC{
+	{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME, always},
+	{csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME, always},
+	{csi.ControllerServiceCapability_RPC_LIST_VOLUMES, always},
+	{csi.ControllerServiceCapability_RPC_GET_CAPACITY, always},
+}
+
+// always enables an RPC regardless of the options
+func always(Opts) bool { return true }
+
+// ControllerCapabilities returns the RPCs the controller service
+// advertises when run with opts
+func ControllerCapabilities(opts Opts) []csi.ControllerServiceCapability_RPC_Type {
+	var rpcs []csi.ControllerServiceCapability_RPC_Type
+	for _, c := range controllerRPCs {
+		if c.enabled(opts) {
+			rpcs = append(rpcs, c.rpc)
+		}
+	}
+	return rpcs
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControllerCapabilities(t *testing.T) {
+	defer func(rpcs []controllerRPC) {
+		controllerRPCs = rpcs
+	}(controllerRPCs)
+
+	// an RPC behind an option is only advertised when it is enabled
+	n := len(controllerRPCs)
+	controllerRPCs = append(controllerRPCs[:n:n], controllerRPC{
+		csi.ControllerServiceCapability_RPC_UNKNOWN,
+		func(opts Opts) bool { return opts.AllowValidateOnly },
+	})
+
+	rpcs := ControllerCapabilities(Opts{})
+	assert.Len(t, rpcs, len(controllerRPCs)-1)
+	assert.NotContains(t, rpcs, csi.ControllerServiceCapability_RPC_UNKNOWN)
+
+	s := &service{opts: Opts{AllowValidateOnly: true}}
+	resp, err := s.ControllerGetCapabilities(context.Background(),
+		&csi.ControllerGetCapabilitiesRequest{})
+	assert.NoError(t, err)
+	var got []csi.ControllerServiceCapability_RPC_Type
+	for _, c := range resp.GetCapabilities() {
+		got = append(got, c.GetRpc().GetType())
+	}
+	assert.Equal(t, ControllerCapabilities(s.opts), got)
+	assert.Contains(t, got, csi.ControllerServiceCapability_RPC_UNKNOWN)
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	csictx "github.com/rexray/gocsi/context"
+	"google.golang.org/grpc/status"
+)
+
+// Commands are the subcommands RunCommand runs, with their descriptions.
+// Each is configured as the plugin is, by the environment variables and
+// configuration file, and runs once instead of serving the plugin.
+var Commands = map[string]string{
+	"check":   "log in to the gateway and find the configured system",
+	"volumes": "list the volumes of the configured system",
+	"config":  "show the configuration, as resolved from all its sources",
+}
+
+// commandResult is the output of a subcommand, which is either written as
+// JSON or as a table
+type commandResult interface {
+	writeTable(w io.Writer)
+}
+
+// RunCommand runs the subcommand name with the arguments args, writing its
+// output to w. The output is a table, or JSON if args has -json.
+func RunCommand(
+	ctx context.Context, name string, args []string, w io.Writer) error {
+
+	if _, ok := Commands[name]; !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "write the output as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	_, err := loadConfigFile(ctx, csictx.Getenv(ctx, EnvConfigFile))
+	if err != nil {
+		return fmt.Errorf("unable to load config file: %s", err.Error())
+	}
+	if err := setLogFormat(csictx.Getenv(ctx, EnvLogFormat)); err != nil {
+		return err
+	}
+	if _, err := setLogLevel(ctx); err != nil {
+		return err
+	}
+	s := New().(*service)
+	if err := s.configure(ctx); err != nil {
+		return err
+	}
+
+	var res commandResult
+	switch name {
+	case "config":
+		res = configResult(s.configFields())
+	case "check":
+		res, err = s.checkCommand(ctx)
+	case "volumes":
+		res, err = s.volumesCommand(ctx)
+	}
+	if serr := s.Shutdown(ctx); serr != nil && err == nil {
+		err = serr
+	}
+	if st, ok := status.FromError(err); ok && err != nil {
+		return errors.New(st.Message())
+	}
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	res.writeTable(tw)
+	return tw.Flush()
+}
+
+// configResult is the output of the config command, the configuration as
+// it is logged when the plugin starts
+type configResult map[string]interface{}
+
+func (r configResult) writeTable(w io.Writer) {
+	keys := make([]string, 0, len(r))
+	for k := range r {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%v\n", k, r[k])
+	}
+}
+
+// checkResult is the output of the check command
+type checkResult struct {
+	Endpoint string `json:"endpoint"`
+	Version  string `json:"version"`
+	System   string `json:"system"`
+	SystemID string `json:"systemId"`
+}
+
+func (r checkResult) writeTable(w io.Writer) {
+	fmt.Fprintf(w, "endpoint\t%s\n", r.Endpoint)
+	fmt.Fprintf(w, "version\t%s\n", r.Version)
+	fmt.Fprintf(w, "system\t%s\n", r.System)
+	fmt.Fprintf(w, "systemId\t%s\n", r.SystemID)
+}
+
+// checkCommand probes the controller, as the plugin does when it starts,
+// and returns the gateway and system found
+func (s *service) checkCommand(ctx context.Context) (commandResult, error) {
+	if err := s.controllerProbe(ctx); err != nil {
+		return nil, err
+	}
+	version, err := s.adminClient.GetVersion()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get gateway version: %s",
+			err.Error())
+	}
+	system := s.currentSystem()
+	return checkResult{
+		Endpoint: s.opts.Endpoint,
+		Version:  version,
+		System:   system.Name,
+		SystemID: system.ID,
+	}, nil
+}
+
+// volumeRow is a volume listed by the volumes command
+type volumeRow struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	StoragePool string   `json:"storagePool"`
+	SizeBytes   int64    `json:"sizeBytes"`
+	MappedSDCs  []string `json:"mappedSdcs"`
+}
+
+// volumesResult is the output of the volumes command
+type volumesResult []volumeRow
+
+func (r volumesResult) writeTable(w io.Writer) {
+	fmt.Fprintln(w, "ID\tNAME\tSTORAGE POOL\tSIZE (GiB)\tMAPPED SDCS")
+	for _, v := range r {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", v.ID, v.Name, v.StoragePool,
+			v.SizeBytes/bytesInGiB, strings.Join(v.MappedSDCs, ","))
+	}
+}
+
+// volumesCommand returns the volumes of each storage pool of the system,
+// as ListVolumes lists them, with their names. Deleted volumes that are
+// only retained, with ListOwnedOnly volumes that aren't the plug-in's own,
+// and with ListExcludeIncomplete volumes reported only in part, aren't
+// listed.
+func (s *service) volumesCommand(ctx context.Context) (commandResult, error) {
+	if err := s.controllerProbe(ctx); err != nil {
+		return nil, err
+	}
+	s.metrics.gatewayCall("GetStoragePools")
+	pools, err := s.adminClient.GetStoragePools()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list storage pools: %s",
+			err.Error())
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+
+	res := volumesResult{}
+	for _, pool := range pools {
+		s.metrics.gatewayCall("GetStoragePoolVolumes")
+		vols, err := s.adminClient.GetStoragePoolVolumes(pool)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list volumes of %s: %s",
+				pool.Name, err.Error())
+		}
+		vols = listableVolumes(pool, vols)
+		sort.Slice(vols, func(i, j int) bool { return vols[i].Name < vols[j].Name })
+		for _, vol := range vols {
+			if isTombstone(vol) || (s.opts.ListOwnedOnly && !isOwned(vol)) {
+				continue
+			}
+			if volumeIncomplete(vol) && !s.listIncomplete(vol) {
+				continue
+			}
+			res = append(res, volumeRow{
+				ID:          vol.ID,
+				Name:        vol.Name,
+				StoragePool: pool.Name,
+				SizeBytes:   getCSIVolume(vol).CapacityBytes,
+				MappedSDCs:  mappedSDCs(vol),
+			})
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+func TestRunCommand(t *testing.T) {
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+	sdc := fake.AddSdc("SDC-1")
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	assert.NoError(t, fake.MapVolumeSdc(&siotypes.Volume{ID: id},
+		&siotypes.MapVolumeSdcParam{SdcID: sdc}))
+	deleted := fake.AddVolume("deleted", "pool", 8*kiBytesInGiB)
+	fake.Volumes[deleted].Name = tombstoneName(deleted, time.Now())
+
+	gw := testutil.NewFakeGateway(fake, "admin", "password")
+	defer gw.Close()
+
+	env := []string{
+		EnvEndpoint + "=" + gw.Endpoint(),
+		EnvPassword + "=password",
+		EnvSystemName + "=sys",
+		EnvAllowHTTP + "=true",
+	}
+	run := func(env []string, name string, args ...string) (string, error) {
+		ctx := csictx.WithEnviron(context.Background(), env)
+		var out bytes.Buffer
+		err := RunCommand(ctx, name, args, &out)
+		return out.String(), err
+	}
+
+	out, err := run(env, "config", "-json")
+	assert.NoError(t, err)
+	cfg := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(out), &cfg))
+	assert.Equal(t, gw.Endpoint(), cfg["endpoint"])
+	assert.Equal(t, "admin", cfg["user"])
+	assert.Equal(t, "******", cfg["password"])
+
+	out, err = run(env, "check")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "sys")
+	assert.Contains(t, out, fake.Version)
+
+	out, err = run(env, "volumes")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, []string{id, "vol", "pool", "8", sdc},
+			strings.Fields(lines[1]))
+	}
+
+	out, err = run(env, "volumes", "-json")
+	assert.NoError(t, err)
+	var vols []volumeRow
+	assert.NoError(t, json.Unmarshal([]byte(out), &vols))
+	assert.Equal(t, []volumeRow{{
+		ID:          id,
+		Name:        "vol",
+		StoragePool: "pool",
+		SizeBytes:   8 * bytesInGiB,
+		MappedSDCs:  []string{sdc},
+	}}, vols)
+
+	// failures are returned without their gRPC code
+	bad := append([]string{EnvPassword + "=wrong"}, env...)
+	_, err = run(bad, "check")
+	if assert.Error(t, err) {
+		assert.True(t, strings.HasPrefix(
+			err.Error(), "unable to login to ScaleIO Gateway"), err.Error())
+	}
+	_, err = run(env, "check", "-table")
+	assert.Error(t, err)
+	_, err = run(env, "serve")
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	csictx "github.com/rexray/gocsi/context"
+	log "github.com/sirupsen/logrus"
+)
+
+// configKeys maps the keys of the configuration file to the environment
+// variables they stand in for
+var configKeys = map[string]string{
+	"endpoint":               EnvEndpoint,
+	"user":                   EnvUser,
+	"password":               EnvPassword,
+	"systemName":             EnvSystemName,
+	"sdcGUID":                EnvSDCGUID,
+	"insecure":               EnvInsecure,
+	"thickProvision":         EnvThick,
+	"autoProbe":              EnvAutoProbe,
+	"drvCfgPath":             EnvDrvCfgPath,
+	"privateMountDir":        EnvPrivateMountDir,
+	"maxVolumesPerNode":      EnvMaxVolumesPerNode,
+	"cleanupOnStart":         EnvCleanupOnStart,
+	"fsck":                   EnvFSCheck,
+	"xfsNoUUID":              EnvXFSNoUUID,
+	"sockPerms":              EnvSockPerms,
+	"sockOwner":              EnvSockOwner,
+	"sockStrict":             EnvSockStrict,
+	"metricsAddr":            EnvMetricsAddr,
+	"healthAddr":             EnvHealthAddr,
+	"probeCacheTTL":          EnvProbeCacheTTL,
+	"logFormat":              EnvLogFormat,
+	"logLevel":               EnvLogLevel,
+	"debug":                  EnvDebug,
+	"rpcTimeouts":            EnvRPCTimeouts,
+	"shutdownTimeout":        EnvShutdownTimeout,
+	"orphanScanInterval":     EnvOrphanScanInterval,
+	"orphanCleanup":          EnvOrphanCleanup,
+	"cleanupDisconnected":    EnvCleanupDisconnected,
+	"keepaliveInterval":      EnvKeepaliveInterval,
+	"prefetch":               EnvPrefetch,
+	"gatewayDebug":           EnvGatewayDebug,
+	"auditLog":               EnvAuditLog,
+	"auditLogMaxSize":        EnvAuditLogMaxSize,
+	"unmapSettleTimeout":     EnvUnmapSettleTimeout,
+	"mappingCacheTTL":        EnvMappingCacheTTL,
+	"strictParams":           EnvStrictParams,
+	"slowOperationThreshold": EnvSlowOperationThreshold,
+	"debugOperations":        EnvDebugOperations,
+	"debugConfig":            EnvDebugConfig,
+	"unpublishCheck":         EnvUnpublishCheck,
+	"unpublishCheckTimeout":  EnvUnpublishCheckTimeout,
+	"allowValidateOnly":      EnvAllowValidateOnly,
+	"traceAddr":              EnvTraceAddr,
+	"profiles":               EnvProfiles,
+	"skipPrivilegeCheck":     EnvSkipPrivilegeCheck,
+	"sdcRoot":                EnvSDCRoot,
+	"poolProvisioning":       EnvPoolProvisioning,
+	"storagePool":            EnvStoragePool,
+	"allowedPools":           EnvAllowedPools,
+	"deleteRetention":        EnvDeleteRetention,
+	"allowHTTP":              EnvAllowHTTP,
+	"nodeIDFallback":         EnvNodeIDFallback,
+	"nodeIDSdcID":            EnvNodeIDSdcID,
+	"poolReservedPercentage": EnvPoolReservedPercentage,
+	"thickFallback":          EnvThickFallback,
+	"statsAddr":              EnvStatsAddr,
+	"statsToken":             EnvStatsToken,
+	"snapshotGroups":         EnvSnapshotGroups,
+	"defaultVolumeSizeGiB":   EnvDefaultVolumeSizeGiB,
+	"enforceOwnership":       EnvEnforceOwnership,
+	"listOwnedOnly":          EnvListOwnedOnly,
+	"listExcludeIncomplete":  EnvListExcludeIncomplete,
+}
+
+// parseConfig parses a configuration file, in either JSON or YAML, into a
+// map of the values it sets. Only flat YAML documents of "key: value"
+// lines are supported, as no setting needs more structure.
+func parseConfig(data []byte) (map[string]string, error) {
+	cfg := map[string]string{}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var raw map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		for k, v := range raw {
+			switch tv := v.(type) {
+			case string:
+				cfg[k] = tv
+			case bool:
+				cfg[k] = strconv.FormatBool(tv)
+			case float64:
+				cfg[k] = strconv.FormatFloat(tv, 'f', -1, 64)
+			default:
+				return nil, fmt.Errorf("invalid value for key: %s", k)
+			}
+		}
+	} else {
+		s := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, fmt.Errorf("invalid line %d: %s", n, line)
+			}
+			cfg[strings.TrimSpace(kv[0])] = unquote(strings.TrimSpace(kv[1]))
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for k := range cfg {
+		if _, ok := configKeys[k]; !ok {
+			return nil, fmt.Errorf("unknown key: %s", k)
+		}
+	}
+	return cfg, nil
+}
+
+// unquote strips a YAML value of its quotes, or of a trailing comment if
+// it is unquoted
+func unquote(v string) string {
+	if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+		if v[0] == '"' {
+			if uv, err := strconv.Unquote(v); err == nil {
+				return uv
+			}
+		}
+		return v[1 : len(v)-1]
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v
+}
+
+// loadConfigFile reads the configuration file at path, and makes each of
+// its values available through the context, unless the corresponding
+// environment variable is already set. It returns the source of each
+// setting.
+func loadConfigFile(ctx context.Context, path string) (map[string]string, error) {
+	sources := map[string]string{}
+	for k, env := range configKeys {
+		if _, ok := csictx.LookupEnv(ctx, env); ok {
+			sources[k] = "env"
+		} else {
+			sources[k] = "default"
+		}
+	}
+	if path == "" {
+		return sources, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	for k, v := range cfg {
+		if sources[k] == "env" {
+			continue
+		}
+		if err := csictx.Setenv(ctx, configKeys[k], v); err != nil {
+			return nil, err
+		}
+		sources[k] = "file"
+	}
+	return sources, nil
+}
+
+// logConfigSources logs the source of each setting
+func logConfigSources(sources map[string]string) {
+	keys := make([]string, 0, len(sources))
+	for k := range sources {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		log.WithField("key", k).WithField("source", sources[k]).Debug(
+			"configuration source")
+	}
+}
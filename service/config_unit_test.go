@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	exp := map[string]string{
+		"endpoint":          "https://gw/api",
+		"password":          "p#ss: word",
+		"insecure":          "true",
+		"maxVolumesPerNode": "100",
+	}
+
+	cfg, err := parseConfig([]byte(`{
+		"endpoint": "https://gw/api",
+		"password": "p#ss: word",
+		"insecure": true,
+		"maxVolumesPerNode": 100
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, exp, cfg)
+
+	cfg, err = parseConfig([]byte(`---
+# gateway
+endpoint: https://gw/api
+password: "p#ss: word"
+insecure: true # skip verification
+
+maxVolumesPerNode: '100'
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, exp, cfg)
+
+	for _, c := range []string{
+		`{"endpoint": {"url": "https://gw/api"}}`,
+		`{"endpoints": "https://gw/api"}`,
+		"endpoints: https://gw/api",
+		"endpoint",
+	} {
+		_, err := parseConfig([]byte(c))
+		assert.Error(t, err, c)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-scaleio-config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(
+		"endpoint: https://file/api\nuser: file\n"), 0600))
+
+	env := map[string]string{EnvUser: "env"}
+	ctx := csictx.WithLookupEnv(context.Background(),
+		func(k string) (string, bool) {
+			v, ok := env[k]
+			return v, ok
+		})
+	ctx = csictx.WithSetenv(ctx, func(k, v string) error {
+		env[k] = v
+		return nil
+	})
+
+	sources, err := loadConfigFile(ctx, path)
+	assert.NoError(t, err)
+	assert.Equal(t, "file", sources["endpoint"])
+	assert.Equal(t, "env", sources["user"])
+	assert.Equal(t, "default", sources["password"])
+
+	// environment variables take precedence
+	assert.Equal(t, "https://file/api", env[EnvEndpoint])
+	assert.Equal(t, "env", env[EnvUser])
+
+	_, err = loadConfigFile(ctx, filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// configPath is the path, on the metrics address, at which the
+// configuration is served when enabled
+const configPath = "/debug/config"
+
+// manifestConfigKeys are the settings of configFields always included in
+// the condensed configuration reported by GetPluginInfo. Other settings
+// are only included when set.
+var manifestConfigKeys = map[string]bool{
+	"endpoint":       true,
+	"user":           true,
+	"systemname":     true,
+	"insecure":       true,
+	"thickprovision": true,
+	"privatedir":     true,
+	"mode":           true,
+}
+
+// condensedConfig returns fields, as returned by configFields, as a
+// single line of comma separated key=value pairs, ordered by key, leaving
+// out the settings that aren't set
+func condensedConfig(fields log.Fields) string {
+	pairs := make([]string, 0, len(fields))
+	for k, v := range fields {
+		if !manifestConfigKeys[k] && unsetSetting(v) {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// unsetSetting returns whether v is the zero value of its type, or empty
+func unsetSetting(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case int64:
+		return v == 0
+	case float64:
+		return v == 0
+	case time.Duration:
+		return v == 0
+	case map[string]string:
+		return len(v) == 0
+	case []string:
+		return len(v) == 0
+	}
+	return false
+}
+
+// serveConfig writes the configuration, as it is logged when the service
+// is configured, as a JSON object
+func (s *service) serveConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configResult(s.configFields()))
+}
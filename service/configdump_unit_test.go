@@ -0,0 +1,61 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCondensedConfig(t *testing.T) {
+	s := New().(*service)
+	s.opts = Opts{
+		Endpoint:      "https://gateway",
+		User:          "admin",
+		Password:      "secret",
+		SystemName:    "sys",
+		StatsToken:    "token",
+		ProbeCacheTTL: 5 * time.Second,
+	}
+	s.privDir = "/dev/disk/csi-scaleio"
+
+	cfg := condensedConfig(s.configFields())
+	assert.NotContains(t, cfg, "secret")
+	assert.NotContains(t, cfg, "token=token")
+	pairs := strings.Split(cfg, ",")
+	for _, p := range []string{
+		"endpoint=https://gateway",
+		"user=admin",
+		"password=******",
+		"systemname=sys",
+		"insecure=false",
+		"thickprovision=false",
+		"privatedir=/dev/disk/csi-scaleio",
+		"probeCacheTTL=5s",
+		"statsToken=******",
+	} {
+		assert.Contains(t, pairs, p)
+	}
+	// settings that aren't set are left out
+	assert.NotContains(t, cfg, "metricsAddr")
+	assert.NotContains(t, cfg, "orphanCleanup")
+}
+
+func TestServeConfig(t *testing.T) {
+	s := New().(*service)
+	s.opts.Password = "secret"
+	s.opts.SystemName = "sys"
+
+	w := httptest.NewRecorder()
+	s.serveConfig(w, httptest.NewRequest("GET", configPath, nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.NotContains(t, w.Body.String(), "secret")
+	cfg := map[string]interface{}{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&cfg))
+	assert.Equal(t, "sys", cfg["systemname"])
+	assert.Equal(t, "******", cfg["password"])
+	assert.Len(t, cfg, len(s.configFields()))
+}
@@ -1,9 +1,16 @@
 package service
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -20,6 +27,99 @@ const (
 	// volume create parameters map
 	KeyStoragePool = "storagepool"
 
+	// KeyFsType is the key used to get, from the volume create parameters
+	// map, the filesystem type a volume is formatted with when a mount
+	// request does not give one
+	KeyFsType = "fsType"
+
+	// KeyMkfsOptions is the key used to get, from the volume create
+	// parameters map, the options added to the mkfs command that formats a
+	// volume when it is first published with a mount access type. It is
+	// kept as a volume attribute to be passed on to the node service.
+	KeyMkfsOptions = "mkfsOptions"
+
+	// KeyRAMCache is the key used to get, from the volume create parameters
+	// map, whether a volume uses the RAM read cache. The storage pool's
+	// setting is used when it is not given. It is also the volume attribute
+	// giving the setting applied.
+	KeyRAMCache = "ramcache"
+
+	// KeyIOPSLimit is the key used to get, from the volume create
+	// parameters map, the IOPS limit set on each mapping of a volume to an
+	// SDC. Zero, or no limit, means unlimited. It is kept as a volume
+	// attribute to be applied when the volume is published.
+	KeyIOPSLimit = "iopsLimit"
+
+	// KeyBandwidthLimitKbps is the key used to get, from the volume create
+	// parameters map, the bandwidth limit, in KB/s, set on each mapping of
+	// a volume to an SDC. Zero, or no limit, means unlimited. It is kept as
+	// a volume attribute to be applied when the volume is published.
+	KeyBandwidthLimitKbps = "bandwidthLimitKbps"
+
+	// KeyImportVolumeName is the key used to get, from the volume create
+	// parameters map, the name of an existing volume to return instead of
+	// creating one
+	KeyImportVolumeName = "importVolumeName"
+
+	// KeyImportRename is the key used to get, from the volume create
+	// parameters map, a flag indicating that an imported volume is renamed
+	// to the name of the request
+	KeyImportRename = "importRename"
+
+	// KeyImportForce is the key used to get, from the volume create
+	// parameters map, a flag indicating that a volume is imported even
+	// though it is mapped to an SDC
+	KeyImportForce = "importForce"
+
+	// KeyValidateOnly is the key used to get, from the volume create
+	// parameters map, a flag indicating that the parameters are only
+	// checked, as creating the volume would, without creating it. It is
+	// only accepted if EnvAllowValidateOnly is set.
+	KeyValidateOnly = "validateOnly"
+
+	// maxVolumeNameLength is the longest volume name ScaleIO accepts
+	maxVolumeNameLength = 31
+
+	// volumeNameHashLength is the number of hex digits of its hash that a
+	// name too long for ScaleIO ends with when shortened
+	volumeNameHashLength = 8
+
+	// minIOPSLimit is the lowest IOPS limit ScaleIO accepts
+	minIOPSLimit = 11
+
+	// bandwidthLimitMultipleKbps is the multiple of KB/s ScaleIO requires
+	// bandwidth limits to be
+	bandwidthLimitMultipleKbps = 1024
+
+	// KeyProvisioningType is the volume attribute giving whether a volume
+	// is thin or thick provisioned
+	KeyProvisioningType = "provisioningType"
+
+	// KeyProvisioning is the volume attribute set to provisioningFallback
+	// when a volume was created thin because its storage pool couldn't
+	// allocate the thick volume requested
+	KeyProvisioning = "provisioning"
+
+	// provisioningFallback is the value of KeyProvisioning for a thin
+	// volume created in place of a thick one
+	provisioningFallback = "thin-fallback"
+
+	// KeyStoragePoolName is the volume attribute giving the name of the
+	// storage pool a volume was created in
+	KeyStoragePoolName = "storagePoolName"
+
+	// KeyProtectionDomainID is the volume attribute giving the ID of the
+	// protection domain a volume was created in
+	KeyProtectionDomainID = "protectionDomainId"
+
+	// KeySystemID is the volume attribute giving the ID of the ScaleIO
+	// system a volume was created in
+	KeySystemID = "systemId"
+
+	// KeyAccessType is the publish info giving the access type, "block" or
+	// "mount", a volume was published with
+	KeyAccessType = "accessType"
+
 	// DefaultVolumeSizeKiB is default volume size to create on a scaleIO
 	// cluster when no size is given, expressed in KiB
 	DefaultVolumeSizeKiB = 16 * kiBytesInGiB
@@ -38,10 +138,17 @@ const (
 	// bytesInGiB is the number of bytes in a gibibyte
 	bytesInGiB = kiBytesInGiB * bytesInKiB
 
+	// maxVolumeSizeGiB is the largest volume size, a multiple of
+	// VolSizeMultipleGiB, whose size in bytes fits the capacity of a CSI
+	// volume
+	maxVolumeSizeGiB = math.MaxInt64 / bytesInGiB /
+		VolSizeMultipleGiB * VolSizeMultipleGiB
+
 	removeModeOnlyMe          = "ONLY_ME"
 	sioGatewayNotFound        = "Not found"
 	sioGatewayVolumeNotFound  = "Could not find the volume"
 	sioGatewayVolumeNameInUse = "Volume name already in use. Please use a different name."
+	sioGatewaySdcNotFound     = "Couldn't find SDC"
 	errNoMultiMap             = "volume not enabled for mapping to multiple hosts"
 	errUnknownAccessMode      = "access mode cannot be UNKNOWN"
 	errNoMultiNodeWriter      = "multi-node with writer(s) only supported for block access type"
@@ -52,53 +159,187 @@ func (s *service) CreateVolume(
 	req *csi.CreateVolumeRequest) (
 	*csi.CreateVolumeResponse, error) {
 
+	// requests for the same name wait for the first, sharing its result if
+	// identical, rather than each reaching the gateway
+	return s.creates.do(ctx, s.volumeName(req.GetName()), req, func() (
+		*csi.CreateVolumeResponse, error) {
+		return s.createVolume(ctx, req)
+	})
+}
+
+// sioVolumeName returns the ScaleIO name of the volume the CO names name.
+// Names longer than ScaleIO allows are cut short, ending with a hash of the
+// whole name, so that creating the volume again finds the same volume.
+func sioVolumeName(name string) string {
+	if len(name) <= maxVolumeNameLength {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return name[:maxVolumeNameLength-volumeNameHashLength-1] + "-" +
+		hex.EncodeToString(sum[:])[:volumeNameHashLength]
+}
+
+func (s *service) createVolume(
+	ctx context.Context,
+	req *csi.CreateVolumeRequest) (
+	*csi.CreateVolumeResponse, error) {
+
 	if err := s.requireProbe(ctx); err != nil {
 		return nil, err
 	}
 
 	cr := req.GetCapacityRange()
-	sizeInKiB, err := validateVolSize(cr)
+	sizeInKiB, err := validateVolSize(cr, s.defaultVolumeSizeKiB())
 	if err != nil {
 		return nil, err
 	}
 
-	params := req.GetParameters()
+	params, err := s.applyProfile(ctx, req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkParams(ctx, params); err != nil {
+		return nil, err
+	}
+	if _, err := parseMkfsOptions(params[KeyMkfsOptions]); err != nil {
+		return nil, err
+	}
+	if _, err := parseRootOwnership(params[KeyGID], params[KeyMode]); err != nil {
+		return nil, err
+	}
+
+	validateOnly, err := s.getValidateOnly(params)
+	if err != nil {
+		return nil, err
+	}
+
+	if importName, ok := params[KeyImportVolumeName]; ok {
+		if validateOnly {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"`%s` can't be combined with `%s`",
+				KeyValidateOnly, KeyImportVolumeName)
+		}
+		return s.importVolume(ctx, req, params, importName)
+	}
 
 	// We require the storagePool name for creation
+	params = s.withStoragePool(params)
 	sp, ok := params[KeyStoragePool]
 	if !ok {
 		return nil, status.Errorf(codes.InvalidArgument,
 			"`%s` is a required parameter", KeyStoragePool)
 	}
+	if err := s.checkPoolAllowed(ctx, sp); err != nil {
+		return nil, err
+	}
+
+	volType, volTypeSource := s.volProvisionType(params)
 
-	volType := s.getVolProvisionType(params)
+	var (
+		ramCache    bool
+		setRAMCache bool
+	)
+	if rc, ok := params[KeyRAMCache]; ok {
+		if ramCache, err = strconv.ParseBool(rc); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid boolean `%s`=(%v) in params", KeyRAMCache, rc)
+		}
+		setRAMCache = true
+	}
 
 	name := req.GetName()
 	if name == "" {
 		return nil, status.Error(codes.InvalidArgument,
 			"'name' cannot be empty")
 	}
+	name = s.volumeName(name)
+
+	limits, err := getMappedSdcLimits(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// looking up the pool checks that it is in the configured system; any
+	// other failure is left for creating the volume to report
+	if _, err := s.getStoragePool(sp); err != nil {
+		if st, ok := status.FromError(err); ok &&
+			st.Code() == codes.InvalidArgument {
+			return nil, err
+		}
+	}
+
+	thickRequested := volType == thickProvisioned
+	if thickRequested {
+		if err := s.checkZeroPadding(ctx, sp); err != nil {
+			return nil, err
+		}
+		if err := s.checkThickCapacity(ctx, sp, sizeInKiB); err != nil {
+			if !s.opts.ThickFallback {
+				return nil, err
+			}
+			reqLog(ctx, "").WithError(err).WithField("storagePool", sp).Warn(
+				"creating thin volume in place of thick")
+			volType, volTypeSource = thinProvisioned, provisionFromFallback
+		}
+	}
+
+	if err := s.checkPoolReserve(ctx, sp, sizeInKiB, volType); err != nil {
+		return nil, err
+	}
+
+	if validateOnly {
+		resp, err := s.validateCreate(
+			ctx, name, sp, sizeInKiB, cr, volType, params, limits)
+		if err == nil && setRAMCache {
+			resp.Volume.Attributes[KeyRAMCache] = strconv.FormatBool(ramCache)
+		}
+		if err == nil && thickRequested && volType == thinProvisioned {
+			resp.Volume.Attributes[KeyProvisioning] = provisioningFallback
+		}
+		return resp, err
+	}
 
 	// TODO handle Access mode in volume capability
 
 	fields := map[string]interface{}{
-		"name":        name,
-		"sizeInKiB":   sizeInKiB,
-		"storagePool": sp,
-		"volType":     volType,
+		"name":          name,
+		"sizeInKiB":     sizeInKiB,
+		"storagePool":   sp,
+		"volType":       volType,
+		"volTypeSource": volTypeSource,
+	}
+	if setRAMCache {
+		fields["ramCache"] = ramCache
+	}
+	if limits != nil {
+		fields["iopsLimit"] = limits.IopsLimit
+		fields["bandwidthLimitKbps"] = limits.BandwidthLimitInKbps
+	}
+	if profile, ok := params[KeyProfile]; ok {
+		fields["profile"] = profile
+		fields["parameters"] = params
 	}
 
-	log.WithFields(fields).Info("creating volume")
+	reqLog(ctx, "").WithFields(fields).Info("creating volume")
 
 	volumeParam := &siotypes.VolumeParam{
 		Name:           name,
 		VolumeSizeInKb: fmt.Sprintf("%d", sizeInKiB),
 		VolumeType:     volType,
 	}
-	createResp, err := s.adminClient.CreateVolume(volumeParam, sp)
+	admin := adminContext(ctx, s.adminClient)
+
+	s.metrics.gatewayCall("CreateVolume")
+	createResp, err := admin.CreateVolume(volumeParam, sp)
 	if err != nil {
+		if cerr := canceledErr(ctx, "creating volume"); cerr != nil {
+			return nil, cerr
+		}
+		if isPoolNotFound(err) {
+			return nil, s.poolNotFoundErr(ctx, sp)
+		}
 		// handle case where volume already exists
-		if !strings.EqualFold(err.Error(), sioGatewayVolumeNameInUse) {
+		if !isVolumeNameInUse(err) {
 			return nil, status.Errorf(codes.Internal,
 				"error when creating volume: %s", err.Error())
 		}
@@ -107,15 +348,38 @@ func (s *service) CreateVolume(
 	var id string
 	if createResp == nil {
 		// volume already exists, look it up by name
-		id, err = s.adminClient.FindVolumeID(name)
+		reqLog(ctx, "").WithField("name", name).Info(
+			"volume name in use, returning existing volume")
+		id, err = s.findVolumeID(ctx, name)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, err.Error())
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 	} else {
 		id = createResp.ID
 	}
 
-	vol, err := s.getVolByID(id)
+	if setRAMCache {
+		if err := canceledErr(ctx, "setting RAM read cache"); err != nil {
+			return nil, s.abortCreate(ctx, id, createResp != nil, err)
+		}
+		s.metrics.gatewayCall("SetVolumeUseRmcache")
+		if err := admin.SetVolumeUseRmcache(
+			&siotypes.Volume{ID: id}, ramCache); err != nil {
+			if cerr := canceledErr(ctx, "setting RAM read cache"); cerr != nil {
+				return nil, s.abortCreate(ctx, id, createResp != nil, cerr)
+			}
+			return nil, status.Errorf(codes.Internal,
+				"error setting RAM read cache: %s", err.Error())
+		}
+	}
+
+	if err := canceledErr(ctx, "retrieving volume details"); err != nil {
+		return nil, err
+	}
+	vol, err := s.getVolByID(ctx, id)
 	if err != nil {
 		return nil, status.Errorf(codes.Unavailable,
 			"error retrieving volume details: %s", err.Error())
@@ -124,65 +388,321 @@ func (s *service) CreateVolume(
 
 	// since the volume could have already exists, double check that the
 	// volume has the expected parameters
-	spID, err := s.getStoragePoolID(sp)
+	pool, err := s.getStoragePool(sp)
 	if err != nil {
 		return nil, status.Errorf(codes.Unavailable,
 			"volume exists, but could not verify parameters: %s",
 			err.Error())
 	}
-	if vol.StoragePoolID != spID {
-		return nil, status.Errorf(codes.Unavailable,
-			"volume exists, but in different storage pool than requested")
+	if err := checkExistingVolume(vol, pool, sizeInKiB, cr); err != nil {
+		return nil, err
+	}
+	if createResp != nil {
+		s.invalidatePoolStats(pool.ID)
 	}
 
-	if (vi.CapacityBytes / bytesInKiB) != sizeInKiB {
-		return nil, status.Errorf(codes.Unavailable,
-			"volume exists, but at different size than requested")
+	vi.Attributes = s.volumeAttributes(vol, pool, params, limits)
+	if setRAMCache {
+		vi.Attributes[KeyRAMCache] = strconv.FormatBool(vol.UseRmCache)
+	}
+	if thickRequested && s.opts.ThickFallback &&
+		vol.VolumeType == thinProvisioned {
+		// a volume created by an earlier attempt may have fallen back
+		vi.Attributes[KeyProvisioning] = provisioningFallback
 	}
 
 	csiResp := &csi.CreateVolumeResponse{
 		Volume: vi,
 	}
 
-	s.clearCache()
-
 	return csiResp, nil
 }
 
-func (s *service) clearCache() {
-	s.volCacheRWL.Lock()
-	defer s.volCacheRWL.Unlock()
-	s.volCache = make([]*siotypes.Volume, 0)
+// isVolumeNameInUse returns whether err is the gateway refusing to create
+// a volume whose name another volume already has
+func isVolumeNameInUse(err error) bool {
+	return strings.Contains(
+		strings.ToLower(err.Error()),
+		strings.ToLower(sioGatewayVolumeNameInUse))
+}
+
+// abortCreate returns err, first removing the volume with id if created is
+// true, so a volume created by a request that was canceled before it was
+// configured is not left behind. The removal is not bound to the canceled
+// request.
+func (s *service) abortCreate(
+	ctx context.Context, id string, created bool, err error) error {
+
+	if !created {
+		return err
+	}
+	s.metrics.gatewayCall("RemoveVolume")
+	if rerr := s.adminClient.RemoveVolume(
+		&siotypes.Volume{ID: id}, removeModeOnlyMe); rerr != nil {
+		reqLog(ctx, id).WithError(rerr).Warn(
+			"unable to remove volume of canceled request")
+		return err
+	}
+	reqLog(ctx, id).Info("removed volume of canceled request")
+	return err
+}
+
+// volumeAttributes returns the attributes of a volume in pool, created or
+// imported with params
+func (s *service) volumeAttributes(
+	vol *siotypes.Volume,
+	pool *siotypes.StoragePool,
+	params map[string]string,
+	limits *siotypes.SetMappedSdcLimitsParam) map[string]string {
+
+	attrs := map[string]string{
+		KeyProvisioningType:   vol.VolumeType,
+		KeyStoragePoolName:    pool.Name,
+		KeyProtectionDomainID: pool.ProtectionDomainID,
+	}
+	if system := s.currentSystem(); system != nil {
+		attrs[KeySystemID] = system.ID
+	}
+	if fs, ok := params[KeyFsType]; ok {
+		attrs[KeyFsType] = fs
+	}
+	if mkfs, ok := params[KeyMkfsOptions]; ok {
+		attrs[KeyMkfsOptions] = mkfs
+	}
+	for _, k := range []string{KeyGID, KeyMode} {
+		if v, ok := params[k]; ok {
+			attrs[k] = v
+		}
+	}
+	if limits != nil {
+		attrs[KeyIOPSLimit] = limits.IopsLimit
+		attrs[KeyBandwidthLimitKbps] = limits.BandwidthLimitInKbps
+	}
+	return attrs
+}
+
+// importVolume returns the existing volume named importName as though it
+// had been created by req, with params. The volume's own provisioning is
+// kept, so only the parameters that become volume attributes apply.
+func (s *service) importVolume(
+	ctx context.Context,
+	req *csi.CreateVolumeRequest,
+	params map[string]string,
+	importName string) (
+	*csi.CreateVolumeResponse, error) {
+
+	name := req.GetName()
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"'name' cannot be empty")
+	}
+	name = s.volumeName(name)
+	if importName == "" {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"`%s` cannot be empty", KeyImportVolumeName)
+	}
+
+	rename, err := getBoolParam(params, KeyImportRename)
+	if err != nil {
+		return nil, err
+	}
+	force, err := getBoolParam(params, KeyImportForce)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := getMappedSdcLimits(params)
+	if err != nil {
+		return nil, err
+	}
+
+	reqLog(ctx, "").WithFields(map[string]interface{}{
+		"name":             name,
+		"importVolumeName": importName,
+		"rename":           rename,
+		"force":            force,
+	}).Info("importing volume")
+
+	// an earlier import may have renamed the volume already
+	renamed := importName
+	if rename {
+		renamed = name
+	} else if s.opts.EnforceOwnership {
+		renamed = stampedVolumeName(importName)
+	}
+	id, err := s.findVolumeID(ctx, importName)
+	if err != nil && renamed != importName &&
+		strings.EqualFold(err.Error(), sioGatewayNotFound) {
+		id, err = s.findVolumeID(ctx, renamed)
+	}
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		if strings.EqualFold(err.Error(), sioGatewayNotFound) {
+			return nil, status.Errorf(codes.NotFound,
+				"volume to import not found: %s", importName)
+		}
+		return nil, status.Errorf(codes.Internal,
+			"error finding volume to import: %s", err.Error())
+	}
+
+	vol, err := s.getVolByID(ctx, id)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"error retrieving volume details: %s", err.Error())
+	}
+
+	// A deleted volume that is retained is recovered by importing it, and
+	// must lose its tombstone name, or it would be removed again
+	if isTombstone(vol) && !rename {
+		reqLog(ctx, vol.ID).WithField("tombstone", vol.Name).Info(
+			"renaming deleted volume being imported")
+		rename = true
+	}
+
+	if len(vol.MappedSdcInfo) > 0 && !force {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"volume to import is mapped to SDC id: %s, set `%s` to "+
+				"import it anyway", vol.MappedSdcInfo[0].SdcID, KeyImportForce)
+	}
+
+	vi := getCSIVolume(vol)
+	cr := req.GetCapacityRange()
+	if vi.CapacityBytes < cr.GetRequiredBytes() ||
+		(cr.GetLimitBytes() != 0 && vi.CapacityBytes > cr.GetLimitBytes()) {
+		return nil, status.Errorf(codes.OutOfRange,
+			"volume to import has size %d, outside of the capacity range",
+			vi.CapacityBytes)
+	}
+
+	s.metrics.gatewayCall("FindStoragePool")
+	pool, err := s.adminClient.FindStoragePool(vol.StoragePoolID, "", "")
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable,
+			"error retrieving storage pool of volume: %s", err.Error())
+	}
+	if sp, ok := params[KeyStoragePool]; ok && sp != pool.Name {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"volume to import is in storage pool %s, not %s", pool.Name, sp)
+	}
+
+	// Volumes adopted while ownership is enforced are marked as the
+	// plug-in's own, even if they keep their names otherwise
+	newName := vol.Name
+	if rename {
+		newName = name
+	} else if s.opts.EnforceOwnership && !isOwned(vol) {
+		newName = stampedVolumeName(vol.Name)
+	}
+	if newName != vol.Name {
+		if err := canceledErr(ctx, "renaming volume to import"); err != nil {
+			return nil, err
+		}
+		s.metrics.gatewayCall("SetVolumeName")
+		if err := adminContext(ctx, s.adminClient).SetVolumeName(
+			vol, newName); err != nil {
+			if cerr := canceledErr(
+				ctx, "renaming volume to import"); cerr != nil {
+				return nil, cerr
+			}
+			return nil, status.Errorf(codes.Internal,
+				"error renaming volume to import: %s", err.Error())
+		}
+		reqLog(ctx, vol.ID).WithFields(map[string]interface{}{
+			"oldName": vol.Name,
+			"name":    newName,
+		}).Info("renamed imported volume")
+	}
+
+	vi.Attributes = s.volumeAttributes(vol, pool, params, limits)
+
+	return &csi.CreateVolumeResponse{Volume: vi}, nil
+}
+
+// getBoolParam returns the flag in params under key, which is false if it
+// is not given
+func getBoolParam(params map[string]string, key string) (bool, error) {
+	v, ok := params[key]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument,
+			"invalid boolean `%s`=(%v) in params", key, v)
+	}
+	return b, nil
+}
+
+// checkZeroPadding returns FailedPrecondition if the named storage pool
+// does not have zero padding enabled, which thick provisioning requires.
+// The gateway's own error for this is easily misread.
+func (s *service) checkZeroPadding(ctx context.Context, name string) error {
+	pool, err := s.getStoragePool(name)
+	if err == nil && !pool.ZeroPaddingEnabled {
+		// the setting may have changed since the pool was cached
+		s.invalidateStoragePool(name)
+		pool, err = s.getStoragePool(name)
+	}
+	if err != nil {
+		// let creating the volume report a pool that can't be found
+		reqLog(ctx, "").WithError(err).WithField("storagePool", name).Warn(
+			"unable to check zero padding of storage pool")
+		return nil
+	}
+	if !pool.ZeroPaddingEnabled {
+		return status.Errorf(codes.FailedPrecondition,
+			"pool %s does not have zero padding enabled; "+
+				"thick provisioning requires it", name)
+	}
+	return nil
+}
+
+// defaultVolumeSizeKiB returns the size of volumes created without a
+// required size
+func (s *service) defaultVolumeSizeKiB() int64 {
+	if s.opts.DefaultVolumeSizeKiB > 0 {
+		return s.opts.DefaultVolumeSizeKiB
+	}
+	return DefaultVolumeSizeKiB
 }
 
 // validateVolSize uses the CapacityRange range params to determine what size
 // volume to create, and returns an error if volume size would be greater than
-// the given limit. Returned size is in KiB
-func validateVolSize(cr *csi.CapacityRange) (int64, error) {
+// the given limit. A volume without a required size is defaultSizeKiB.
+// Sizes too large to be created, or to be given in bytes, are refused with
+// OutOfRange rather than overflowing. Returned size is in KiB
+func validateVolSize(cr *csi.CapacityRange, defaultSizeKiB int64) (int64, error) {
 
 	minSize := cr.GetRequiredBytes()
 	maxSize := cr.GetLimitBytes()
+	if minSize < 0 || maxSize < 0 {
+		return 0, status.Errorf(codes.OutOfRange,
+			"required_bytes %d and limit_bytes %d can't be negative",
+			minSize, maxSize)
+	}
 
+	// ScaleIO creates volumes in multiples of 8GiB, rounding up.
+	// Determine what actual size of volume will be, in GiB so that no
+	// size overflows, and check that we do not exceed maxSize
+	var sizeGiB int64
 	if minSize == 0 {
-		minSize = DefaultVolumeSizeKiB
+		sizeGiB = defaultSizeKiB / kiBytesInGiB
 	} else {
-		minSize = minSize / bytesInKiB
+		sizeGiB = minSize / bytesInGiB
+		if minSize%bytesInGiB != 0 {
+			sizeGiB++
+		}
 	}
-
-	var (
-		sizeGiB int64
-		sizeKiB int64
-		sizeB   int64
-	)
-	// ScaleIO creates volumes in multiples of 8GiB, rounding up.
-	// Determine what actual size of volume will be, and check that
-	// we do not exceed maxSize
-	sizeGiB = minSize / kiBytesInGiB
-	mod := sizeGiB % VolSizeMultipleGiB
-	if mod > 0 {
+	if mod := sizeGiB % VolSizeMultipleGiB; mod > 0 {
 		sizeGiB = sizeGiB - mod + VolSizeMultipleGiB
 	}
-	sizeB = sizeGiB * bytesInGiB
+	if sizeGiB > maxVolumeSizeGiB {
+		return 0, status.Errorf(codes.OutOfRange,
+			"required_bytes %d is more than the largest volume size, "+
+				"%d bytes", minSize, int64(maxVolumeSizeGiB*bytesInGiB))
+	}
+	sizeB := sizeGiB * bytesInGiB
 	if maxSize != 0 {
 		if sizeB > maxSize {
 			return 0, status.Errorf(
@@ -191,7 +711,12 @@ func validateVolSize(cr *csi.CapacityRange) (int64, error) {
 		}
 	}
 
-	sizeKiB = sizeGiB * kiBytesInGiB
+	// the gateway's volumes give their size in KiB as an int
+	sizeKiB := sizeGiB * kiBytesInGiB
+	if int64(int(sizeKiB)) != sizeKiB {
+		return 0, status.Errorf(codes.OutOfRange,
+			"volume size %d bytes is too large for this platform", sizeB)
+	}
 	return sizeKiB, nil
 }
 
@@ -204,35 +729,78 @@ func (s *service) DeleteVolume(
 		return nil, err
 	}
 
-	id := req.GetVolumeId()
+	id, err := s.volumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
 
-	vol, err := s.getVolByID(id)
+	vol, err := s.getVolByID(ctx, id)
 	if err != nil {
 		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
-			log.Debug("volume already deleted")
+			reqLog(ctx, id).Debug("volume already deleted")
 			return &csi.DeleteVolumeResponse{}, nil
 		}
 		return nil, status.Errorf(codes.Internal,
 			"failure checking volume status before deletion: %s",
 			err.Error())
 	}
+	if s.opts.DeleteRetention > 0 && isTombstone(vol) {
+		reqLog(ctx, id).Debug("volume already deleted, and retained")
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err := s.checkOwned(vol); err != nil {
+		return nil, err
+	}
+
+	// The gateway may still report a mapping that was just removed
+	if vol, err = s.awaitUnmapped(ctx, vol); err != nil {
+		return nil, err
+	}
+	if vol == nil {
+		reqLog(ctx, id).Debug("volume deleted while waiting for unmap")
+		return &csi.DeleteVolumeResponse{}, nil
+	}
 
 	if len(vol.MappedSdcInfo) > 0 {
-		// Volume is in use
-		return nil, status.Errorf(codes.FailedPrecondition,
-			"volume in use by %s", vol.MappedSdcInfo[0].SdcID)
+		unmapped := false
+		if s.opts.CleanupDisconnected {
+			if unmapped, err = s.unmapDisconnected(ctx, vol); err != nil {
+				return nil, status.Errorf(codes.Internal,
+					"failure checking SDCs volume is mapped to: %s",
+					err.Error())
+			}
+		}
+		if !unmapped {
+			// Volume is in use
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume in use by %s", vol.MappedSdcInfo[0].SdcID)
+		}
 	}
 
-	tgtVol := goscaleio.NewVolume(s.adminClient)
-	tgtVol.Volume = vol
-	err = tgtVol.RemoveVolume(removeModeOnlyMe)
+	if err := canceledErr(ctx, "removing volume"); err != nil {
+		return nil, err
+	}
+	if s.opts.DeleteRetention > 0 {
+		if err := s.tombstone(ctx, vol); err != nil {
+			if cerr := canceledErr(ctx, "retaining volume"); cerr != nil {
+				return nil, cerr
+			}
+			return nil, status.Errorf(codes.Internal,
+				"error retaining deleted volume: %s", err.Error())
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	s.metrics.gatewayCall("RemoveVolume")
+	err = adminContext(ctx, s.adminClient).RemoveVolume(vol, removeModeOnlyMe)
+	s.forgetMappings(vol.ID)
 	if err != nil {
+		if cerr := canceledErr(ctx, "removing volume"); cerr != nil {
+			return nil, cerr
+		}
 		return nil, status.Errorf(codes.Internal,
 			"error removing volume: %s", err.Error())
 	}
 
-	s.clearCache()
-
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -250,8 +818,12 @@ func (s *service) ControllerPublishVolume(
 		return nil, status.Error(codes.InvalidArgument,
 			"volumeID is required")
 	}
+	volID, err := s.volumeID(volID)
+	if err != nil {
+		return nil, err
+	}
 
-	vol, err := s.getVolByID(volID)
+	vol, err := s.getVolByID(ctx, volID)
 	if err != nil {
 		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
 			return nil, status.Error(codes.NotFound,
@@ -261,84 +833,523 @@ func (s *service) ControllerPublishVolume(
 			"failure checking volume status before controller publish: %s",
 			err.Error())
 	}
+	if isTombstone(vol) {
+		return nil, status.Error(codes.NotFound,
+			"volume not found, it was deleted")
+	}
+
+	nodeID := req.GetNodeId()
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"node ID is required")
+	}
+
+	sdcID, err := s.getSDCID(ctx, nodeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	vc := req.GetVolumeCapability()
+	if vc == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"volume capability is required")
+	}
+
+	am := vc.GetAccessMode()
+	if am == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"access mode is required")
+	}
+
+	if am.Mode == csi.VolumeCapability_AccessMode_UNKNOWN {
+		return nil, status.Error(codes.InvalidArgument,
+			errUnknownAccessMode)
+	}
+
+	// Whether the volume may be mapped to more than one node is checked
+	// below, once it is known whether it is mapped already
+	vcs := []*csi.VolumeCapability{vc}
+	if ok, reason := valVolumeCaps(
+		vcs, vol, req.GetVolumeAttributes()); !ok && reason != errNoMultiMap {
+		return nil, status.Error(codes.InvalidArgument, reason)
+	}
+
+	limits, err := getMappedSdcLimits(req.GetVolumeAttributes())
+	if err != nil {
+		return nil, err
+	}
+
+	granted := requestedCap(vc, req.GetVolumeAttributes())
+
+	// Check if volume is published to any node already
+	if len(vol.MappedSdcInfo) > 0 {
+		isBlock := accTypeIsBlock(vcs)
+
+		if prev, ok := s.getGrantedCap(vol.ID); ok {
+			if !prev.compatible(granted) {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"volume already published as %s, not %s", prev, granted)
+			}
+			granted = prev.merge(granted)
+		}
+
+		// The cached SDC ID is stale if the SDC was re-registered since,
+		// and the volume may be mapped to it under its new ID already
+		if !mappedTo(vol, sdcID) {
+			s.invalidateSDC(nodeID)
+			id, err := s.getSDCID(ctx, nodeID)
+			if err != nil {
+				return nil, status.Error(codes.NotFound, err.Error())
+			}
+			if id != sdcID {
+				reqLog(ctx, volID).WithField("sdcID", id).Info(
+					"SDC ID changed")
+				sdcID = id
+			}
+		}
+
+		for _, sdc := range vol.MappedSdcInfo {
+			if sdc.SdcID == sdcID {
+				// volume already mapped
+				reqLog(ctx, volID).Debug("volume already mapped")
+				if err := s.checkMappingMode(
+					ctx, vol, sdcID, am.Mode); err != nil {
+					return nil, err
+				}
+				if err := s.setMappedSdcLimits(
+					ctx, vol.ID, sdcID, limits); err != nil {
+					return nil, err
+				}
+				s.setGrantedCap(vol.ID, granted)
+				s.setMappingMode(vol.ID, sdcID, am.Mode)
+				info := publishInfo(req.GetVolumeAttributes(), granted)
+				s.multiWriterInfo(info, vol, sdcID, am.Mode, granted)
+				return &csi.ControllerPublishVolumeResponse{
+					PublishInfo: info,
+				}, nil
+			}
+		}
+
+		// If volume has SINGLE_NODE cap, go no farther
+		switch am.Mode {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+			return nil, status.Errorf(codes.FailedPrecondition,
+				"volume already published to SDC id: %s", vol.MappedSdcInfo[0].SdcID)
+		}
+
+		// All remaining cases are MULTI_NODE, make sure volume has
+		// multi-map enabled
+		if !vol.MappingToAllSdcsEnabled {
+			return nil, status.Error(codes.FailedPrecondition,
+				errNoMultiMap)
+		}
+
+		if err := validateAccessType(am, isBlock); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.checkSdcVolLimit(ctx, volID, sdcID); err != nil {
+		return nil, err
+	}
+
+	mapVolumeSdcParam := &siotypes.MapVolumeSdcParam{
+		SdcID: sdcID,
+		AllowMultipleMappings: "false",
+		AllSdcs:               "",
+	}
+	if len(vol.MappedSdcInfo) > 0 {
+		// A volume mapped already was checked above to be published
+		// MULTI_NODE with multi-map enabled
+		mapVolumeSdcParam.AllowMultipleMappings = "true"
+	}
+
+	if err := canceledErr(ctx, "mapping volume to node"); err != nil {
+		return nil, err
+	}
+	admin := adminContext(ctx, s.adminClient)
+
+	s.metrics.gatewayCall("MapVolumeSdc")
+	err = admin.MapVolumeSdc(
+		&siotypes.Volume{ID: vol.ID}, mapVolumeSdcParam)
+	if err != nil && isSDCNotFound(err) {
+		// The SDC may have been re-registered under a new ID since it was
+		// cached, so look it up again
+		s.invalidateSDC(nodeID)
+		if id, lerr := s.getSDCID(ctx, nodeID); lerr == nil && id != sdcID {
+			reqLog(ctx, volID).WithField("sdcID", id).Info(
+				"SDC ID changed, retrying mapping")
+			mapVolumeSdcParam.SdcID = id
+			s.metrics.gatewayCall("MapVolumeSdc")
+			err = admin.MapVolumeSdc(
+				&siotypes.Volume{ID: vol.ID}, mapVolumeSdcParam)
+		}
+	}
+	if err != nil && isAlreadyMapped(err) &&
+		s.confirmMapped(ctx, vol.ID, mapVolumeSdcParam.SdcID) {
+		// A request the CO retried may find the mapping made for the
+		// attempt that timed out, which the gateway completed after the
+		// volume was read above
+		reqLog(ctx, volID).WithField("sdcID", mapVolumeSdcParam.SdcID).Info(
+			"volume already mapped by an earlier request")
+		err = nil
+	}
+	s.setRemapped(vol.ID)
+	if err != nil {
+		if cerr := canceledErr(ctx, "mapping volume to node"); cerr != nil {
+			return nil, cerr
+		}
+		return nil, status.Errorf(codes.Internal,
+			"error mapping volume to node: %s", err.Error())
+	}
+
+	s.addSdcVolCount(mapVolumeSdcParam.SdcID, 1)
+	s.noteMapping(vol.ID, mapVolumeSdcParam.SdcID, true)
+
+	if err := s.setMappedSdcLimits(
+		ctx, vol.ID, mapVolumeSdcParam.SdcID, limits); err != nil {
+		if st, ok := status.FromError(err); ok &&
+			(st.Code() == codes.Canceled ||
+				st.Code() == codes.DeadlineExceeded) {
+			s.abortPublish(ctx, vol.ID, mapVolumeSdcParam.SdcID)
+		}
+		return nil, err
+	}
+
+	s.setGrantedCap(vol.ID, granted)
+	s.setMappingMode(vol.ID, mapVolumeSdcParam.SdcID, am.Mode)
+	info := publishInfo(req.GetVolumeAttributes(), granted)
+	s.multiWriterInfo(info, vol, mapVolumeSdcParam.SdcID, am.Mode, granted)
+	return &csi.ControllerPublishVolumeResponse{
+		PublishInfo: info,
+	}, nil
+}
+
+// checkSdcVolLimit returns ResourceExhausted if mapping another volume to
+// the SDC with the given ID would exceed the maximum volumes per node. The
+// limit is left to the gateway when the SDC's volumes can't be counted.
+func (s *service) checkSdcVolLimit(
+	ctx context.Context, volID, sdcID string) error {
+
+	max := s.opts.MaxVolumesPerNode
+	if max == 0 {
+		return nil
+	}
+
+	n, err := s.getSdcVolCount(sdcID)
+	if err != nil {
+		reqLog(ctx, volID).WithError(err).WithField("sdcID", sdcID).Warn(
+			"unable to count volumes mapped to SDC")
+		return nil
+	}
+	if n >= max {
+		return status.Errorf(codes.ResourceExhausted,
+			"SDC %s has %d volumes mapped, the maximum volumes per node is %d",
+			sdcID, n, max)
+	}
+	return nil
+}
+
+// grantedCap is the access type and filesystem a volume is published with
+type grantedCap struct {
+	block  bool
+	fsType string
+}
+
+// requestedCap returns the capability requested by vc for a volume with
+// attrs, whose fsType applies if vc gives none
+func requestedCap(
+	vc *csi.VolumeCapability, attrs map[string]string) grantedCap {
+
+	if vc.GetBlock() != nil {
+		return grantedCap{block: true}
+	}
+	fs := vc.GetMount().GetFsType()
+	if fs == "" {
+		fs = attrs[KeyFsType]
+	}
+	return grantedCap{fsType: fs}
+}
+
+// compatible returns whether a volume published with c may also be
+// published with o. An empty fsType mounts whatever is on the volume.
+func (c grantedCap) compatible(o grantedCap) bool {
+	if c.block || o.block {
+		return c.block == o.block
+	}
+	return c.fsType == "" || o.fsType == "" || c.fsType == o.fsType
+}
+
+// merge returns c with the fsType of o, if c has none
+func (c grantedCap) merge(o grantedCap) grantedCap {
+	if c.fsType == "" {
+		c.fsType = o.fsType
+	}
+	return c
+}
+
+func (c grantedCap) String() string {
+	switch {
+	case c.block:
+		return "block"
+	case c.fsType != "":
+		return "mount (" + c.fsType + ")"
+	}
+	return "mount"
+}
+
+// getGrantedCap returns the capability a volume was last published with
+// by this controller, which is forgotten when it restarts
+func (s *service) getGrantedCap(volID string) (grantedCap, bool) {
+	s.grantedRWL.RLock()
+	defer s.grantedRWL.RUnlock()
+	c, ok := s.granted[volID]
+	return c, ok
+}
+
+func (s *service) setGrantedCap(volID string, c grantedCap) {
+	s.grantedRWL.Lock()
+	defer s.grantedRWL.Unlock()
+	s.granted[volID] = c
+}
+
+func (s *service) clearGrantedCap(volID string) {
+	s.grantedRWL.Lock()
+	defer s.grantedRWL.Unlock()
+	delete(s.granted, volID)
+}
+
+// mappingKey identifies the mapping of a volume to an SDC
+type mappingKey struct {
+	volID string
+	sdcID string
+}
+
+// getMappingMode returns the access mode a volume was last published to an
+// SDC with by this controller, which is forgotten when it restarts
+func (s *service) getMappingMode(
+	volID, sdcID string) (csi.VolumeCapability_AccessMode_Mode, bool) {
+
+	s.grantedRWL.RLock()
+	defer s.grantedRWL.RUnlock()
+	m, ok := s.mappingModes[mappingKey{volID, sdcID}]
+	return m, ok
+}
+
+func (s *service) setMappingMode(
+	volID, sdcID string, m csi.VolumeCapability_AccessMode_Mode) {
+
+	s.grantedRWL.Lock()
+	defer s.grantedRWL.Unlock()
+	s.mappingModes[mappingKey{volID, sdcID}] = m
+}
+
+func (s *service) clearMappingMode(volID, sdcID string) {
+	s.grantedRWL.Lock()
+	defer s.grantedRWL.Unlock()
+	delete(s.mappingModes, mappingKey{volID, sdcID})
+}
+
+// checkMappingMode checks that a volume already mapped to an SDC may be
+// published to it again with the given access mode. ScaleIO maps volumes
+// read-write whatever the access mode, so a mapping that is the volume's
+// only one may change mode, but one alongside others may not, as they were
+// published on the understanding it kept its mode. A mapping whose mode
+// isn't known, as after a restart, is taken to match.
+func (s *service) checkMappingMode(
+	ctx context.Context,
+	vol *siotypes.Volume,
+	sdcID string,
+	mode csi.VolumeCapability_AccessMode_Mode) error {
+
+	prev, ok := s.getMappingMode(vol.ID, sdcID)
+	if !ok || prev == mode {
+		return nil
+	}
+
+	if len(vol.MappedSdcInfo) == 1 {
+		reqLog(ctx, vol.ID).WithFields(log.Fields{
+			"sdcID": sdcID,
+			"from":  prev,
+			"to":    mode,
+		}).Info("changing access mode of volume mapping")
+		return nil
+	}
+
+	return status.Errorf(codes.AlreadyExists,
+		"volume already published to SDC %s as %s, which can't change to "+
+			"%s while the volume is published to %d other SDCs",
+		sdcID, prev, mode, len(vol.MappedSdcInfo)-1)
+}
+
+// getMappedSdcLimits returns the limits on the mappings of a volume to SDCs
+// given in params, or nil if none are given
+func getMappedSdcLimits(
+	params map[string]string) (*siotypes.SetMappedSdcLimitsParam, error) {
+
+	iops, iopsOK := params[KeyIOPSLimit]
+	bw, bwOK := params[KeyBandwidthLimitKbps]
+	if !iopsOK && !bwOK {
+		return nil, nil
+	}
 
-	nodeID := req.GetNodeId()
-	if nodeID == "" {
-		return nil, status.Error(codes.InvalidArgument,
-			"node ID is required")
+	parse := func(key, v string) (int64, error) {
+		if v == "" {
+			return 0, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, status.Errorf(codes.InvalidArgument,
+				"invalid limit `%s`=(%v) in params", key, v)
+		}
+		return n, nil
 	}
 
-	sdcID, err := s.getSDCID(nodeID)
+	iopsLimit, err := parse(KeyIOPSLimit, iops)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, err
 	}
-
-	vc := req.GetVolumeCapability()
-	if vc == nil {
-		return nil, status.Error(codes.InvalidArgument,
-			"volume capability is required")
+	if iopsLimit > 0 && iopsLimit < minIOPSLimit {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"`%s` must be 0 or at least %d", KeyIOPSLimit, minIOPSLimit)
 	}
 
-	am := vc.GetAccessMode()
-	if am == nil {
-		return nil, status.Error(codes.InvalidArgument,
-			"access mode is required")
+	bwLimit, err := parse(KeyBandwidthLimitKbps, bw)
+	if err != nil {
+		return nil, err
+	}
+	if bwLimit%bandwidthLimitMultipleKbps != 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"`%s` must be a multiple of %d", KeyBandwidthLimitKbps,
+			bandwidthLimitMultipleKbps)
 	}
 
-	if am.Mode == csi.VolumeCapability_AccessMode_UNKNOWN {
-		return nil, status.Error(codes.InvalidArgument,
-			errUnknownAccessMode)
+	return &siotypes.SetMappedSdcLimitsParam{
+		IopsLimit:            strconv.FormatInt(iopsLimit, 10),
+		BandwidthLimitInKbps: strconv.FormatInt(bwLimit, 10),
+	}, nil
+}
+
+// setMappedSdcLimits applies limits, if any, to the mapping of a volume to
+// an SDC
+func (s *service) setMappedSdcLimits(
+	ctx context.Context,
+	volID, sdcID string,
+	limits *siotypes.SetMappedSdcLimitsParam) error {
+
+	if limits == nil {
+		return nil
 	}
-	// Check if volume is published to any node already
-	if len(vol.MappedSdcInfo) > 0 {
-		vcs := []*csi.VolumeCapability{req.GetVolumeCapability()}
-		isBlock := accTypeIsBlock(vcs)
 
-		for _, sdc := range vol.MappedSdcInfo {
-			if sdc.SdcID == sdcID {
-				// TODO check if published volume is compatible with this request
-				// volume already mapped
-				log.Debug("volume already mapped")
-				return &csi.ControllerPublishVolumeResponse{}, nil
-			}
-		}
+	if err := canceledErr(ctx, "setting limits of volume mapping"); err != nil {
+		return err
+	}
 
-		// If volume has SINGLE_NODE cap, go no farther
-		switch am.Mode {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
-			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
-			return nil, status.Errorf(codes.FailedPrecondition,
-				"volume already published to SDC id: %s", vol.MappedSdcInfo[0].SdcID)
+	param := *limits
+	param.SdcID = sdcID
+	s.metrics.gatewayCall("SetMappedSdcLimits")
+	if err := adminContext(ctx, s.adminClient).SetMappedSdcLimits(
+		&siotypes.Volume{ID: volID}, &param); err != nil {
+		if cerr := canceledErr(
+			ctx, "setting limits of volume mapping"); cerr != nil {
+			return cerr
 		}
+		return status.Errorf(codes.Internal,
+			"error setting limits of volume mapping: %s", err.Error())
+	}
 
-		// All remaining cases are MULTI_NODE, make sure volume has
-		// multi-map enabled
-		if !vol.MappingToAllSdcsEnabled {
-			return nil, status.Error(codes.FailedPrecondition,
-				errNoMultiMap)
-		}
+	reqLog(ctx, volID).WithFields(map[string]interface{}{
+		"sdcID":              sdcID,
+		"iopsLimit":          param.IopsLimit,
+		"bandwidthLimitKbps": param.BandwidthLimitInKbps,
+	}).Info("applied limits to volume mapping")
+	return nil
+}
 
-		if err := validateAccessType(am, isBlock); err != nil {
-			return nil, err
+// mappedTo returns whether vol is mapped to the SDC with the given ID
+func mappedTo(vol *siotypes.Volume, sdcID string) bool {
+	for _, m := range vol.MappedSdcInfo {
+		if m != nil && m.SdcID == sdcID {
+			return true
 		}
 	}
+	return false
+}
 
-	mapVolumeSdcParam := &siotypes.MapVolumeSdcParam{
-		SdcID: sdcID,
-		AllowMultipleMappings: "false",
-		AllSdcs:               "",
-	}
+// isAlreadyMapped returns whether err is the gateway refusing to map a
+// volume to an SDC it is mapped to already
+func isAlreadyMapped(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "already mapped")
+}
 
-	targetVolume := goscaleio.NewVolume(s.adminClient)
-	targetVolume.Volume = &siotypes.Volume{ID: vol.ID}
+// confirmMapped reads the volume with the given ID again, returning
+// whether it is mapped to the SDC with the given ID
+func (s *service) confirmMapped(
+	ctx context.Context, volID, sdcID string) bool {
 
-	err = targetVolume.MapVolumeSdc(mapVolumeSdcParam)
+	vol, err := s.getVolByID(ctx, volID)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal,
-			"error mapping volume to node: %s", err.Error())
+		reqLog(ctx, volID).WithError(err).Warn(
+			"unable to confirm volume mapping")
+		return false
+	}
+	return mappedTo(vol, sdcID)
+}
+
+// abortPublish unmaps a volume from an SDC it was mapped to by a request
+// that was canceled before the mapping's limits were set, so the volume is
+// not left mapped without them. The unmapping is not bound to the canceled
+// request.
+func (s *service) abortPublish(ctx context.Context, volID, sdcID string) {
+	s.metrics.gatewayCall("UnmapVolumeSdc")
+	err := s.adminClient.UnmapVolumeSdc(
+		&siotypes.Volume{ID: volID},
+		&siotypes.UnmapVolumeSdcParam{
+			SdcID:                sdcID,
+			IgnoreScsiInitiators: "true",
+		})
+	s.setRemapped(volID)
+	if err != nil {
+		reqLog(ctx, volID).WithError(err).Warn(
+			"unable to unmap volume of canceled request")
+		return
 	}
+	reqLog(ctx, volID).WithField("sdcID", sdcID).Info(
+		"unmapped volume of canceled request")
+}
 
-	return &csi.ControllerPublishVolumeResponse{}, nil
+// publishInfoKeys are the volume attributes passed on to the node service
+// when a volume is published
+var publishInfoKeys = []string{
+	KeyProvisioningType,
+	KeyStoragePoolName,
+	KeyProtectionDomainID,
+	KeySystemID,
+	KeyFsType,
+	KeyMkfsOptions,
+	KeyGID,
+	KeyMode,
+}
+
+// publishInfo returns the volume attributes in attrs that are passed on to
+// the node service, along with the capability granted
+func publishInfo(attrs map[string]string, granted grantedCap) map[string]string {
+	info := map[string]string{}
+	for _, k := range publishInfoKeys {
+		if v, ok := attrs[k]; ok {
+			info[k] = v
+		}
+	}
+	if granted.block {
+		info[KeyAccessType] = "block"
+	} else {
+		info[KeyAccessType] = "mount"
+		if granted.fsType != "" {
+			info[KeyFsType] = granted.fsType
+		}
+	}
+	return info
 }
 
 func validateAccessType(
@@ -381,16 +1392,9 @@ func (s *service) ControllerUnpublishVolume(
 		return nil, status.Error(codes.InvalidArgument,
 			"volumeID is required")
 	}
-
-	vol, err := s.getVolByID(volID)
+	volID, err := s.volumeID(volID)
 	if err != nil {
-		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
-			return nil, status.Error(codes.NotFound,
-				"volume not found")
-		}
-		return nil, status.Errorf(codes.Internal,
-			"failure checking volume status before controller unpublish: %s",
-			err.Error())
+		return nil, err
 	}
 
 	nodeID := req.GetNodeId()
@@ -399,9 +1403,35 @@ func (s *service) ControllerUnpublishVolume(
 			"Node ID is required")
 	}
 
-	sdcID, err := s.getSDCID(nodeID)
+	sdcID, err := s.getSDCID(ctx, nodeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	// A volume seen not to be mapped to the SDC moments ago, as when the
+	// CO retries an unpublish that succeeded, isn't read again
+	if s.knownUnmapped(volID, sdcID) {
+		reqLog(ctx, volID).Debug("volume recently unpublished")
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+
+	// A volume listed as mapped to the SDC moments ago, as while the node
+	// is drained, isn't read again
+	vol, err := s.mappedVolume(ctx, sdcID, volID)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, err.Error())
+		return nil, err
+	}
+	if vol == nil {
+		vol, err = s.getVolByID(ctx, volID)
+		if err != nil {
+			if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
+				return nil, status.Error(codes.NotFound,
+					"volume not found")
+			}
+			return nil, status.Errorf(codes.Internal,
+				"failure checking volume status before controller unpublish: %s",
+				err.Error())
+		}
 	}
 
 	// check if volume is attached to node at all
@@ -414,12 +1444,13 @@ func (s *service) ControllerUnpublishVolume(
 	}
 
 	if !mappedToNode {
-		log.Debug("volume already unpublished")
+		reqLog(ctx, volID).Debug("volume already unpublished")
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
 	}
 
-	targetVolume := goscaleio.NewVolume(s.adminClient)
-	targetVolume.Volume = vol
+	if err := s.awaitQuiesced(ctx, vol, sdcID); err != nil {
+		return nil, err
+	}
 
 	unmapVolumeSdcParam := &siotypes.UnmapVolumeSdcParam{
 		SdcID:                sdcID,
@@ -427,11 +1458,34 @@ func (s *service) ControllerUnpublishVolume(
 		AllSdcs:              "",
 	}
 
-	if err = targetVolume.UnmapVolumeSdc(unmapVolumeSdcParam); err != nil {
+	if err := canceledErr(ctx, "unmapping volume from node"); err != nil {
+		return nil, err
+	}
+	s.metrics.gatewayCall("UnmapVolumeSdc")
+	err = adminContext(ctx, s.adminClient).UnmapVolumeSdc(
+		vol, unmapVolumeSdcParam)
+	s.setRemapped(volID)
+	if err != nil {
+		if cerr := canceledErr(ctx, "unmapping volume from node"); cerr != nil {
+			return nil, cerr
+		}
+		if isSDCNotFound(err) {
+			s.invalidateSDC(nodeID)
+		}
 		return nil, status.Errorf(codes.Internal,
 			"error unmapping volume from node: %s", err.Error())
 	}
 
+	s.addSdcVolCount(sdcID, -1)
+	s.noteMapping(volID, sdcID, false)
+	s.setUnmapped(volID)
+	s.clearMappingMode(volID, sdcID)
+
+	if len(vol.MappedSdcInfo) == 1 {
+		s.clearGrantedCap(volID)
+		s.clearMappingGeneration(volID)
+	}
+
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
@@ -444,8 +1498,11 @@ func (s *service) ValidateVolumeCapabilities(
 		return nil, err
 	}
 
-	volID := req.GetVolumeId()
-	vol, err := s.getVolByID(volID)
+	volID, err := s.volumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	vol, err := s.getVolByID(ctx, volID)
 	if err != nil {
 		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
 			return nil, status.Error(codes.NotFound,
@@ -455,9 +1512,13 @@ func (s *service) ValidateVolumeCapabilities(
 			"failure checking volume status for capabilities: %s",
 			err.Error())
 	}
+	if isTombstone(vol) {
+		return nil, status.Error(codes.NotFound,
+			"volume not found, it was deleted")
+	}
 
 	vcs := req.GetVolumeCapabilities()
-	supported, reason := valVolumeCaps(vcs, vol)
+	supported, reason := valVolumeCaps(vcs, vol, req.GetVolumeAttributes())
 
 	resp := &csi.ValidateVolumeCapabilitiesResponse{
 		Supported: supported,
@@ -478,9 +1539,12 @@ func accTypeIsBlock(vcs []*csi.VolumeCapability) bool {
 	return false
 }
 
+// valVolumeCaps returns whether vcs are supported by vol, created with
+// attrs, and if not, why
 func valVolumeCaps(
 	vcs []*csi.VolumeCapability,
-	vol *siotypes.Volume) (bool, string) {
+	vol *siotypes.Volume,
+	attrs map[string]string) (bool, string) {
 
 	var (
 		supported = true
@@ -520,6 +1584,17 @@ func valVolumeCaps(
 		}
 	}
 
+	// a volume created for a filesystem can't be mounted as another
+	volFS := attrs[KeyFsType]
+	for _, vc := range vcs {
+		if fs := vc.GetMount().GetFsType(); fs != "" && volFS != "" &&
+			fs != volFS {
+			supported = false
+			reason = fmt.Sprintf(
+				"fs type %s does not match fs type %s of volume", fs, volFS)
+		}
+	}
+
 	return supported, reason
 }
 
@@ -532,119 +1607,11 @@ func (s *service) ListVolumes(
 		return nil, err
 	}
 
-	var (
-		startToken int
-		cacheLen   int
-	)
-
-	if v := req.StartingToken; v != "" {
-		i, err := strconv.ParseInt(v, 10, 32)
-		if err != nil {
-			return nil, status.Errorf(
-				codes.Aborted,
-				"unable to parse startingToken:%v into uint32",
-				req.StartingToken)
-		}
-		startToken = int(i)
-	}
-
-	// Get the length of cached volumes. Do it in a funcion so as not to
-	// hold the lock
-	func() {
-		s.volCacheRWL.RLock()
-		defer s.volCacheRWL.RUnlock()
-		cacheLen = len(s.volCache)
-	}()
-
-	var (
-		lvols      int
-		sioVols    []*siotypes.Volume
-		err        error
-		maxEntries = int(req.MaxEntries)
-	)
-
-	if startToken == 0 || (startToken > 0 && cacheLen == 0) {
-		// make call to cluster to get all volumes
-		sioVols, err = s.adminClient.GetVolume("", "", "", "", false)
-		if err != nil {
-			return nil, status.Errorf(
-				codes.Internal,
-				"unable to list volumes: %s", err.Error())
-		}
-
-		lvols = len(sioVols)
-		if maxEntries > 0 && maxEntries < lvols {
-			// We want to cache this volume list so that we don't
-			// have to get all the volumes again on the next call
-			func() {
-				s.volCacheRWL.Lock()
-				defer s.volCacheRWL.Unlock()
-				s.volCache = make([]*siotypes.Volume, lvols)
-				copy(s.volCache, sioVols)
-				cacheLen = lvols
-			}()
-		}
-	} else {
-		lvols = cacheLen
-	}
-
-	if startToken > lvols {
-		return nil, status.Errorf(
-			codes.Aborted,
-			"startingToken=%d > len(vols)=%d",
-			startToken, lvols)
-	}
-
-	// Discern the number of remaining entries.
-	rem := lvols - startToken
-
-	// If maxEntries is 0 or greater than the number of remaining entries then
-	// set maxEntries to the number of remaining entries.
-	if maxEntries == 0 || maxEntries > rem {
-		maxEntries = rem
-	}
-
-	var (
-		entries = make(
-			[]*csi.ListVolumesResponse_Entry,
-			maxEntries)
-		source []*siotypes.Volume
-	)
-
-	if startToken == 0 && req.MaxEntries == 0 {
-		// Use the just populated sioVols
-		source = sioVols
-	} else {
-		// Return only the requested vols from the cache
-		cacheVols := make([]*siotypes.Volume, maxEntries)
-		// Copy vols from cache so we don't keep lock entire time
-		func() {
-			s.volCacheRWL.RLock()
-			defer s.volCacheRWL.RUnlock()
-			j := startToken
-			for i := 0; i < len(entries); i++ {
-				cacheVols[i] = s.volCache[i]
-				j++
-			}
-		}()
-		source = cacheVols
-	}
-
-	for i, vol := range source {
-		entries[i] = &csi.ListVolumesResponse_Entry{
-			Volume: getCSIVolume(vol),
-		}
-	}
-
-	var nextToken string
-	if n := startToken + len(source); n < lvols {
-		nextToken = fmt.Sprintf("%d", n)
+	if req.MaxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"max_entries %d can't be negative", req.MaxEntries)
 	}
-
-	return &csi.ListVolumesResponse{
-		Entries:   entries,
-		NextToken: nextToken,
-	}, nil
+	return s.listVolumes(req.StartingToken, int(req.MaxEntries))
 }
 
 func (s *service) GetCapacity(
@@ -656,23 +1623,36 @@ func (s *service) GetCapacity(
 		return nil, err
 	}
 
-	var statsFunc func() (*siotypes.Statistics, error)
-
 	// Default to get Capacity of system
-	statsFunc = s.system.GetStatistics
+	statsFunc := func() (stats *siotypes.Statistics, err error) {
+		s.metrics.gatewayCall("GetStatistics")
+		err = s.withSystem(ctx, func(system *siotypes.System) error {
+			stats, err = s.adminClient.GetSystemStatistics(system)
+			return err
+		})
+		return stats, err
+	}
 
 	params := req.GetParameters()
 	if len(params) > 0 {
 		// if storage pool is given, get capacity of storage pool
 		if spname, ok := params[KeyStoragePool]; ok {
+			if err := s.checkPoolAllowed(ctx, spname); err != nil {
+				return nil, err
+			}
+			s.metrics.gatewayCall("FindStoragePool")
 			sp, err := s.adminClient.FindStoragePool("", spname, "")
 			if err != nil {
+				if isPoolNotFound(err) {
+					return nil, s.poolNotFoundErr(ctx, spname)
+				}
 				return nil, status.Errorf(codes.Internal,
 					"unable to look up storage pool: %s, err: %s",
 					spname, err.Error())
 			}
-			spc := goscaleio.NewStoragePoolEx(s.adminClient, sp)
-			statsFunc = spc.GetStatistics
+			statsFunc = func() (*siotypes.Statistics, error) {
+				return s.getCachedPoolStats(sp.ID)
+			}
 		}
 	}
 	stats, err := statsFunc()
@@ -681,7 +1661,9 @@ func (s *service) GetCapacity(
 			"unable to get system stats: %s", err.Error())
 	}
 	return &csi.GetCapacityResponse{
-		AvailableCapacity: int64(stats.CapacityAvailableForVolumeAllocationInKb * bytesInKiB),
+		AvailableCapacity: kiBToBytes(
+			int64(stats.CapacityAvailableForVolumeAllocationInKb),
+			log.Fields{"capacity": "available"}),
 	}, nil
 }
 
@@ -690,109 +1672,376 @@ func (s *service) ControllerGetCapabilities(
 	req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
-	return &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
-				},
-			},
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-					},
-				},
+	rpcs := ControllerCapabilities(s.opts)
+	caps := make([]*csi.ControllerServiceCapability, len(rpcs))
+	for i, rpc := range rpcs {
+		caps[i] = &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: rpc},
 			},
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-					},
-				},
-			},
-			&csi.ControllerServiceCapability{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-					},
-				},
-			},
-		},
-	}, nil
+		}
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
 func (s *service) controllerProbe(ctx context.Context) error {
+	_, err := s.ensureSystem(ctx)
+	return err
+}
+
+// ensureSystem returns the configured system, creating the gateway client,
+// logging in, and looking the system up first if that wasn't done yet. It
+// is shared by the controller probe and the requests of either service that
+// need the system before the controller is probed, as in a deployment
+// running both services. The calls to the gateway are bound to ctx, and
+// concurrent first requests wait for one lookup rather than each logging
+// in.
+func (s *service) ensureSystem(ctx context.Context) (*siotypes.System, error) {
+	if system := s.currentSystem(); system != nil &&
+		s.adminClient.GetToken() != "" {
+
+		s.probeMu.Lock()
+		s.startKeepalive()
+		s.probeMu.Unlock()
+		return system, nil
+	}
 
 	// Check that we have the details needed to login to the Gateway
 	if s.opts.Endpoint == "" {
-		return status.Error(codes.FailedPrecondition,
+		return nil, status.Error(codes.FailedPrecondition,
 			"missing ScaleIO Gateway endpoint")
 	}
 	if s.opts.User == "" {
-		return status.Error(codes.FailedPrecondition,
+		return nil, status.Error(codes.FailedPrecondition,
 			"missing ScaleIO MDM user")
 	}
 	if s.opts.Password == "" {
-		return status.Error(codes.FailedPrecondition,
+		return nil, status.Error(codes.FailedPrecondition,
 			"missing ScaleIO MDM password")
 	}
 	if s.opts.SystemName == "" {
-		return status.Error(codes.FailedPrecondition,
+		return nil, status.Error(codes.FailedPrecondition,
 			"missing ScaleIO system name")
 	}
 
-	// Create our ScaleIO API client, if needed
-	if s.adminClient == nil {
-		c, err := goscaleio.NewClientWithArgs(
-			s.opts.Endpoint, "", s.opts.Insecure, true)
+	s.probeMu.Lock()
+	admin, err := s.ensureAdminClient()
+	s.probeMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.systemFlight.do(ctx, func() (*siotypes.System, error) {
+		admin := adminContext(ctx, admin)
+		err := s.login(admin)
+		system := s.currentSystem()
+		if err == nil && system == nil {
+			system, err = s.findSystem(admin)
+		}
+		if err != nil {
+			if cerr := canceledErr(ctx, "probing ScaleIO Gateway"); cerr != nil {
+				return nil, cerr
+			}
+			return nil, err
+		}
+
+		s.systemMu.Lock()
+		found := s.system == nil
+		s.system = system
+		s.systemMu.Unlock()
+
+		s.probeMu.Lock()
+		defer s.probeMu.Unlock()
+		if found && !strings.EqualFold(s.mode, "node") {
+			s.startPrefetch()
+		}
+		s.startKeepalive()
+		return system, nil
+	})
+}
+
+// ensureAdminClient creates the ScaleIO API client, if needed, and returns
+// it. It must be called with probeMu held.
+func (s *service) ensureAdminClient() (ScaleIOAdmin, error) {
+	if s.adminClient != nil {
+		return s.adminClient, nil
+	}
+	if endpoints := splitEndpoints(s.opts.Endpoint); len(endpoints) > 1 {
+		s.gateways = newFailoverAdmin(endpoints, s.opts.Insecure, s.metrics)
+		s.adminClient = s.traceAdmin(s.gateways)
+	} else {
+		c, err := newSIOAdmin(s.opts.Endpoint, s.opts.Insecure)
 		if err != nil {
-			return status.Errorf(codes.FailedPrecondition,
+			return nil, status.Errorf(codes.FailedPrecondition,
 				"unable to create ScaleIO client: %s", err.Error())
 		}
-		s.adminClient = c
+		s.adminClient = s.traceAdmin(c)
+	}
+	return s.adminClient, nil
+}
+
+// login logs in to the gateway with admin, unless already logged in
+func (s *service) login(admin ScaleIOAdmin) error {
+	if admin.GetToken() != "" {
+		return nil
+	}
+	s.metrics.gatewayAuth()
+	_, err := admin.Authenticate(&goscaleio.ConfigConnect{
+		Endpoint: s.opts.Endpoint,
+		Username: s.opts.User,
+		Password: s.opts.Password,
+	})
+	if err != nil {
+		return status.Errorf(s.probeErrCode(err),
+			"unable to login to ScaleIO Gateway: %s", err.Error())
+	}
+	return nil
+}
+
+// findSystem looks up the configured system with admin, and checks the
+// privileges of the user logged in
+func (s *service) findSystem(admin ScaleIOAdmin) (*siotypes.System, error) {
+	s.metrics.gatewayCall("FindSystem")
+	system, err := admin.FindSystem("", s.opts.SystemName, "")
+	if err != nil {
+		return nil, status.Errorf(s.probeErrCode(err),
+			"unable to find matching ScaleIO system name: %s",
+			err.Error())
+	}
+	if !s.opts.SkipPrivilegeCheck {
+		if err := s.checkPrivileges(admin); err != nil {
+			return nil, err
+		}
 	}
+	return system, nil
+}
 
-	if s.adminClient.GetToken() == "" {
-		_, err := s.adminClient.Authenticate(&goscaleio.ConfigConnect{
-			Endpoint: s.opts.Endpoint,
-			Username: s.opts.User,
-			Password: s.opts.Password,
-		})
-		if err != nil {
-			return status.Errorf(codes.FailedPrecondition,
-				"unable to login to ScaleIO Gateway: %s", err.Error())
+// probeErrCode returns the code for an error encountered while probing the
+// gateway. Errors reaching the gateway are reported as Unavailable, so a
+// gateway restart isn't mistaken for a broken plug-in, and a reconnect is
+// attempted in the background.
+func (s *service) probeErrCode(err error) codes.Code {
+	if !gatewayUnreachable(err) {
+		return codes.FailedPrecondition
+	}
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	if !s.reconnecting {
+		s.reconnecting = true
+		go s.reconnect()
+	}
+	return codes.Unavailable
+}
 
+// checkPrivileges lists the storage pools with admin, which every
+// controller request that creates a volume needs to, so that a user
+// without the privileges to manage volumes fails the probe with
+// PermissionDenied rather than failing each request with the gateway's
+// 403. Errors other than a 403 are left to the requests to report.
+func (s *service) checkPrivileges(admin ScaleIOAdmin) error {
+	s.metrics.gatewayCall("GetStoragePools")
+	_, err := admin.GetStoragePools()
+	if err == nil {
+		return nil
+	}
+	if isForbidden(err) {
+		return status.Errorf(codes.PermissionDenied,
+			"ScaleIO user %s is missing the privilege to list storage "+
+				"pools, needed to manage volumes: %s. Set %s to skip this "+
+				"check for a deliberately restricted user",
+			s.opts.User, err.Error(), EnvSkipPrivilegeCheck)
+	}
+	if gatewayUnreachable(err) {
+		return status.Errorf(s.probeErrCode(err),
+			"unable to list ScaleIO storage pools: %s", err.Error())
+	}
+	log.WithError(err).Warn("unable to check ScaleIO user privileges")
+	return nil
+}
+
+// isForbidden returns whether err is the gateway refusing a request the
+// user lacks the privileges for
+func isForbidden(err error) bool {
+	var e *siotypes.Error
+	return errors.As(err, &e) && e.HTTPStatusCode == http.StatusForbidden
+}
+
+// gatewayUnreachable returns a flag indicating whether err was caused by a
+// failure to reach the gateway, rather than by the gateway rejecting the
+// request
+func gatewayUnreachable(err error) bool {
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	// goscaleio flattens some errors into strings
+	msg := err.Error()
+	for _, m := range []string{
+		"connection refused",
+		"connection reset",
+		"i/o timeout",
+		"no such host",
+		"network is unreachable",
+		"EOF",
+	} {
+		if strings.Contains(msg, m) {
+			return true
 		}
 	}
+	return false
+}
 
-	if s.system == nil {
-		system, err := s.adminClient.FindSystem(
-			"", s.opts.SystemName, "")
-		if err != nil {
-			return status.Errorf(codes.FailedPrecondition,
-				"unable to find matching ScaleIO system name: %s",
-				err.Error())
+var (
+	// reconnectMinBackoff is the delay before the first reconnect attempt
+	reconnectMinBackoff = time.Second
+
+	// reconnectMaxBackoff is the maximum delay between reconnect attempts
+	reconnectMaxBackoff = time.Minute
+)
+
+// reconnect probes the gateway, with exponential backoff, until it can be
+// reached again
+func (s *service) reconnect() {
+	backoff := reconnectMinBackoff
+	for {
+		time.Sleep(backoff)
+
+		err := s.controllerProbe(context.Background())
+		if err == nil || !isUnavailable(err) {
+			s.probeMu.Lock()
+			s.reconnecting = false
+			s.probeMu.Unlock()
+			if err == nil {
+				log.Info("reconnected to ScaleIO Gateway")
+			} else {
+				log.WithError(err).Warn("gave up reconnecting to ScaleIO Gateway")
+			}
+			return
+		}
+
+		log.WithError(err).WithField("backoff", backoff).Debug(
+			"ScaleIO Gateway still unreachable")
+		if backoff *= 2; backoff > reconnectMaxBackoff {
+			backoff = reconnectMaxBackoff
 		}
-		s.system = system
 	}
+}
 
-	return nil
+// isUnavailable returns a flag indicating whether err is a gRPC status
+// error with the Unavailable code
+func isUnavailable(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && st.Code() == codes.Unavailable
 }
 
+// requireProbe returns an error if the controller service has not been
+// successfully probed, unless auto-probe is enabled and probing on demand
+// succeeds
 func (s *service) requireProbe(ctx context.Context) error {
-	if s.adminClient == nil {
+	if !s.controllerProbed() {
 		if !s.opts.AutoProbe {
 			return status.Error(codes.FailedPrecondition,
 				"Controller Service has not been probed")
 		}
-		log.Debug("probing controller service automatically")
+		reqLog(ctx, "").Debug("probing controller service automatically")
 		if err := s.controllerProbe(ctx); err != nil {
-			return status.Errorf(codes.FailedPrecondition,
+			code := codes.FailedPrecondition
+			if isUnavailable(err) {
+				code = codes.Unavailable
+			}
+			return status.Errorf(code,
 				"failed to probe/init plugin: %s", err.Error())
 		}
 	}
 	return nil
 }
+
+// controllerProbed returns a flag indicating whether the controller service
+// has been successfully probed. The client alone is not enough, as it is
+// created before authenticating to the gateway.
+func (s *service) controllerProbed() bool {
+	return s.currentSystem() != nil
+}
+
+// currentSystem returns the system found by the last controller probe
+func (s *service) currentSystem() *siotypes.System {
+	s.systemMu.RLock()
+	defer s.systemMu.RUnlock()
+	return s.system
+}
+
+// withSystem calls f with the current system. If f fails because the
+// system could not be found, as happens after an MDM ownership change, the
+// system is looked up again by name and f is retried once. The lookup is
+// bound to ctx.
+func (s *service) withSystem(
+	ctx context.Context, f func(*siotypes.System) error) error {
+
+	system := s.currentSystem()
+	if system == nil {
+		return status.Error(codes.FailedPrecondition,
+			"ScaleIO system not found, the controller service has not "+
+				"been probed")
+	}
+	err := f(system)
+	if err == nil || !isSystemNotFound(err) {
+		return err
+	}
+
+	system, rerr := s.refreshSystem(ctx, system)
+	if rerr != nil {
+		return fmt.Errorf("%s, and unable to find system again: %s",
+			err.Error(), rerr.Error())
+	}
+	return f(system)
+}
+
+// refreshSystem replaces the stale system with the one found by looking up
+// the configured system name again, unless another request already did so.
+// If the system can't be found, it is forgotten, so that the controller
+// must be probed again.
+func (s *service) refreshSystem(
+	ctx context.Context, stale *siotypes.System) (*siotypes.System, error) {
+
+	return s.systemFlight.do(ctx, func() (*siotypes.System, error) {
+		if system := s.currentSystem(); system != stale {
+			if system == nil {
+				return nil, errors.New("ScaleIO system not found")
+			}
+			return system, nil
+		}
+
+		f := log.Fields{
+			"systemName": s.opts.SystemName,
+			"systemID":   stale.ID,
+		}
+		s.metrics.gatewayCall("FindSystem")
+		system, err := adminContext(ctx, s.adminClient).FindSystem(
+			"", s.opts.SystemName, "")
+
+		s.systemMu.Lock()
+		defer s.systemMu.Unlock()
+		if err != nil {
+			if cerr := canceledErr(ctx, "finding ScaleIO system"); cerr != nil {
+				return nil, cerr
+			}
+			log.WithFields(f).WithError(err).Error(
+				"ScaleIO system no longer found")
+			s.system = nil
+			return nil, err
+		}
+		log.WithFields(f).WithField("newSystemID", system.ID).Warn(
+			"refreshed stale ScaleIO system")
+		s.system = system
+		return system, nil
+	})
+}
+
+// isSystemNotFound returns a flag indicating whether err reports that a
+// system does not exist
+func isSystemNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "system") &&
+		(strings.Contains(msg, "not find") ||
+			strings.Contains(msg, "not found"))
+}
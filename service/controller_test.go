@@ -2,10 +2,24 @@ package service_test
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"os"
 	"testing"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
 	"github.com/stretchr/testify/assert"
+	"github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/service"
+	"github.com/thecodeteam/csi-scaleio/testutil"
 )
 
 func TestControllerGetCaps(t *testing.T) {
@@ -17,12 +31,13 @@ func TestControllerGetCaps(t *testing.T) {
 
 	client := csi.NewControllerClient(gclient)
 
-	rpcs := map[csi.ControllerServiceCapability_RPC_Type]struct{}{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME:     struct{}{},
-		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME: struct{}{},
-		csi.ControllerServiceCapability_RPC_LIST_VOLUMES:             struct{}{},
-		csi.ControllerServiceCapability_RPC_GET_CAPACITY:             struct{}{},
+	// the server is started without any options enabling optional RPCs
+	rpcs := map[csi.ControllerServiceCapability_RPC_Type]struct{}{}
+	for _, rpc := range service.ControllerCapabilities(service.Opts{}) {
+		rpcs[rpc] = struct{}{}
 	}
+	assert.Contains(t, rpcs,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
 
 	resp, err := client.ControllerGetCapabilities(ctx,
 		&csi.ControllerGetCapabilitiesRequest{})
@@ -39,15 +54,531 @@ func TestControllerGetCaps(t *testing.T) {
 	assert.Empty(t, rpcs)
 }
 
-/*
-func TestControllerProbe(t *testing.T) {
-	ctx := context.Background()
+// startGatewayServer starts the plug-in's controller service against a fake
+// ScaleIO Gateway, with a single storage pool, named "pool", and an SDC
+func startGatewayServer(ctx context.Context, t *testing.T) (
+	csi.ControllerClient, *testutil.FakeGateway, func()) {
+
+	admin := testutil.NewFakeAdmin("sys")
+	admin.AddStoragePool("pool", 100*1024*1024)
+	admin.AddSdc("1A2B3C4D-0000-0000-0000-000000000000")
+	gw := testutil.NewFakeGateway(admin, "admin", "password")
 
-	os.Setenv("X_CSI_SCALEIO_ENDPOINT", "https://localhost:443")
+	env := map[string]string{
+		gocsi.EnvVarMode:      "controller",
+		service.EnvEndpoint:   gw.Endpoint(),
+		service.EnvUser:       "admin",
+		service.EnvPassword:   "password",
+		service.EnvSystemName: "sys",
+		service.EnvAutoProbe:  "true",
+		service.EnvAllowHTTP:  "true",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
 
 	gclient, stop := startServer(ctx, t)
+	return csi.NewControllerClient(gclient), gw, func() {
+		stop()
+		gw.Close()
+		for k := range env {
+			os.Unsetenv(k)
+		}
+	}
+}
+
+var mountVolCap = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{
+		Mount: &csi.VolumeCapability_MountVolume{},
+	},
+	AccessMode: &csi.VolumeCapability_AccessMode{
+		Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	},
+}
+
+func TestControllerGateway(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
 	defer stop()
 
-	client := csi.NewControllerClient(gclient)
+	cr, err := client.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 8 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters: map[string]string{
+			service.KeyStoragePool: "pool",
+			service.KeyIOPSLimit:   "100",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := cr.Volume.Id
+	assert.Equal(t, int64(8<<30), cr.Volume.CapacityBytes)
+
+	_, err = client.ControllerPublishVolume(ctx,
+		&csi.ControllerPublishVolumeRequest{
+			VolumeId:         id,
+			NodeId:           "1a2b3c4d-0000-0000-0000-000000000000",
+			VolumeCapability: mountVolCap,
+			VolumeAttributes: cr.Volume.Attributes,
+		})
+	assert.NoError(t, err)
+	if assert.Len(t, gw.Admin.Volumes[id].MappedSdcInfo, 1) {
+		assert.Equal(t, 100, gw.Admin.Volumes[id].MappedSdcInfo[0].LimitIops)
+	}
+	// the volumes of the SDC are counted against the maximum per node
+	assert.Equal(t, 1, gw.Requests(testutil.RouteGetSdcVolumes))
+
+	// mapped volumes can't be deleted
+	_, err = client.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+
+	_, err = client.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{
+			VolumeId: id,
+			NodeId:   "1a2b3c4d-0000-0000-0000-000000000000",
+		})
+	assert.NoError(t, err)
+
+	lr, err := client.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, lr.Entries, 1)
+
+	cap, err := client.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{service.KeyStoragePool: "pool"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100<<30), cap.AvailableCapacity)
+
+	_, err = client.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	assert.NoError(t, err)
+	assert.Empty(t, gw.Admin.Volumes)
+
+	// deleting it again succeeds, as the volume is already gone
+	_, err = client.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	assert.NoError(t, err)
+}
+
+func TestControllerGatewayRequestID(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
+	defer stop()
+
+	// the ID a request is sent with is given to the gateway
+	rctx := metadata.NewOutgoingContext(ctx,
+		metadata.Pairs(csictx.RequestIDKey, "42"))
+	cr, err := client.CreateVolume(rctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 8 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters: map[string]string{
+			service.KeyStoragePool: "pool",
+			service.KeyIOPSLimit:   "100",
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"42"}, gw.RequestIDs(testutil.RouteCreateVolume))
+
+	// as is the one injected into a request sent without one, for each
+	// call made for the request
+	_, err = client.ControllerPublishVolume(ctx,
+		&csi.ControllerPublishVolumeRequest{
+			VolumeId:         cr.Volume.Id,
+			NodeId:           "1a2b3c4d-0000-0000-0000-000000000000",
+			VolumeCapability: mountVolCap,
+			VolumeAttributes: cr.Volume.Attributes,
+		})
+	assert.NoError(t, err)
+	mapped := gw.RequestIDs(testutil.RouteMapVolumeSdc)
+	limited := gw.RequestIDs(testutil.RouteSetMappedSdcLimits)
+	if assert.Len(t, mapped, 1) && assert.Len(t, limited, 1) {
+		assert.NotEmpty(t, mapped[0])
+		assert.NotEqual(t, "42", mapped[0])
+		assert.Equal(t, mapped[0], limited[0])
+	}
+}
+
+func TestControllerGatewayReauth(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
+	defer stop()
+
+	_, err := client.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, gw.Logins())
+
+	// an expired session is renewed transparently
+	gw.ExpireToken()
+	_, err = client.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, gw.Logins())
+}
+
+func TestControllerGatewayErrors(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
+	defer stop()
+
+	gw.Inject(testutil.RouteGetStoragePoolVolumes, 1, http.StatusOK, "[]")
+	lr, err := client.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, lr.Entries)
+
+	gw.Fail(testutil.RouteGetStoragePoolVolumes, 1, http.StatusServiceUnavailable)
+	_, err = client.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Contains(t, st.Message(), "Service Unavailable")
+
+	gw.Fail(testutil.RouteCreateVolume, 1, http.StatusServiceUnavailable)
+	_, err = client.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters:         map[string]string{service.KeyStoragePool: "pool"},
+	})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Empty(t, gw.Admin.Volumes)
+
+	_, err = client.ControllerPublishVolume(ctx,
+		&csi.ControllerPublishVolumeRequest{
+			VolumeId:         "0123456789abcdef",
+			NodeId:           "1a2b3c4d-0000-0000-0000-000000000000",
+			VolumeCapability: mountVolCap,
+		})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.NotFound, st.Code())
+}
+
+func TestControllerGatewayRAMCache(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
+	defer stop()
+
+	rep, err := client.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters: map[string]string{
+			service.KeyStoragePool: "pool",
+			service.KeyRAMCache:    "true",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", rep.Volume.Attributes[service.KeyRAMCache])
+	assert.True(t, gw.Admin.Volumes[rep.Volume.Id].UseRmCache)
+	assert.Equal(t, 1, gw.Requests(testutil.RouteSetVolumeUseRmcache))
+
+	// the setting is applied with a renewed session once it expires
+	gw.Fail(testutil.RouteSetVolumeUseRmcache, 1, http.StatusUnauthorized)
+	rep, err = client.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters: map[string]string{
+			service.KeyStoragePool: "pool",
+			service.KeyRAMCache:    "false",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "false", rep.Volume.Attributes[service.KeyRAMCache])
+	assert.False(t, gw.Admin.Volumes[rep.Volume.Id].UseRmCache)
+	assert.Equal(t, 2, gw.Logins())
+}
+
+func TestControllerGatewayImport(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
+	defer stop()
+
+	id := gw.Admin.AddVolume("rexray-vol", "pool", 8<<20)
+	rep, err := client.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "csi-vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters: map[string]string{
+			service.KeyImportVolumeName: "rexray-vol",
+			service.KeyImportRename:     "true",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, id, rep.Volume.Id)
+	assert.Equal(t, "csi-vol", gw.Admin.Volumes[id].Name)
+	assert.Equal(t, 1, gw.Requests(testutil.RouteSetVolumeName))
+}
+
+func TestControllerGatewayDuplicateName(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
+	defer stop()
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "csi-vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters:         map[string]string{service.KeyStoragePool: "pool"},
+	}
+	rep, err := client.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+
+	// creating the volume again finds it, until an admin gives another
+	// volume its name
+	again, err := client.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, rep.Volume.Id, again.Volume.Id)
+
+	other := gw.Admin.AddVolume("other", "pool", 8<<20)
+	gw.Admin.Lock()
+	gw.Admin.Volumes[other].Name = "csi-vol"
+	gw.Admin.Unlock()
+
+	_, err = client.CreateVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Contains(t, st.Message(), rep.Volume.Id)
+	assert.Contains(t, st.Message(), other)
+
+	_, err = client.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "imported",
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters: map[string]string{
+			service.KeyImportVolumeName: "csi-vol",
+		},
+	})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Equal(t, 0, gw.Requests(testutil.RouteSetVolumeName))
+
+	// only the pool of the volume is listed, never every volume
+	assert.Equal(t, 0, gw.Requests(testutil.RouteGetVolumes))
+	assert.NotZero(t, gw.Requests(testutil.RouteGetStoragePoolVolumes))
+}
+
+func TestControllerGatewayCancel(t *testing.T) {
+	ctx := context.Background()
+	client, gw, stop := startGatewayServer(ctx, t)
+	defer stop()
+
+	req := &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		Parameters: map[string]string{
+			service.KeyStoragePool: "pool",
+			service.KeyRAMCache:    "true",
+		},
+	}
+
+	// volumes waits briefly for the canceled handler to finish with the
+	// gateway, then returns the number of volumes
+	volumes := func() int {
+		for i := 0; ; i++ {
+			gw.Admin.Lock()
+			n := len(gw.Admin.Volumes)
+			gw.Admin.Unlock()
+			if n == 0 || i == 100 {
+				return n
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// a request canceled while creating the volume returns promptly, and
+	// the abandoned request never creates it
+	gw.Delay(testutil.RouteCreateVolume, time.Minute)
+	cctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	start := time.Now()
+	_, err := client.CreateVolume(cctx, req)
+	cancel()
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, volumes())
+	gw.Delay(testutil.RouteCreateVolume, 0)
+
+	// a volume created by a request canceled before it was configured is
+	// removed rather than left half-configured
+	gw.Delay(testutil.RouteSetVolumeUseRmcache, time.Minute)
+	cctx, cancel = context.WithTimeout(ctx, 200*time.Millisecond)
+	_, err = client.CreateVolume(cctx, req)
+	cancel()
+	assert.Error(t, err)
+	assert.Equal(t, 2, gw.Requests(testutil.RouteCreateVolume))
+	assert.Equal(t, 0, volumes())
+	assert.Equal(t, 1, gw.Requests(testutil.RouteRemoveVolume))
+	gw.Delay(testutil.RouteSetVolumeUseRmcache, 0)
+
+	// the retry then starts afresh
+	rep, err := client.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.True(t, gw.Admin.Volumes[rep.Volume.Id].UseRmCache)
+}
+
+func TestNewWithOpts(t *testing.T) {
+	ctx := context.Background()
+	admin := testutil.NewFakeAdmin("sys")
+	admin.AddStoragePool("pool", 100*1024*1024)
+	admin.AddSdc("1A2B3C4D-0000-0000-0000-000000000000")
+	gw := testutil.NewFakeGateway(admin, "admin", "password")
+	defer gw.Close()
+
+	opts := service.Opts{
+		Endpoint:   gw.Endpoint(),
+		User:       "admin",
+		Password:   "wrong",
+		SystemName: "sys",
+	}
+	_, err := service.NewWithOpts(ctx, opts, nil)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+
+	// a client that is already logged in is used as it is
+	client, err := goscaleio.NewClientWithArgs(gw.Endpoint(), "", true, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = client.Authenticate(&goscaleio.ConfigConnect{
+		Endpoint: gw.Endpoint(),
+		Username: "admin",
+		Password: "password",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	logins := gw.Logins()
+	opts.Password = "password"
+	svc, err := service.NewWithOpts(ctx, opts, client)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer svc.Shutdown(ctx)
+	assert.Equal(t, logins, gw.Logins())
+
+	// every controller handler works as a plain call
+	_, err = svc.Probe(ctx, &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	cr, err := svc.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 8 << 30},
+		Parameters:    map[string]string{service.KeyStoragePool: "pool"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	id := cr.Volume.Id
+	_, err = svc.ControllerPublishVolume(ctx,
+		&csi.ControllerPublishVolumeRequest{
+			VolumeId:         id,
+			NodeId:           "1a2b3c4d-0000-0000-0000-000000000000",
+			VolumeCapability: mountVolCap,
+			VolumeAttributes: cr.Volume.Attributes,
+		})
+	assert.NoError(t, err)
+	vr, err := svc.ValidateVolumeCapabilities(ctx,
+		&csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId:           id,
+			VolumeCapabilities: []*csi.VolumeCapability{mountVolCap},
+		})
+	assert.NoError(t, err)
+	assert.True(t, vr.GetSupported())
+	lr, err := svc.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, lr.Entries, 1)
+	_, err = svc.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{service.KeyStoragePool: "pool"},
+	})
+	assert.NoError(t, err)
+
+	// the session is renewed with the credentials of opts
+	gw.ExpireToken()
+	_, err = svc.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{
+			VolumeId: id,
+			NodeId:   "1a2b3c4d-0000-0000-0000-000000000000",
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, logins+1, gw.Logins())
+	_, err = svc.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	assert.NoError(t, err)
+	assert.Empty(t, gw.Admin.Volumes)
+}
+
+func TestControllerGatewayForbidden(t *testing.T) {
+	ctx := context.Background()
+	admin := testutil.NewFakeAdmin("sys")
+	admin.Errors["GetStoragePools"] = &siotypes.Error{
+		Message:        "Forbidden",
+		HTTPStatusCode: http.StatusForbidden,
+	}
+	gw := testutil.NewFakeGateway(admin, "admin", "password")
+	defer gw.Close()
+
+	opts := service.Opts{
+		Endpoint:   gw.Endpoint(),
+		User:       "admin",
+		Password:   "password",
+		SystemName: "sys",
+	}
+	_, err := service.NewWithOpts(ctx, opts, nil)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.PermissionDenied, st.Code())
+
+	opts.SkipPrivilegeCheck = true
+	svc, err := service.NewWithOpts(ctx, opts, nil)
+	if assert.NoError(t, err) {
+		svc.Shutdown(ctx)
+	}
+}
+
+func TestPublishAlreadyMapped(t *testing.T) {
+	ctx := context.Background()
+	admin := testutil.NewFakeAdmin("sys")
+	admin.AddStoragePool("pool", 100*1024*1024)
+	sdc := admin.AddSdc("1A2B3C4D-0000-0000-0000-000000000000")
+	id := admin.AddVolume("vol", "pool", 8*1024*1024)
+	gw := testutil.NewFakeGateway(admin, "admin", "password")
+	defer gw.Close()
+
+	svc, err := service.NewWithOpts(ctx, service.Opts{
+		Endpoint:   gw.Endpoint(),
+		User:       "admin",
+		Password:   "password",
+		SystemName: "sys",
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer svc.Shutdown(ctx)
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         id,
+		NodeId:           "1a2b3c4d-0000-0000-0000-000000000000",
+		VolumeCapability: mountVolCap,
+	}
+	alreadyMapped, _ := json.Marshal(&siotypes.Error{
+		Message:        testutil.ErrAlreadyMapped,
+		HTTPStatusCode: http.StatusInternalServerError,
+	})
+
+	// the gateway claiming a mapping that isn't there still fails
+	gw.Inject(testutil.RouteMapVolumeSdc, 1,
+		http.StatusInternalServerError, string(alreadyMapped))
+	_, err = svc.ControllerPublishVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Empty(t, admin.Volumes[id].MappedSdcInfo)
+
+	// a retry that read the volume before the mapping of the attempt that
+	// timed out was made finds it when the gateway refuses to map again
+	vols, err := admin.GetVolume("", id, "", "", false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	stale, _ := json.Marshal(vols[0])
+	assert.NoError(t, admin.MapVolumeSdc(&siotypes.Volume{ID: id},
+		&siotypes.MapVolumeSdcParam{SdcID: sdc}))
+	gw.Inject(testutil.RouteGetVolume, 1, http.StatusOK, string(stale))
+	maps := gw.Requests(testutil.RouteMapVolumeSdc)
+	_, err = svc.ControllerPublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, maps+1, gw.Requests(testutil.RouteMapVolumeSdc))
+	assert.Len(t, admin.Volumes[id].MappedSdcInfo, 1)
 }
-*/
@@ -0,0 +1,1264 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+var _ ScaleIOAdmin = &testutil.FakeAdmin{}
+
+func TestRequireProbe(t *testing.T) {
+	ctx := context.Background()
+
+	// without auto-probe, an unprobed service is refused
+	s := &service{}
+	err := s.requireProbe(ctx)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+
+	// auto-probe is attempted, but fails without a configured gateway
+	s.opts.AutoProbe = true
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.requireProbe(ctx)
+			st, _ := status.FromError(err)
+			assert.Equal(t, codes.FailedPrecondition, st.Code())
+		}()
+	}
+	wg.Wait()
+
+	// a client alone doesn't mean the probe succeeded
+	s.opts.AutoProbe = false
+	s.adminClient = testutil.NewFakeAdmin("sys")
+	assert.Error(t, s.requireProbe(ctx))
+
+	s.system = &siotypes.System{}
+	assert.NoError(t, s.requireProbe(ctx))
+}
+
+// fakeGateway serves the subset of the ScaleIO Gateway API used by probes
+func fakeGateway() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `"token"`)
+	})
+	mux.HandleFunc("/api/version", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `"2.0"`)
+	})
+	mux.HandleFunc("/api/types/System/instances",
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[{"id":"1a2b3c4d00000000","name":"sys"}]`)
+		})
+	mux.HandleFunc("/api/types/StoragePool/instances",
+		func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `[]`)
+		})
+	return mux
+}
+
+func TestProbeGatewayUnreachable(t *testing.T) {
+	defer func(min, max time.Duration) {
+		reconnectMinBackoff, reconnectMaxBackoff = min, max
+	}(reconnectMinBackoff, reconnectMaxBackoff)
+	reconnectMinBackoff = 10 * time.Millisecond
+	reconnectMaxBackoff = 50 * time.Millisecond
+
+	// reserve an address, and refuse connections to it for now
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	s := &service{opts: Opts{
+		Endpoint:   "http://" + addr + "/api",
+		User:       "admin",
+		Password:   "password",
+		SystemName: "sys",
+	}}
+
+	ctx := context.Background()
+	err = s.controllerProbe(ctx)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.False(t, s.controllerProbed())
+
+	// once the gateway is back, the background reconnect succeeds
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("unable to listen on %s again: %v", addr, err)
+	}
+	gw := httptest.NewUnstartedServer(fakeGateway())
+	gw.Listener = lis
+	gw.Start()
+	defer gw.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.controllerProbed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, s.controllerProbed())
+	assert.NoError(t, s.requireProbe(ctx))
+}
+
+func TestProbeMisconfigured(t *testing.T) {
+	s := &service{opts: Opts{User: "admin", Password: "password"}}
+	err := s.controllerProbe(context.Background())
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+}
+
+func TestProbePrivileges(t *testing.T) {
+	ctx := context.Background()
+	fake := testutil.NewFakeAdmin("sys")
+	fake.Errors["GetStoragePools"] = &siotypes.Error{
+		Message:        "Forbidden",
+		HTTPStatusCode: http.StatusForbidden,
+	}
+	s := &service{opts: Opts{
+		Endpoint:   "http://127.0.0.1/api",
+		User:       "monitor",
+		Password:   "password",
+		SystemName: "sys",
+	}}
+	s.adminClient = fake
+
+	// a user that can't list pools fails the probe, and is checked again
+	err := s.controllerProbe(ctx)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.PermissionDenied, st.Code())
+	assert.Contains(t, st.Message(), "monitor")
+	assert.Contains(t, st.Message(), EnvSkipPrivilegeCheck)
+	assert.False(t, s.controllerProbed())
+
+	// other errors are left to the requests that list pools
+	fake.Errors["GetStoragePools"] = errors.New("internal error")
+	assert.NoError(t, s.controllerProbe(ctx))
+	assert.Equal(t, 2, fake.Calls["GetStoragePools"])
+
+	// the check is only made when the system is found
+	assert.NoError(t, s.controllerProbe(ctx))
+	assert.Equal(t, 2, fake.Calls["GetStoragePools"])
+
+	// and is skipped for restricted users
+	s.system = nil
+	s.opts.SkipPrivilegeCheck = true
+	fake.Errors["GetStoragePools"] = &siotypes.Error{
+		HTTPStatusCode: http.StatusForbidden,
+	}
+	assert.NoError(t, s.controllerProbe(ctx))
+	assert.Equal(t, 2, fake.Calls["GetStoragePools"])
+}
+
+// hungLoginAdmin is a FakeAdmin whose logins wait for release, as for a
+// gateway that doesn't answer
+type hungLoginAdmin struct {
+	*testutil.FakeAdmin
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a *hungLoginAdmin) Authenticate(
+	configConnect *sio.ConfigConnect) (sio.Cluster, error) {
+
+	a.started <- struct{}{}
+	<-a.release
+	return a.FakeAdmin.Authenticate(configConnect)
+}
+
+func TestProbeHungLogin(t *testing.T) {
+	ctx := context.Background()
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+	admin := &hungLoginAdmin{
+		FakeAdmin: fake,
+		started:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	s := &service{opts: Opts{
+		Endpoint:   "http://127.0.0.1/api",
+		User:       "admin",
+		Password:   "password",
+		SystemName: "sys",
+	}}
+	s.adminClient = admin
+
+	probed := make(chan error)
+	go func() { probed <- s.controllerProbe(ctx) }()
+	<-admin.started
+
+	// reading the state of the probe doesn't wait for the login
+	assert.False(t, s.controllerProbed())
+	assert.Equal(t, s.opts.Endpoint, s.gatewayEndpoint())
+
+	// and a request waiting on it gives up with its own context
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := s.controllerProbe(cctx)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+
+	// as does a node service looking up its SDC before the controller
+	// is probed
+	cctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = s.getSDCID(cctx, "1A2B3C4D-0000-0000-0000-000000000000")
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+
+	// the waiting requests share the one login
+	waiting := make(chan error)
+	go func() { waiting <- s.controllerProbe(ctx) }()
+	close(admin.release)
+	assert.NoError(t, <-probed)
+	assert.NoError(t, <-waiting)
+	assert.True(t, s.controllerProbed())
+	assert.Equal(t, 1, fake.Calls["Authenticate"])
+	assert.Equal(t, 1, fake.Calls["FindSystem"])
+}
+
+// newFakeService returns a probed controller service backed by an
+// in-memory ScaleIO system with a single storage pool, named "pool"
+func newFakeService() (*service, *testutil.FakeAdmin) {
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+
+	s := New().(*service)
+	s.opts.SystemName = "sys"
+	s.adminClient = fake
+	s.system, _ = fake.FindSystem("", "sys", "")
+	return s, fake
+}
+
+func mountCap(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestCreateVolumeRounding(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+
+	tests := []struct {
+		name     string
+		required int64
+		limit    int64
+		sizeGiB  int
+		code     codes.Code
+	}{
+		{"default", 0, 0, 16, codes.OK},
+		{"one", bytesInGiB, 0, 8, codes.OK},
+		{"multiple", 8 * bytesInGiB, 0, 8, codes.OK},
+		{"above", 9 * bytesInGiB, 0, 16, codes.OK},
+		{"limit", 9 * bytesInGiB, 16 * bytesInGiB, 16, codes.OK},
+		{"over", bytesInGiB, 4 * bytesInGiB, 0, codes.OutOfRange},
+		{"2^31", 1 << 31, 0, 8, codes.OK},
+		{"2^32", 1 << 32, 1 << 33, 8, codes.OK},
+		{"2^63", math.MaxInt64, 0, 0, codes.OutOfRange},
+		{"negative", -1 << 32, 0, 0, codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		rep, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: tt.name,
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: tt.required,
+				LimitBytes:    tt.limit,
+			},
+			Parameters: map[string]string{KeyStoragePool: "pool"},
+		})
+		st, _ := status.FromError(err)
+		assert.Equal(t, tt.code, st.Code(), tt.name)
+		if err != nil {
+			continue
+		}
+		assert.Equal(t, int64(tt.sizeGiB)*bytesInGiB,
+			rep.Volume.CapacityBytes, tt.name)
+		assert.Equal(t, tt.sizeGiB*kiBytesInGiB,
+			fake.Volumes[rep.Volume.Id].SizeInKb, tt.name)
+	}
+
+	// creating an existing volume returns it, unless it differs
+	req := &csi.CreateVolumeRequest{
+		Name:          "one",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: bytesInGiB},
+		Parameters:    map[string]string{KeyStoragePool: "pool"},
+	}
+	rep, err := s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	id, _ := fake.FindVolumeID("one")
+	assert.Equal(t, id, rep.Volume.Id)
+
+	req.CapacityRange.RequiredBytes = 9 * bytesInGiB
+	_, err = s.CreateVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.AlreadyExists, st.Code())
+}
+
+func TestCreateVolumeExisting(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+
+	create := func(required, limit int64) (*csi.CreateVolumeResponse, codes.Code) {
+		rep, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: "vol",
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: required,
+				LimitBytes:    limit,
+			},
+			Parameters: map[string]string{KeyStoragePool: "pool"},
+		})
+		st, _ := status.FromError(err)
+		return rep, st.Code()
+	}
+
+	rep, code := create(16*bytesInGiB, 0)
+	assert.Equal(t, codes.OK, code)
+	id := rep.Volume.Id
+
+	tests := []struct {
+		name     string
+		required int64
+		limit    int64
+		code     codes.Code
+	}{
+		{"same size", 16 * bytesInGiB, 0, codes.OK},
+		{"same rounded size", 9 * bytesInGiB, 16 * bytesInGiB, codes.OK},
+		{"smaller size", 8 * bytesInGiB, 0, codes.OK},
+		{"larger size", 17 * bytesInGiB, 0, codes.AlreadyExists},
+		{"smaller limit", 8 * bytesInGiB, 8 * bytesInGiB, codes.AlreadyExists},
+	}
+	for _, tt := range tests {
+		rep, code := create(tt.required, tt.limit)
+		assert.Equal(t, tt.code, code, tt.name)
+		if code == codes.OK {
+			assert.Equal(t, id, rep.Volume.Id, tt.name)
+			assert.Equal(t, int64(16*bytesInGiB), rep.Volume.CapacityBytes, tt.name)
+		}
+	}
+	assert.Len(t, fake.Volumes, 1)
+}
+
+func TestCreateVolumeLongName(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+
+	name := strings.Repeat("v", 128)
+	assert.Equal(t, maxVolumeNameLength, len(sioVolumeName(name)))
+	assert.Equal(t, "vol", sioVolumeName("vol"))
+	assert.NotEqual(t, sioVolumeName(name), sioVolumeName(name+"w"))
+
+	// names too long for ScaleIO are shortened the same way every time
+	req := &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: bytesInGiB},
+		Parameters:    map[string]string{KeyStoragePool: "pool"},
+	}
+	rep, err := s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	id, _ := fake.FindVolumeID(sioVolumeName(name))
+	assert.Equal(t, id, rep.GetVolume().GetId())
+
+	again, err := s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, rep.GetVolume().GetId(), again.GetVolume().GetId())
+	assert.Len(t, fake.Volumes, 1)
+}
+
+func TestCreateVolumeDefaultPool(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddStoragePool("other", 100*kiBytesInGiB)
+
+	req := &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: bytesInGiB},
+	}
+	_, err := s.CreateVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+
+	s.opts.StoragePool = "pool"
+	rep, err := s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "pool", rep.GetVolume().GetAttributes()[KeyStoragePoolName])
+
+	// the parameter takes precedence
+	req.Name = "vol2"
+	req.Parameters = map[string]string{KeyStoragePool: "other"}
+	rep, err = s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "other", rep.GetVolume().GetAttributes()[KeyStoragePoolName])
+}
+
+func TestDeleteVolumeInUse(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	sdcID := fake.AddSdc("SDC-GUID")
+	assert.NoError(t, fake.MapVolumeSdc(
+		&siotypes.Volume{ID: id},
+		&siotypes.MapVolumeSdcParam{SdcID: sdcID}))
+
+	_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Contains(t, st.Message(), sdcID)
+	assert.Contains(t, fake.Volumes, id)
+
+	assert.NoError(t, fake.UnmapVolumeSdc(
+		&siotypes.Volume{ID: id},
+		&siotypes.UnmapVolumeSdcParam{SdcID: sdcID}))
+	_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	assert.NoError(t, err)
+	assert.NotContains(t, fake.Volumes, id)
+
+	// deleting a volume that is already gone succeeds
+	_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	assert.NoError(t, err)
+}
+
+func TestControllerPublishUnpublish(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	sdc1 := fake.AddSdc("SDC-1")
+	fake.AddSdc("SDC-2")
+
+	pub := func(node string) error {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   node,
+				VolumeCapability: mountCap(
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+		return err
+	}
+	unpub := func(node string) error {
+		_, err := s.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: node})
+		return err
+	}
+	mapped := func() []string {
+		var ids []string
+		for _, m := range fake.Volumes[id].MappedSdcInfo {
+			ids = append(ids, m.SdcID)
+		}
+		return ids
+	}
+
+	assert.NoError(t, pub("sdc-1"))
+	assert.Equal(t, []string{sdc1}, mapped())
+
+	// publishing again to the same node is a no-op
+	assert.NoError(t, pub("sdc-1"))
+	assert.Equal(t, 1, fake.Calls["MapVolumeSdc"])
+
+	// a single node volume can't be published to a second node
+	st, _ := status.FromError(pub("sdc-2"))
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+
+	// unknown nodes and volumes are reported as not found
+	st, _ = status.FromError(pub("sdc-3"))
+	assert.Equal(t, codes.NotFound, st.Code())
+
+	assert.NoError(t, unpub("sdc-1"))
+	assert.Empty(t, mapped())
+
+	// unpublishing again is a no-op
+	assert.NoError(t, unpub("sdc-1"))
+	assert.Equal(t, 1, fake.Calls["UnmapVolumeSdc"])
+
+	delete(fake.Volumes, id)
+	st, _ = status.FromError(pub("sdc-1"))
+	assert.Equal(t, codes.NotFound, st.Code())
+	st, _ = status.FromError(unpub("sdc-1"))
+	assert.Equal(t, codes.NotFound, st.Code())
+}
+
+func TestListVolumesPagination(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, fake.AddVolume(
+			fmt.Sprintf("vol%d", i), "pool", 8*kiBytesInGiB))
+	}
+
+	// everything is listed at once without max_entries
+	rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, rep.Entries, 5)
+	assert.Empty(t, rep.NextToken)
+
+	var (
+		listed []string
+		tokens []string
+		token  string
+	)
+	for {
+		rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{
+			MaxEntries:    2,
+			StartingToken: token,
+		})
+		assert.NoError(t, err)
+		for _, e := range rep.Entries {
+			listed = append(listed, e.Volume.Id)
+		}
+		if token = rep.NextToken; token == "" {
+			break
+		}
+		tokens = append(tokens, token)
+	}
+	assert.Equal(t, ids, listed)
+	assert.Len(t, tokens, 2)
+
+	// tokens that weren't returned by the plugin are rejected
+	for _, token := range []string{"6", "a.b", tokens[0] + "0"} {
+		_, err = s.ListVolumes(ctx, &csi.ListVolumesRequest{
+			MaxEntries:    2,
+			StartingToken: token,
+		})
+		st, _ := status.FromError(err)
+		assert.Equal(t, codes.Aborted, st.Code(), token)
+	}
+}
+
+func TestSDCReinstall(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	old := fake.AddSdc("SDC-1")
+
+	pub := &csi.ControllerPublishVolumeRequest{
+		VolumeId: id,
+		NodeId:   "sdc-1",
+		VolumeCapability: mountCap(
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	}
+	_, err := s.ControllerPublishVolume(ctx, pub)
+	assert.NoError(t, err)
+	_, err = s.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+	assert.NoError(t, err)
+
+	// the host is reinstalled, and its SDC registered under a new ID
+	delete(fake.SDCs, old)
+	sdc := fake.AddSdc("SDC-1")
+
+	_, err = s.ControllerPublishVolume(ctx, pub)
+	assert.NoError(t, err)
+	if assert.Len(t, fake.Volumes[id].MappedSdcInfo, 1) {
+		assert.Equal(t, sdc, fake.Volumes[id].MappedSdcInfo[0].SdcID)
+	}
+	assert.Equal(t, 2, fake.Calls["FindSdc"])
+}
+
+func TestPublishReregisteredMixedCase(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	fake.Volumes[id].MappingToAllSdcsEnabled = true
+
+	// the node registered its SDC with a lower case GUID
+	guid := "271bad82-08ee-44f2-a2b1-7e2787c27be1"
+	old := fake.AddSdc(guid)
+	pub := func(nodeID string) error {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   nodeID,
+				VolumeCapability: mountCap(
+					csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+			})
+		return err
+	}
+	assert.NoError(t, pub(strings.ToUpper(guid)))
+	if assert.Len(t, fake.Volumes[id].MappedSdcInfo, 1) {
+		assert.Equal(t, old, fake.Volumes[id].MappedSdcInfo[0].SdcID)
+	}
+
+	// the SDC re-registers under a new ID, and the volume is mapped to it
+	// there, while its old ID is still cached
+	delete(fake.SDCs, old)
+	sdc := fake.AddSdc(guid)
+	fake.Volumes[id].MappedSdcInfo = []*siotypes.MappedSdcInfo{
+		{SdcID: sdc},
+	}
+	calls := fake.Calls["MapVolumeSdc"]
+
+	// publishing with the GUID in another case, or padded, doesn't map the
+	// volume to it again
+	assert.NoError(t, pub(guid))
+	assert.NoError(t, pub(" {"+guid+"}"))
+	assert.Equal(t, calls, fake.Calls["MapVolumeSdc"])
+	if assert.Len(t, fake.Volumes[id].MappedSdcInfo, 1) {
+		assert.Equal(t, sdc, fake.Volumes[id].MappedSdcInfo[0].SdcID)
+	}
+}
+
+func TestPublishVolumeLimit(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.MaxVolumesPerNode = 2
+	fake.AddSdc("SDC-1")
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, fake.AddVolume(
+			fmt.Sprintf("vol%d", i), "pool", 8*kiBytesInGiB))
+	}
+	pub := func(id string) error {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   "sdc-1",
+				VolumeCapability: mountCap(
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+		return err
+	}
+
+	assert.NoError(t, pub(ids[0]))
+	assert.NoError(t, pub(ids[1]))
+	err := pub(ids[2])
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Contains(t, st.Message(), "has 2 volumes mapped")
+	assert.Len(t, fake.Volumes[ids[2]].MappedSdcInfo, 0)
+
+	// the count is cached, and kept up to date by the plugin's own
+	// mappings
+	assert.Equal(t, 1, fake.Calls["GetSdcVolumes"])
+
+	// volumes already mapped may still be published
+	assert.NoError(t, pub(ids[1]))
+
+	_, err = s.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: ids[0], NodeId: "sdc-1"})
+	assert.NoError(t, err)
+	assert.NoError(t, pub(ids[2]))
+	assert.Equal(t, 1, fake.Calls["GetSdcVolumes"])
+
+	// a failure to count leaves the limit to the gateway
+	s, fake = newFakeService()
+	s.opts.MaxVolumesPerNode = 2
+	fake.AddSdc("SDC-1")
+	fake.Errors["GetSdcVolumes"] = errors.New("gateway down")
+	assert.NoError(t, pub(fake.AddVolume("vol", "pool", 8*kiBytesInGiB)))
+}
+
+func TestPublishAccessModes(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	sdc := fake.AddSdc("SDC-1")
+	other := fake.AddSdc("SDC-2")
+
+	pub := func(mode csi.VolumeCapability_AccessMode_Mode) error {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId:         id,
+				NodeId:           "sdc-1",
+				VolumeCapability: mountCap(mode),
+			})
+		return err
+	}
+	mode := func() csi.VolumeCapability_AccessMode_Mode {
+		m, _ := s.getMappingMode(id, sdc)
+		return m
+	}
+
+	// publishing again with the same mode succeeds
+	assert.NoError(t, pub(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+	assert.NoError(t, pub(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+	assert.Equal(t, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, mode())
+
+	// the only mapping of a volume may change mode either way
+	assert.NoError(t, pub(
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY))
+	assert.Equal(t,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, mode())
+	assert.NoError(t, pub(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+	assert.Equal(t, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, mode())
+	assert.Equal(t, 1, fake.Calls["MapVolumeSdc"])
+
+	// one alongside others may not
+	fake.Volumes[id].MappingToAllSdcsEnabled = true
+	fake.Volumes[id].MappedSdcInfo = append(fake.Volumes[id].MappedSdcInfo,
+		&siotypes.MappedSdcInfo{SdcID: other})
+	st, _ := status.FromError(pub(
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY))
+	assert.Equal(t, codes.AlreadyExists, st.Code())
+	assert.Contains(t, st.Message(), "SINGLE_NODE_WRITER")
+	assert.Equal(t, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, mode())
+	assert.NoError(t, pub(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER))
+
+	// the mode of a mapping is forgotten once it is unpublished
+	_, err := s.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+	assert.NoError(t, err)
+	_, ok := s.getMappingMode(id, sdc)
+	assert.False(t, ok)
+
+	// a mapping whose mode isn't known, as after a restart, is taken to
+	// match
+	fake.Volumes[id].MappedSdcInfo = append(fake.Volumes[id].MappedSdcInfo,
+		&siotypes.MappedSdcInfo{SdcID: sdc})
+	assert.NoError(t, pub(
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY))
+	assert.Equal(t,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, mode())
+}
+
+func TestSDCCacheExpiry(t *testing.T) {
+	defer func(ttl, neg time.Duration) {
+		sdcCacheTTL, sdcNegativeTTL = ttl, neg
+	}(sdcCacheTTL, sdcNegativeTTL)
+	sdcCacheTTL = 50 * time.Millisecond
+	sdcNegativeTTL = 50 * time.Millisecond
+
+	s, fake := newFakeService()
+
+	// GUIDs in the SDC's format are only looked up as GUIDs
+	guid := "271bad82-08ee-44f2-a2b1-7e2787c27be1"
+
+	// failed lookups are cached briefly
+	for i := 0; i < 3; i++ {
+		_, err := s.getSDCID(context.Background(), guid)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 1, fake.Calls["FindSdc"])
+
+	sdc := fake.AddSdc(strings.ToUpper(guid))
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		id, err := s.getSDCID(context.Background(), guid)
+		assert.NoError(t, err)
+		assert.Equal(t, sdc, id)
+	}
+	assert.Equal(t, 2, fake.Calls["FindSdc"])
+
+	// resolved IDs are looked up again once they expire
+	time.Sleep(60 * time.Millisecond)
+	_, err := s.getSDCID(context.Background(), guid)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fake.Calls["FindSdc"])
+
+	s.invalidateSDC(guid)
+	_, err = s.getSDCID(context.Background(), guid)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, fake.Calls["FindSdc"])
+}
+
+// hungFindAdmin is a FakeAdmin whose system lookups wait for release
+type hungFindAdmin struct {
+	*testutil.FakeAdmin
+	started chan struct{}
+	release chan struct{}
+}
+
+func (a *hungFindAdmin) FindSystem(
+	instanceID, name, href string) (*siotypes.System, error) {
+
+	a.started <- struct{}{}
+	<-a.release
+	return a.FakeAdmin.FindSystem(instanceID, name, href)
+}
+
+func TestRefreshSystemHung(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	admin := &hungFindAdmin{
+		FakeAdmin: fake,
+		started:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	s.adminClient = admin
+	stale := s.currentSystem()
+
+	refreshed := make(chan error)
+	go func() {
+		refreshed <- s.withSystem(ctx, func(system *siotypes.System) error {
+			if system.ID == stale.ID {
+				return errors.New("Could not find system")
+			}
+			return nil
+		})
+	}()
+	<-admin.started
+
+	// the system is still read while it is looked up again
+	assert.True(t, s.controllerProbed())
+	assert.Equal(t, stale, s.currentSystem())
+
+	// and a request waiting on the lookup gives up with its own context
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := s.refreshSystem(cctx, stale)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+
+	fake.Systems = map[string]*siotypes.System{
+		"feedface00000000": {ID: "feedface00000000", Name: "sys"},
+	}
+	close(admin.release)
+	assert.NoError(t, <-refreshed)
+	assert.Equal(t, "feedface00000000", s.currentSystem().ID)
+	assert.Equal(t, 2, fake.Calls["FindSystem"])
+}
+
+func TestRefreshStaleSystem(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddSdc("SDC-1")
+	old := s.system.ID
+
+	// the MDM cluster changes ownership, and the system a new ID
+	fake.Systems = map[string]*siotypes.System{
+		"feedface00000000": {ID: "feedface00000000", Name: "sys"},
+	}
+	_, err := s.getSDCID(context.Background(), "sdc-1")
+	assert.NoError(t, err)
+	assert.NotEqual(t, old, s.currentSystem().ID)
+	assert.Equal(t, "feedface00000000", s.currentSystem().ID)
+
+	_, err = s.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fake.Calls["FindSystem"])
+
+	// a system that no longer exists requires the controller to be probed
+	// again, which then fails
+	fake.Systems = map[string]*siotypes.System{}
+	_, err = s.GetCapacity(ctx, &csi.GetCapacityRequest{})
+	assert.Error(t, err)
+	assert.False(t, s.controllerProbed())
+
+	s.opts.User, s.opts.Password, s.opts.Endpoint = "admin", "password", "x"
+	err = s.controllerProbe(ctx)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+}
+
+func TestVolumeAttributes(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddSdc("SDC-1")
+
+	rep, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		Parameters: map[string]string{
+			KeyStoragePool:       "pool",
+			KeyThickProvisioning: "true",
+			KeyFsType:            "xfs",
+		},
+	})
+	assert.NoError(t, err)
+	attrs := rep.Volume.Attributes
+	assert.Equal(t, map[string]string{
+		KeyProvisioningType:   thickProvisioned,
+		KeyStoragePoolName:    "pool",
+		KeyProtectionDomainID: testutil.ProtectionDomainID,
+		KeySystemID:           s.currentSystem().ID,
+		KeyFsType:             "xfs",
+	}, attrs)
+
+	// the attributes are passed on to the node service, others are not
+	attrs["other"] = "value"
+	pub, err := s.ControllerPublishVolume(ctx,
+		&csi.ControllerPublishVolumeRequest{
+			VolumeId:         rep.Volume.Id,
+			NodeId:           "SDC-1",
+			VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			VolumeAttributes: attrs,
+		})
+	assert.NoError(t, err)
+	delete(attrs, "other")
+	attrs[KeyAccessType] = "mount"
+	assert.Equal(t, attrs, pub.PublishInfo)
+
+	// without any, only the granted capability is passed on
+	pub, err = s.ControllerPublishVolume(ctx,
+		&csi.ControllerPublishVolumeRequest{
+			VolumeId:         rep.Volume.Id,
+			NodeId:           "SDC-1",
+			VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		KeyAccessType: "mount",
+		KeyFsType:     "xfs",
+	}, pub.PublishInfo)
+}
+
+func TestPublishCapabilities(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddSdc("SDC-1")
+	fake.AddSdc("SDC-2")
+
+	rep, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		Parameters: map[string]string{
+			KeyStoragePool: "pool",
+			KeyFsType:      "ext4",
+		},
+	})
+	assert.NoError(t, err)
+	id := rep.Volume.Id
+	fake.Volumes[id].MappingToAllSdcsEnabled = true
+
+	fsCap := func(fs string) *csi.VolumeCapability {
+		vc := mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)
+		vc.GetMount().FsType = fs
+		return vc
+	}
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+	}
+	publish := func(node string, vc *csi.VolumeCapability) (
+		*csi.ControllerPublishVolumeResponse, codes.Code) {
+
+		pub, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId:         id,
+				NodeId:           node,
+				VolumeCapability: vc,
+				VolumeAttributes: rep.Volume.Attributes,
+			})
+		st, _ := status.FromError(err)
+		return pub, st.Code()
+	}
+
+	// a filesystem other than the volume's is refused before mapping
+	_, code := publish("SDC-1", fsCap("xfs"))
+	assert.Equal(t, codes.InvalidArgument, code)
+	assert.Equal(t, 0, fake.Calls["MapVolumeSdc"])
+
+	pub, code := publish("SDC-1", fsCap(""))
+	assert.Equal(t, codes.OK, code)
+	assert.Equal(t, "mount", pub.PublishInfo[KeyAccessType])
+	assert.Equal(t, "ext4", pub.PublishInfo[KeyFsType])
+
+	// later publishes must use the capability granted to the first
+	for _, node := range []string{"SDC-1", "SDC-2"} {
+		_, code = publish(node, blockCap)
+		assert.Equal(t, codes.InvalidArgument, code, node)
+	}
+	assert.Equal(t, 1, fake.Calls["MapVolumeSdc"])
+	pub, code = publish("SDC-1", fsCap("ext4"))
+	assert.Equal(t, codes.OK, code)
+
+	// once unpublished, the volume may be used as a block device
+	_, err = s.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "SDC-1"})
+	assert.NoError(t, err)
+	pub, code = publish("SDC-2", blockCap)
+	assert.Equal(t, codes.OK, code)
+	assert.Equal(t, map[string]string{
+		KeyAccessType:         "block",
+		KeyFsType:             "ext4",
+		KeyProvisioningType:   rep.Volume.Attributes[KeyProvisioningType],
+		KeyStoragePoolName:    "pool",
+		KeyProtectionDomainID: testutil.ProtectionDomainID,
+		KeySystemID:           s.currentSystem().ID,
+	}, pub.PublishInfo)
+}
+
+func TestCreateVolumeRAMCache(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+
+	create := func(name string, params map[string]string) (
+		*csi.CreateVolumeResponse, error) {
+
+		params[KeyStoragePool] = "pool"
+		return s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       name,
+			Parameters: params,
+		})
+	}
+
+	// the pool's setting is left alone unless the parameter is given
+	rep, err := create("default", map[string]string{})
+	assert.NoError(t, err)
+	assert.NotContains(t, rep.Volume.Attributes, KeyRAMCache)
+	assert.Equal(t, 0, fake.Calls["SetVolumeUseRmcache"])
+
+	rep, err = create("cached", map[string]string{KeyRAMCache: "true"})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", rep.Volume.Attributes[KeyRAMCache])
+	assert.True(t, fake.Volumes[rep.Volume.Id].UseRmCache)
+	assert.Equal(t, 1, fake.Calls["SetVolumeUseRmcache"])
+
+	_, err = create("invalid", map[string]string{KeyRAMCache: "sometimes"})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, 1, fake.Calls["SetVolumeUseRmcache"])
+	_, err = fake.FindVolumeID("invalid")
+	assert.Error(t, err)
+
+	fake.Errors["SetVolumeUseRmcache"] = errors.New("failed")
+	_, err = create("uncached", map[string]string{KeyRAMCache: "false"})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.Internal, st.Code())
+}
+
+func TestMappedSdcLimits(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	sdcID := fake.AddSdc("SDC-1")
+
+	for _, params := range []map[string]string{
+		{KeyIOPSLimit: "10"},
+		{KeyIOPSLimit: "-1"},
+		{KeyIOPSLimit: "many"},
+		{KeyBandwidthLimitKbps: "1000"},
+	} {
+		params[KeyStoragePool] = "pool"
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       "invalid",
+			Parameters: params,
+		})
+		st, _ := status.FromError(err)
+		assert.Equal(t, codes.InvalidArgument, st.Code(), params)
+	}
+	assert.Empty(t, fake.Volumes)
+
+	rep, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		Parameters: map[string]string{
+			KeyStoragePool:        "pool",
+			KeyIOPSLimit:          "100",
+			KeyBandwidthLimitKbps: "2048",
+		},
+	})
+	assert.NoError(t, err)
+	attrs := rep.Volume.Attributes
+	assert.Equal(t, "100", attrs[KeyIOPSLimit])
+	assert.Equal(t, "2048", attrs[KeyBandwidthLimitKbps])
+
+	// the limits are applied on every publish
+	pub := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         rep.Volume.Id,
+		NodeId:           "SDC-1",
+		VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeAttributes: attrs,
+	}
+	for i := 1; i <= 2; i++ {
+		_, err = s.ControllerPublishVolume(ctx, pub)
+		assert.NoError(t, err)
+		assert.Equal(t, i, fake.Calls["SetMappedSdcLimits"])
+	}
+	mapping := fake.Volumes[rep.Volume.Id].MappedSdcInfo[0]
+	assert.Equal(t, sdcID, mapping.SdcID)
+	assert.Equal(t, 100, mapping.LimitIops)
+	assert.Equal(t, 2, mapping.LimitBwInMbps)
+
+	_, err = s.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{
+			VolumeId: rep.Volume.Id,
+			NodeId:   "SDC-1",
+		})
+	assert.NoError(t, err)
+
+	// volumes without limits are left unlimited
+	pub.VolumeAttributes = nil
+	_, err = s.ControllerPublishVolume(ctx, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fake.Calls["SetMappedSdcLimits"])
+}
+
+func TestCreateThickZeroPadding(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	poolID := fake.AddStoragePool("nozero", 100*kiBytesInGiB)
+	fake.StoragePools[poolID].ZeroPaddingEnabled = false
+
+	req := &csi.CreateVolumeRequest{
+		Name: "thick",
+		Parameters: map[string]string{
+			KeyStoragePool:       "nozero",
+			KeyThickProvisioning: "true",
+		},
+	}
+	_, err := s.CreateVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Contains(t, st.Message(), "pool nozero does not have zero padding")
+	assert.Equal(t, 0, fake.Calls["CreateVolume"])
+
+	// thin volumes don't need zero padding
+	req.Parameters[KeyThickProvisioning] = "false"
+	_, err = s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	calls := fake.Calls["FindStoragePool"]
+
+	// enabling zero padding is noticed, after which the pool is cached
+	fake.StoragePools[poolID].ZeroPaddingEnabled = true
+	req.Name = "thick"
+	req.Parameters[KeyThickProvisioning] = "true"
+	_, err = s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	req.Name = "thick2"
+	_, err = s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, calls+1, fake.Calls["FindStoragePool"])
+}
+
+func TestImportVolume(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("rexray-vol", "pool", 16*kiBytesInGiB)
+	sdcID := fake.AddSdc("SDC-1")
+	assert.NoError(t, fake.MapVolumeSdc(
+		&siotypes.Volume{ID: id},
+		&siotypes.MapVolumeSdcParam{SdcID: sdcID}))
+
+	req := &csi.CreateVolumeRequest{
+		Name:          "csi-vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 8 * bytesInGiB},
+		Parameters: map[string]string{
+			KeyImportVolumeName: "rexray-vol",
+			KeyImportRename:     "true",
+		},
+	}
+
+	// mapped volumes need to be forced
+	_, err := s.CreateVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	req.Parameters[KeyImportForce] = "true"
+
+	// the volume must fit the capacity range
+	req.CapacityRange.LimitBytes = 8 * bytesInGiB
+	_, err = s.CreateVolume(ctx, req)
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.OutOfRange, st.Code())
+	req.CapacityRange.LimitBytes = 0
+
+	// importing again finds the renamed volume
+	for i := 0; i < 2; i++ {
+		rep, err := s.CreateVolume(ctx, req)
+		assert.NoError(t, err)
+		assert.Equal(t, id, rep.Volume.Id)
+		assert.Equal(t, int64(16*bytesInGiB), rep.Volume.CapacityBytes)
+		assert.Equal(t, "pool", rep.Volume.Attributes[KeyStoragePoolName])
+		assert.Equal(t, "csi-vol", fake.Volumes[id].Name)
+	}
+	assert.Equal(t, 1, fake.Calls["SetVolumeName"])
+	// only the volume added above was created
+	assert.Equal(t, 1, fake.Calls["CreateVolume"])
+
+	req.Parameters[KeyImportVolumeName] = "missing"
+	req.Parameters[KeyImportRename] = "false"
+	_, err = s.CreateVolume(ctx, req)
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.NotFound, st.Code())
+}
+
+// cancelingAdmin cancels a request once its first step is done
+type cancelingAdmin struct {
+	ScaleIOAdmin
+	cancel func()
+}
+
+func (a *cancelingAdmin) CreateVolume(
+	volume *siotypes.VolumeParam,
+	storagePoolName string) (*siotypes.VolumeResp, error) {
+
+	defer a.cancel()
+	return a.ScaleIOAdmin.CreateVolume(volume, storagePoolName)
+}
+
+func (a *cancelingAdmin) MapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.MapVolumeSdcParam) error {
+
+	defer a.cancel()
+	return a.ScaleIOAdmin.MapVolumeSdc(volume, param)
+}
+
+func TestCanceledRequests(t *testing.T) {
+	s, fake := newFakeService()
+	fake.AddSdc("SDC-1")
+
+	create := &csi.CreateVolumeRequest{
+		Name: "vol",
+		Parameters: map[string]string{
+			KeyStoragePool: "pool",
+			KeyRAMCache:    "true",
+			KeyIOPSLimit:   "100",
+		},
+	}
+
+	// nothing is done for a request canceled before it starts
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: fake.AddVolume("other", "pool", 8*kiBytesInGiB),
+	})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Canceled, st.Code())
+	assert.Equal(t, 0, fake.Calls["RemoveVolume"])
+
+	// a volume created before the request was canceled is removed
+	// rather than left without its RAM read cache setting
+	ctx, cancel = context.WithCancel(context.Background())
+	s.adminClient = &cancelingAdmin{ScaleIOAdmin: fake, cancel: cancel}
+	_, err = s.CreateVolume(ctx, create)
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.Canceled, st.Code())
+	assert.Equal(t, 0, fake.Calls["SetVolumeUseRmcache"])
+	assert.Equal(t, 1, fake.Calls["RemoveVolume"])
+	_, err = fake.FindVolumeID("vol")
+	assert.Error(t, err)
+
+	s.adminClient = fake
+	rep, err := s.CreateVolume(context.Background(), create)
+	assert.NoError(t, err)
+
+	// a mapping made before the request was canceled is removed rather
+	// than left without its limits
+	ctx, cancel = context.WithCancel(context.Background())
+	s.adminClient = &cancelingAdmin{ScaleIOAdmin: fake, cancel: cancel}
+	_, err = s.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         rep.Volume.Id,
+		NodeId:           "SDC-1",
+		VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		VolumeAttributes: rep.Volume.Attributes,
+	})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.Canceled, st.Code())
+	assert.Equal(t, 1, fake.Calls["MapVolumeSdc"])
+	assert.Equal(t, 0, fake.Calls["SetMappedSdcLimits"])
+	assert.Empty(t, fake.Volumes[rep.Volume.Id].MappedSdcInfo)
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	sio "github.com/thecodeteam/goscaleio"
+)
+
+// diskIDDir is the directory in which udev links each ScaleIO volume mapped
+// to the SDC to its device
+const diskIDDir = "/dev/disk/by-id"
+
+// sdcDiskID matches the names of the links to ScaleIO volumes in diskIDDir,
+// emc-vol-<MDM ID>-<volume ID>
+var sdcDiskID = regexp.MustCompile(`^emc-vol-\w*-\w*$`)
+
+// maxDeviceLinks is the number of links followed to a volume's device
+// before giving up
+const maxDeviceLinks = 8
+
+// sdcDeviceMap finds the volumes mapped to the local SDC, and their
+// devices, under root, where the host's /dev is found when the SDC isn't
+// installed in the plug-in's own filesystem, as with a containerized SDC
+type sdcDeviceMap struct {
+	root string
+}
+
+// GetLocalVolumeMap returns the volumes mapped to the local SDC, ordered by
+// MDM and volume ID, as goscaleio.GetLocalVolumeMap does for a root of /.
+// The devices returned are under root, so they can be mounted from the
+// plug-in's filesystem.
+func (d sdcDeviceMap) GetLocalVolumeMap() ([]*sio.SdcMappedVolume, error) {
+	if d.root == "" || filepath.Clean(d.root) == "/" {
+		return sio.GetLocalVolumeMap()
+	}
+
+	dir := filepath.Join(d.root, diskIDDir)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var vols []*sio.SdcMappedVolume
+	for _, f := range files {
+		if !sdcDiskID.MatchString(f.Name()) {
+			continue
+		}
+		dev, err := d.resolve(filepath.Join(dir, f.Name()))
+		if err != nil {
+			log.WithError(err).WithField("link", f.Name()).Warn(
+				"unable to find device of mapped volume")
+			continue
+		}
+		split := strings.Split(f.Name(), "-")
+		vols = append(vols, &sio.SdcMappedVolume{
+			MdmID:     split[2],
+			VolumeID:  split[3],
+			SdcDevice: dev,
+		})
+	}
+
+	sort.Slice(vols, func(i, j int) bool {
+		if vols[i].MdmID != vols[j].MdmID {
+			return vols[i].MdmID < vols[j].MdmID
+		}
+		return vols[i].VolumeID < vols[j].VolumeID
+	})
+	return vols, nil
+}
+
+// resolve follows the links from path to the device they end at. The
+// links are the host's, so absolute targets are found under root.
+func (d sdcDeviceMap) resolve(path string) (string, error) {
+	for i := 0; i < maxDeviceLinks; i++ {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			path = filepath.Join(d.root, target)
+		} else {
+			path = filepath.Join(filepath.Dir(path), target)
+		}
+	}
+	return "", fmt.Errorf("too many links from %s", path)
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sio "github.com/thecodeteam/goscaleio"
+)
+
+func TestSDCDeviceMap(t *testing.T) {
+	root, err := ioutil.TempDir("", "sdcroot")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(root)
+
+	dir := filepath.Join(root, diskIDDir)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	for _, dev := range []string{"scinia", "scinib", "sda"} {
+		assert.NoError(t, ioutil.WriteFile(
+			filepath.Join(root, "dev", dev), nil, 0644))
+	}
+	for name, target := range map[string]string{
+		// udev links relatively, but absolute links are the host's too
+		"emc-vol-7ec27ef4-2":     "../../scinib",
+		"emc-vol-7ec27ef4-1":     "/dev/scinia",
+		"wwn-0x5000c500a0b1c2d3": "../../sda",
+		"emc-vol-7ec27ef4-3":     "../../scinic",
+	} {
+		assert.NoError(t, os.Symlink(target, filepath.Join(dir, name)))
+	}
+
+	vols, err := sdcDeviceMap{root: root}.GetLocalVolumeMap()
+	assert.NoError(t, err)
+	assert.Equal(t, []*sio.SdcMappedVolume{
+		{
+			MdmID:     "7ec27ef4",
+			VolumeID:  "1",
+			SdcDevice: filepath.Join(root, "dev", "scinia"),
+		},
+		{
+			MdmID:     "7ec27ef4",
+			VolumeID:  "2",
+			SdcDevice: filepath.Join(root, "dev", "scinib"),
+		},
+	}, vols)
+
+	// a root without the host's /dev is a mistake
+	_, err = sdcDeviceMap{root: filepath.Join(root, "dev")}.GetLocalVolumeMap()
+	assert.Error(t, err)
+
+	// links that never end at a device are ignored
+	assert.NoError(t, os.Symlink("loop", filepath.Join(dir, "emc-vol-7ec27ef4-4")))
+	assert.NoError(t, os.Symlink("emc-vol-7ec27ef4-4", filepath.Join(dir, "loop")))
+	vols, err = sdcDeviceMap{root: root}.GetLocalVolumeMap()
+	assert.NoError(t, err)
+	assert.Len(t, vols, 2)
+}
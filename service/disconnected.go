@@ -0,0 +1,96 @@
+package service
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"golang.org/x/net/context"
+)
+
+// sdcDisconnected is the MDM connection state of an SDC whose host is
+// down, or gone
+const sdcDisconnected = "Disconnected"
+
+// sdcUnregistered is the state logged for a mapped SDC that is no longer
+// registered with the system
+const sdcUnregistered = "Unregistered"
+
+// staleMapping is the mapping of a volume to an SDC that is disconnected
+// from the system, with the SDC's last reported connection state
+type staleMapping struct {
+	sdcID string
+	state string
+}
+
+// disconnectedMappings returns the mappings of vol, if every one of them is
+// to an SDC in sdcs that is disconnected, or to one that is no longer
+// registered. false is returned if any is to an SDC in another state, as
+// the volume may then be in use by a live host.
+func disconnectedMappings(
+	vol *siotypes.Volume, sdcs []siotypes.Sdc) ([]staleMapping, bool) {
+
+	states := make(map[string]string, len(sdcs))
+	for _, sdc := range sdcs {
+		states[sdc.ID] = sdc.MdmConnectionState
+	}
+
+	var stale []staleMapping
+	for _, m := range vol.MappedSdcInfo {
+		state, ok := states[m.SdcID]
+		if !ok {
+			state = sdcUnregistered
+		} else if !strings.EqualFold(state, sdcDisconnected) {
+			return nil, false
+		}
+		stale = append(stale, staleMapping{sdcID: m.SdcID, state: state})
+	}
+	return stale, len(stale) > 0
+}
+
+// unmapDisconnected unmaps vol from the SDCs it is mapped to, if every one
+// of them is disconnected from the system, logging each. It returns
+// whether the volume was unmapped from every one of them.
+func (s *service) unmapDisconnected(
+	ctx context.Context, vol *siotypes.Volume) (bool, error) {
+
+	var sdcs []siotypes.Sdc
+	if err := s.withSystem(ctx, func(system *siotypes.System) error {
+		var err error
+		s.metrics.gatewayCall("GetSdcs")
+		sdcs, err = adminContext(ctx, s.adminClient).GetSdcs(system)
+		return err
+	}); err != nil {
+		if cerr := canceledErr(ctx, "listing SDCs"); cerr != nil {
+			return false, cerr
+		}
+		return false, err
+	}
+
+	stale, ok := disconnectedMappings(vol, sdcs)
+	if !ok {
+		return false, nil
+	}
+	for _, m := range stale {
+		f := log.Fields{"sdcID": m.sdcID, "sdcState": m.state}
+		s.metrics.gatewayCall("UnmapVolumeSdc")
+		err := adminContext(ctx, s.adminClient).UnmapVolumeSdc(
+			&siotypes.Volume{ID: vol.ID},
+			&siotypes.UnmapVolumeSdcParam{
+				SdcID:                m.sdcID,
+				IgnoreScsiInitiators: "true",
+			})
+		s.setRemapped(vol.ID)
+		if err != nil {
+			if cerr := canceledErr(ctx, "unmapping volume"); cerr != nil {
+				return false, cerr
+			}
+			reqLog(ctx, vol.ID).WithFields(f).WithError(err).Warn(
+				"unable to unmap volume from disconnected SDC")
+			return false, nil
+		}
+		reqLog(ctx, vol.ID).WithFields(f).Warn(
+			"unmapped volume from disconnected SDC before deletion")
+	}
+	return true, nil
+}
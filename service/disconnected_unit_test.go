@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDisconnectedMappings(t *testing.T) {
+	sdcs := []siotypes.Sdc{
+		{ID: "up", MdmConnectionState: "Connected"},
+		{ID: "down1", MdmConnectionState: "Disconnected"},
+		{ID: "down2", MdmConnectionState: "disconnected"},
+		{ID: "unknown"},
+	}
+	vol := func(ids ...string) *siotypes.Volume {
+		v := &siotypes.Volume{}
+		for _, id := range ids {
+			v.MappedSdcInfo = append(v.MappedSdcInfo,
+				&siotypes.MappedSdcInfo{SdcID: id})
+		}
+		return v
+	}
+
+	tests := []struct {
+		name  string
+		vol   *siotypes.Volume
+		stale []staleMapping
+		ok    bool
+	}{
+		{"connected", vol("up"), nil, false},
+		{"disconnected", vol("down1", "down2"), []staleMapping{
+			{sdcID: "down1", state: "Disconnected"},
+			{sdcID: "down2", state: "disconnected"},
+		}, true},
+		{"unregistered", vol("gone"), []staleMapping{
+			{sdcID: "gone", state: sdcUnregistered},
+		}, true},
+		{"mixed", vol("down1", "up"), nil, false},
+		{"unknown state", vol("down1", "unknown"), nil, false},
+		{"unmapped", vol(), nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stale, ok := disconnectedMappings(tt.vol, sdcs)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.stale, stale)
+		})
+	}
+}
+
+func TestDeleteVolumeDisconnected(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	up := fake.AddSdc("SDC-UP")
+	down := fake.AddSdc("SDC-DOWN")
+	fake.SDCs[up].MdmConnectionState = "Connected"
+	fake.SDCs[down].MdmConnectionState = "Disconnected"
+	for _, sdc := range []string{up, down} {
+		assert.NoError(t, fake.MapVolumeSdc(
+			&siotypes.Volume{ID: id},
+			&siotypes.MapVolumeSdcParam{
+				SdcID:                 sdc,
+				AllowMultipleMappings: "true",
+			}))
+	}
+	del := func() codes.Code {
+		_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+		st, _ := status.FromError(err)
+		return st.Code()
+	}
+
+	// mappings to disconnected SDCs are kept unless cleanup is enabled
+	fake.SDCs[up].MdmConnectionState = "Disconnected"
+	assert.Equal(t, codes.FailedPrecondition, del())
+	assert.Equal(t, 0, fake.Calls["GetSdcs"])
+	fake.SDCs[up].MdmConnectionState = "Connected"
+
+	// a volume mapped to a connected SDC is in use
+	s.opts.CleanupDisconnected = true
+	assert.Equal(t, codes.FailedPrecondition, del())
+	assert.Len(t, fake.Volumes[id].MappedSdcInfo, 2)
+	assert.Equal(t, 0, fake.Calls["UnmapVolumeSdc"])
+
+	// once that SDC's host is gone too, the volume is unmapped and deleted
+	fake.SDCs[up].MdmConnectionState = "Disconnected"
+	assert.Equal(t, codes.OK, del())
+	assert.Equal(t, 2, fake.Calls["UnmapVolumeSdc"])
+	assert.NotContains(t, fake.Volumes, id)
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultShutdownTimeout is how long a graceful stop waits for in-flight
+// RPCs by default
+const defaultShutdownTimeout = 30 * time.Second
+
+// operation is an RPC being handled
+type operation struct {
+	method   string
+	volumeID string
+	started  time.Time
+}
+
+// inflight tracks the RPCs being handled, so that a graceful stop can wait
+// for them to finish, and so that those that stall can be found
+type inflight struct {
+	sync.Mutex
+	ops      map[uint64]operation
+	next     uint64
+	draining bool
+	done     chan struct{}
+
+	// slowAfter is how long an RPC runs before a warning is logged, or 0
+	// to never warn. It is set before RPCs are served.
+	slowAfter time.Duration
+}
+
+// volumeIDer is implemented by requests that concern a single volume
+type volumeIDer interface {
+	GetVolumeId() string
+}
+
+// interceptor tracks each RPC while it is handled. Once draining has begun
+// new RPCs are rejected.
+func (f *inflight) interceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	op := operation{
+		method:  path.Base(info.FullMethod),
+		started: time.Now(),
+	}
+	if r, ok := req.(volumeIDer); ok {
+		op.volumeID = r.GetVolumeId()
+	}
+
+	f.Lock()
+	if f.draining {
+		f.Unlock()
+		return nil, status.Error(codes.Unavailable, "shutting down")
+	}
+	if f.ops == nil {
+		f.ops = map[uint64]operation{}
+	}
+	id := f.next
+	f.next++
+	f.ops[id] = op
+	f.Unlock()
+
+	if f.slowAfter > 0 {
+		t := time.AfterFunc(f.slowAfter, func() { warnSlow(ctx, op) })
+		defer t.Stop()
+	}
+
+	defer func() {
+		f.Lock()
+		defer f.Unlock()
+		delete(f.ops, id)
+		if f.draining && len(f.ops) == 0 {
+			close(f.done)
+		}
+	}()
+
+	return handler(ctx, req)
+}
+
+// drain stops new RPCs from being accepted and waits up to timeout for the
+// RPCs in flight to finish. The RPCs still in flight are returned if the
+// timeout expires first.
+func (f *inflight) drain(ctx context.Context, timeout time.Duration) []operation {
+	f.Lock()
+	if !f.draining {
+		f.draining = true
+		f.done = make(chan struct{})
+		if len(f.ops) == 0 {
+			close(f.done)
+		}
+	}
+	done := f.done
+	f.Unlock()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-t.C:
+	case <-ctx.Done():
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	ops := make([]operation, 0, len(f.ops))
+	for _, op := range f.ops {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+func (s *service) Drain(ctx context.Context) bool {
+	s.readiness.Lock()
+	s.readiness.stopping = true
+	s.readiness.Unlock()
+
+	log.WithField("timeout", s.opts.ShutdownTimeout).Info(
+		"waiting for in-flight requests")
+	ops := s.inflight.drain(ctx, s.opts.ShutdownTimeout)
+	for _, op := range ops {
+		log.WithFields(log.Fields{
+			"method":   op.method,
+			"volumeID": op.volumeID,
+			"started":  op.started,
+		}).Warn("abandoning in-flight request")
+	}
+	return len(ops) == 0
+}
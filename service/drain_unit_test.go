@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDrain(t *testing.T) {
+	var f inflight
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/DeleteVolume"}
+
+	// nothing in flight drains immediately
+	assert.Empty(t, (&inflight{}).drain(context.Background(), time.Hour))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan error)
+	go func() {
+		_, err := f.interceptor(context.Background(),
+			&csi.DeleteVolumeRequest{VolumeId: "vol1"}, info,
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				close(started)
+				<-release
+				return nil, nil
+			})
+		finished <- err
+	}()
+	<-started
+
+	// the request still in flight when the timeout expires is returned
+	ops := f.drain(context.Background(), 10*time.Millisecond)
+	assert.Len(t, ops, 1)
+	assert.Equal(t, "DeleteVolume", ops[0].method)
+	assert.Equal(t, "vol1", ops[0].volumeID)
+
+	// new requests are refused while draining
+	_, err := f.interceptor(context.Background(), nil, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			t.Fatal("handler called while draining")
+			return nil, nil
+		})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+
+	// once the request finishes the drain completes
+	close(release)
+	assert.NoError(t, <-finished)
+	assert.Empty(t, f.drain(context.Background(), time.Hour))
+}
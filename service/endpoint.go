@@ -0,0 +1,108 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// endpointFormat is the form of a gateway endpoint, given in errors
+const endpointFormat = "https://<gateway host>[:<port>][/api]"
+
+// endpointPorts are the ports of the gateway when the endpoint gives none
+var endpointPorts = map[string]string{
+	"https": "443",
+	"http":  "80",
+}
+
+// endpointSuffixes are paths that are copied along with the gateway's
+// address, such as from a browser, and dropped from endpoints
+var endpointSuffixes = []string{"/api/login", "/api/version", "/api"}
+
+// normalizeEndpoints normalizes each of the comma separated list of
+// gateway endpoints v, as normalizeEndpoint does
+func normalizeEndpoints(v string, allowHTTP bool) (string, error) {
+	var endpoints []string
+	seen := map[string]bool{}
+	for _, ep := range splitEndpoints(v) {
+		n, err := normalizeEndpoint(ep, allowHTTP)
+		if err != nil {
+			return "", err
+		}
+		if seen[n] {
+			return "", fmt.Errorf("%q is listed more than once", ep)
+		}
+		seen[n] = true
+		endpoints = append(endpoints, n)
+	}
+	if len(endpoints) == 0 {
+		return "", fmt.Errorf("no endpoint in %q, expected %s",
+			v, endpointFormat)
+	}
+	return strings.Join(endpoints, ","), nil
+}
+
+// normalizeEndpoint returns the gateway endpoint ep as goscaleio expects
+// it, https://host:port/api, or an error describing what is wrong with it.
+// https is assumed when ep has no scheme, and http is refused unless
+// allowHTTP is set. The port of the scheme is added when ep has none.
+func normalizeEndpoint(ep string, allowHTTP bool) (string, error) {
+	raw := ep
+	if !strings.Contains(ep, "://") {
+		ep = "https://" + ep
+	}
+	u, err := url.Parse(ep)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a URL, expected %s",
+			raw, endpointFormat)
+	}
+
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !allowHTTP {
+			return "", fmt.Errorf(
+				"%q is not https, set %s to use http", raw, EnvAllowHTTP)
+		}
+	default:
+		return "", fmt.Errorf("%q has scheme %s, expected %s",
+			raw, u.Scheme, endpointFormat)
+	}
+	if u.User != nil {
+		return "", fmt.Errorf("%q has credentials, which are set with "+
+			"%s and %s instead", raw, EnvUser, EnvPassword)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("%q has a query or fragment, expected %s",
+			raw, endpointFormat)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", fmt.Errorf("%q has no host, expected %s",
+			raw, endpointFormat)
+	}
+	port := u.Port()
+	if port == "" {
+		port = endpointPorts[u.Scheme]
+	} else if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("%q has invalid port %s, expected %s",
+			raw, port, endpointFormat)
+	}
+
+	path := strings.TrimRight(u.Path, "/")
+	for _, suffix := range endpointSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			path = strings.TrimSuffix(path, suffix)
+			break
+		}
+	}
+	if path != "" {
+		return "", fmt.Errorf("%q has path %s, expected %s",
+			raw, u.Path, endpointFormat)
+	}
+
+	return u.Scheme + "://" + net.JoinHostPort(host, port) + "/api", nil
+}
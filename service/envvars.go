@@ -2,7 +2,8 @@ package service
 
 const (
 	// EnvEndpoint is the name of the enviroment variable used to set the
-	// HTTP endpoint of the ScaleIO Gateway
+	// HTTP endpoint of the ScaleIO Gateway, or a comma separated list of
+	// the endpoints of several, which are failed over between
 	EnvEndpoint = "X_CSI_SCALEIO_ENDPOINT"
 
 	// EnvUser is the name of the enviroment variable used to set the
@@ -24,9 +25,14 @@ const (
 
 	// EnvSDCGUID is the name of the enviroment variable used to set the
 	// GUID of the SDC. This is only used by the Node Service, and removes
-	// a need for calling an external binary to retrieve the GUID
+	// a need for querying the SDC for the GUID
 	EnvSDCGUID = "X_CSI_SCALEIO_SDCGUID"
 
+	// EnvDrvCfgPath is the name of the environment variable used to set the
+	// path to the SDC's drv_cfg binary. When set, drv_cfg is used to get the
+	// SDC GUID if the SDC kernel module cannot be queried directly
+	EnvDrvCfgPath = "X_CSI_SCALEIO_DRVCFG_PATH"
+
 	// EnvThick is the name of the enviroment variable used to specify
 	// that thick provisioning should be used when creating volumes
 	EnvThick = "X_CSI_SCALEIO_THICKPROVISIONING"
@@ -36,4 +42,279 @@ const (
 	// receives incoming requests before having been probed, in direct
 	// violation of the CSI spec
 	EnvAutoProbe = "X_CSI_SCALEIO_AUTOPROBE"
+
+	// EnvMaxVolumesPerNode is the name of the environment variable used to
+	// set the maximum number of volumes that may be mapped to a single SDC.
+	// A value of 0 means no limit is enforced
+	EnvMaxVolumesPerNode = "X_CSI_SCALEIO_MAX_VOLUMES_PER_NODE"
+
+	// EnvCleanupOnStart is the name of the environment variable used to
+	// specify whether the node service should unmount stale private mounts,
+	// left behind by volumes no longer mapped to the SDC, when it starts
+	EnvCleanupOnStart = "X_CSI_SCALEIO_CLEANUP_ON_START"
+
+	// EnvFSCheck is the name of the environment variable used to specify
+	// whether the node service should check a volume's filesystem for
+	// corruption before mounting it
+	EnvFSCheck = "X_CSI_SCALEIO_FSCK"
+
+	// EnvXFSNoUUID is the name of the environment variable used to specify
+	// whether xfs filesystems are mounted with the nouuid option, so that
+	// clones sharing their parent's filesystem UUID can be mounted
+	EnvXFSNoUUID = "X_CSI_SCALEIO_XFS_NOUUID"
+
+	// EnvSockPerms is the name of the environment variable used to set the
+	// permissions, in octal, of the unix socket the plug-in listens on
+	EnvSockPerms = "X_CSI_SCALEIO_SOCK_PERMS"
+
+	// EnvSockOwner is the name of the environment variable used to set the
+	// owner, as user[:group], of the unix socket the plug-in listens on
+	EnvSockOwner = "X_CSI_SCALEIO_SOCK_OWNER"
+
+	// EnvSockStrict is the name of the environment variable used to specify
+	// that failing to apply the socket permissions or owner is fatal
+	EnvSockStrict = "X_CSI_SCALEIO_SOCK_STRICT"
+
+	// EnvMetricsAddr is the name of the environment variable used to set
+	// the address on which Prometheus metrics are served. Metrics are not
+	// collected if it is not set
+	EnvMetricsAddr = "X_CSI_SCALEIO_METRICS_ADDR"
+
+	// EnvHealthAddr is the name of the environment variable used to set
+	// the address on which the HTTP liveness and readiness endpoints are
+	// served
+	EnvHealthAddr = "X_CSI_SCALEIO_HEALTH_ADDR"
+
+	// EnvProbeCacheTTL is the name of the environment variable used to set
+	// how long Probe reuses the result of a successful probe, rather than
+	// probing, and contacting the gateway, again
+	EnvProbeCacheTTL = "X_CSI_SCALEIO_PROBE_CACHE_TTL"
+
+	// EnvLogFormat is the name of the environment variable used to set the
+	// format of the log output, either text or json
+	EnvLogFormat = "X_CSI_SCALEIO_LOG_FORMAT"
+
+	// EnvLogLevel is the name of the environment variable used to set the
+	// level of the log output, one of error, warn, info, debug or trace.
+	// It takes precedence over EnvDebug
+	EnvLogLevel = "X_CSI_SCALEIO_LOG_LEVEL"
+
+	// EnvDebug is the name of the environment variable used to specify
+	// whether debug output, including each request and response, is logged
+	EnvDebug = "X_CSI_SCALEIO_DEBUG"
+
+	// EnvRPCTimeouts is the name of the environment variable used to set
+	// the deadlines applied to RPCs that arrive without one, as a comma
+	// separated list of Method=duration pairs
+	EnvRPCTimeouts = "X_CSI_SCALEIO_RPC_TIMEOUTS"
+
+	// EnvPrivateMountDir is the name of the environment variable used to
+	// set the directory in which volumes are privately mounted on the node
+	EnvPrivateMountDir = "X_CSI_PRIVATE_MOUNT_DIR"
+
+	// EnvConfigFile is the name of the environment variable used to set
+	// the path to a JSON or YAML configuration file. Environment variables
+	// take precedence over the values in the file
+	EnvConfigFile = "X_CSI_SCALEIO_CONFIG_FILE"
+
+	// EnvShutdownTimeout is the name of the environment variable used to
+	// set how long a graceful stop waits for in-flight requests to finish
+	// before they are abandoned
+	EnvShutdownTimeout = "X_CSI_SCALEIO_SHUTDOWN_TIMEOUT"
+
+	// EnvOrphanScanInterval is the name of the environment variable used
+	// to set how often the controller looks for volumes mapped to SDCs
+	// that no longer exist. Scans are disabled if it is not set
+	EnvOrphanScanInterval = "X_CSI_SCALEIO_ORPHAN_SCAN_INTERVAL"
+
+	// EnvOrphanCleanup is the name of the environment variable used to
+	// specify whether volumes found mapped to SDCs that no longer exist
+	// are unmapped from them
+	EnvOrphanCleanup = "X_CSI_SCALEIO_ORPHAN_CLEANUP"
+
+	// EnvCleanupDisconnected is the name of the environment variable used
+	// to specify whether DeleteVolume unmaps a volume mapped only to SDCs
+	// that are disconnected from the system, rather than failing
+	EnvCleanupDisconnected = "X_CSI_SCALEIO_CLEANUP_DISCONNECTED"
+
+	// EnvKeepaliveInterval is the name of the environment variable used to
+	// set how often the controller pings the gateway to keep its session
+	// alive. The gateway is not pinged if it is not set or is 0
+	EnvKeepaliveInterval = "X_CSI_SCALEIO_KEEPALIVE_INTERVAL"
+
+	// EnvPrefetch is the name of the environment variable used to specify
+	// whether the controller fills its caches of storage pools and SDC IDs
+	// in the background once first probed
+	EnvPrefetch = "X_CSI_SCALEIO_PREFETCH"
+
+	// EnvGatewayDebug is the name of the environment variable used to
+	// specify whether each call made to the ScaleIO Gateway is logged,
+	// with its duration and outcome
+	EnvGatewayDebug = "X_CSI_SCALEIO_GATEWAY_DEBUG"
+
+	// EnvAuditLog is the name of the environment variable used to set the
+	// file to which the controller records the volumes it creates,
+	// deletes, maps and unmaps, one JSON line each, or stdout to write
+	// them there. Operations are not recorded if it is not set
+	EnvAuditLog = "X_CSI_SCALEIO_AUDIT_LOG"
+
+	// EnvAuditLogMaxSize is the name of the environment variable used to
+	// set the size, in bytes, at which the audit log file is moved aside
+	// to a file of the same name ending in .1, replacing any earlier one.
+	// The file is not rotated if it is not set or is 0
+	EnvAuditLogMaxSize = "X_CSI_SCALEIO_AUDIT_LOG_MAX_SIZE"
+
+	// EnvUnmapSettleTimeout is the name of the environment variable used
+	// to set how long DeleteVolume waits for the gateway to stop reporting
+	// the mappings of a volume that was just unpublished
+	EnvUnmapSettleTimeout = "X_CSI_SCALEIO_UNMAP_SETTLE_TIMEOUT"
+
+	// EnvMappingCacheTTL is the name of the environment variable used to
+	// set how long ControllerUnpublishVolume trusts, without reading the
+	// volume again, that a volume just read, mapped or unmapped is not
+	// mapped to the node. 0 always reads the volume
+	EnvMappingCacheTTL = "X_CSI_SCALEIO_MAPPING_CACHE_TTL"
+
+	// EnvStrictParams is the name of the environment variable used to
+	// specify whether CreateVolume rejects parameters it doesn't accept,
+	// rather than logging a warning for each
+	EnvStrictParams = "X_CSI_SCALEIO_STRICT_PARAMS"
+
+	// EnvPoolReservedPercentage is the name of the environment variable
+	// used to set the percentage of the raw capacity of each storage pool
+	// that CreateVolume refuses to consume. No capacity is reserved if it
+	// is not set or is 0
+	EnvPoolReservedPercentage = "X_CSI_SCALEIO_POOL_RESERVED_PERCENTAGE"
+
+	// EnvThickFallback is the name of the environment variable used to
+	// specify whether CreateVolume creates a thin volume when a thick one
+	// is requested in a storage pool without the capacity to allocate it,
+	// rather than failing
+	EnvThickFallback = "X_CSI_SCALEIO_THICK_FALLBACK"
+
+	// EnvStatsAddr is the name of the environment variable used to set
+	// the address on which the controller serves the gateway's statistics
+	// of each volume, by CSI volume ID. They are not served if it is not
+	// set
+	EnvStatsAddr = "X_CSI_SCALEIO_STATS_ADDR"
+
+	// EnvStatsToken is the name of the environment variable used to set
+	// the bearer token callers of the volume statistics endpoint must
+	// present, which is required to serve it
+	EnvStatsToken = "X_CSI_SCALEIO_STATS_TOKEN"
+
+	// EnvSnapshotGroups is the name of the environment variable used to
+	// specify whether the controller also takes snapshot groups, the
+	// snapshots of several volumes at the same point in time, on the
+	// volume statistics address, which it then requires
+	EnvSnapshotGroups = "X_CSI_SCALEIO_SNAPSHOT_GROUPS"
+
+	// EnvDefaultVolumeSizeGiB is the name of the environment variable used
+	// to set the size, in GiB, of volumes created without a required size.
+	// It must be a multiple of VolSizeMultipleGiB
+	EnvDefaultVolumeSizeGiB = "X_CSI_SCALEIO_DEFAULT_VOLUME_SIZE_GIB"
+
+	// EnvEnforceOwnership is the name of the environment variable used to
+	// specify whether the volumes the plug-in creates or imports are
+	// marked as its own, and DeleteVolume refuses volumes without the mark
+	EnvEnforceOwnership = "X_CSI_SCALEIO_ENFORCE_OWNERSHIP"
+
+	// EnvListOwnedOnly is the name of the environment variable used to
+	// specify whether ListVolumes leaves out the volumes not marked as the
+	// plug-in's own
+	EnvListOwnedOnly = "X_CSI_SCALEIO_LIST_OWNED_ONLY"
+
+	// EnvListExcludeIncomplete is the name of the environment variable
+	// used to specify whether ListVolumes leaves out the volumes the
+	// gateway reports without their size or storage pool, as it does
+	// volumes being deleted or in error, rather than flagging them
+	EnvListExcludeIncomplete = "X_CSI_SCALEIO_LIST_EXCLUDE_INCOMPLETE"
+
+	// EnvNodeIDFallback is the name of the environment variable used to
+	// set the node ID the node service reports when the SDC GUID can't be
+	// determined: "ip" for the node's IP address, or "hostname" for its
+	// host name, which must be the SDC's name
+	EnvNodeIDFallback = "X_CSI_SCALEIO_NODE_ID_FALLBACK"
+
+	// EnvNodeIDSdcID is the name of the environment variable used to
+	// specify whether the node ID carries the SDC ID along with the SDC
+	// GUID, when the node service can resolve it
+	EnvNodeIDSdcID = "X_CSI_SCALEIO_NODE_ID_SDC_ID"
+
+	// EnvSlowOperationThreshold is the name of the environment variable
+	// used to set how long an RPC runs before a warning is logged with its
+	// method and volume. No warning is logged if it is 0
+	EnvSlowOperationThreshold = "X_CSI_SCALEIO_SLOW_OPERATION_THRESHOLD"
+
+	// EnvDebugOperations is the name of the environment variable used to
+	// specify whether the RPCs in flight are listed, as JSON, at
+	// /debug/operations on the metrics address
+	EnvDebugOperations = "X_CSI_SCALEIO_DEBUG_OPERATIONS"
+
+	// EnvDebugConfig is the name of the environment variable used to
+	// specify whether the configuration, with secrets masked, is served as
+	// JSON at /debug/config on the metrics address
+	EnvDebugConfig = "X_CSI_SCALEIO_DEBUG_CONFIG"
+
+	// EnvUnpublishCheck is the name of the environment variable used to
+	// specify whether ControllerUnpublishVolume delays unmapping a volume
+	// the gateway reports writes to, as the node may still be unmounting it
+	EnvUnpublishCheck = "X_CSI_SCALEIO_UNPUBLISH_CHECK"
+
+	// EnvUnpublishCheckTimeout is the name of the environment variable
+	// used to set how long ControllerUnpublishVolume delays unmapping a
+	// volume that is still written to before unmapping it anyway
+	EnvUnpublishCheckTimeout = "X_CSI_SCALEIO_UNPUBLISH_CHECK_TIMEOUT"
+
+	// EnvAllowValidateOnly is the name of the environment variable used to
+	// specify whether CreateVolume accepts the validateOnly parameter,
+	// which checks the other parameters without creating a volume
+	EnvAllowValidateOnly = "X_CSI_SCALEIO_ALLOW_VALIDATE_ONLY"
+
+	// EnvTraceAddr is the name of the environment variable used to set
+	// the address on which traces of the RPCs, and of the gateway calls
+	// they make, are served at /debug/requests. RPCs are not traced if it
+	// is not set
+	EnvTraceAddr = "X_CSI_SCALEIO_TRACE_ADDR"
+
+	// EnvProfiles is the name of the environment variable used to set the
+	// path of a file of named CreateVolume parameter profiles, which
+	// requests select with the profile parameter
+	EnvProfiles = "X_CSI_SCALEIO_PROFILES"
+
+	// EnvSkipPrivilegeCheck is the name of the environment variable used
+	// to specify whether the controller probe skips checking that the
+	// ScaleIO user has the privileges to manage volumes
+	EnvSkipPrivilegeCheck = "X_CSI_SCALEIO_SKIP_PRIVILEGE_CHECK"
+
+	// EnvSDCRoot is the name of the environment variable used to set the
+	// path at which the host's root filesystem is mounted, so that the
+	// Node Service finds the devices of the volumes mapped to a
+	// containerized SDC under it
+	EnvSDCRoot = "X_CSI_SCALEIO_SDC_ROOT"
+
+	// EnvPoolProvisioning is the name of the environment variable used to
+	// set the provisioning type, thick or thin, of volumes created in each
+	// storage pool, as a comma separated list of pool:type pairs
+	EnvPoolProvisioning = "X_CSI_SCALEIO_POOL_PROVISIONING"
+
+	// EnvStoragePool is the name of the environment variable used to set
+	// the storage pool volumes are created in when their parameters name
+	// none
+	EnvStoragePool = "X_CSI_SCALEIO_STORAGE_POOL"
+
+	// EnvAllowedPools is the name of the environment variable used to set
+	// the storage pools volumes may be created in, as a comma separated
+	// list of pools, each optionally qualified by its protection domain as
+	// domain/pool. Every pool is allowed if it is not set or is empty
+	EnvAllowedPools = "X_CSI_SCALEIO_ALLOWED_POOLS"
+
+	// EnvDeleteRetention is the name of the environment variable used to
+	// set how long deleted volumes are retained, renamed to a tombstone,
+	// before they are removed
+	EnvDeleteRetention = "X_CSI_SCALEIO_DELETE_RETENTION"
+
+	// EnvAllowHTTP is the name of the environment variable used to allow
+	// gateway endpoints that use http rather than https
+	EnvAllowHTTP = "X_CSI_SCALEIO_ALLOW_HTTP"
 )
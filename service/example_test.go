@@ -0,0 +1,59 @@
+package service_test
+
+import (
+	"context"
+	"fmt"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+
+	"github.com/thecodeteam/csi-scaleio/service"
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+// The controller service is embedded by calling its handlers directly,
+// here against a fake ScaleIO Gateway with a storage pool named "pool".
+func ExampleNewWithOpts() {
+	ctx := context.Background()
+
+	admin := testutil.NewFakeAdmin("sys")
+	admin.AddStoragePool("pool", 100*1024*1024)
+	gw := testutil.NewFakeGateway(admin, "admin", "password")
+	defer gw.Close()
+
+	svc, err := service.NewWithOpts(ctx, service.Opts{
+		Endpoint:   gw.Endpoint(),
+		User:       "admin",
+		Password:   "password",
+		SystemName: "sys",
+	}, nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer svc.Shutdown(ctx)
+
+	cr, err := svc.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 8 << 30},
+		Parameters:    map[string]string{service.KeyStoragePool: "pool"},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("created %d GiB volume in %s\n", cr.Volume.CapacityBytes>>30,
+		cr.Volume.Attributes[service.KeyStoragePoolName])
+
+	_, err = svc.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: cr.Volume.Id,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println("deleted volume")
+
+	// Output:
+	// created 8 GiB volume in pool
+	// deleted volume
+}
@@ -0,0 +1,469 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// endpointCooldown is how long a gateway that could not be reached is
+// tried only after the others, so that requests don't flap between
+// gateways that are each intermittently reachable
+var endpointCooldown = time.Minute
+
+// splitEndpoints returns the endpoints of the comma separated list v
+func splitEndpoints(v string) []string {
+	var endpoints []string
+	for _, ep := range strings.Split(v, ",") {
+		if ep = strings.TrimSpace(ep); ep != "" {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	return endpoints
+}
+
+// gatewayEndpoints are the gateways of a ScaleIO system, one of which is
+// active, shared by the failoverAdmins bound to each request
+type gatewayEndpoints struct {
+	sync.Mutex
+	endpoints []string
+	insecure  bool
+	metrics   *metrics
+
+	// newAdmin returns a client of the gateway at endpoint
+	newAdmin func(endpoint string, insecure bool) (ScaleIOAdmin, error)
+
+	// active is the endpoint requests are made to first, the last that
+	// was reached
+	active string
+
+	// admins are the clients of each endpoint, created when first used
+	admins map[string]ScaleIOAdmin
+
+	// down is when each endpoint was last found unreachable
+	down map[string]time.Time
+
+	// configConnect is what clients of endpoints other than the active
+	// one log in with, once the active one has
+	configConnect *sio.ConfigConnect
+}
+
+// failoverAdmin implements ScaleIOAdmin across several gateways. Calls are
+// made to the active gateway, and, if it can't be reached, to the others in
+// the order they were configured, logging in to each when first used. The
+// first reached becomes the active gateway.
+//
+// A call that changes the system may be repeated on another gateway if the
+// connection is lost after the first received it, as when retried by the
+// CO. CreateVolume returns the volume of the same name in that case.
+type failoverAdmin struct {
+	*gatewayEndpoints
+
+	// ctx is the context of the request calls are made for
+	ctx context.Context
+}
+
+// newFailoverAdmin returns a ScaleIOAdmin for the gateways at endpoints,
+// which are tried in order
+func newFailoverAdmin(
+	endpoints []string, insecure bool, m *metrics) *failoverAdmin {
+
+	a := &failoverAdmin{
+		gatewayEndpoints: &gatewayEndpoints{
+			endpoints: endpoints,
+			insecure:  insecure,
+			metrics:   m,
+			newAdmin:  newSIOAdmin,
+			active:    endpoints[0],
+			admins:    map[string]ScaleIOAdmin{},
+			down:      map[string]time.Time{},
+		},
+		ctx: context.Background(),
+	}
+	m.gatewayEndpoint(endpoints, a.active, false)
+	return a
+}
+
+func (a *failoverAdmin) withContext(ctx context.Context) ScaleIOAdmin {
+	return &failoverAdmin{gatewayEndpoints: a.gatewayEndpoints, ctx: ctx}
+}
+
+// activeEndpoint returns the endpoint requests are made to first
+func (g *gatewayEndpoints) activeEndpoint() string {
+	g.Lock()
+	defer g.Unlock()
+	return g.active
+}
+
+// order returns the endpoints in the order they are tried: the active one,
+// then the others, in the order configured after it, with those found
+// unreachable within endpointCooldown last
+func (g *gatewayEndpoints) order() []string {
+	g.Lock()
+	defer g.Unlock()
+
+	start := 0
+	for i, ep := range g.endpoints {
+		if ep == g.active {
+			start = i
+		}
+	}
+	var up, down []string
+	for i := range g.endpoints {
+		ep := g.endpoints[(start+i)%len(g.endpoints)]
+		if t, ok := g.down[ep]; ok && time.Since(t) < endpointCooldown {
+			down = append(down, ep)
+		} else {
+			up = append(up, ep)
+		}
+	}
+	return append(up, down...)
+}
+
+// admin returns the client of endpoint, creating it and logging in, if
+// the active endpoint has, the first time
+func (g *gatewayEndpoints) admin(endpoint string) (ScaleIOAdmin, error) {
+	g.Lock()
+	admin, ok := g.admins[endpoint]
+	cc := g.configConnect
+	g.Unlock()
+	if ok {
+		return admin, nil
+	}
+
+	admin, err := g.newAdmin(endpoint, g.insecure)
+	if err != nil {
+		return nil, err
+	}
+	if cc != nil {
+		c := *cc
+		c.Endpoint = endpoint
+		g.metrics.gatewayAuth()
+		if _, err := admin.Authenticate(&c); err != nil {
+			return nil, err
+		}
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if a, ok := g.admins[endpoint]; ok {
+		return a, nil
+	}
+	g.admins[endpoint] = admin
+	return admin, nil
+}
+
+// reached records that endpoint was reached, making it the active one
+func (g *gatewayEndpoints) reached(endpoint string) {
+	g.Lock()
+	defer g.Unlock()
+	if endpoint == g.active {
+		return
+	}
+	log.WithFields(log.Fields{
+		"from": g.active,
+		"to":   endpoint,
+	}).Warn("failed over to another ScaleIO Gateway")
+	g.active = endpoint
+	g.metrics.gatewayEndpoint(g.endpoints, endpoint, true)
+}
+
+// unreachable records that endpoint could not be reached
+func (g *gatewayEndpoints) unreachable(endpoint string, err error) {
+	g.Lock()
+	defer g.Unlock()
+	log.WithError(err).WithField("endpoint", endpoint).Warn(
+		"unable to reach ScaleIO Gateway")
+	g.down[endpoint] = time.Now()
+}
+
+// do calls f with the client of each endpoint, in order, until one can be
+// reached, returning its error
+func (a *failoverAdmin) do(f func(endpoint string, c ScaleIOAdmin) error) error {
+	var err error
+	for i, ep := range a.order() {
+		if i > 0 && a.ctx.Err() != nil {
+			break
+		}
+		c, aerr := a.admin(ep)
+		if aerr == nil {
+			err = f(ep, adminContext(a.ctx, c))
+		} else {
+			err = aerr
+		}
+		if err == nil || !gatewayUnreachable(err) {
+			if aerr == nil {
+				a.reached(ep)
+			}
+			return err
+		}
+		a.unreachable(ep, err)
+	}
+	return err
+}
+
+func (a *failoverAdmin) Authenticate(
+	configConnect *sio.ConfigConnect) (cl sio.Cluster, err error) {
+
+	err = a.do(func(ep string, c ScaleIOAdmin) error {
+		cc := *configConnect
+		cc.Endpoint = ep
+		cl, err = c.Authenticate(&cc)
+		return err
+	})
+	if err == nil {
+		a.Lock()
+		a.configConnect = configConnect
+		a.Unlock()
+	}
+	return cl, err
+}
+
+// GetToken returns the token of the session with the active gateway
+func (a *failoverAdmin) GetToken() string {
+	a.Lock()
+	c, ok := a.admins[a.active]
+	a.Unlock()
+	if !ok {
+		return ""
+	}
+	return c.GetToken()
+}
+
+func (a *failoverAdmin) GetVersion() (v string, err error) {
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		v, err = c.GetVersion()
+		return err
+	})
+	return v, err
+}
+
+func (a *failoverAdmin) FindSystem(
+	instanceID, name, href string) (sys *siotypes.System, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		sys, err = c.FindSystem(instanceID, name, href)
+		return err
+	})
+	return sys, err
+}
+
+func (a *failoverAdmin) GetSystemStatistics(
+	system *siotypes.System) (stats *siotypes.Statistics, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		stats, err = c.GetSystemStatistics(system)
+		return err
+	})
+	return stats, err
+}
+
+func (a *failoverAdmin) FindSdc(
+	system *siotypes.System, field, value string) (
+	sdc *siotypes.Sdc, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		sdc, err = c.FindSdc(system, field, value)
+		return err
+	})
+	return sdc, err
+}
+
+func (a *failoverAdmin) GetSdcs(
+	system *siotypes.System) (sdcs []siotypes.Sdc, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		sdcs, err = c.GetSdcs(system)
+		return err
+	})
+	return sdcs, err
+}
+
+func (a *failoverAdmin) GetSdcVolumes(
+	sdcID string) (vols []*siotypes.Volume, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		vols, err = c.GetSdcVolumes(sdcID)
+		return err
+	})
+	return vols, err
+}
+
+func (a *failoverAdmin) CreateVolume(
+	volume *siotypes.VolumeParam,
+	storagePoolName string) (resp *siotypes.VolumeResp, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		resp, err = c.CreateVolume(volume, storagePoolName)
+		return err
+	})
+	return resp, err
+}
+
+func (a *failoverAdmin) GetVolume(
+	volumehref, volumeid, ancestorvolumeid, volumename string,
+	getSnapshots bool) (vols []*siotypes.Volume, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		vols, err = c.GetVolume(volumehref, volumeid, ancestorvolumeid,
+			volumename, getSnapshots)
+		return err
+	})
+	return vols, err
+}
+
+func (a *failoverAdmin) FindVolumeID(volumename string) (id string, err error) {
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		id, err = c.FindVolumeID(volumename)
+		return err
+	})
+	return id, err
+}
+
+func (a *failoverAdmin) RemoveVolume(
+	volume *siotypes.Volume, removeMode string) error {
+
+	return a.do(func(_ string, c ScaleIOAdmin) error {
+		return c.RemoveVolume(volume, removeMode)
+	})
+}
+
+func (a *failoverAdmin) MapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.MapVolumeSdcParam) error {
+
+	return a.do(func(_ string, c ScaleIOAdmin) error {
+		return c.MapVolumeSdc(volume, param)
+	})
+}
+
+func (a *failoverAdmin) UnmapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.UnmapVolumeSdcParam) error {
+
+	return a.do(func(_ string, c ScaleIOAdmin) error {
+		return c.UnmapVolumeSdc(volume, param)
+	})
+}
+
+func (a *failoverAdmin) SetMappedSdcLimits(
+	volume *siotypes.Volume,
+	param *siotypes.SetMappedSdcLimitsParam) error {
+
+	return a.do(func(_ string, c ScaleIOAdmin) error {
+		return c.SetMappedSdcLimits(volume, param)
+	})
+}
+
+func (a *failoverAdmin) SetVolumeName(
+	volume *siotypes.Volume, newName string) error {
+
+	return a.do(func(_ string, c ScaleIOAdmin) error {
+		return c.SetVolumeName(volume, newName)
+	})
+}
+
+func (a *failoverAdmin) SetVolumeUseRmcache(
+	volume *siotypes.Volume, useRmcache bool) error {
+
+	return a.do(func(_ string, c ScaleIOAdmin) error {
+		return c.SetVolumeUseRmcache(volume, useRmcache)
+	})
+}
+
+func (a *failoverAdmin) FindStoragePool(
+	id, name, href string) (pool *siotypes.StoragePool, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		pool, err = c.FindStoragePool(id, name, href)
+		return err
+	})
+	return pool, err
+}
+
+func (a *failoverAdmin) SnapshotVolumes(
+	system *siotypes.System,
+	param *siotypes.SnapshotVolumesParam) (
+	resp *siotypes.SnapshotVolumesResp, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		resp, err = c.SnapshotVolumes(system, param)
+		return err
+	})
+	return resp, err
+}
+
+func (a *failoverAdmin) GetProtectionDomain(
+	id string) (pd *siotypes.ProtectionDomain, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		pd, err = c.GetProtectionDomain(id)
+		return err
+	})
+	return pd, err
+}
+
+func (a *failoverAdmin) GetStoragePools() (
+	pools []*siotypes.StoragePool, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		pools, err = c.GetStoragePools()
+		return err
+	})
+	return pools, err
+}
+
+func (a *failoverAdmin) GetStoragePoolVolumes(
+	pool *siotypes.StoragePool) (vols []*siotypes.Volume, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		vols, err = c.GetStoragePoolVolumes(pool)
+		return err
+	})
+	return vols, err
+}
+
+func (a *failoverAdmin) GetStoragePoolStatistics(
+	pool *siotypes.StoragePool) (stats *siotypes.Statistics, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		stats, err = c.GetStoragePoolStatistics(pool)
+		return err
+	})
+	return stats, err
+}
+
+func (a *failoverAdmin) GetVolumeWriteBwc(
+	volume *siotypes.Volume) (bwc *siotypes.BWC, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		bwc, err = c.GetVolumeWriteBwc(volume)
+		return err
+	})
+	return bwc, err
+}
+
+func (a *failoverAdmin) GetVolumeBwcs(
+	volume *siotypes.Volume) (bwcs map[string]siotypes.BWC, err error) {
+
+	err = a.do(func(_ string, c ScaleIOAdmin) error {
+		bwcs, err = c.GetVolumeBwcs(volume)
+		return err
+	})
+	return bwcs, err
+}
+
+// gatewayEndpoint returns the endpoint of the gateway requests are made
+// to, the active one if several are configured
+func (s *service) gatewayEndpoint() string {
+	s.probeMu.Lock()
+	gateways := s.gateways
+	s.probeMu.Unlock()
+	if gateways != nil {
+		return gateways.activeEndpoint()
+	}
+	return s.opts.Endpoint
+}
@@ -0,0 +1,84 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	sio "github.com/thecodeteam/goscaleio"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+func TestSplitEndpoints(t *testing.T) {
+	assert.Nil(t, splitEndpoints(""))
+	assert.Equal(t, []string{"https://gw1/api"},
+		splitEndpoints("https://gw1/api"))
+	assert.Equal(t, []string{"https://gw1/api", "https://gw2/api"},
+		splitEndpoints(" https://gw1/api, ,https://gw2/api,"))
+}
+
+func TestFailoverAdmin(t *testing.T) {
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+	gw1 := testutil.NewFakeGateway(fake, "admin", "password")
+	gw2 := testutil.NewFakeGateway(fake, "admin", "password")
+	defer gw2.Close()
+
+	m := newMetrics()
+	a := newFailoverAdmin(
+		[]string{gw1.Endpoint(), gw2.Endpoint()}, true, m)
+	_, err := a.Authenticate(&sio.ConfigConnect{
+		Endpoint: gw1.Endpoint(),
+		Username: "admin",
+		Password: "password",
+	})
+	assert.NoError(t, err)
+	_, err = a.FindSystem("", "sys", "")
+	assert.NoError(t, err)
+	assert.Equal(t, gw1.Endpoint(), a.activeEndpoint())
+	assert.Equal(t, 1, gw1.Logins())
+	assert.Equal(t, 0, gw2.Logins())
+
+	// the second gateway is logged in to once the first is down, and
+	// used from then on
+	gw1.Close()
+	pools, err := a.withContext(context.Background()).GetStoragePools()
+	assert.NoError(t, err)
+	assert.Len(t, pools, 1)
+	assert.Equal(t, gw2.Endpoint(), a.activeEndpoint())
+	assert.Equal(t, 1, gw2.Logins())
+	assert.NotEmpty(t, a.GetToken())
+
+	_, err = a.GetStoragePools()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, gw2.Logins())
+
+	var buf bytes.Buffer
+	m.write(&buf)
+	assert.Contains(t, buf.String(), fmt.Sprintf(
+		"csi_scaleio_gateway_endpoint_active{endpoint=%q} 0", gw1.Endpoint()))
+	assert.Contains(t, buf.String(), fmt.Sprintf(
+		"csi_scaleio_gateway_endpoint_active{endpoint=%q} 1", gw2.Endpoint()))
+	assert.Contains(t, buf.String(), "csi_scaleio_gateway_failovers_total 1")
+}
+
+func TestFailoverOrder(t *testing.T) {
+	defer func(d time.Duration) { endpointCooldown = d }(endpointCooldown)
+
+	a := newFailoverAdmin([]string{"gw1", "gw2", "gw3"}, true, newMetrics())
+	assert.Equal(t, []string{"gw1", "gw2", "gw3"}, a.order())
+
+	// the others are tried in the order configured after the active one
+	a.active = "gw2"
+	assert.Equal(t, []string{"gw2", "gw3", "gw1"}, a.order())
+
+	// unreachable gateways are tried last, until they cool down
+	a.down["gw3"] = time.Now()
+	assert.Equal(t, []string{"gw2", "gw1", "gw3"}, a.order())
+	endpointCooldown = 0
+	assert.Equal(t, []string{"gw2", "gw3", "gw1"}, a.order())
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"sync"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/protobuf/proto"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// createFlights lets CreateVolume requests for a volume name that arrive
+// while one for the name is already in flight, as sent when the CO's
+// provisioner fails over, wait for it rather than each creating the volume.
+// Only requests equal to the one in flight share its result. The others,
+// such as a retry with rotated secrets, run once it is done, one at a
+// time, so that they find the volume created and are checked against it.
+type createFlights struct {
+	sync.Mutex
+	calls map[string]*createCall
+}
+
+// createCall is a CreateVolume request in flight, whose result is set
+// before done is closed
+type createCall struct {
+	req  *csi.CreateVolumeRequest
+	done chan struct{}
+	resp *csi.CreateVolumeResponse
+	err  error
+
+	// waiters is the number of requests for the name waiting on this one,
+	// guarded by the createFlights lock
+	waiters int
+}
+
+// do returns the result of create for req, once no other request with the
+// same key is in flight, or the result of one that is if it is equal to
+// req. A request that was canceled or timed out doesn't decide the result
+// of those waiting on it, which try again.
+func (f *createFlights) do(
+	ctx context.Context,
+	key string,
+	req *csi.CreateVolumeRequest,
+	create func() (*csi.CreateVolumeResponse, error)) (
+	*csi.CreateVolumeResponse, error) {
+
+	for {
+		f.Lock()
+		if c, ok := f.calls[key]; ok {
+			c.waiters++
+			waiters := c.waiters
+			f.Unlock()
+			reqLog(ctx, "").WithField("waiters", waiters).Debug(
+				"waiting for CreateVolume of the same name")
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return nil, canceledErr(ctx, "waiting for request of the same name")
+			}
+			if proto.Equal(c.req, req) && !isCanceledErr(c.err) {
+				return c.resp, c.err
+			}
+			continue
+		}
+
+		c := &createCall{req: req, done: make(chan struct{})}
+		if f.calls == nil {
+			f.calls = map[string]*createCall{}
+		}
+		f.calls[key] = c
+		f.Unlock()
+
+		c.resp, c.err = create()
+
+		f.Lock()
+		delete(f.calls, key)
+		f.Unlock()
+		close(c.done)
+		return c.resp, c.err
+	}
+}
+
+// isCanceledErr returns whether err is a request being canceled or timing
+// out
+func isCanceledErr(err error) bool {
+	st, ok := status.FromError(err)
+	return ok && (st.Code() == codes.Canceled ||
+		st.Code() == codes.DeadlineExceeded)
+}
+
+// systemFlight lets requests that need the system while it is being looked
+// up, by a probe or after it was found stale, wait for that lookup rather
+// than each making it. No lock is held across the calls to the gateway, so
+// requests that only read the system aren't held up by a slow one.
+type systemFlight struct {
+	sync.Mutex
+	call *systemCall
+}
+
+// systemCall is a lookup of the system in flight, whose result is set
+// before done is closed
+type systemCall struct {
+	done   chan struct{}
+	system *siotypes.System
+	err    error
+}
+
+// do returns the result of find, or, if a lookup is in flight, of that
+// lookup. As for createFlights, a lookup that was canceled or timed out
+// doesn't decide the result of those waiting on it.
+func (f *systemFlight) do(
+	ctx context.Context,
+	find func() (*siotypes.System, error)) (*siotypes.System, error) {
+
+	for {
+		f.Lock()
+		if c := f.call; c != nil {
+			f.Unlock()
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				return nil, canceledErr(ctx, "waiting for the ScaleIO system")
+			}
+			if !isCanceledErr(c.err) {
+				return c.system, c.err
+			}
+			continue
+		}
+
+		c := &systemCall{done: make(chan struct{})}
+		f.call = c
+		f.Unlock()
+
+		c.system, c.err = find()
+
+		f.Lock()
+		f.call = nil
+		f.Unlock()
+		close(c.done)
+		return c.system, c.err
+	}
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+// gatedAdmin is a FakeAdmin whose volume creates wait for release
+type gatedAdmin struct {
+	*testutil.FakeAdmin
+	release chan struct{}
+}
+
+func (a *gatedAdmin) CreateVolume(
+	volume *siotypes.VolumeParam,
+	storagePoolName string) (*siotypes.VolumeResp, error) {
+
+	<-a.release
+	return a.FakeAdmin.CreateVolume(volume, storagePoolName)
+}
+
+// waitForWaiters waits until n requests are waiting on the request in
+// flight with key
+func waitForWaiters(t *testing.T, f *createFlights, key string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		f.Lock()
+		c, ok := f.calls[key]
+		waiting := ok && c.waiters == n
+		f.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d requests never waited", n)
+}
+
+func TestConcurrentCreateVolume(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	gated := &gatedAdmin{FakeAdmin: fake, release: make(chan struct{})}
+	s.adminClient = gated
+
+	req := &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 8 * bytesInGiB},
+		Parameters:    map[string]string{KeyStoragePool: "pool"},
+	}
+
+	// requests for the same name that differ, as after the provisioner
+	// restarts with rotated secrets, or asks for another size, wait too,
+	// then are checked against the volume created
+	rotated := *req
+	rotated.ControllerCreateSecrets = map[string]string{"token": "rotated"}
+	resized := *req
+	resized.CapacityRange = &csi.CapacityRange{RequiredBytes: 16 * bytesInGiB}
+
+	const n = 10
+	var wg sync.WaitGroup
+	resps := make([]*csi.CreateVolumeResponse, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			resps[i], err = s.CreateVolume(ctx, req)
+			assert.NoError(t, err)
+		}(i)
+	}
+	key := s.volumeName(req.Name)
+	waitForWaiters(t, &s.creates, key, n-1)
+	var (
+		rotatedResp *csi.CreateVolumeResponse
+		rotatedErr  error
+		resizedErr  error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		rotatedResp, rotatedErr = s.CreateVolume(ctx, &rotated)
+	}()
+	go func() {
+		defer wg.Done()
+		_, resizedErr = s.CreateVolume(ctx, &resized)
+	}()
+	waitForWaiters(t, &s.creates, key, n+1)
+	close(gated.release)
+	wg.Wait()
+
+	// only the differing requests reach the gateway again
+	assert.Equal(t, 3, fake.Calls["CreateVolume"])
+	assert.Len(t, fake.Volumes, 1)
+	for _, resp := range resps {
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, resps[0].GetVolume(), resp.GetVolume())
+		}
+	}
+	assert.NoError(t, rotatedErr)
+	assert.Equal(t, resps[0].GetVolume().GetId(),
+		rotatedResp.GetVolume().GetId())
+	st, _ := status.FromError(resizedErr)
+	assert.Equal(t, codes.AlreadyExists, st.Code())
+	assert.Empty(t, s.creates.calls)
+
+	// a name conflict, as when another controller created the volume,
+	// returns the existing volume
+	fake.Calls["CreateVolume"] = 0
+	resp, err := s.CreateVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, resps[0].GetVolume().GetId(), resp.GetVolume().GetId())
+	assert.Equal(t, 1, fake.Calls["CreateVolume"])
+}
+
+func TestCreateFlightsCanceled(t *testing.T) {
+	var f createFlights
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	// the request in flight is canceled, so the waiting one creates the
+	// volume itself
+	go f.do(context.Background(), "key", nil, func() (
+		*csi.CreateVolumeResponse, error) {
+		close(started)
+		<-release
+		return nil, status.Error(codes.Canceled, "canceled")
+	})
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, err := f.do(context.Background(), "key", nil, func() (
+			*csi.CreateVolumeResponse, error) {
+			return nil, errors.New("created")
+		})
+		done <- err
+	}()
+	waitForWaiters(t, &f, "key", 1)
+	close(release)
+	assert.EqualError(t, <-done, "created")
+
+	// a waiting request that is itself canceled stops waiting
+	started = make(chan struct{})
+	release = make(chan struct{})
+	defer close(release)
+	go f.do(context.Background(), "key", nil, func() (
+		*csi.CreateVolumeResponse, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		waitForWaiters(t, &f, "key", 1)
+		cancel()
+	}()
+	_, err := f.do(ctx, "key", nil, func() (*csi.CreateVolumeResponse, error) {
+		return nil, nil
+	})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Canceled, st.Code())
+}
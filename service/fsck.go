@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// fsckUncorrected is the bit set in the exit code of fsck when
+	// filesystem errors were found but left uncorrected
+	fsckUncorrected = 4
+
+	// fsckOperational is the lowest exit code of fsck indicating that the
+	// check itself could not be carried out
+	fsckOperational = 8
+
+	// xfsRepairCorrupt is the exit code of xfs_repair -n when corruption
+	// is detected
+	xfsRepairCorrupt = 1
+)
+
+// fsChecker checks the filesystem on a device prior to it being mounted
+type fsChecker func(ctx context.Context, dev *Device, ro bool) error
+
+// exitCoder is implemented by errors that carry a process exit code, such
+// as *exec.ExitError
+type exitCoder interface {
+	ExitCode() int
+}
+
+// checkFS checks the filesystem on the given device for corruption. ext
+// filesystems are repaired automatically unless ro is set, in which case
+// they are only checked. xfs filesystems are only checked, as xfs_repair
+// cannot safely repair a filesystem with a dirty log. Devices without a
+// recognized filesystem are skipped.
+func (s *service) checkFS(ctx context.Context, dev *Device, ro bool) error {
+	fs, err := s.mounter.GetDiskFormat(ctx, dev.FullPath)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"unable to determine filesystem on device: %s, err: %s",
+			dev.FullPath, err.Error())
+	}
+
+	var cmd string
+	var args []string
+	switch {
+	case strings.HasPrefix(fs, "ext"):
+		cmd = "fsck"
+		if ro {
+			args = []string{"-n", dev.FullPath}
+		} else {
+			args = []string{"-a", dev.FullPath}
+		}
+	case fs == "xfs":
+		cmd = "xfs_repair"
+		args = []string{"-n", dev.FullPath}
+	default:
+		reqLog(ctx, "").WithField("device", dev.FullPath).WithField(
+			"fsType", fs).Debug("skipping filesystem check")
+		return nil
+	}
+
+	f := logFields(ctx, "")
+	f["device"] = dev.FullPath
+	f["fsType"] = fs
+	f["cmd"] = cmd
+	f["args"] = args
+
+	out, err := s.executor.CombinedOutput(ctx, cmd, args...)
+	if ctx.Err() == context.DeadlineExceeded {
+		return status.Errorf(codes.DeadlineExceeded,
+			"timed out checking filesystem on device: %s", dev.FullPath)
+	}
+	code := 0
+	if err != nil {
+		ec, ok := err.(exitCoder)
+		if !ok {
+			return status.Errorf(codes.Internal,
+				"unable to run %s on device: %s, err: %s",
+				cmd, dev.FullPath, err.Error())
+		}
+		code = ec.ExitCode()
+	}
+	log.WithFields(f).WithField("exitCode", code).WithField(
+		"output", string(out)).Info("checked filesystem")
+
+	corrupt, failed := fsckResult(fs, code)
+	if corrupt {
+		return status.Errorf(codes.FailedPrecondition,
+			"unrecoverable filesystem corruption detected on device: %s",
+			dev.FullPath)
+	}
+	if failed {
+		return status.Errorf(codes.Internal,
+			"%s failed on device: %s with exit code: %d",
+			cmd, dev.FullPath, code)
+	}
+	return nil
+}
+
+// fsckResult interprets the exit code of the check run for the given
+// filesystem, returning whether unrecoverable corruption was detected and
+// whether the check itself failed
+func fsckResult(fs string, code int) (corrupt, failed bool) {
+	if fs == "xfs" {
+		return code == xfsRepairCorrupt, code != 0 && code != xfsRepairCorrupt
+	}
+	if code >= fsckOperational {
+		return false, true
+	}
+	return code&fsckUncorrected != 0, false
+}
@@ -0,0 +1,33 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsckResult(t *testing.T) {
+	tests := []struct {
+		fs      string
+		code    int
+		corrupt bool
+		failed  bool
+	}{
+		{"ext4", 0, false, false},
+		{"ext4", 1, false, false},
+		{"ext4", 2, false, false},
+		{"ext4", 4, true, false},
+		{"ext3", 5, true, false},
+		{"ext4", 8, false, true},
+		{"ext4", 12, false, true},
+		{"xfs", 0, false, false},
+		{"xfs", 1, true, false},
+		{"xfs", 2, false, true},
+	}
+
+	for _, tt := range tests {
+		corrupt, failed := fsckResult(tt.fs, tt.code)
+		assert.Equal(t, tt.corrupt, corrupt, "%s exit %d", tt.fs, tt.code)
+		assert.Equal(t, tt.failed, failed, "%s exit %d", tt.fs, tt.code)
+	}
+}
@@ -0,0 +1,145 @@
+package service
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// KeyGID is the key used to get, from the volume create parameters
+	// map, the group given the root of a volume's filesystem when it is
+	// first mounted, so that pods not running as root can write to it. It
+	// is kept as a volume attribute to be passed on to the node service.
+	KeyGID = "gid"
+
+	// KeyMode is the key used to get, from the volume create parameters
+	// map, the mode, in octal, given the root of a volume's filesystem when
+	// it is first mounted. It is kept as a volume attribute to be passed on
+	// to the node service.
+	KeyMode = "mode"
+)
+
+// defaultRootMode is the mode mkfs gives the root of a new filesystem
+const defaultRootMode os.FileMode = 0755
+
+// defaultGroupMode is the mode the root of a filesystem is given along with
+// a group when no mode is requested: writable by the group, with the files
+// created in it inheriting the group
+const defaultGroupMode = os.ModeSetgid | 0775
+
+// rootOwnership is the group and mode given the root of a volume's
+// filesystem when it is first mounted
+type rootOwnership struct {
+	// gid is the group, or -1 to leave the group as it is
+	gid int
+
+	// mode is the mode, or 0 to leave the mode as it is
+	mode os.FileMode
+}
+
+// parseRootOwnership returns the ownership requested by the gid and mode
+// parameters, or nil if neither is given
+func parseRootOwnership(gid, mode string) (*rootOwnership, error) {
+	if gid == "" && mode == "" {
+		return nil, nil
+	}
+	o := &rootOwnership{gid: -1}
+	if gid != "" {
+		n, err := strconv.ParseUint(gid, 10, 31)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid %s: %s, must be a group ID", KeyGID, gid)
+		}
+		o.gid = int(n)
+		o.mode = defaultGroupMode
+	}
+	if mode != "" {
+		m, err := parseFileMode(mode)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid %s: %s, must be an octal mode such as 2775",
+				KeyMode, mode)
+		}
+		o.mode = m
+	}
+	return o, nil
+}
+
+// parseFileMode returns the os.FileMode of the octal mode s, which may
+// include the setuid, setgid and sticky bits
+func parseFileMode(s string) (os.FileMode, error) {
+	n, err := strconv.ParseUint(s, 8, 12)
+	if err != nil {
+		return 0, err
+	}
+	m := os.FileMode(n) & os.ModePerm
+	if n&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if n&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if n&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	if m == 0 {
+		return 0, strconv.ErrRange
+	}
+	return m, nil
+}
+
+// chown changes the owner and group of a file, and may be replaced by tests
+var chown = os.Chown
+
+// applyRootOwnership gives root, the root of the volume id's filesystem,
+// the group and mode of o. Nothing is changed unless root still has the
+// ownership mkfs gives it, so a filesystem whose ownership was changed
+// since it was created, or that was already given it, is left as it is.
+func applyRootOwnership(
+	ctx context.Context, id, root string, o *rootOwnership) error {
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"unable to set ownership of volume: %s", err.Error())
+	}
+	f := logFields(ctx, id)
+	f["path"] = root
+	f["rootMode"] = fi.Mode().String()
+	if !defaultRootOwnership(fi) {
+		log.WithFields(f).Debug(
+			"volume filesystem ownership already set, leaving it")
+		return nil
+	}
+
+	if o.gid >= 0 {
+		if err := chown(root, -1, o.gid); err != nil {
+			return status.Errorf(codes.Internal,
+				"unable to set group of volume: %s", err.Error())
+		}
+		f[KeyGID] = o.gid
+	}
+	if o.mode != 0 {
+		if err := os.Chmod(root, o.mode); err != nil {
+			return status.Errorf(codes.Internal,
+				"unable to set mode of volume: %s", err.Error())
+		}
+		f[KeyMode] = o.mode.String()
+	}
+	log.WithFields(f).Info("set ownership of volume filesystem")
+	return nil
+}
+
+// defaultRootOwnership returns whether fi, of the root of a filesystem, has
+// the owner, group and mode mkfs gives it
+func defaultRootOwnership(fi os.FileInfo) bool {
+	uid, gid, ok := fileOwner(fi)
+	return ok && uid == 0 && gid == 0 &&
+		fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky) ==
+			defaultRootMode
+}
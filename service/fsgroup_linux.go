@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the user and group owning the file fi describes
+func fileOwner(fi os.FileInfo) (int, int, bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRootOwnership(t *testing.T) {
+	tests := []struct {
+		gid, mode string
+		exp       *rootOwnership
+		ok        bool
+	}{
+		{"", "", nil, true},
+		{"1000", "", &rootOwnership{gid: 1000, mode: defaultGroupMode}, true},
+		{"0", "0770", &rootOwnership{gid: 0, mode: 0770}, true},
+		{"1000", "2770", &rootOwnership{
+			gid: 1000, mode: os.ModeSetgid | 0770}, true},
+		{"", "1777", &rootOwnership{gid: -1, mode: os.ModeSticky | 0777}, true},
+		{"-1", "", nil, false},
+		{"users", "", nil, false},
+		{"1000", "0", nil, false},
+		{"1000", "u+w", nil, false},
+		{"1000", "10000", nil, false},
+		{"1000", "0778", nil, false},
+	}
+	for _, tt := range tests {
+		o, err := parseRootOwnership(tt.gid, tt.mode)
+		if tt.ok {
+			assert.NoError(t, err, tt.gid+"/"+tt.mode)
+			assert.Equal(t, tt.exp, o, tt.gid+"/"+tt.mode)
+			continue
+		}
+		st, _ := status.FromError(err)
+		assert.Equal(t, codes.InvalidArgument, st.Code(), tt.gid+"/"+tt.mode)
+	}
+}
+
+func TestCreateVolumeOwnership(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newFakeService()
+
+	resp, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		Parameters: map[string]string{
+			KeyStoragePool: "pool",
+			KeyGID:         "1000",
+			KeyMode:        "2770",
+		},
+	})
+	if assert.NoError(t, err) {
+		attrs := resp.GetVolume().GetAttributes()
+		assert.Equal(t, "1000", attrs[KeyGID])
+		assert.Equal(t, "2770", attrs[KeyMode])
+		info := publishInfo(attrs, grantedCap{})
+		assert.Equal(t, "1000", info[KeyGID])
+		assert.Equal(t, "2770", info[KeyMode])
+	}
+
+	_, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol2",
+		Parameters: map[string]string{
+			KeyStoragePool: "pool",
+			KeyGID:         "users",
+		},
+	})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
+
+func TestNodePublishOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the private mount is only owned by root when run as root")
+	}
+	ctx := context.Background()
+	s, _, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	var chowned []int
+	defer func(f func(string, int, int) error) { chown = f }(chown)
+	chown = func(path string, uid, gid int) error {
+		chowned = append(chowned, gid)
+		return nil
+	}
+
+	// the fake mounter mounts nothing, so the private mount point stands in
+	// for the root of a new filesystem
+	privTgt := getPrivateMountPoint(s.volPrivDir(ctx, "vol1"), "vol1")
+	assert.NoError(t, os.MkdirAll(privTgt, 0755))
+	assert.NoError(t, os.Chmod(privTgt, 0755))
+	mode := func() os.FileMode {
+		fi, err := os.Stat(privTgt)
+		assert.NoError(t, err)
+		return fi.Mode() &^ os.ModeDir
+	}
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	req.PublishInfo = map[string]string{KeyGID: "1000"}
+	_, err := s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1000}, chowned)
+	assert.Equal(t, defaultGroupMode, mode())
+
+	// publishing again, even asking for another mode, leaves the ownership
+	// already given
+	target2 := filepath.Join(dir, "target2")
+	assert.NoError(t, os.Mkdir(target2, 0755))
+	req.TargetPath = target2
+	req.PublishInfo[KeyMode] = "0700"
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1000}, chowned)
+	assert.Equal(t, defaultGroupMode, mode())
+
+	// modes that aren't octal are refused
+	req.PublishInfo[KeyMode] = "g+w"
+	_, err = s.NodePublishVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
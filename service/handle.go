@@ -0,0 +1,38 @@
+package service
+
+import (
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/handle"
+)
+
+// parseHandle parses the volume handle raw, failing with InvalidArgument,
+// rather than as though the volume doesn't exist, if it is in no format
+// this version understands, as when a newer controller service made it
+func parseHandle(raw string) (handle.Handle, error) {
+	h, err := handle.Parse(raw)
+	if err != nil {
+		return h, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return h, nil
+}
+
+// volumeID returns the ScaleIO volume ID of the volume handle raw, failing
+// with NotFound if the handle is of a volume in another system
+func (s *service) volumeID(raw string) (string, error) {
+	h, err := parseHandle(raw)
+	if err != nil {
+		return "", err
+	}
+	system := s.currentSystem()
+	if h.SystemID != "" && system != nil &&
+		!strings.EqualFold(h.SystemID, system.ID) {
+		return "", status.Errorf(codes.NotFound,
+			"volume %s is in ScaleIO system %s, not %s",
+			h.VolumeID, h.SystemID, system.ID)
+	}
+	return h.VolumeID, nil
+}
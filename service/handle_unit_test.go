@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeHandles(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+
+	validate := func(handle string) codes.Code {
+		_, err := s.ValidateVolumeCapabilities(ctx,
+			&csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId: handle,
+				VolumeCapabilities: []*csi.VolumeCapability{
+					mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+				},
+			})
+		st, _ := status.FromError(err)
+		return st.Code()
+	}
+	assert.Equal(t, codes.OK, validate(id))
+	assert.Equal(t, codes.OK, validate(s.system.ID+"-"+id))
+	assert.Equal(t, codes.NotFound, validate("7ec27ef41b2e1d00-"+id))
+	assert.Equal(t, codes.InvalidArgument, validate(id+"-"+id+"-"+id))
+
+	_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: s.system.ID + "-" + id,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, fake.Volumes)
+}
+
+func TestNodeVolumeHandles(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+
+	// a handle from a newer controller is found mapped like an old one,
+	// and shares the private mount and state named after the volume
+	req.VolumeId = "7ec27ef41b2e1d00-vol1"
+	_, err := s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	legacy := filepath.Join(dir, "legacy")
+	assert.NoError(t, os.Mkdir(legacy, 0755))
+	legacyReq := publishReq(legacy,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	_, err = s.NodePublishVolume(ctx, legacyReq)
+	assert.NoError(t, err)
+	privTgt := getPrivateMountPoint(s.privDir, "vol1")
+	if st := s.volStates.get(ctx, s.privDir, "vol1"); assert.NotNil(t, st) {
+		assert.Len(t, st.Targets, 2)
+	}
+	_, err = os.Stat(getPrivateMountPoint(s.privDir, req.VolumeId))
+	assert.True(t, os.IsNotExist(err))
+
+	// the private mount of a volume still mapped isn't stale on restart
+	assert.NoError(t, cleanupPrivateMounts(ctx, m, s.localVolumes,
+		func() bool { return true }, s.privDir))
+	mounted, err := isMounted(ctx, m, privTgt)
+	assert.NoError(t, err)
+	assert.True(t, mounted)
+
+	for _, r := range []*csi.NodeUnpublishVolumeRequest{
+		{VolumeId: req.VolumeId, TargetPath: target},
+		{VolumeId: legacyReq.VolumeId, TargetPath: legacy},
+	} {
+		_, err = s.NodeUnpublishVolume(ctx, r)
+		assert.NoError(t, err)
+	}
+	mounted, err = isMounted(ctx, m, privTgt)
+	assert.NoError(t, err)
+	assert.False(t, mounted)
+	assert.Nil(t, s.volStates.get(ctx, s.privDir, "vol1"))
+
+	// one that can't be parsed isn't reported as unpublished
+	req.VolumeId = "pvc-7ec27ef4/vol1"
+	_, err = s.NodePublishVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Contains(t, st.Message(), req.VolumeId)
+	assert.Contains(t, st.Message(), "<systemID>-<volumeID>")
+}
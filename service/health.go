@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+const (
+	// KeyMappedSDCs is the volume attribute listing, comma separated, the
+	// IDs of the SDCs a volume is mapped to
+	KeyMappedSDCs = "mappedSdcs"
+
+	// KeyAbnormal is the volume attribute indicating whether a volume is
+	// in an abnormal condition
+	KeyAbnormal = "abnormal"
+
+	// KeyCondition is the volume attribute describing a volume's condition
+	KeyCondition = "condition"
+
+	// KeyState is the volume attribute flagging a volume the gateway
+	// reports only in part, as it does volumes being deleted or in error
+	KeyState = "state"
+
+	// stateIncomplete is the KeyState of a volume reported without its
+	// size or storage pool
+	stateIncomplete = "incomplete"
+
+	poolStatsRel  = "/api/StoragePool/relationship/Statistics"
+	poolStatsHREF = "/api/instances/StoragePool::%s/relationships/Statistics"
+)
+
+// getPoolStats returns the statistics of the storage pool with the given ID,
+// using a single call to the gateway
+func (s *service) getPoolStats(id string) (*siotypes.Statistics, error) {
+	pool := &siotypes.StoragePool{
+		ID: id,
+		Links: []*siotypes.Link{{
+			Rel:  poolStatsRel,
+			HREF: fmt.Sprintf(poolStatsHREF, id),
+		}},
+	}
+	s.metrics.gatewayCall("GetStatistics")
+	return s.adminClient.GetStoragePoolStatistics(pool)
+}
+
+// volumeCondition returns whether the given volume is abnormal, and a
+// message describing its condition, based on the statistics of the storage
+// pool it belongs to. If the pool statistics are unknown, the volume is not
+// considered abnormal.
+func volumeCondition(
+	vol *siotypes.Volume, stats *siotypes.Statistics) (bool, string) {
+
+	if stats == nil {
+		return false, fmt.Sprintf(
+			"storage pool %s condition unknown", vol.StoragePoolID)
+	}
+	if stats.FailedCapacityInKb > 0 || stats.DegradedFailedCapacityInKb > 0 {
+		return true, fmt.Sprintf(
+			"storage pool %s has failed capacity", vol.StoragePoolID)
+	}
+	if stats.DegradedHealthyCapacityInKb > 0 {
+		return true, fmt.Sprintf(
+			"storage pool %s is degraded", vol.StoragePoolID)
+	}
+	return false, "volume is healthy"
+}
+
+// volumeIncomplete returns whether the gateway reported vol without the
+// size or storage pool every volume has, as it does volumes being deleted
+// or in error
+func volumeIncomplete(vol *siotypes.Volume) bool {
+	return vol.SizeInKb <= 0 || vol.StoragePoolID == ""
+}
+
+// mappedSDCs returns the IDs of the SDCs vol is mapped to, skipping the
+// mappings the gateway reported without one
+func mappedSDCs(vol *siotypes.Volume) []string {
+	sdcs := []string{}
+	for _, m := range vol.MappedSdcInfo {
+		if m != nil && m.SdcID != "" {
+			sdcs = append(sdcs, m.SdcID)
+		}
+	}
+	return sdcs
+}
+
+// setVolumeCondition records the mapping state and condition of vol in
+// the attributes of the given CSI volume
+func setVolumeCondition(
+	csiVol *csi.Volume,
+	vol *siotypes.Volume,
+	stats *siotypes.Statistics) {
+
+	sdcs := mappedSDCs(vol)
+	abnormal, msg := volumeCondition(vol, stats)
+
+	if csiVol.Attributes == nil {
+		csiVol.Attributes = map[string]string{}
+	}
+	csiVol.Attributes[KeyMappedSDCs] = strings.Join(sdcs, ",")
+	csiVol.Attributes[KeyAbnormal] = strconv.FormatBool(abnormal)
+	csiVol.Attributes[KeyCondition] = msg
+}
+
+// poolStatsCache looks up storage pool statistics at most once per pool
+type poolStatsCache struct {
+	s     *service
+	stats map[string]*siotypes.Statistics
+}
+
+func (c *poolStatsCache) get(id string) *siotypes.Statistics {
+	if stats, ok := c.stats[id]; ok {
+		return stats
+	}
+	stats, err := c.s.getPoolStats(id)
+	if err != nil {
+		log.WithError(err).WithField("storagePool", id).Warn(
+			"unable to get storage pool statistics")
+	}
+	c.stats[id] = stats
+	return stats
+}
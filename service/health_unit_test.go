@@ -0,0 +1,85 @@
+package service
+
+import (
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+func TestVolumeCondition(t *testing.T) {
+	vol := &siotypes.Volume{StoragePoolID: "pool1"}
+
+	tests := []struct {
+		name     string
+		stats    *siotypes.Statistics
+		abnormal bool
+	}{
+		{"unknown", nil, false},
+		{"healthy", &siotypes.Statistics{}, false},
+		{"degraded",
+			&siotypes.Statistics{DegradedHealthyCapacityInKb: 1}, true},
+		{"failed", &siotypes.Statistics{FailedCapacityInKb: 1}, true},
+		{"degraded failed",
+			&siotypes.Statistics{DegradedFailedCapacityInKb: 1}, true},
+	}
+
+	for _, tt := range tests {
+		abnormal, msg := volumeCondition(vol, tt.stats)
+		assert.Equal(t, tt.abnormal, abnormal, tt.name)
+		assert.NotEmpty(t, msg, tt.name)
+	}
+}
+
+func TestSetVolumeCondition(t *testing.T) {
+	vol := &siotypes.Volume{
+		ID:            "vol1",
+		StoragePoolID: "pool1",
+		MappedSdcInfo: []*siotypes.MappedSdcInfo{
+			{SdcID: "sdc1"},
+			{SdcID: "sdc2"},
+		},
+	}
+
+	csiVol := &csi.Volume{Id: vol.ID}
+	setVolumeCondition(csiVol, vol,
+		&siotypes.Statistics{FailedCapacityInKb: 1})
+	assert.Equal(t, "sdc1,sdc2", csiVol.Attributes[KeyMappedSDCs])
+	assert.Equal(t, "true", csiVol.Attributes[KeyAbnormal])
+	assert.NotEmpty(t, csiVol.Attributes[KeyCondition])
+
+	vol.MappedSdcInfo = nil
+	csiVol = &csi.Volume{Id: vol.ID}
+	setVolumeCondition(csiVol, vol, &siotypes.Statistics{})
+	assert.Equal(t, "", csiVol.Attributes[KeyMappedSDCs])
+	assert.Equal(t, "false", csiVol.Attributes[KeyAbnormal])
+}
+
+func TestIncompleteVolume(t *testing.T) {
+	for _, vol := range []*siotypes.Volume{
+		{},
+		{ID: "vol1", SizeInKb: -8},
+		{ID: "vol1", StoragePoolID: "pool1"},
+		{ID: "vol1", SizeInKb: 8, MappedSdcInfo: []*siotypes.MappedSdcInfo{
+			nil, {}, {SdcID: "sdc1"}}},
+	} {
+		assert.True(t, volumeIncomplete(vol), "%+v", vol)
+		csiVol := getCSIVolume(vol)
+		assert.Equal(t, vol.ID, csiVol.Id)
+		assert.True(t, csiVol.CapacityBytes >= 0, "%+v", vol)
+
+		setVolumeCondition(csiVol, vol, nil)
+		assert.Equal(t, "false", csiVol.Attributes[KeyAbnormal])
+		assert.NotEmpty(t, csiVol.Attributes[KeyCondition])
+	}
+
+	csiVol := &csi.Volume{}
+	setVolumeCondition(csiVol, &siotypes.Volume{
+		MappedSdcInfo: []*siotypes.MappedSdcInfo{nil, {}, {SdcID: "sdc1"}},
+	}, nil)
+	assert.Equal(t, "sdc1", csiVol.Attributes[KeyMappedSDCs])
+
+	assert.False(t, volumeIncomplete(&siotypes.Volume{
+		ID: "vol1", SizeInKb: 8, StoragePoolID: "pool1"}))
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/thecodeteam/csi-scaleio/core"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// readyWindow is how long the result of a probe, and a successful
+	// contact with the gateway, are trusted by the readiness check before
+	// they are refreshed
+	readyWindow = 30 * time.Second
+
+	// defaultProbeCacheTTL is how long, by default, Probe reuses the
+	// result of a successful probe
+	defaultProbeCacheTTL = 5 * time.Second
+
+	// probeFailureTTL is how long Probe reuses the result of a failed
+	// probe, however long successes are reused, so that a recovery is
+	// noticed promptly
+	probeFailureTTL = time.Second
+)
+
+// readiness tracks the outcome of the most recent probe
+type readiness struct {
+	sync.Mutex
+	probed   time.Time
+	probeErr error
+	stopping bool
+
+	// probing serializes Probe, so a burst of calls shares one probe
+	probing sync.Mutex
+}
+
+// record stores the outcome of a probe
+func (r *readiness) record(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.probed = time.Now()
+	r.probeErr = err
+}
+
+// cached returns true, and the outcome of the last probe, if it succeeded
+// within ttl, or failed within probeFailureTTL
+func (r *readiness) cached(ttl time.Duration) (bool, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.probed.IsZero() {
+		return false, nil
+	}
+	if r.probeErr != nil && ttl > probeFailureTTL {
+		ttl = probeFailureTTL
+	}
+	return time.Since(r.probed) < ttl, r.probeErr
+}
+
+// healthResponse is the body of the health and readiness responses
+type healthResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, err error) {
+	rep := healthResponse{Status: "ok", Version: core.SemVer}
+	code := http.StatusOK
+	if err != nil {
+		rep.Status = "unavailable"
+		rep.Reason = err.Error()
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rep)
+}
+
+// live returns an error if the plug-in is shutting down
+func (s *service) live() error {
+	s.readiness.Lock()
+	defer s.readiness.Unlock()
+	if s.readiness.stopping {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// ready returns an error if the plug-in is not ready to serve requests.
+// The last probe is reused if it is recent enough, otherwise the plug-in
+// probes itself, which for the controller includes contacting the gateway.
+func (s *service) ready(ctx context.Context) error {
+	if err := s.live(); err != nil {
+		return err
+	}
+
+	s.readiness.Lock()
+	fresh := time.Since(s.readiness.probed) < readyWindow
+	err := s.readiness.probeErr
+	s.readiness.Unlock()
+	if fresh {
+		return err
+	}
+
+	_, err = s.Probe(ctx, &csi.ProbeRequest{})
+	return err
+}
+
+// pingGateway makes a single call to the gateway to verify it is reachable
+func (s *service) pingGateway() error {
+	s.metrics.gatewayCall("FindSystem")
+	if _, err := s.adminClient.FindSystem("", s.opts.SystemName, ""); err != nil {
+		return errors.New("unable to reach ScaleIO Gateway: " + err.Error())
+	}
+	return nil
+}
+
+// serveHealth starts serving the liveness and readiness endpoints on addr
+func (s *service) serveHealth(addr string) (*http.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.live())
+	})
+	mux.HandleFunc(readyzPath, func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.ready(r.Context()))
+	})
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("health server failed")
+		}
+	}()
+	log.WithField("addr", lis.Addr().String()).Info("serving health checks")
+
+	return srv, nil
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/thecodeteam/csi-scaleio/core"
+)
+
+func TestReady(t *testing.T) {
+	ctx := context.Background()
+	s := &service{mode: "node"}
+
+	// a recent probe result is reused
+	s.readiness.record(errors.New("SDC not found"))
+	assert.EqualError(t, s.ready(ctx), "SDC not found")
+	s.readiness.record(nil)
+	assert.NoError(t, s.ready(ctx))
+	assert.NoError(t, s.live())
+
+	assert.NoError(t, s.Shutdown(ctx))
+	assert.Error(t, s.live())
+	assert.Error(t, s.ready(ctx))
+}
+
+func TestWriteHealth(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeHealth(w, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var rep healthResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&rep))
+	assert.Equal(t, healthResponse{Status: "ok", Version: core.SemVer}, rep)
+
+	w = httptest.NewRecorder()
+	writeHealth(w, errors.New("unable to reach ScaleIO Gateway"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&rep))
+	assert.Equal(t, "unavailable", rep.Status)
+	assert.Equal(t, "unable to reach ScaleIO Gateway", rep.Reason)
+}
@@ -6,6 +6,9 @@ import (
 	"golang.org/x/net/context"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/thecodeteam/csi-scaleio/core"
 )
@@ -15,13 +18,81 @@ func (s *service) GetPluginInfo(
 	req *csi.GetPluginInfoRequest) (
 	*csi.GetPluginInfoResponse, error) {
 
+	manifest := make(map[string]string, len(Manifest)+5)
+	for k, v := range Manifest {
+		manifest[k] = v
+	}
+
+	switch {
+	case strings.EqualFold(s.mode, "controller"):
+		manifest["mode"] = "controller"
+	case strings.EqualFold(s.mode, "node"):
+		manifest["mode"] = "node"
+	default:
+		manifest["mode"] = "both"
+	}
+	if s.opts.SystemName != "" {
+		manifest["systemName"] = s.opts.SystemName
+	}
+	manifest["config"] = condensedConfig(s.configFields())
+
+	// The versions are only known once the controller is probed, and
+	// identity calls must not wait for, or fail on, the gateway, so only
+	// what the probe looked up is reported
+	if system := s.currentSystem(); system != nil {
+		if system.SystemVersionName != "" {
+			manifest["mdmVersion"] = system.SystemVersionName
+		}
+		if v := s.getGatewayVersion(); v != "" {
+			manifest["gatewayVersion"] = v
+		}
+		manifest["gatewayEndpoint"] = s.gatewayEndpoint()
+		if !strings.EqualFold(s.mode, "node") {
+			s.setPoolsManifest(manifest)
+		}
+	}
+
 	return &csi.GetPluginInfoResponse{
 		Name:          Name,
 		VendorVersion: core.SemVer,
-		Manifest:      Manifest,
+		Manifest:      manifest,
 	}, nil
 }
 
+// getGatewayVersion returns the version of the gateway, as looked up by
+// the probe, or an empty string if it hasn't been
+func (s *service) getGatewayVersion() string {
+	s.gatewayVersionMu.Lock()
+	defer s.gatewayVersionMu.Unlock()
+	return s.gatewayVersion
+}
+
+// refreshManifest looks up what GetPluginInfo reports of the gateway once
+// the system is known: the version of the gateway, until it is found, and
+// the storage pools, whenever their list has expired. Failures are only
+// logged, and the lookups retried on the next probe.
+func (s *service) refreshManifest() {
+	if s.currentSystem() == nil {
+		return
+	}
+	if s.getGatewayVersion() == "" {
+		s.metrics.gatewayCall("GetVersion")
+		v, err := s.adminClient.GetVersion()
+		if err != nil {
+			log.WithError(err).Debug("unable to get ScaleIO Gateway version")
+		} else {
+			s.gatewayVersionMu.Lock()
+			s.gatewayVersion = v
+			s.gatewayVersionMu.Unlock()
+		}
+	}
+	if !strings.EqualFold(s.mode, "node") {
+		if _, err := s.getPoolNames(); err != nil {
+			log.WithError(err).Debug("unable to list storage pools")
+		}
+	}
+}
+
 func (s *service) GetPluginCapabilities(
 	ctx context.Context,
 	req *csi.GetPluginCapabilitiesRequest) (
@@ -47,16 +118,41 @@ func (s *service) Probe(
 	req *csi.ProbeRequest) (
 	*csi.ProbeResponse, error) {
 
+	// Liveness checks call Probe every few seconds, which would otherwise
+	// contact the gateway each time
+	s.readiness.probing.Lock()
+	defer s.readiness.probing.Unlock()
+	ok, err := s.readiness.cached(s.opts.ProbeCacheTTL)
+	if !ok {
+		err = s.probe(ctx)
+		s.readiness.record(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ProbeResponse{}, nil
+}
+
+// probe probes the services served in the configured mode. A controller
+// that was already probed checks the gateway can still be reached.
+func (s *service) probe(ctx context.Context) error {
 	if !strings.EqualFold(s.mode, "node") {
+		probed := s.controllerProbed()
 		if err := s.controllerProbe(ctx); err != nil {
-			return nil, err
+			return err
+		}
+		if probed {
+			if err := s.pingGateway(); err != nil {
+				return status.Error(codes.Unavailable, err.Error())
+			}
 		}
 	}
 	if !strings.EqualFold(s.mode, "controller") {
 		if err := s.nodeProbe(ctx); err != nil {
-			return nil, err
+			return err
 		}
 	}
-
-	return &csi.ProbeResponse{}, nil
+	s.refreshManifest()
+	return nil
 }
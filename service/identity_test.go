@@ -2,10 +2,14 @@ package service_test
 
 import (
 	"context"
+	"os"
 	"testing"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/rexray/gocsi"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/thecodeteam/csi-scaleio/core"
 	"github.com/thecodeteam/csi-scaleio/service"
@@ -26,4 +30,69 @@ func TestPluginInfo(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, info.GetName(), service.Name)
 	assert.Equal(t, info.GetVendorVersion(), core.SemVer)
+
+	m := info.GetManifest()
+	for _, k := range []string{"url", "semver", "commit", "formed"} {
+		assert.Equal(t, service.Manifest[k], m[k], k)
+	}
+	assert.NotEmpty(t, m["goscaleio"])
+	assert.NotEmpty(t, m["mode"])
+}
+
+func TestModes(t *testing.T) {
+
+	tests := []struct {
+		mode       string
+		controller bool
+		node       bool
+	}{
+		{"", true, true},
+		{"controller", true, false},
+		{"node", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			os.Setenv(gocsi.EnvVarMode, tt.mode)
+			defer os.Unsetenv(gocsi.EnvVarMode)
+
+			ctx := context.Background()
+
+			gclient, stop := startServer(ctx, t)
+			defer stop()
+
+			// The controller capability is only advertised when the
+			// controller service is served
+			caps, err := csi.NewIdentityClient(gclient).GetPluginCapabilities(
+				ctx, &csi.GetPluginCapabilitiesRequest{})
+			assert.NoError(t, err)
+			hasController := false
+			for _, c := range caps.GetCapabilities() {
+				if c.GetService().GetType() ==
+					csi.PluginCapability_Service_CONTROLLER_SERVICE {
+					hasController = true
+				}
+			}
+			assert.Equal(t, tt.controller, hasController)
+
+			// Services not served by the mode are not registered
+			_, err = csi.NewControllerClient(gclient).ControllerGetCapabilities(
+				ctx, &csi.ControllerGetCapabilitiesRequest{})
+			assertRegistered(t, tt.controller, err)
+
+			_, err = csi.NewNodeClient(gclient).NodeGetCapabilities(
+				ctx, &csi.NodeGetCapabilitiesRequest{})
+			assertRegistered(t, tt.node, err)
+		})
+	}
+}
+
+func assertRegistered(t *testing.T, registered bool, err error) {
+	if registered {
+		assert.NoError(t, err)
+		return
+	}
+	st, ok := status.FromError(err)
+	assert.True(t, ok)
+	assert.Equal(t, codes.Unimplemented, st.Code())
 }
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPluginInfoManifest(t *testing.T) {
+	ctx := context.Background()
+
+	// Before the probe the versions are unknown, but the call succeeds
+	s, fake := newFakeService()
+	s.system = nil
+	s.mode = "node"
+	info, err := s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.NoError(t, err)
+	m := info.GetManifest()
+	assert.Equal(t, "node", m["mode"])
+	assert.Equal(t, "sys", m["systemName"])
+	assert.Equal(t, goscaleioRevision, m["goscaleio"])
+	assert.Contains(t, m["config"], "systemname=sys")
+	assert.Contains(t, m["config"], "mode=node")
+	assert.NotContains(t, m, "gatewayVersion")
+	assert.NotContains(t, m, "mdmVersion")
+	assert.Equal(t, 0, fake.Calls["GetVersion"])
+
+	// A failed lookup is not reported, and is retried on the next probe
+	s, fake = newFakeService()
+	s.system.SystemVersionName = "DellEMC ScaleIO Version: R2_5.0.254"
+	fake.Errors["GetVersion"] = errors.New("gateway down")
+	s.refreshManifest()
+	info, err = s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.NoError(t, err)
+	m = info.GetManifest()
+	assert.Equal(t, "both", m["mode"])
+	assert.Equal(t, "DellEMC ScaleIO Version: R2_5.0.254", m["mdmVersion"])
+	assert.NotContains(t, m, "gatewayVersion")
+
+	delete(fake.Errors, "GetVersion")
+	info, err = s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.NoError(t, err)
+	assert.NotContains(t, info.GetManifest(), "gatewayVersion")
+	for i := 0; i < 2; i++ {
+		s.refreshManifest()
+		info, err = s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, "2.0", info.GetManifest()["gatewayVersion"])
+	}
+	assert.Equal(t, 2, fake.Calls["GetVersion"])
+
+	// GetPluginInfo never calls the gateway, even for what isn't known
+	calls := func() (n int) {
+		for _, c := range fake.Calls {
+			n += c
+		}
+		return n
+	}
+	before := calls()
+	s.gatewayVersion = ""
+	s.poolList = poolList{}
+	_, err = s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, before, calls())
+
+	// The shared manifest is never modified
+	assert.NotContains(t, Manifest, "mode")
+}
+
+func TestProbeCache(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.mode = "controller"
+	s.opts.Endpoint = "https://gateway"
+	s.opts.User = "admin"
+	s.opts.Password = "password"
+	s.opts.ProbeCacheTTL = time.Minute
+	delete(fake.Calls, "FindSystem")
+
+	burst := func() (failed int) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := s.Probe(ctx, &csi.ProbeRequest{}); err != nil {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return failed
+	}
+	age := func(d time.Duration) {
+		s.readiness.Lock()
+		s.readiness.probed = s.readiness.probed.Add(-d)
+		s.readiness.Unlock()
+	}
+
+	// a burst shares one check of the gateway
+	assert.Equal(t, 0, burst())
+	assert.Equal(t, 1, fake.Calls["FindSystem"])
+
+	// which isn't repeated until the result expires
+	age(30 * time.Second)
+	assert.Equal(t, 0, burst())
+	assert.Equal(t, 1, fake.Calls["FindSystem"])
+
+	// a failure is reused only briefly
+	fake.Errors["FindSystem"] = errors.New("gateway down")
+	age(time.Minute)
+	assert.Equal(t, 100, burst())
+	assert.Equal(t, 2, fake.Calls["FindSystem"])
+
+	delete(fake.Errors, "FindSystem")
+	assert.Equal(t, 100, burst())
+	age(probeFailureTTL)
+	assert.Equal(t, 0, burst())
+	assert.Equal(t, 3, fake.Calls["FindSystem"])
+
+	// without a TTL every call probes
+	s.opts.ProbeCacheTTL = 0
+	for i := 0; i < 3; i++ {
+		_, err := s.Probe(ctx, &csi.ProbeRequest{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 6, fake.Calls["FindSystem"])
+	assert.Equal(t, 1, fake.Calls["Authenticate"])
+}
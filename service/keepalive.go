@@ -0,0 +1,85 @@
+package service
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// keepaliveMaxBackoff is the longest keep-alives are put off while the
+// gateway can't be reached, unless the interval itself is longer
+var keepaliveMaxBackoff = 30 * time.Minute
+
+// startKeepalive starts pinging the gateway in the background, if enabled
+// and not already started. It must be called with probeMu held.
+func (s *service) startKeepalive() {
+	if s.opts.KeepaliveInterval <= 0 || s.keepaliveStop != nil {
+		return
+	}
+
+	s.readiness.Lock()
+	stopping := s.readiness.stopping
+	s.readiness.Unlock()
+	if stopping {
+		return
+	}
+
+	s.keepaliveStop = make(chan struct{})
+	go s.keepalive(s.opts.KeepaliveInterval, s.keepaliveStop)
+}
+
+// stopKeepalive stops pinging the gateway
+func (s *service) stopKeepalive() {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	if s.keepaliveStop != nil {
+		close(s.keepaliveStop)
+		s.keepaliveStop = nil
+	}
+}
+
+// keepalive pings the gateway every interval until stop is closed, so that
+// the session, which the gateway expires when idle, stays valid. goscaleio
+// logs in again if it has expired anyway.
+func (s *service) keepalive(interval time.Duration, stop chan struct{}) {
+	wait := interval
+	failing := false
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+		if !s.controllerProbed() {
+			continue
+		}
+
+		err := s.pingGateway()
+		if err == nil {
+			if failing {
+				log.Info("ScaleIO Gateway keep-alive succeeded again")
+			}
+			failing = false
+			wait = interval
+			continue
+		}
+
+		failing = true
+		wait = keepaliveBackoff(wait, interval)
+		log.WithError(err).WithField("retryIn", wait).Warn(
+			"ScaleIO Gateway keep-alive failed")
+	}
+}
+
+// keepaliveBackoff returns how long to wait after a failed keep-alive that
+// followed a wait of the given length
+func keepaliveBackoff(wait, interval time.Duration) time.Duration {
+	max := keepaliveMaxBackoff
+	if interval > max {
+		max = interval
+	}
+	if wait *= 2; wait > max {
+		wait = max
+	}
+	return wait
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepaliveBackoff(t *testing.T) {
+	defer func(max time.Duration) {
+		keepaliveMaxBackoff = max
+	}(keepaliveMaxBackoff)
+	keepaliveMaxBackoff = 30 * time.Minute
+
+	assert.Equal(t, 10*time.Minute,
+		keepaliveBackoff(5*time.Minute, 5*time.Minute))
+	assert.Equal(t, 30*time.Minute,
+		keepaliveBackoff(20*time.Minute, 5*time.Minute))
+
+	// the interval is never shortened
+	assert.Equal(t, time.Hour, keepaliveBackoff(time.Hour, time.Hour))
+}
+
+func TestKeepalive(t *testing.T) {
+	s, fake := newFakeService()
+	s.opts.SystemName = "sys"
+	s.opts.KeepaliveInterval = time.Millisecond
+
+	calls := func() int {
+		fake.Lock()
+		defer fake.Unlock()
+		return fake.Calls["FindSystem"]
+	}
+	waitCalls := func(n int) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for calls() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		return calls() >= n
+	}
+
+	s.probeMu.Lock()
+	s.startKeepalive()
+	stop := s.keepaliveStop
+	s.startKeepalive()
+	assert.Equal(t, stop, s.keepaliveStop)
+	s.probeMu.Unlock()
+
+	start := calls()
+	assert.True(t, waitCalls(start+3))
+
+	// failures are retried less and less often
+	fake.Lock()
+	fake.Errors["FindSystem"] = errors.New("Service Unavailable")
+	fake.Unlock()
+	failing := calls()
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, calls()-failing < 10)
+
+	s.stopKeepalive()
+	assert.Nil(t, s.keepaliveStop)
+	n := calls()
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, calls() <= n+1)
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListVolumes pages through the volumes of each storage pool in turn, with
+// the pools, and the volumes of each, ordered by ID.
+//
+// Listing every volume at once takes minutes, and a lot of memory, on
+// systems with tens of thousands of them, so each page is built from the
+// volumes of as few pools as it covers, fetched a pool at a time. Nothing
+// is kept between pages: the token returned with each page gives the last
+// volume listed, so concurrent listings can't interfere with each other.
+
+// listToken is the position in the volume list after the last volume of a
+// page. Its hash covers the storage pools, and the volumes of the pool the
+// page ended in up to its last volume, so a token presented after those
+// changed is refused rather than skipping or repeating volumes.
+type listToken struct {
+	poolID   string
+	volumeID string
+	hash     string
+}
+
+func (t listToken) String() string {
+	return t.poolID + "." + t.volumeID + "." + t.hash
+}
+
+func parseListToken(v string) (listToken, error) {
+	p := strings.Split(v, ".")
+	if len(p) != 3 || p[0] == "" || p[1] == "" || p[2] == "" {
+		return listToken{}, errors.New("invalid token")
+	}
+	return listToken{poolID: p[0], volumeID: p[1], hash: p[2]}, nil
+}
+
+// listingHash returns the hash of a token whose last volume is the last of
+// vols, the volumes of one of pools up to that volume
+func listingHash(
+	pools []*siotypes.StoragePool, vols []*siotypes.Volume) string {
+
+	h := fnv.New64a()
+	for _, p := range pools {
+		fmt.Fprintf(h, "%s,", p.ID)
+	}
+	fmt.Fprint(h, "/")
+	for _, v := range vols {
+		fmt.Fprintf(h, "%s,", v.ID)
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// listableVolumes returns vols without the volumes the gateway reported
+// without an ID, which can't be listed
+func listableVolumes(
+	pool *siotypes.StoragePool, vols []*siotypes.Volume) []*siotypes.Volume {
+
+	listable := vols[:0]
+	for _, vol := range vols {
+		if vol == nil || vol.ID == "" {
+			log.WithField("storagePool", pool.ID).Warn(
+				"skipping volume reported without an ID")
+			continue
+		}
+		listable = append(listable, vol)
+	}
+	return listable
+}
+
+// listIncomplete returns whether vol, which the gateway reported without
+// its size or storage pool, is listed, warning of it either way. Listed,
+// it carries the KeyState attribute.
+func (s *service) listIncomplete(vol *siotypes.Volume) bool {
+	log.WithFields(log.Fields{
+		"volumeID":    vol.ID,
+		"name":        vol.Name,
+		"sizeInKb":    vol.SizeInKb,
+		"storagePool": vol.StoragePoolID,
+		"excluded":    s.opts.ListExcludeIncomplete,
+	}).Warn("volume reported without its size or storage pool, " +
+		"it may be being deleted")
+	return !s.opts.ListExcludeIncomplete
+}
+
+// listVolumes returns the page of at most maxEntries volumes, or all of
+// them if maxEntries is 0, after the position given by startToken. Volumes
+// not marked as the plug-in's own are left out if ListOwnedOnly is set,
+// and those the gateway reports only in part if ListExcludeIncomplete is.
+// Only the storage pools AllowedPools lists are listed, if it is set.
+func (s *service) listVolumes(
+	startToken string, maxEntries int) (*csi.ListVolumesResponse, error) {
+
+	s.metrics.gatewayCall("GetStoragePools")
+	pools, err := s.adminClient.GetStoragePools()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to list volumes: %s", err.Error())
+	}
+	if pools, err = s.allowedPools(pools); err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to list volumes: %s", err.Error())
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+
+	var (
+		after *listToken
+		start int
+	)
+	if startToken != "" {
+		t, err := parseListToken(startToken)
+		if err != nil {
+			return nil, status.Errorf(codes.Aborted,
+				"unable to parse startingToken: %v", startToken)
+		}
+		start = sort.Search(len(pools), func(i int) bool {
+			return pools[i].ID >= t.poolID
+		})
+		if start == len(pools) || pools[start].ID != t.poolID {
+			return nil, status.Error(codes.Aborted,
+				"storage pools changed since startingToken was returned")
+		}
+		after = &t
+	}
+
+	var (
+		entries []*csi.ListVolumesResponse_Entry
+		more    bool
+
+		// lastVols is the volumes of the pool of the last volume listed,
+		// up to and including it
+		lastVols []*siotypes.Volume
+		lastPool string
+	)
+
+	// Pool statistics are only fetched once per pool, regardless of how
+	// many of the listed volumes belong to it
+	stats := &poolStatsCache{
+		s:     s,
+		stats: map[string]*siotypes.Statistics{},
+	}
+
+	full := func() bool { return maxEntries > 0 && len(entries) == maxEntries }
+
+	for i := start; i < len(pools); i++ {
+		if full() {
+			// later pools may turn out to be empty, leaving an empty
+			// last page
+			more = true
+			break
+		}
+
+		s.metrics.gatewayCall("GetStoragePoolVolumes")
+		vols, err := s.adminClient.GetStoragePoolVolumes(pools[i])
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"unable to list volumes: %s", err.Error())
+		}
+		vols = listableVolumes(pools[i], vols)
+		sort.Slice(vols, func(i, j int) bool { return vols[i].ID < vols[j].ID })
+
+		j := 0
+		if after != nil && i == start {
+			j = sort.Search(len(vols), func(k int) bool {
+				return vols[k].ID > after.volumeID
+			})
+			if listingHash(pools, vols[:j]) != after.hash {
+				return nil, status.Error(codes.Aborted,
+					"volumes changed since startingToken was returned")
+			}
+		}
+
+		for ; j < len(vols); j++ {
+			if full() {
+				more = true
+				break
+			}
+			vol := vols[j]
+			if isTombstone(vol) || (s.opts.ListOwnedOnly && !isOwned(vol)) {
+				continue
+			}
+			incomplete := volumeIncomplete(vol)
+			if incomplete && !s.listIncomplete(vol) {
+				continue
+			}
+			csiVol := getCSIVolume(vol)
+			// the pool listed the volume, even if it doesn't say so
+			setVolumeCondition(csiVol, vol, stats.get(pools[i].ID))
+			if incomplete {
+				csiVol.Attributes[KeyState] = stateIncomplete
+			}
+			entries = append(entries, &csi.ListVolumesResponse_Entry{
+				Volume: csiVol,
+			})
+			lastVols, lastPool = vols[:j+1], pools[i].ID
+		}
+	}
+
+	var nextToken string
+	if more {
+		nextToken = listToken{
+			poolID:   lastPool,
+			volumeID: lastVols[len(lastVols)-1].ID,
+			hash:     listingHash(pools, lastVols),
+		}.String()
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
@@ -0,0 +1,387 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+// addSyntheticVolumes adds n volumes to the named pool directly, as
+// creating tens of thousands through the fake one by one is slow. It
+// returns their IDs in the order they are listed.
+func addSyntheticVolumes(
+	fake *testutil.FakeAdmin, pool string, n int) []string {
+
+	p, err := fake.FindStoragePool("", pool, "")
+	if err != nil {
+		panic(err)
+	}
+	fake.Lock()
+	defer fake.Unlock()
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("%s%08x", p.ID[len(p.ID)-8:], i)
+		fake.Volumes[ids[i]] = &siotypes.Volume{
+			ID:            ids[i],
+			Name:          fmt.Sprintf("%s-vol%d", pool, i),
+			StoragePoolID: p.ID,
+			SizeInKb:      8 * kiBytesInGiB,
+			VolumeType:    thinProvisioned,
+		}
+	}
+	return ids
+}
+
+// newListService returns a service whose system has the given number of
+// volumes in each of its pools, and the IDs of every volume in the order
+// they are listed
+func newListService(perPool ...int) (*service, *testutil.FakeAdmin, []string) {
+	s, fake := newFakeService()
+	p, _ := fake.FindStoragePool("", "pool", "")
+	delete(fake.StoragePools, p.ID)
+
+	var ids []string
+	for i, n := range perPool {
+		name := fmt.Sprintf("pool%d", i)
+		fake.AddStoragePool(name, 100*kiBytesInGiB)
+		ids = append(ids, addSyntheticVolumes(fake, name, n)...)
+	}
+	return s, fake, ids
+}
+
+// listAll pages through every volume, returning their IDs and the tokens
+// returned
+func listAll(t testing.TB, s *service, maxEntries int32) (
+	[]string, []string) {
+
+	var (
+		ids    []string
+		tokens []string
+		token  string
+	)
+	for {
+		rep, err := s.ListVolumes(context.Background(),
+			&csi.ListVolumesRequest{
+				MaxEntries:    maxEntries,
+				StartingToken: token,
+			})
+		if !assert.NoError(t, err) {
+			return ids, tokens
+		}
+		for _, e := range rep.Entries {
+			ids = append(ids, e.Volume.Id)
+		}
+		if token = rep.NextToken; token == "" {
+			return ids, tokens
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+func TestListVolumesPools(t *testing.T) {
+	ctx := context.Background()
+
+	// an empty pool between others, and at the end, is skipped over
+	s, fake, ids := newListService(3, 0, 2, 0)
+	listed, tokens := listAll(t, s, 2)
+	assert.Equal(t, ids, listed)
+	assert.Len(t, tokens, 2)
+
+	// a page ending with a pool has a token while the pools after it are
+	// not yet fetched
+	listed, tokens = listAll(t, s, 3)
+	assert.Equal(t, ids, listed)
+	assert.Len(t, tokens, 1)
+
+	// a token is honored by any instance of the plugin, as after a restart
+	rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{
+		MaxEntries: 4,
+	})
+	assert.NoError(t, err)
+	s2, fake2 := newFakeService()
+	fake2.StoragePools = fake.StoragePools
+	fake2.Volumes = fake.Volumes
+	rep, err = s2.ListVolumes(ctx, &csi.ListVolumesRequest{
+		MaxEntries:    10,
+		StartingToken: rep.NextToken,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, rep.Entries, 1)
+	assert.Equal(t, ids[4], rep.Entries[0].Volume.Id)
+	assert.Empty(t, rep.NextToken)
+	assert.Equal(t, 0, fake.Calls["GetVolume"])
+}
+
+func TestListVolumesWindows(t *testing.T) {
+	ctx := context.Background()
+	s, _, ids := newListService(3, 0, 4)
+
+	// tokenAt returns the token of a page ending after the first n volumes
+	tokenAt := func(n int32) string {
+		if n == 0 {
+			return ""
+		}
+		rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: n})
+		assert.NoError(t, err)
+		return rep.NextToken
+	}
+
+	for _, tc := range []struct {
+		name       string
+		start      int32
+		maxEntries int32
+		want       []string
+		more       bool
+	}{
+		{"(0,0)", 0, 0, ids, false},
+		{"(0,n)", 0, 2, ids[:2], true},
+		{"(0,n) all", 0, 7, ids, false},
+		{"(0,n) past end", 0, 10, ids, false},
+		{"(n,0)", 2, 0, ids[2:], false},
+		{"(n,0) at pool end", 3, 0, ids[3:], false},
+		{"(n,m)", 2, 3, ids[2:5], true},
+		{"(n,m) to end", 4, 3, ids[4:], false},
+		{"(n,m) past end", 5, 10, ids[5:], false},
+	} {
+		rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{
+			StartingToken: tokenAt(tc.start),
+			MaxEntries:    tc.maxEntries,
+		})
+		if !assert.NoError(t, err, tc.name) {
+			continue
+		}
+		var listed []string
+		for _, e := range rep.Entries {
+			listed = append(listed, e.Volume.Id)
+		}
+		assert.Equal(t, tc.want, listed, tc.name)
+		assert.Equal(t, tc.more, rep.NextToken != "", tc.name)
+	}
+
+	_, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: -1})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+
+	// paging with a maximum, then taking the rest without one, lists each
+	// volume once
+	for n := int32(1); n <= 7; n++ {
+		first, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: n})
+		if !assert.NoError(t, err) {
+			continue
+		}
+		listed := make([]string, 0, len(ids))
+		for _, e := range first.Entries {
+			listed = append(listed, e.Volume.Id)
+		}
+		if first.NextToken != "" {
+			rest, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{
+				StartingToken: first.NextToken,
+			})
+			if !assert.NoError(t, err) {
+				continue
+			}
+			assert.Empty(t, rest.NextToken)
+			for _, e := range rest.Entries {
+				listed = append(listed, e.Volume.Id)
+			}
+		}
+		assert.Equal(t, ids, listed, "first page of %d", n)
+	}
+}
+
+func TestListVolumesChanged(t *testing.T) {
+	ctx := context.Background()
+	list := func(s *service, token string) (*csi.ListVolumesResponse, error) {
+		return s.ListVolumes(ctx, &csi.ListVolumesRequest{
+			MaxEntries:    2,
+			StartingToken: token,
+		})
+	}
+	aborted := func(s *service, token string) {
+		_, err := list(s, token)
+		st, _ := status.FromError(err)
+		assert.Equal(t, codes.Aborted, st.Code())
+	}
+
+	// a volume removed before the position of a token
+	s, fake, ids := newListService(3, 2)
+	rep, err := list(s, "")
+	assert.NoError(t, err)
+	fake.Lock()
+	delete(fake.Volumes, ids[0])
+	fake.Unlock()
+	aborted(s, rep.NextToken)
+
+	// a volume added before the position of a token
+	s, fake, ids = newListService(3, 2)
+	rep, err = list(s, "")
+	assert.NoError(t, err)
+	fake.Lock()
+	fake.Volumes["0"] = &siotypes.Volume{
+		ID:            "0",
+		StoragePoolID: fake.Volumes[ids[0]].StoragePoolID,
+	}
+	fake.Unlock()
+	aborted(s, rep.NextToken)
+
+	// a pool removed
+	s, fake, _ = newListService(3, 2)
+	rep, err = list(s, "")
+	assert.NoError(t, err)
+	p, _ := fake.FindStoragePool("", "pool1", "")
+	fake.Lock()
+	delete(fake.StoragePools, p.ID)
+	fake.Unlock()
+	aborted(s, rep.NextToken)
+
+	// volumes changing after the position of a token are listed as they
+	// are when reached
+	s, fake, ids = newListService(3, 2)
+	rep, err = list(s, "")
+	assert.NoError(t, err)
+	fake.Lock()
+	delete(fake.Volumes, ids[4])
+	fake.Unlock()
+	rep, err = list(s, rep.NextToken)
+	assert.NoError(t, err)
+	assert.Len(t, rep.Entries, 2)
+	assert.Equal(t, ids[2], rep.Entries[0].Volume.Id)
+	assert.Equal(t, ids[3], rep.Entries[1].Volume.Id)
+}
+
+func TestListVolumesInterleaved(t *testing.T) {
+	ctx := context.Background()
+	s, _, ids := newListService(5, 0, 4, 3)
+
+	// two listings with different page sizes take turns, neither seeing
+	// the other's pages
+	var (
+		listed [2][]string
+		tokens [2]string
+		done   [2]bool
+	)
+	for !done[0] || !done[1] {
+		for i, max := range []int32{2, 3} {
+			if done[i] {
+				continue
+			}
+			rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{
+				MaxEntries:    max,
+				StartingToken: tokens[i],
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.True(t, len(rep.Entries) <= int(max))
+			for _, e := range rep.Entries {
+				listed[i] = append(listed[i], e.Volume.Id)
+			}
+			tokens[i] = rep.NextToken
+			done[i] = rep.NextToken == ""
+		}
+	}
+	assert.Equal(t, ids, listed[0])
+	assert.Equal(t, ids, listed[1])
+}
+
+func TestListVolumesLarge(t *testing.T) {
+	ctx := context.Background()
+	s, fake, ids := newListService(5000, 5000, 5000, 5000)
+
+	// the first page only fetches the volumes of the first pool
+	rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 100})
+	assert.NoError(t, err)
+	assert.Len(t, rep.Entries, 100)
+	assert.NotEmpty(t, rep.NextToken)
+	assert.Equal(t, 1, fake.Calls["GetStoragePoolVolumes"])
+	assert.Equal(t, 0, fake.Calls["GetVolume"])
+
+	// each later page only fetches the pools it covers
+	fake.Calls["GetStoragePoolVolumes"] = 0
+	listed, tokens := listAll(t, s, 1000)
+	assert.Equal(t, ids, listed)
+	assert.Len(t, tokens, 19)
+	assert.Equal(t, 23, fake.Calls["GetStoragePoolVolumes"])
+}
+
+func BenchmarkListVolumesFirstPage(b *testing.B) {
+	s, _, _ := newListService(5000, 5000, 5000, 5000)
+	req := &csi.ListVolumesRequest{MaxEntries: 100}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.ListVolumes(context.Background(), req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// partialAdmin lists, with the volumes of each pool, volumes the gateway
+// reported only in part
+type partialAdmin struct {
+	ScaleIOAdmin
+	partial []*siotypes.Volume
+}
+
+func (a *partialAdmin) GetStoragePoolVolumes(
+	pool *siotypes.StoragePool) ([]*siotypes.Volume, error) {
+
+	vols, err := a.ScaleIOAdmin.GetStoragePoolVolumes(pool)
+	return append(vols, a.partial...), err
+}
+
+func TestListVolumesIncomplete(t *testing.T) {
+	s, fake, ids := newListService(1)
+	s.adminClient = &partialAdmin{ScaleIOAdmin: fake, partial: []*siotypes.Volume{
+		nil,
+		{Name: "no-id", SizeInKb: 8 * kiBytesInGiB},
+		{ID: "deleting1", SizeInKb: -1},
+		{ID: "deleting2", SizeInKb: 8 * kiBytesInGiB,
+			MappedSdcInfo: []*siotypes.MappedSdcInfo{nil, {SdcID: "sdc1"}}},
+	}}
+
+	rep, err := s.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, rep.Entries, 3)
+	byID := map[string]*csi.Volume{}
+	for _, e := range rep.Entries {
+		byID[e.Volume.Id] = e.Volume
+	}
+	assert.Empty(t, byID[ids[0]].Attributes[KeyState])
+	assert.Equal(t, int64(8*bytesInGiB), byID[ids[0]].CapacityBytes)
+
+	// volumes reported in part are flagged, with what is known of them
+	assert.Equal(t, stateIncomplete, byID["deleting1"].Attributes[KeyState])
+	assert.Equal(t, int64(0), byID["deleting1"].CapacityBytes)
+	assert.Equal(t, stateIncomplete, byID["deleting2"].Attributes[KeyState])
+	assert.Equal(t, int64(8*bytesInGiB), byID["deleting2"].CapacityBytes)
+	assert.Equal(t, "sdc1", byID["deleting2"].Attributes[KeyMappedSDCs])
+	assert.Equal(t, "false", byID["deleting2"].Attributes[KeyAbnormal])
+
+	// or left out
+	s.opts.ListExcludeIncomplete = true
+	rep, err = s.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, rep.Entries, 1)
+	assert.Equal(t, ids[0], rep.Entries[0].Volume.Id)
+
+	// the volumes command lists them the same way
+	s.opts.Endpoint, s.opts.User, s.opts.Password =
+		"https://gw/api", "admin", "password"
+	res, err := s.volumesCommand(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, res, 1)
+	s.opts.ListExcludeIncomplete = false
+	res, err = s.volumesCommand(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, res, 3)
+}
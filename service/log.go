@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/middleware/logging"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// setLogFormat sets the format of the plug-in's log output. Text remains
+// the default.
+func setLogFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", logFormatText:
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format: %s, must be %s or %s",
+			format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// parseLogLevel parses the value of EnvLogLevel. Trace is accepted for
+// the most verbose output, which is the same as debug.
+func parseLogLevel(v string) (log.Level, error) {
+	switch strings.ToLower(v) {
+	case "error":
+		return log.ErrorLevel, nil
+	case "warn", "warning":
+		return log.WarnLevel, nil
+	case "info":
+		return log.InfoLevel, nil
+	case "debug", "trace":
+		return log.DebugLevel, nil
+	}
+	return 0, fmt.Errorf(
+		"invalid log level: %s, must be error, warn, info, debug or trace", v)
+}
+
+// setLogLevel sets the level of the plug-in's log output from EnvLogLevel
+// or, if that isn't set, EnvDebug. The level set by gocsi, from X_CSI_DEBUG
+// or X_CSI_LOG_LEVEL, is kept if neither is set. It returns whether debug
+// output is enabled.
+func setLogLevel(ctx context.Context) (bool, error) {
+	if v, ok := csictx.LookupEnv(ctx, EnvLogLevel); ok && v != "" {
+		lvl, err := parseLogLevel(v)
+		if err != nil {
+			return false, err
+		}
+		log.SetLevel(lvl)
+	} else if v, ok := csictx.LookupEnv(ctx, EnvDebug); ok {
+		debug, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a boolean", EnvDebug, v)
+		}
+		if debug {
+			log.SetLevel(log.DebugLevel)
+		}
+	}
+	return log.GetLevel() >= log.DebugLevel, nil
+}
+
+// debugWriter writes the request and response logs of gocsi's logging
+// interceptor at debug level, as gocsi itself does
+type debugWriter struct{}
+
+func (debugWriter) Write(p []byte) (int, error) {
+	log.Debug(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// debugInterceptors returns the interceptors that log requests and
+// responses when debug output is enabled by the plug-in's own settings.
+// gocsi only adds them itself for X_CSI_DEBUG, X_CSI_REQ_LOGGING and
+// X_CSI_REP_LOGGING.
+func debugInterceptors(ctx context.Context) []grpc.UnaryServerInterceptor {
+	isSet := func(n string) bool {
+		b, _ := strconv.ParseBool(csictx.Getenv(ctx, n))
+		return b
+	}
+	withReq := !isSet(gocsi.EnvVarReqLogging)
+	withRep := !isSet(gocsi.EnvVarRepLogging)
+	if !withReq && !withRep {
+		return nil
+	}
+
+	var opts []logging.Option
+	if withReq {
+		opts = append(opts, logging.WithRequestLogging(debugWriter{}))
+	}
+	if withRep {
+		opts = append(opts, logging.WithResponseLogging(debugWriter{}))
+	}
+	return []grpc.UnaryServerInterceptor{logging.NewServerLogger(opts...)}
+}
+
+// logFields returns the fields that identify the request in ctx, by the
+// request ID injected by gocsi, and the volume it concerns, if volID is not
+// empty
+func logFields(ctx context.Context, volID string) log.Fields {
+	f := log.Fields{}
+	if id, ok := csictx.GetRequestID(ctx); ok {
+		f["reqID"] = id
+	}
+	if volID != "" {
+		f["volumeID"] = volID
+	}
+	return f
+}
+
+// reqLog returns a log entry carrying the fields that identify the request
+// in ctx, and the volume it concerns
+func reqLog(ctx context.Context, volID string) *log.Entry {
+	return log.WithFields(logFields(ctx, volID))
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rexray/gocsi"
+	csictx "github.com/rexray/gocsi/context"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestLogFields(t *testing.T) {
+	assert.Equal(t, log.Fields{}, logFields(context.Background(), ""))
+
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(csictx.RequestIDKey, "42"))
+	assert.Equal(t,
+		log.Fields{"reqID": uint64(42), "volumeID": "d0f055a700000000"},
+		logFields(ctx, "d0f055a700000000"))
+}
+
+func TestSetLogFormat(t *testing.T) {
+	defer log.SetFormatter(&log.TextFormatter{})
+
+	assert.NoError(t, setLogFormat(""))
+	assert.NoError(t, setLogFormat("text"))
+	assert.Error(t, setLogFormat("xml"))
+
+	assert.NoError(t, setLogFormat("JSON"))
+	_, ok := log.StandardLogger().Formatter.(*log.JSONFormatter)
+	assert.True(t, ok)
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+
+	level := func(env map[string]string) (log.Level, bool, error) {
+		log.SetLevel(log.InfoLevel)
+		ctx := csictx.WithLookupEnv(context.Background(),
+			func(k string) (string, bool) {
+				v, ok := env[k]
+				return v, ok
+			})
+		debug, err := setLogLevel(ctx)
+		return log.GetLevel(), debug, err
+	}
+
+	tests := []struct {
+		env   map[string]string
+		level log.Level
+		debug bool
+	}{
+		{nil, log.InfoLevel, false},
+		{map[string]string{EnvDebug: "true"}, log.DebugLevel, true},
+		{map[string]string{EnvDebug: "false"}, log.InfoLevel, false},
+		{map[string]string{EnvLogLevel: "warn"}, log.WarnLevel, false},
+		{map[string]string{EnvLogLevel: "TRACE"}, log.DebugLevel, true},
+		{map[string]string{EnvLogLevel: "error", EnvDebug: "true"},
+			log.ErrorLevel, false},
+	}
+	for _, tt := range tests {
+		lvl, debug, err := level(tt.env)
+		assert.NoError(t, err, tt.env)
+		assert.Equal(t, tt.level, lvl, tt.env)
+		assert.Equal(t, tt.debug, debug, tt.env)
+	}
+
+	for _, env := range []map[string]string{
+		{EnvLogLevel: "verbose"},
+		{EnvDebug: "maybe"},
+	} {
+		_, _, err := level(env)
+		assert.Error(t, err, env)
+	}
+}
+
+func TestDebugInterceptors(t *testing.T) {
+	env := map[string]string{}
+	ctx := csictx.WithLookupEnv(context.Background(),
+		func(k string) (string, bool) {
+			v, ok := env[k]
+			return v, ok
+		})
+
+	// requests and responses are logged
+	assert.Len(t, debugInterceptors(ctx), 1)
+
+	// unless gocsi already logs them
+	env[gocsi.EnvVarReqLogging] = "true"
+	assert.Len(t, debugInterceptors(ctx), 1)
+	env[gocsi.EnvVarRepLogging] = "true"
+	assert.Empty(t, debugInterceptors(ctx))
+}
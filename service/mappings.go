@@ -0,0 +1,237 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// sdcMappingsTTL is how long the volumes mapped to an SDC, as listed when
+// unpublishing from it or counting them, are used for. A node being drained
+// has each of its volumes unpublished in quick succession, which then share
+// one listing rather than each reading its volume. 0 disables sharing.
+var sdcMappingsTTL = 5 * time.Second
+
+// sdcMappings is a listing of the volumes mapped to an SDC, which is
+// shared by the requests that want it while it is being made
+type sdcMappings struct {
+	// listed is when the listing was started
+	listed time.Time
+
+	// done is closed once vols, or err, is set
+	done chan struct{}
+	vols map[string]*siotypes.Volume
+	err  error
+}
+
+// mappedVolume returns the volume volID as it was listed among the volumes
+// mapped to the SDC sdcID within sdcMappingsTTL, listing them if need be.
+// nil is returned if it wasn't listed, if its mappings have changed since,
+// or if they couldn't be listed, in which case the volume is to be read
+// instead. Only a canceled request returns an error.
+func (s *service) mappedVolume(
+	ctx context.Context, sdcID, volID string) (*siotypes.Volume, error) {
+
+	if sdcMappingsTTL <= 0 {
+		return nil, nil
+	}
+	m, err := s.sdcListing(ctx, sdcID, false)
+	if err != nil {
+		return nil, err
+	}
+	if m.err != nil {
+		reqLog(ctx, volID).WithError(m.err).Debug(
+			"unable to list volumes mapped to node, reading volume")
+		return nil, nil
+	}
+
+	vol, ok := m.vols[volID]
+	if !ok || time.Since(m.listed) > sdcMappingsTTL {
+		return nil, nil
+	}
+	s.mappingsMu.Lock()
+	defer s.mappingsMu.Unlock()
+	if t, ok := s.remapped[volID]; ok && !m.listed.After(t) {
+		return nil, nil
+	}
+	return vol, nil
+}
+
+// sdcListing returns the listing of the volumes mapped to the SDC sdcID
+// started within sdcMappingsTTL, or a new one, once it is done. Requests
+// that want a listing while one is being made share it. If exact is set,
+// a listing started before any volume was remapped isn't used.
+func (s *service) sdcListing(
+	ctx context.Context, sdcID string, exact bool) (*sdcMappings, error) {
+
+	s.mappingsMu.Lock()
+	m, ok := s.mappings[sdcID]
+	if !ok || time.Since(m.listed) > sdcMappingsTTL ||
+		(exact && s.remappedSince(m.listed)) {
+		m = &sdcMappings{listed: time.Now(), done: make(chan struct{})}
+		if sdcMappingsTTL > 0 {
+			if s.mappings == nil {
+				s.mappings = map[string]*sdcMappings{}
+			}
+			s.mappings[sdcID] = m
+		}
+		s.mappingsMu.Unlock()
+		s.listMappings(sdcID, m)
+	} else {
+		s.mappingsMu.Unlock()
+	}
+
+	select {
+	case <-m.done:
+		return m, nil
+	case <-ctx.Done():
+		return nil, canceledErr(ctx, "listing volumes mapped to node")
+	}
+}
+
+// listMappings lists the volumes mapped to the SDC sdcID into m. A listing
+// that fails is dropped, so that the next request tries again.
+func (s *service) listMappings(sdcID string, m *sdcMappings) {
+	defer close(m.done)
+
+	s.metrics.gatewayCall("GetSdcVolumes")
+	vols, err := s.adminClient.GetSdcVolumes(sdcID)
+	if err != nil {
+		m.err = err
+		s.mappingsMu.Lock()
+		defer s.mappingsMu.Unlock()
+		if s.mappings[sdcID] == m {
+			delete(s.mappings, sdcID)
+		}
+		return
+	}
+	m.vols = make(map[string]*siotypes.Volume, len(vols))
+	for _, vol := range vols {
+		m.vols[vol.ID] = vol
+	}
+}
+
+// defaultMappingCacheTTL is how long, by default, the SDCs a volume was
+// last seen mapped to are trusted for
+const defaultMappingCacheTTL = 5 * time.Second
+
+// volMappings are the SDCs a volume was mapped to, as of a time
+type volMappings struct {
+	sdcs map[string]bool
+	at   time.Time
+}
+
+// cacheMappings records the SDCs vol is mapped to, as read from the
+// gateway by a request made at the given time
+func (s *service) cacheMappings(vol *siotypes.Volume, at time.Time) {
+	ttl := s.opts.MappingCacheTTL
+	if ttl <= 0 {
+		return
+	}
+	sdcs := make(map[string]bool, len(vol.MappedSdcInfo))
+	for _, m := range vol.MappedSdcInfo {
+		if m != nil {
+			sdcs[m.SdcID] = true
+		}
+	}
+
+	s.mappingsMu.Lock()
+	defer s.mappingsMu.Unlock()
+	if s.volMappings == nil {
+		s.volMappings = map[string]volMappings{}
+	}
+	now := time.Now()
+	for id, m := range s.volMappings {
+		if now.Sub(m.at) > ttl {
+			delete(s.volMappings, id)
+		}
+	}
+	if m, ok := s.volMappings[vol.ID]; ok && m.at.After(at) {
+		return
+	}
+	s.volMappings[vol.ID] = volMappings{sdcs: sdcs, at: at}
+}
+
+// noteMapping records that the volume volID was just mapped to the SDC
+// sdcID, or unmapped from it, if the SDCs it was mapped to before were
+// recorded within MappingCacheTTL. It must be called once the change was
+// recorded by setRemapped, which the record is then newer than.
+func (s *service) noteMapping(volID, sdcID string, mapped bool) {
+	s.mappingsMu.Lock()
+	defer s.mappingsMu.Unlock()
+	m, ok := s.volMappings[volID]
+	if !ok || time.Since(m.at) > s.opts.MappingCacheTTL {
+		return
+	}
+	sdcs := make(map[string]bool, len(m.sdcs)+1)
+	for id := range m.sdcs {
+		sdcs[id] = true
+	}
+	if mapped {
+		sdcs[sdcID] = true
+	} else {
+		delete(sdcs, sdcID)
+	}
+	s.volMappings[volID] = volMappings{sdcs: sdcs, at: time.Now()}
+}
+
+// forgetMappings drops the SDCs recorded for the volume volID, which was
+// removed
+func (s *service) forgetMappings(volID string) {
+	s.mappingsMu.Lock()
+	defer s.mappingsMu.Unlock()
+	delete(s.volMappings, volID)
+}
+
+// knownUnmapped returns whether the volume volID was recorded, within
+// MappingCacheTTL and since its mappings were last changed, as not mapped
+// to the SDC sdcID. Anything else, including a record of the volume being
+// mapped to it, is left for the gateway to tell.
+func (s *service) knownUnmapped(volID, sdcID string) bool {
+	s.mappingsMu.Lock()
+	defer s.mappingsMu.Unlock()
+	m, ok := s.volMappings[volID]
+	if !ok || m.sdcs[sdcID] || time.Since(m.at) > s.opts.MappingCacheTTL {
+		return false
+	}
+	if t, ok := s.remapped[volID]; ok && !m.at.After(t) {
+		return false
+	}
+	return true
+}
+
+// remappedSince returns whether any volume was remapped since t. The
+// mappings lock must be held.
+func (s *service) remappedSince(t time.Time) bool {
+	for _, r := range s.remapped {
+		if !t.After(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// setRemapped records that the mappings of a volume were changed, so that
+// listings started before are no longer used for it
+func (s *service) setRemapped(volID string) {
+	s.mappingsMu.Lock()
+	defer s.mappingsMu.Unlock()
+
+	if s.remapped == nil {
+		s.remapped = map[string]time.Time{}
+	}
+	// changes are kept for as long as listings, or the SDCs of volumes,
+	// made before them may be
+	ttl := sdcMappingsTTL
+	if s.opts.MappingCacheTTL > ttl {
+		ttl = s.opts.MappingCacheTTL
+	}
+	now := time.Now()
+	for id, t := range s.remapped {
+		if now.Sub(t) > ttl {
+			delete(s.remapped, id)
+		}
+	}
+	s.remapped[volID] = now
+}
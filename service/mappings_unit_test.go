@@ -0,0 +1,263 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+func TestUnpublishSharesMappings(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	sdc := fake.AddSdc("SDC-1")
+
+	var ids []string
+	for i := 0; i < 10; i++ {
+		id := fake.AddVolume(fmt.Sprintf("vol%d", i), "pool", 8*kiBytesInGiB)
+		assert.NoError(t, fake.MapVolumeSdc(&siotypes.Volume{ID: id},
+			&siotypes.MapVolumeSdcParam{SdcID: sdc}))
+		ids = append(ids, id)
+	}
+	unpub := func(id string) error {
+		_, err := s.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+		return err
+	}
+
+	// the volumes of a node being drained are listed once, rather than
+	// each read, however many are unpublished at once
+	var wg sync.WaitGroup
+	for _, id := range ids[:5] {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			assert.NoError(t, unpub(id))
+		}(id)
+	}
+	wg.Wait()
+	for _, id := range ids[5:] {
+		assert.NoError(t, unpub(id))
+	}
+	assert.Equal(t, 1, fake.Calls["GetSdcVolumes"])
+	assert.Equal(t, 0, fake.Calls["GetVolume"])
+	assert.Equal(t, 10, fake.Calls["UnmapVolumeSdc"])
+	for _, id := range ids {
+		assert.Empty(t, fake.Volumes[id].MappedSdcInfo)
+	}
+
+	// a volume unpublished since it was listed is read again, and found
+	// to be unpublished already
+	assert.NoError(t, unpub(ids[0]))
+	assert.Equal(t, 1, fake.Calls["GetVolume"])
+	assert.Equal(t, 10, fake.Calls["UnmapVolumeSdc"])
+
+	// as is one published since
+	_, err := s.ControllerPublishVolume(ctx,
+		&csi.ControllerPublishVolumeRequest{
+			VolumeId: ids[0],
+			NodeId:   "sdc-1",
+			VolumeCapability: mountCap(
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		})
+	assert.NoError(t, err)
+	reads := fake.Calls["GetVolume"]
+	assert.NoError(t, unpub(ids[0]))
+	assert.Equal(t, reads+1, fake.Calls["GetVolume"])
+	assert.Empty(t, fake.Volumes[ids[0]].MappedSdcInfo)
+	assert.Equal(t, 1, fake.Calls["GetSdcVolumes"])
+}
+
+func TestUnpublishMappingsUnavailable(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	sdc := fake.AddSdc("SDC-1")
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	assert.NoError(t, fake.MapVolumeSdc(&siotypes.Volume{ID: id},
+		&siotypes.MapVolumeSdcParam{SdcID: sdc}))
+
+	// a failed listing falls back to reading the volume, and isn't kept
+	fake.Errors["GetSdcVolumes"] = errors.New("gateway busy")
+	_, err := s.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+	assert.NoError(t, err)
+	assert.Empty(t, fake.Volumes[id].MappedSdcInfo)
+	assert.Equal(t, 1, fake.Calls["GetVolume"])
+	assert.Empty(t, s.mappings)
+}
+
+func TestUnpublishMappingCache(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.MappingCacheTTL = time.Minute
+	sdc := fake.AddSdc("SDC-1")
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+
+	pub := func() error {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   "sdc-1",
+				VolumeCapability: mountCap(
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+		return err
+	}
+	unpub := func() error {
+		_, err := s.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+		return err
+	}
+
+	// a volume just published is read before it is unpublished, and an
+	// unpublish retried after is answered without reading it
+	assert.NoError(t, pub())
+	assert.NoError(t, unpub())
+	assert.Empty(t, fake.Volumes[id].MappedSdcInfo)
+	reads := fake.Calls["GetVolume"]
+	assert.NoError(t, unpub())
+	assert.Equal(t, reads, fake.Calls["GetVolume"])
+	assert.Equal(t, 1, fake.Calls["UnmapVolumeSdc"])
+
+	// a record older than the TTL is checked with the gateway, which then
+	// finds the volume mapped behind the plug-in's back
+	assert.NoError(t, fake.MapVolumeSdc(&siotypes.Volume{ID: id},
+		&siotypes.MapVolumeSdcParam{SdcID: sdc}))
+	s.volMappings[id] = volMappings{at: time.Now().Add(-2 * time.Minute)}
+	assert.NoError(t, unpub())
+	assert.Equal(t, reads+1, fake.Calls["GetVolume"])
+	assert.Equal(t, 2, fake.Calls["UnmapVolumeSdc"])
+	assert.Empty(t, fake.Volumes[id].MappedSdcInfo)
+
+	// so is one made before the volume was last remapped
+	assert.NoError(t, fake.MapVolumeSdc(&siotypes.Volume{ID: id},
+		&siotypes.MapVolumeSdcParam{SdcID: sdc}))
+	s.setRemapped(id)
+	assert.NoError(t, unpub())
+	assert.Equal(t, 3, fake.Calls["UnmapVolumeSdc"])
+
+	// nothing is trusted with a TTL of 0
+	s.opts.MappingCacheTTL = 0
+	reads = fake.Calls["GetVolume"]
+	assert.NoError(t, unpub())
+	assert.Equal(t, reads+1, fake.Calls["GetVolume"])
+}
+
+// BenchmarkDrainNode unpublishes the 60 volumes mapped to a node, one at a
+// time and ten at once, as a CO draining the node does, from a gateway that
+// takes 2ms to answer. Each volume is either read before it is unmapped, or
+// found in a listing of the node's volumes shared by every unpublish.
+func BenchmarkDrainNode(b *testing.B) {
+	defer func(d time.Duration) { sdcMappingsTTL = d }(sdcMappingsTTL)
+
+	for _, bc := range []struct {
+		name    string
+		ttl     time.Duration
+		workers int
+	}{
+		{"read/serial", 0, 1},
+		{"read/parallel", 0, 10},
+		{"listed/serial", 5 * time.Second, 1},
+		{"listed/parallel", 5 * time.Second, 10},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			sdcMappingsTTL = bc.ttl
+			benchmarkDrain(b, 60, bc.workers)
+		})
+	}
+}
+
+func benchmarkDrain(b *testing.B, nvols, workers int) {
+	ctx := context.Background()
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+	sdc := fake.AddSdc("SDC-1")
+	var ids []string
+	for i := 0; i < nvols; i++ {
+		ids = append(ids, fake.AddVolume(
+			fmt.Sprintf("vol%d", i), "pool", 8*kiBytesInGiB))
+	}
+
+	gw := testutil.NewFakeGateway(fake, "admin", "password")
+	defer gw.Close()
+	routes := []string{
+		testutil.RouteGetVolume,
+		testutil.RouteGetSdcVolumes,
+		testutil.RouteUnmapVolumeSdc,
+	}
+	for _, r := range routes {
+		gw.Delay(r, 2*time.Millisecond)
+	}
+
+	svc, err := NewWithOpts(ctx, Opts{
+		Endpoint:   gw.Endpoint(),
+		User:       "admin",
+		Password:   "password",
+		SystemName: "sys",
+	}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer svc.Shutdown(ctx)
+	s := svc.(*service)
+
+	requests := func() (n int) {
+		for _, r := range routes {
+			n += gw.Requests(r)
+		}
+		return n
+	}
+
+	var total int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, id := range ids {
+			if err := fake.MapVolumeSdc(&siotypes.Volume{ID: id},
+				&siotypes.MapVolumeSdcParam{SdcID: sdc}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		s.mappingsMu.Lock()
+		s.mappings, s.remapped = nil, nil
+		s.mappingsMu.Unlock()
+		before := requests()
+		b.StartTimer()
+
+		work := make(chan string, len(ids))
+		for _, id := range ids {
+			work <- id
+		}
+		close(work)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for id := range work {
+					if _, err := s.ControllerUnpublishVolume(ctx,
+						&csi.ControllerUnpublishVolumeRequest{
+							VolumeId: id,
+							NodeId:   "sdc-1",
+						}); err != nil {
+						b.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		b.StopTimer()
+		total += requests() - before
+		b.StartTimer()
+	}
+	b.ReportMetric(float64(total)/float64(b.N), "requests/drain")
+}
@@ -0,0 +1,383 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	metricsPrefix = "csi_scaleio_"
+	metricsPath   = "/metrics"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the RPC latency
+// histogram buckets. Volume creation and mapping can take tens of seconds
+// on a busy cluster, so the buckets extend beyond the usual ten seconds.
+var latencyBuckets = []float64{
+	.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60,
+}
+
+// histogram is a cumulative histogram of observed values
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics records the plug-in's metrics, and exposes them in the
+// Prometheus text format. A nil *metrics is valid and records nothing, so
+// that call sites are cheap when metrics are disabled.
+//
+// Labels are limited to RPC method names, gRPC codes and gateway operation
+// names. Volume names and IDs, and credentials, are never recorded.
+type metrics struct {
+	sync.Mutex
+	rpcs         map[string]uint64
+	rpcErrs      map[[2]string]uint64
+	rpcLatency   map[string]*histogram
+	gatewayCalls map[string]uint64
+	gatewayAuths uint64
+
+	// gatewayErrs and gatewayLatency are recorded by tracedAdmin, by
+	// ScaleIOAdmin method
+	gatewayErrs    map[string]uint64
+	gatewayLatency map[string]*histogram
+
+	// inflight, if set, is the source of the in-flight RPC gauges
+	inflight *inflight
+
+	// endpoints are the gateways failed over between, if more than one
+	// is configured, of which activeEndpoint is in use
+	endpoints        []string
+	activeEndpoint   string
+	endpointFailover uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rpcs:         map[string]uint64{},
+		rpcErrs:      map[[2]string]uint64{},
+		rpcLatency:   map[string]*histogram{},
+		gatewayCalls: map[string]uint64{},
+
+		gatewayErrs:    map[string]uint64{},
+		gatewayLatency: map[string]*histogram{},
+	}
+}
+
+// interceptor is a unary server interceptor that records the count,
+// errors and latency of each RPC
+func (m *metrics) interceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	start := time.Now()
+	rep, err := handler(ctx, req)
+	m.observeRPC(path.Base(info.FullMethod), time.Since(start), err)
+	return rep, err
+}
+
+func (m *metrics) observeRPC(method string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	m.rpcs[method]++
+	if err != nil {
+		code := "Unknown"
+		if st, ok := status.FromError(err); ok {
+			code = st.Code().String()
+		}
+		m.rpcErrs[[2]string{method, code}]++
+	}
+
+	observeLatency(m.rpcLatency, method, d)
+}
+
+// observeLatency records d in the histogram of hists under key
+func observeLatency(hists map[string]*histogram, key string, d time.Duration) {
+	h, ok := hists[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		hists[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// observeGateway records the latency, and failure, of a gateway operation
+func (m *metrics) observeGateway(op string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+
+	if err != nil {
+		m.gatewayErrs[op]++
+	}
+	observeLatency(m.gatewayLatency, op, d)
+}
+
+// gatewayCall records a call to the ScaleIO Gateway for the named operation
+func (m *metrics) gatewayCall(op string) {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.gatewayCalls[op]++
+}
+
+// gatewayAuth records an authentication to the ScaleIO Gateway
+func (m *metrics) gatewayAuth() {
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.gatewayAuths++
+}
+
+// gatewayEndpoint records that active is the gateway in use, of endpoints,
+// and whether it was failed over to
+func (m *metrics) gatewayEndpoint(
+	endpoints []string, active string, failover bool) {
+
+	if m == nil {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	m.endpoints = endpoints
+	m.activeEndpoint = active
+	if failover {
+		m.endpointFailover++
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	fmt.Fprintf(w, "# HELP %srpc_requests_total Total RPCs received.\n",
+		metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %srpc_requests_total counter\n", metricsPrefix)
+	for _, k := range sortedKeys(m.rpcs) {
+		fmt.Fprintf(w, "%srpc_requests_total{method=%q} %d\n",
+			metricsPrefix, k, m.rpcs[k])
+	}
+
+	fmt.Fprintf(w, "# HELP %srpc_errors_total Total RPCs that failed, "+
+		"by gRPC code.\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %srpc_errors_total counter\n", metricsPrefix)
+	errKeys := make([][2]string, 0, len(m.rpcErrs))
+	for k := range m.rpcErrs {
+		errKeys = append(errKeys, k)
+	}
+	sort.Slice(errKeys, func(i, j int) bool {
+		if errKeys[i][0] != errKeys[j][0] {
+			return errKeys[i][0] < errKeys[j][0]
+		}
+		return errKeys[i][1] < errKeys[j][1]
+	})
+	for _, k := range errKeys {
+		fmt.Fprintf(w, "%srpc_errors_total{method=%q,code=%q} %d\n",
+			metricsPrefix, k[0], k[1], m.rpcErrs[k])
+	}
+
+	fmt.Fprintf(w, "# HELP %srpc_duration_seconds RPC latency.\n",
+		metricsPrefix)
+	writeHistograms(w, "rpc_duration_seconds", "method", m.rpcLatency)
+
+	if m.inflight != nil {
+		m.writeInflight(w)
+	}
+
+	fmt.Fprintf(w, "# HELP %sgateway_calls_total Total calls made to the "+
+		"ScaleIO Gateway.\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %sgateway_calls_total counter\n", metricsPrefix)
+	for _, k := range sortedKeys(m.gatewayCalls) {
+		fmt.Fprintf(w, "%sgateway_calls_total{operation=%q} %d\n",
+			metricsPrefix, k, m.gatewayCalls[k])
+	}
+
+	fmt.Fprintf(w, "# HELP %sgateway_errors_total Total ScaleIO Gateway "+
+		"operations that failed.\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %sgateway_errors_total counter\n", metricsPrefix)
+	for _, k := range sortedKeys(m.gatewayErrs) {
+		fmt.Fprintf(w, "%sgateway_errors_total{operation=%q} %d\n",
+			metricsPrefix, k, m.gatewayErrs[k])
+	}
+
+	fmt.Fprintf(w, "# HELP %sgateway_duration_seconds ScaleIO Gateway "+
+		"operation latency.\n", metricsPrefix)
+	writeHistograms(w, "gateway_duration_seconds", "operation",
+		m.gatewayLatency)
+
+	fmt.Fprintf(w, "# HELP %sgateway_authentications_total Total "+
+		"authentications to the ScaleIO Gateway.\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %sgateway_authentications_total counter\n",
+		metricsPrefix)
+	fmt.Fprintf(w, "%sgateway_authentications_total %d\n",
+		metricsPrefix, m.gatewayAuths)
+
+	if len(m.endpoints) > 0 {
+		m.writeEndpoints(w)
+	}
+}
+
+// writeEndpoints writes which of the gateways failed over between is in
+// use, and how often another was failed over to
+func (m *metrics) writeEndpoints(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %sgateway_endpoint_active Whether requests are "+
+		"made to the ScaleIO Gateway at the endpoint.\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %sgateway_endpoint_active gauge\n", metricsPrefix)
+	for _, ep := range m.endpoints {
+		active := 0
+		if ep == m.activeEndpoint {
+			active = 1
+		}
+		fmt.Fprintf(w, "%sgateway_endpoint_active{endpoint=%q} %d\n",
+			metricsPrefix, ep, active)
+	}
+
+	fmt.Fprintf(w, "# HELP %sgateway_failovers_total Total times another "+
+		"ScaleIO Gateway was failed over to.\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %sgateway_failovers_total counter\n",
+		metricsPrefix)
+	fmt.Fprintf(w, "%sgateway_failovers_total %d\n",
+		metricsPrefix, m.endpointFailover)
+}
+
+// writeInflight writes the number of RPCs in flight, and how long the
+// oldest has been running, by method. Methods that have been handled
+// before are written with zero values, so that their series don't vanish.
+func (m *metrics) writeInflight(w io.Writer) {
+	counts := map[string]uint64{}
+	oldest := map[string]time.Time{}
+	for k := range m.rpcs {
+		counts[k] = 0
+	}
+	for _, op := range m.inflight.operations() {
+		counts[op.method]++
+		if _, ok := oldest[op.method]; !ok {
+			oldest[op.method] = op.started
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP %srpc_in_flight RPCs being handled.\n",
+		metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %srpc_in_flight gauge\n", metricsPrefix)
+	for _, k := range sortedKeys(counts) {
+		fmt.Fprintf(w, "%srpc_in_flight{method=%q} %d\n",
+			metricsPrefix, k, counts[k])
+	}
+
+	fmt.Fprintf(w, "# HELP %srpc_in_flight_oldest_seconds How long the "+
+		"oldest RPC being handled has been running.\n", metricsPrefix)
+	fmt.Fprintf(w, "# TYPE %srpc_in_flight_oldest_seconds gauge\n",
+		metricsPrefix)
+	for _, k := range sortedKeys(counts) {
+		var age float64
+		if started, ok := oldest[k]; ok {
+			age = time.Since(started).Seconds()
+		}
+		fmt.Fprintf(w, "%srpc_in_flight_oldest_seconds{method=%q} %g\n",
+			metricsPrefix, k, age)
+	}
+}
+
+// writeHistograms writes the TYPE line, and the series, of the histogram
+// metric name, with hists keyed by the label named label
+func writeHistograms(
+	w io.Writer, name, label string, hists map[string]*histogram) {
+
+	fmt.Fprintf(w, "# TYPE %s%s histogram\n", metricsPrefix, name)
+	keys := make([]string, 0, len(hists))
+	for k := range hists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := hists[k]
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "%s%s_bucket{%s=%q,le=\"%g\"} %d\n",
+				metricsPrefix, name, label, k, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s%s_bucket{%s=%q,le=\"+Inf\"} %d\n",
+			metricsPrefix, name, label, k, h.count)
+		fmt.Fprintf(w, "%s%s_sum{%s=%q} %g\n",
+			metricsPrefix, name, label, k, h.sum)
+		fmt.Fprintf(w, "%s%s_count{%s=%q} %d\n",
+			metricsPrefix, name, label, k, h.count)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serveMetrics starts serving the metrics on addr, along with the debug
+// handlers, keyed by path. The listener is created before returning, so
+// that an invalid address is reported immediately.
+func serveMetrics(
+	addr string, m *metrics,
+	debug map[string]http.Handler) (*http.Server, error) {
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, m)
+	for path, h := range debug {
+		mux.Handle(path, h)
+	}
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("metrics server failed")
+		}
+	}()
+	log.WithField("addr", lis.Addr().String()).Info("serving metrics")
+
+	return srv, nil
+}
@@ -0,0 +1,55 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMetricsNil(t *testing.T) {
+	// disabled metrics must be safe to record to
+	var m *metrics
+	m.observeRPC("CreateVolume", time.Second, nil)
+	m.gatewayCall("CreateVolume")
+	m.gatewayAuth()
+	m.observeGateway("CreateVolume", time.Second, nil)
+}
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+
+	m.observeRPC("CreateVolume", 2*time.Second, nil)
+	m.observeRPC("CreateVolume", 20*time.Millisecond,
+		status.Error(codes.Internal, "vol-name must not leak"))
+	m.gatewayCall("CreateVolume")
+	m.gatewayAuth()
+	m.observeGateway("MapVolumeSdc", 3*time.Second,
+		errors.New("vol-name must not leak"))
+
+	var b bytes.Buffer
+	m.write(&b)
+	out := b.String()
+
+	for _, l := range []string{
+		`csi_scaleio_rpc_requests_total{method="CreateVolume"} 2`,
+		`csi_scaleio_rpc_errors_total{method="CreateVolume",code="Internal"} 1`,
+		`csi_scaleio_rpc_duration_seconds_bucket{method="CreateVolume",le="0.025"} 1`,
+		`csi_scaleio_rpc_duration_seconds_bucket{method="CreateVolume",le="2.5"} 2`,
+		`csi_scaleio_rpc_duration_seconds_bucket{method="CreateVolume",le="+Inf"} 2`,
+		`csi_scaleio_rpc_duration_seconds_count{method="CreateVolume"} 2`,
+		`csi_scaleio_gateway_calls_total{operation="CreateVolume"} 1`,
+		`csi_scaleio_gateway_authentications_total 1`,
+		`csi_scaleio_gateway_errors_total{operation="MapVolumeSdc"} 1`,
+		`csi_scaleio_gateway_duration_seconds_bucket{operation="MapVolumeSdc",le="2.5"} 0`,
+		`csi_scaleio_gateway_duration_seconds_bucket{operation="MapVolumeSdc",le="5"} 1`,
+		`csi_scaleio_gateway_duration_seconds_count{operation="MapVolumeSdc"} 1`,
+	} {
+		assert.Contains(t, out, l+"\n")
+	}
+	assert.NotContains(t, out, "vol-name")
+}
@@ -5,10 +5,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/akutz/gofsutil"
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	log "github.com/sirupsen/logrus"
+	"github.com/thecodeteam/goscaleio"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -51,16 +53,234 @@ func GetDevice(path string) (*Device, error) {
 	}, nil
 }
 
+// Mounter mounts filesystems and block devices on behalf of the node
+// service. It exists so that tests can run without touching the host.
+type Mounter interface {
+	// GetDevice returns the block device at path
+	GetDevice(path string) (*Device, error)
+
+	// GetMounts returns the host's mounts
+	GetMounts(ctx context.Context) ([]gofsutil.Info, error)
+
+	// GetDiskFormat returns the filesystem on disk, or an empty string if
+	// it is unformatted
+	GetDiskFormat(ctx context.Context, disk string) (string, error)
+
+	// Mount mounts the filesystem on source at target
+	Mount(ctx context.Context, source, target, fsType string,
+		opts ...string) error
+
+	// BindMount bind mounts source at target
+	BindMount(ctx context.Context, source, target string,
+		opts ...string) error
+
+	// FormatAndMount formats source with fsType, unless it is already
+	// formatted, and mounts it at target
+	FormatAndMount(ctx context.Context, source, target, fsType string,
+		opts ...string) error
+
+	// Format formats source with fsType, adding mkfsOpts to the mkfs
+	// command
+	Format(ctx context.Context, source, fsType string,
+		mkfsOpts ...string) error
+
+	// Unmount unmounts target
+	Unmount(ctx context.Context, target string) error
+
+	// ResizeFS grows the filesystem on devicePath, mounted at mountPath,
+	// to fill the device
+	ResizeFS(ctx context.Context, devicePath, mountPath, fsType string) error
+}
+
+// osMounter implements Mounter with the host's mount tools. Each is run by
+// executor, so that it is killed once the request's ctx is done rather than
+// holding the request for as long as a hung mount or mkfs runs.
+type osMounter struct {
+	executor Executor
+}
+
+func (osMounter) GetDevice(path string) (*Device, error) {
+	return GetDevice(path)
+}
+
+func (osMounter) GetMounts(ctx context.Context) ([]gofsutil.Info, error) {
+	return gofsutil.GetMounts(ctx)
+}
+
+// GetDiskFormat asks lsblk for the filesystem on disk, as gofsutil does
+func (m osMounter) GetDiskFormat(ctx context.Context, disk string) (string, error) {
+	out, err := m.executor.CombinedOutput(
+		ctx, "lsblk", "-n", "-o", "FSTYPE", disk)
+	if err != nil {
+		return "", fmt.Errorf("lsblk failed: %s: %s",
+			err, strings.TrimSpace(string(out)))
+	}
+
+	// Unformatted devices have an empty line, and those with partitions a
+	// further line for each partition
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	switch {
+	case lines[0] != "":
+		return lines[0], nil
+	case len(lines) == 1:
+		return "", nil
+	}
+	return "unknown data, probably partitions", nil
+}
+
+func (m osMounter) Mount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	if contains(opts, "bind") {
+		return m.BindMount(ctx, source, target, opts...)
+	}
+	return m.mount(ctx, source, target, fsType, opts...)
+}
+
+// BindMount bind mounts source at target, then remounts it with opts, as a
+// bind mount ignores the options it is made with
+func (m osMounter) BindMount(
+	ctx context.Context, source, target string, opts ...string) error {
+
+	if err := m.mount(ctx, source, target, "", "bind"); err != nil {
+		return err
+	}
+	remount := []string{"remount"}
+	for _, o := range opts {
+		if o != "bind" && o != "remount" {
+			remount = append(remount, o)
+		}
+	}
+	return m.mount(ctx, source, target, "", remount...)
+}
+
+// FormatAndMount mounts source, formatting it first if it turns out to be
+// unformatted, as gofsutil does. Nothing more is run once ctx is done.
+func (m osMounter) FormatAndMount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	opts = append(opts, "defaults")
+	mountErr := m.Mount(ctx, source, target, fsType, opts...)
+	if mountErr == nil || ctx.Err() != nil {
+		return mountErr
+	}
+
+	format, err := m.GetDiskFormat(ctx, source)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		if fsType == "" {
+			fsType = defaultMkfsFSType
+		}
+		if err := m.Format(ctx, source, fsType); err != nil {
+			return err
+		}
+		return m.Mount(ctx, source, target, fsType, opts...)
+	}
+	if fsType == "" || fsType == format {
+		return mountErr
+	}
+	return fmt.Errorf("failed to mount volume as %q; already contains %s: %s",
+		fsType, format, mountErr)
+}
+
+func (m osMounter) Format(
+	ctx context.Context, source, fsType string, mkfsOpts ...string) error {
+
+	args := mkfsArgs(source, fsType, mkfsOpts)
+	log.WithField("command", "mkfs."+fsType+" "+strings.Join(args, " ")).Info(
+		"formatting volume")
+	out, err := m.executor.CombinedOutput(ctx, "mkfs."+fsType, args...)
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (m osMounter) Unmount(ctx context.Context, target string) error {
+	log.WithField("command", "umount "+target).Info("unmounting")
+	out, err := m.executor.CombinedOutput(ctx, "umount", target)
+	if err != nil {
+		return fmt.Errorf("umount failed: %s: %s",
+			err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (m osMounter) ResizeFS(
+	ctx context.Context, devicePath, mountPath, fsType string) error {
+
+	var name, arg string
+	switch {
+	case strings.HasPrefix(fsType, "ext"):
+		name, arg = "resize2fs", devicePath
+	case fsType == "xfs":
+		name, arg = "xfs_growfs", mountPath
+	default:
+		return fmt.Errorf("resizing %s filesystems is not supported", fsType)
+	}
+	if out, err := m.executor.CombinedOutput(ctx, name, arg); err != nil {
+		return fmt.Errorf("%s failed: %s: %s",
+			name, err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// mount runs mount with the arguments gofsutil would give it
+func (m osMounter) mount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	args := gofsutil.MakeMountArgs(ctx, source, target, fsType, opts...)
+	log.WithField("command", "mount "+strings.Join(args, " ")).Info(
+		"mounting")
+	out, err := m.executor.CombinedOutput(ctx, "mount", args...)
+	if err != nil {
+		return fmt.Errorf("mount failed: %s: %s",
+			err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// publishOpts holds the node service settings that affect how a volume is
+// published
+type publishOpts struct {
+	// checkFS, if not nil, is run against the device before its filesystem
+	// is first mounted
+	checkFS fsChecker
+
+	// xfsNoUUID causes xfs filesystems to be mounted with the nouuid
+	// option, so that clones may be mounted alongside their parent
+	xfsNoUUID bool
+
+	// defaultFSType is the filesystem type used when the request does not
+	// give one
+	defaultFSType string
+
+	// mkfsOptions are added to the mkfs command when an unformatted volume
+	// is formatted
+	mkfsOptions []string
+
+	// targets records the target paths created when publishing
+	targets *createdTargets
+
+	// ownership, if not nil, is given the root of a filesystem that still
+	// has the ownership mkfs gave it
+	ownership *rootOwnership
+}
+
 // publishVolume uses the parameters in req to bindmount the underlying block
-// device to the requested target path. A private mount is performed first
-// within the given privDir directory.
+// device to the requested target path. A private mount, named after the
+// ScaleIO volume ID id, is performed first within the given privDir
+// directory.
 //
 // publishVolume handles both Mount and Block access types
 func publishVolume(
+	ctx context.Context,
+	mounter Mounter,
 	req *csi.NodePublishVolumeRequest,
-	privDir, device string) error {
-
-	id := req.GetVolumeId()
+	id, privDir, device string,
+	opts publishOpts) (err error) {
 
 	target := req.GetTargetPath()
 	if target == "" {
@@ -83,27 +303,18 @@ func publishVolume(
 	}
 
 	// make sure device is valid
-	sysDevice, err := GetDevice(device)
+	sysDevice, err := mounter.GetDevice(device)
 	if err != nil {
 		return status.Errorf(codes.Internal,
 			"error getting block device for volume: %s, err: %s",
 			id, err.Error())
 	}
 
-	// make sure target is created
-	tgtStat, err := os.Stat(target)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return status.Errorf(codes.FailedPrecondition,
-				"publish target: %s not pre-created", target)
-		}
-		return status.Errorf(codes.Internal,
-			"failed to stat target, err: %s", err.Error())
-	}
-
 	// make sure privDir exists and is a directory
-	if _, err := mkdir(privDir); err != nil {
-		return err
+	if err := os.MkdirAll(privDir, 0755); err != nil {
+		return status.Errorf(codes.Internal,
+			"unable to create private mount directory %s: %s",
+			privDir, err.Error())
 	}
 
 	isBlock := false
@@ -129,32 +340,51 @@ func publishVolume(
 			"volume access type required")
 	}
 
-	// check that target is right type for vol type
-	if !(tgtStat.IsDir() == !isBlock) {
-		return status.Errorf(codes.FailedPrecondition,
-			"target: %s wrong type (file vs dir) Access Type", target)
+	// make sure target is created, and is the right type for the access
+	// type. A target created here is removed again if publishing fails.
+	created, err := opts.targets.ensure(target, isBlock)
+	if err != nil {
+		return err
+	}
+	if created {
+		defer func() {
+			if err != nil {
+				opts.targets.remove(target)
+			}
+		}()
 	}
 
 	// Path to mount device to
 	privTgt := getPrivateMountPoint(privDir, id)
 
-	f := log.Fields{
-		"id":           id,
-		"volumePath":   sysDevice.FullPath,
-		"device":       sysDevice.RealDev,
-		"target":       target,
-		"privateMount": privTgt,
-	}
-
-	ctx := context.Background()
+	f := logFields(ctx, id)
+	f["volumePath"] = sysDevice.FullPath
+	f["device"] = sysDevice.RealDev
+	f["target"] = target
+	f["privateMount"] = privTgt
 
-	// Check if device is already mounted
-	devMnts, err := getDevMounts(sysDevice)
+	mnts, err := mounter.GetMounts(ctx)
 	if err != nil {
 		return status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
 			err.Error())
 	}
+	mnts = resolveMountDevices(ctx, mounter, mnts)
+
+	// A retried publish may find the target already mounted. That is only
+	// acceptable if it is our device, which is verified further below
+	for _, m := range mnts {
+		if m.Path == target && !isDevMount(m, sysDevice) {
+			log.WithFields(f).WithField("mountedDevice", m.Device).Error(
+				"target already in use by another device")
+			return status.Errorf(codes.AlreadyExists,
+				"target: %s already mounted from device: %s",
+				target, m.Device)
+		}
+	}
+
+	// Check if device is already mounted
+	devMnts := filterDevMounts(mnts, sysDevice)
 
 	if len(devMnts) == 0 {
 		// Device isn't mounted anywhere, do the private mount
@@ -181,7 +411,7 @@ func publishVolume(
 			// If the private mount is not in use, it's okay to re-use it. But make sure
 			// it's not in use first
 
-			mnts, err := gofsutil.GetMounts(ctx)
+			mnts, err := mounter.GetMounts(ctx)
 			if err != nil {
 				return status.Errorf(codes.Internal,
 					"could not reliably determine existing mount status: %s",
@@ -199,16 +429,41 @@ func publishVolume(
 
 		if !isBlock {
 			fs := mntVol.GetFsType()
-			mntFlags := mntVol.GetMountFlags()
+			if fs == "" {
+				fs = opts.defaultFSType
+			}
+			roMode := accMode.GetMode() ==
+				csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
 
-			if err := handlePrivFSMount(
-				ctx, accMode, sysDevice, mntFlags, fs, privTgt); err != nil {
-				return err
+			if opts.checkFS != nil {
+				if err := opts.checkFS(ctx, sysDevice, roMode); err != nil {
+					return err
+				}
+			}
+
+			// The requested fs type may be empty, in which case whatever
+			// is already on the device is mounted
+			mntFS := fs
+			if mntFS == "" && opts.xfsNoUUID {
+				if mntFS, err = mounter.GetDiskFormat(
+					ctx, sysDevice.FullPath); err != nil {
+					log.WithFields(f).WithError(err).Debug(
+						"unable to determine existing filesystem")
+				}
+			}
+			mntFlags := privMountFlags(
+				mntVol.GetMountFlags(), mntFS, roMode, opts.xfsNoUUID)
+
+			if err := handlePrivFSMount(ctx, mounter, accMode, sysDevice,
+				mntFlags, fs, privTgt, opts.mkfsOptions); err != nil {
+				return stageErr(ctx, "mounting private mount", err)
 			}
 		} else {
-			if err := gofsutil.BindMount(ctx, sysDevice.FullPath, privTgt); err != nil {
-				return status.Errorf(codes.Internal,
-					"failure bind-mounting block device to private mount: %s", err.Error())
+			if err := mounter.BindMount(ctx, sysDevice.FullPath, privTgt); err != nil {
+				return stageErr(ctx, "mounting private mount", status.Errorf(
+					codes.Internal,
+					"failure bind-mounting block device to private mount: %s",
+					err.Error()))
 			}
 		}
 
@@ -239,7 +494,18 @@ func publishVolume(
 		}
 	}
 
-	// Private mount in place, now bind mount to target path
+	// Private mount in place. A new filesystem is given the ownership
+	// requested, which is checked on every publish so that a publish that
+	// failed after mounting still gives it once retried.
+	if !isBlock && opts.ownership != nil && accMode.GetMode() !=
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
+		if err := applyRootOwnership(
+			ctx, id, privTgt, opts.ownership); err != nil {
+			return err
+		}
+	}
+
+	// Now bind mount to target path
 
 	// If mounts already existed for this device, check if mount to
 	// target path was already there
@@ -253,9 +519,8 @@ func publishVolume(
 					rwo = "ro"
 				}
 				if !contains(m.Opts, rwo) {
-					return status.Error(codes.Internal,
+					return status.Error(codes.AlreadyExists,
 						"volume previously published with different options")
-
 				}
 				// Existing mount satisfies request
 				log.WithFields(f).Debug("volume already published to target")
@@ -274,10 +539,10 @@ func publishVolume(
 			mntFlags = append(mntFlags, "ro")
 		}
 	}
-	if err := gofsutil.BindMount(ctx, privTgt, target, mntFlags...); err != nil {
-		return status.Errorf(codes.Internal,
+	if err := mounter.BindMount(ctx, privTgt, target, mntFlags...); err != nil {
+		return stageErr(ctx, "mounting target", status.Errorf(codes.Internal,
 			"error publish volume to target path: %s",
-			err.Error())
+			err.Error()))
 	}
 
 	return nil
@@ -285,22 +550,27 @@ func publishVolume(
 
 func handlePrivFSMount(
 	ctx context.Context,
+	mounter Mounter,
 	accMode *csi.VolumeCapability_AccessMode,
 	sysDevice *Device,
 	mntFlags []string,
-	fs, privTgt string) error {
+	fs, privTgt string,
+	mkfsOpts []string) error {
 
 	// If read-only access mode, we don't allow formatting
 	if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY {
-		mntFlags = append(mntFlags, "ro")
-		if err := gofsutil.Mount(ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
+		if err := mounter.Mount(ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
 			return status.Errorf(codes.Internal,
 				"error performing private mount: %s",
 				err.Error())
 		}
 		return nil
 	} else if accMode.GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
-		if err := gofsutil.FormatAndMount(ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
+		if len(mkfsOpts) > 0 {
+			return formatAndMount(
+				ctx, mounter, sysDevice, mntFlags, fs, privTgt, mkfsOpts)
+		}
+		if err := mounter.FormatAndMount(ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
 			return status.Errorf(codes.Internal,
 				"error performing private mount: %s",
 				err.Error())
@@ -310,6 +580,97 @@ func handlePrivFSMount(
 	return status.Error(codes.Internal, "Invalid access mode")
 }
 
+// formatAndMount formats the device with fs and mkfsOpts, unless it is
+// already formatted, and mounts it at privTgt. The mounter's FormatAndMount
+// is not used as it can't pass options to mkfs.
+func formatAndMount(
+	ctx context.Context,
+	mounter Mounter,
+	sysDevice *Device,
+	mntFlags []string,
+	fs, privTgt string,
+	mkfsOpts []string) error {
+
+	format, err := mounter.GetDiskFormat(ctx, sysDevice.FullPath)
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			"error determining existing filesystem: %s", err.Error())
+	}
+	switch {
+	case format == "":
+		if fs == "" {
+			fs = defaultMkfsFSType
+		}
+		if err := mounter.Format(
+			ctx, sysDevice.FullPath, fs, mkfsOpts...); err != nil {
+			return status.Errorf(codes.Internal,
+				"error formatting volume: %s", err.Error())
+		}
+	case fs != "" && format != fs:
+		return status.Errorf(codes.Internal,
+			"error performing private mount: volume already contains %s",
+			format)
+	}
+	if err := mounter.Mount(
+		ctx, sysDevice.FullPath, privTgt, fs, mntFlags...); err != nil {
+		return status.Errorf(codes.Internal,
+			"error performing private mount: %s",
+			err.Error())
+	}
+	return nil
+}
+
+// defaultMkfsFSType is the filesystem type a volume is formatted with when
+// none is requested, as by gofsutil
+const defaultMkfsFSType = "ext4"
+
+// mkfsArgs returns the arguments of the mkfs command formatting device with
+// fsType, with the requested options before the device
+func mkfsArgs(device, fsType string, mkfsOpts []string) []string {
+	args := append([]string(nil), mkfsOpts...)
+	if strings.HasPrefix(fsType, "ext") && !contains(args, "-F") {
+		// mke2fs asks for confirmation before formatting a whole device
+		args = append(args, "-F")
+	}
+	return append(args, device)
+}
+
+// parseMkfsOptions returns the mkfs options in opts, separated by white
+// space. They may not give the device, which is always the volume, nor the
+// filesystem type, which is the fsType of the volume or its capability.
+func parseMkfsOptions(opts string) ([]string, error) {
+	args := strings.Fields(opts)
+	for _, a := range args {
+		var reason string
+		switch {
+		case a == "--type" || strings.HasPrefix(a, "--type=") ||
+			strings.HasPrefix(a, "-t"):
+			reason = "the filesystem type is given by fsType"
+		case strings.HasPrefix(a, "/"):
+			reason = "the device is always the volume"
+		}
+		if reason != "" {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"invalid %s option %s: %s", KeyMkfsOptions, a, reason)
+		}
+	}
+	return args, nil
+}
+
+// privMountFlags returns the options used for the private mount of a
+// filesystem, given the requested mount flags and the filesystem type
+func privMountFlags(flags []string, fs string, ro, xfsNoUUID bool) []string {
+	opts := make([]string, 0, len(flags)+2)
+	opts = append(opts, flags...)
+	if ro && !contains(opts, "ro") {
+		opts = append(opts, "ro")
+	}
+	if xfsNoUUID && fs == "xfs" && !contains(opts, "nouuid") {
+		opts = append(opts, "nouuid")
+	}
+	return opts
+}
+
 func getPrivateMountPoint(privDir string, name string) string {
 	return filepath.Join(privDir, name)
 }
@@ -366,13 +727,15 @@ func mkdir(path string) (bool, error) {
 // unpublishVolume removes the bind mount to the target path, and also removes
 // the mount to the private mount directory if the volume is no longer in use.
 // It determines this by checking to see if the volume is mounted anywhere else
-// other than the private mount.
+// other than the private mount. The volume's mounts are those of device, its
+// current device if it is still mapped, or of recorded, the device it was
+// published from if that was recorded, which differ once the SDC restarts.
+// The private mount is named after the ScaleIO volume ID id.
 func unpublishVolume(
+	ctx context.Context,
+	mounter Mounter,
 	req *csi.NodeUnpublishVolumeRequest,
-	privDir, device string) error {
-
-	ctx := context.Background()
-	id := req.GetVolumeId()
+	id, privDir, device, recorded string) error {
 
 	target := req.GetTargetPath()
 	if target == "" {
@@ -381,27 +744,44 @@ func unpublishVolume(
 	}
 
 	// make sure device is valid
-	sysDevice, err := GetDevice(device)
-	if err != nil {
-		return status.Errorf(codes.Internal,
-			"error getting block device for volume: %s, err: %s",
-			id, err.Error())
+	var devices []string
+	if device != "" {
+		sysDevice, err := mounter.GetDevice(device)
+		if err != nil && recorded == "" {
+			return status.Errorf(codes.Internal,
+				"error getting block device for volume: %s, err: %s",
+				id, err.Error())
+		}
+		if err == nil {
+			devices = append(devices, sysDevice.RealDev)
+		}
+	}
+	if recorded != "" && !contains(devices, recorded) {
+		if len(devices) > 0 {
+			reqLog(ctx, id).WithFields(log.Fields{
+				"device":         devices[0],
+				"recordedDevice": recorded,
+			}).Info("volume's device changed since it was published")
+		}
+		devices = append(devices, recorded)
 	}
 
 	// Path to mount device to
 	privTgt := getPrivateMountPoint(privDir, id)
 
-	mnts, err := gofsutil.GetMounts(ctx)
+	mnts, err := mounter.GetMounts(ctx)
 	if err != nil {
 		return status.Errorf(codes.Internal,
 			"could not reliably determine existing mount status: %s",
 			err.Error())
 	}
 
+	mnts = resolveMountDevices(ctx, mounter, mnts)
+
 	tgtMnt := false
 	privMnt := false
 	for _, m := range mnts {
-		if m.Source == sysDevice.RealDev || m.Device == sysDevice.RealDev {
+		if contains(devices, m.Source) || contains(devices, m.Device) {
 			if m.Path == privTgt {
 				privMnt = true
 			} else if m.Path == target {
@@ -411,58 +791,216 @@ func unpublishVolume(
 	}
 
 	if tgtMnt {
-		if err := gofsutil.Unmount(ctx, target); err != nil {
-			return status.Errorf(codes.Internal,
-				"Error unmounting target: %s", err.Error())
+		if err := mounter.Unmount(ctx, target); err != nil {
+			return stageErr(ctx, "unmounting target", status.Errorf(
+				codes.Internal, "Error unmounting target: %s", err.Error()))
 		}
 	}
 
 	if privMnt {
-		if err := unmountPrivMount(ctx, sysDevice, privTgt); err != nil {
-			return status.Errorf(codes.Internal,
-				"Error unmounting private mount: %s", err.Error())
+		if err := unmountPrivMount(ctx, mounter, privTgt); err != nil {
+			return stageErr(ctx, "unmounting private mount", status.Errorf(
+				codes.Internal,
+				"Error unmounting private mount: %s", err.Error()))
 		}
 	}
 
 	return nil
 }
 
+// unmountPrivMount unmounts the private mount at target, and removes its
+// mount point, once no target is mounted from it. Targets are counted as the
+// other mounts of the private mount's device, which include bind mounts of
+// the private mount itself. A private mount that is already gone is not an
+// error, and its mount point is removed if it was left behind.
 func unmountPrivMount(
 	ctx context.Context,
-	dev *Device,
+	mounter Mounter,
 	target string) error {
 
-	mnts, err := getDevMounts(dev)
+	mnts, err := mounter.GetMounts(ctx)
 	if err != nil {
 		return err
 	}
 
-	// remove private mount if we can
-	if len(mnts) == 1 && mnts[0].Path == target {
-		if err := gofsutil.Unmount(ctx, target); err != nil {
-			return err
+	var privMnt *gofsutil.Info
+	for i := range mnts {
+		if mnts[i].Path == target {
+			privMnt = &mnts[i]
+			break
+		}
+	}
+	if privMnt == nil {
+		removePrivMountPoint(target)
+		return nil
+	}
+
+	dev := &Device{RealDev: privMnt.Device}
+	if privMnt.Device == "devtmpfs" {
+		dev.RealDev = privMnt.Source
+	}
+	var targets []string
+	for _, m := range filterDevMounts(mnts, dev) {
+		if m.Path != target {
+			targets = append(targets, m.Path)
 		}
-		log.WithField("directory", target).Debug(
-			"removing directory")
-		os.Remove(target)
 	}
+	if len(targets) > 0 {
+		log.WithField("privateMount", target).WithField(
+			"targets", targets).Debug("private mount still in use")
+		return nil
+	}
+
+	if err := mounter.Unmount(ctx, target); err != nil {
+		return err
+	}
+	removePrivMountPoint(target)
 	return nil
 }
 
-func getDevMounts(
-	sysDevice *Device) ([]gofsutil.Info, error) {
+// removePrivMountPoint removes the mount point of a private mount, which
+// may already be gone
+func removePrivMountPoint(target string) {
+	log.WithField("directory", target).Debug("removing directory")
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		log.WithField("directory", target).WithError(err).Warn(
+			"unable to remove private mount point")
+	}
+}
+
+// filterDevMounts returns the mounts in mnts of the given device
+func filterDevMounts(
+	mnts []gofsutil.Info, sysDevice *Device) []gofsutil.Info {
 
-	ctx := context.Background()
 	devMnts := make([]gofsutil.Info, 0)
+	for _, m := range mnts {
+		if isDevMount(m, sysDevice) {
+			devMnts = append(devMnts, m)
+		}
+	}
+	return devMnts
+}
+
+// isDevMount returns a flag indicating whether m is a mount of the given
+// device, either as a filesystem or as a bind mount of the block device
+func isDevMount(m gofsutil.Info, sysDevice *Device) bool {
+	return m.Device == sysDevice.RealDev ||
+		(m.Device == "devtmpfs" && m.Source == sysDevice.RealDev)
+}
+
+// resolveMountDevices returns mnts with the device of each mount made through
+// a udev symlink, such as a volume's /dev/disk/by-id path, replaced by the
+// device the symlink resolves to now, so that it compares with a Device's
+// RealDev. A symlink that no longer resolves to a block device, as after
+// its volume was unmapped, is left as it is, and so matches no volume.
+func resolveMountDevices(
+	ctx context.Context,
+	mounter Mounter,
+	mnts []gofsutil.Info) []gofsutil.Info {
+
+	resolved := make([]gofsutil.Info, len(mnts))
+	for i, m := range mnts {
+		resolved[i] = m
+		if !strings.HasPrefix(m.Device, "/dev/disk/") {
+			continue
+		}
+		dev, err := mounter.GetDevice(m.Device)
+		if err != nil {
+			reqLog(ctx, "").WithFields(log.Fields{
+				"path":   m.Path,
+				"device": m.Device,
+			}).WithError(err).Debug("mount is of a stale device symlink")
+			continue
+		}
+		resolved[i].Device = dev.RealDev
+	}
+	return resolved
+}
 
-	mnts, err := gofsutil.GetMounts(ctx)
+// isMounted returns a flag indicating whether anything is mounted at target
+func isMounted(
+	ctx context.Context, mounter Mounter, target string) (bool, error) {
+
+	mnts, err := mounter.GetMounts(ctx)
 	if err != nil {
-		return devMnts, err
+		return false, err
 	}
 	for _, m := range mnts {
-		if m.Device == sysDevice.RealDev || (m.Device == "devtmpfs" && m.Source == sysDevice.RealDev) {
-			devMnts = append(devMnts, m)
+		if m.Path == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cleanupPrivateMounts unmounts private mounts within privDir whose volumes
+// are no longer mapped to the local SDC, as listed by localVolumes, which
+// can be left behind when the node goes down while its volumes are
+// unpublished. Mounts outside of privDir are never touched, and none are
+// unless sdcLoaded reports the SDC running.
+func cleanupPrivateMounts(
+	ctx context.Context,
+	mounter Mounter,
+	localVolumes func() ([]*goscaleio.SdcMappedVolume, error),
+	sdcLoaded func() bool,
+	privDir string) error {
+	if !sdcLoaded() {
+		return fmt.Errorf("%s kernel module not loaded", sdcModule)
+	}
+
+	localVols, err := localVolumes()
+	if err != nil {
+		return err
+	}
+	mapped := make(map[string]bool, len(localVols))
+	for _, v := range localVols {
+		mapped[v.VolumeID] = true
+	}
+
+	mnts, err := mounter.GetMounts(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range stalePrivateMounts(mnts, privDir, mapped) {
+		f := log.Fields{
+			"privateMount": m.Path,
+			"device":       m.Device,
+			"source":       m.Source,
+		}
+		log.WithFields(f).Info("unmounting stale private mount")
+		if err := mounter.Unmount(ctx, m.Path); err != nil {
+			log.WithFields(f).WithError(err).Error(
+				"unable to unmount stale private mount")
+			continue
+		}
+		log.WithFields(f).Info("removing stale private mount point")
+		if err := os.Remove(m.Path); err != nil {
+			log.WithFields(f).WithError(err).Warn(
+				"unable to remove stale private mount point")
+		}
+	}
+	return nil
+}
+
+// stalePrivateMounts returns the mounts directly within privDir, which are
+// named after volume IDs, whose volume IDs are not in mapped
+func stalePrivateMounts(
+	mnts []gofsutil.Info,
+	privDir string,
+	mapped map[string]bool) []gofsutil.Info {
+
+	privDir = filepath.Clean(privDir)
+
+	var stale []gofsutil.Info
+	for _, m := range mnts {
+		if !strings.HasPrefix(m.Path, privDir+"/") ||
+			filepath.Dir(m.Path) != privDir {
+			continue
+		}
+		if !mapped[filepath.Base(m.Path)] {
+			stale = append(stale, m)
 		}
 	}
-	return devMnts, nil
+	return stale
 }
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+const (
+	// KeyScaleIOVolumeID is the publish info giving the ScaleIO ID of a
+	// block volume published MULTI_NODE_MULTI_WRITER, which every node it
+	// is published to shares
+	KeyScaleIOVolumeID = "scaleioVolumeId"
+
+	// KeyMappingCount is the publish info giving the number of SDCs a
+	// block volume published MULTI_NODE_MULTI_WRITER is mapped to
+	KeyMappingCount = "mappingCount"
+
+	// KeyMappingGeneration is the publish info giving the generation of
+	// the SDCs a block volume published MULTI_NODE_MULTI_WRITER is mapped
+	// to. It increases whenever they change, so that agents coordinating
+	// the nodes sharing the volume, as a clustered filesystem's fencing
+	// does, can detect a change of membership.
+	KeyMappingGeneration = "mappingGeneration"
+)
+
+// mappingGeneration is the generation of the SDCs a volume is mapped to
+type mappingGeneration struct {
+	// sdcs are the IDs of the SDCs, sorted and comma separated
+	sdcs string
+	gen  int64
+}
+
+// multiWriterInfo adds to info, the publish info of vol being published
+// with mode and granted to the SDC sdcID, the keys coordinating the nodes
+// that share a block volume published MULTI_NODE_MULTI_WRITER. vol's
+// mappings are those the gateway reported before it was published, which
+// sdcID is added to if it isn't among them.
+func (s *service) multiWriterInfo(
+	info map[string]string,
+	vol *siotypes.Volume,
+	sdcID string,
+	mode csi.VolumeCapability_AccessMode_Mode,
+	granted grantedCap) {
+
+	if mode != csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER ||
+		!granted.block {
+		return
+	}
+
+	sdcs := []string{sdcID}
+	for _, sdc := range vol.MappedSdcInfo {
+		if sdc.SdcID != sdcID {
+			sdcs = append(sdcs, sdc.SdcID)
+		}
+	}
+	info[KeyScaleIOVolumeID] = vol.ID
+	info[KeyMappingCount] = strconv.Itoa(len(sdcs))
+	info[KeyMappingGeneration] = strconv.FormatInt(
+		s.mappingGeneration(vol.ID, sdcs), 10)
+}
+
+// mappingGeneration returns the generation of the SDCs sdcs that the
+// volume volID is mapped to. It is kept while they are unchanged, so that
+// publishing again returns the same generation, and otherwise derived from
+// the time in milliseconds, always above the previous generation. The
+// generation is forgotten once the volume is unmapped from every SDC, or
+// the controller restarts, after which the clock keeps it increasing.
+func (s *service) mappingGeneration(volID string, sdcs []string) int64 {
+	sort.Strings(sdcs)
+	key := strings.Join(sdcs, ",")
+
+	s.grantedRWL.Lock()
+	defer s.grantedRWL.Unlock()
+	prev, ok := s.generations[volID]
+	if ok && prev.sdcs == key {
+		return prev.gen
+	}
+	gen := time.Now().UnixNano() / int64(time.Millisecond)
+	if gen <= prev.gen {
+		gen = prev.gen + 1
+	}
+	s.generations[volID] = mappingGeneration{sdcs: key, gen: gen}
+	return gen
+}
+
+func (s *service) clearMappingGeneration(volID string) {
+	s.grantedRWL.Lock()
+	defer s.grantedRWL.Unlock()
+	delete(s.generations, volID)
+}
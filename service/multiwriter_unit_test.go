@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishMultiWriterInfo(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddSdc("SDC-1")
+	fake.AddSdc("SDC-2")
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	fake.Volumes[id].MappingToAllSdcsEnabled = true
+
+	blockCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	publish := func(node string) map[string]string {
+		pub, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   node,
+				VolumeCapability: blockCap(
+					csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			})
+		if !assert.NoError(t, err, node) {
+			return nil
+		}
+		return pub.PublishInfo
+	}
+	generation := func(info map[string]string) int64 {
+		gen, err := strconv.ParseInt(info[KeyMappingGeneration], 10, 64)
+		assert.NoError(t, err)
+		return gen
+	}
+
+	first := publish("SDC-1")
+	assert.Equal(t, id, first[KeyScaleIOVolumeID])
+	assert.Equal(t, "1", first[KeyMappingCount])
+	gen := generation(first)
+	assert.True(t, gen > 0)
+
+	// publishing again returns the same info
+	assert.Equal(t, first, publish("SDC-1"))
+
+	// another node joining is a new generation, seen by both nodes
+	second := publish("SDC-2")
+	assert.Equal(t, "2", second[KeyMappingCount])
+	assert.True(t, generation(second) > gen)
+	assert.Equal(t, second, publish("SDC-1"))
+	assert.Equal(t, second, publish("SDC-2"))
+	assert.Equal(t, 2, fake.Calls["MapVolumeSdc"])
+	gen = generation(second)
+
+	// as is one leaving
+	_, err := s.ControllerUnpublishVolume(ctx,
+		&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "SDC-2"})
+	assert.NoError(t, err)
+	third := publish("SDC-1")
+	assert.Equal(t, "1", third[KeyMappingCount])
+	assert.True(t, generation(third) > gen)
+
+	// other volumes and modes don't have the keys
+	other := fake.AddVolume("other", "pool", 8*kiBytesInGiB)
+	for _, vc := range []*csi.VolumeCapability{
+		blockCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+	} {
+		pub, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId:         other,
+				NodeId:           "SDC-1",
+				VolumeCapability: vc,
+			})
+		if assert.NoError(t, err) {
+			assert.NotContains(t, pub.PublishInfo, KeyScaleIOVolumeID)
+			assert.NotContains(t, pub.PublishInfo, KeyMappingCount)
+			assert.NotContains(t, pub.PublishInfo, KeyMappingGeneration)
+		}
+		_, err = s.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{
+				VolumeId: other, NodeId: "SDC-1"})
+		assert.NoError(t, err)
+	}
+}
@@ -1,11 +1,8 @@
 package service
 
 import (
-	"bufio"
-	"bytes"
-	"os"
-	"os/exec"
 	"strings"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	log "github.com/sirupsen/logrus"
@@ -16,9 +13,21 @@ import (
 )
 
 const (
-	drvCfg = "/opt/emc/scaleio/sdc/bin/drv_cfg"
+	// volLimitWarnPercent is the percentage of the max volumes per node at
+	// which node probe starts warning
+	volLimitWarnPercent = 90
 )
 
+// deviceWaitTimeout is how long NodePublishVolume waits for the SDC to
+// list a volume not yet mapped to it, as when the CO publishes the volume
+// on the node as soon as the controller has mapped it. NodePublishVolume
+// blocks for up to this long on such a volume.
+var deviceWaitTimeout = 10 * time.Second
+
+// deviceWaitInterval is how often the SDC's volumes are listed again while
+// waiting for a volume
+var deviceWaitInterval = 500 * time.Millisecond
+
 func (s *service) NodeStageVolume(
 	ctx context.Context,
 	req *csi.NodeStageVolumeRequest) (
@@ -40,16 +49,69 @@ func (s *service) NodePublishVolume(
 	req *csi.NodePublishVolumeRequest) (
 	*csi.NodePublishVolumeResponse, error) {
 
-	id := req.GetVolumeId()
+	// The private mount and state of a volume are named after its ScaleIO
+	// volume ID, whatever the format of the handle it is published by
+	h, err := parseHandle(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	id := h.VolumeID
 
-	sdcMappedVol, err := getMappedVol(id)
+	sdcMappedVol, err := s.waitMappedVol(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := publishVolume(req, s.privDir, sdcMappedVol.SdcDevice); err != nil {
+	// Attributes set when the volume was created are passed both directly
+	// and, from the controller service, in the publish info
+	attrs := map[string]string{}
+	for k, v := range req.GetVolumeAttributes() {
+		attrs[k] = v
+	}
+	for k, v := range req.GetPublishInfo() {
+		attrs[k] = v
+	}
+	if len(attrs) > 0 {
+		fields := log.Fields{}
+		for k, v := range attrs {
+			fields[k] = v
+		}
+		reqLog(ctx, id).WithFields(fields).Info("publishing volume")
+	}
+
+	mkfsOpts, err := parseMkfsOptions(attrs[KeyMkfsOptions])
+	if err != nil {
 		return nil, err
 	}
+	ownership, err := parseRootOwnership(attrs[KeyGID], attrs[KeyMode])
+	if err != nil {
+		return nil, err
+	}
+
+	opts := publishOpts{
+		xfsNoUUID:     s.opts.XFSNoUUID,
+		defaultFSType: attrs[KeyFsType],
+		mkfsOptions:   mkfsOpts,
+		targets:       &s.targets,
+		ownership:     ownership,
+	}
+	if s.opts.FSCheck {
+		opts.checkFS = s.checkFS
+	}
+
+	if err := publishVolume(
+		ctx, s.mounter, req, id, s.volPrivDir(ctx, id),
+		sdcMappedVol.SdcDevice, opts); err != nil {
+		return nil, err
+	}
+
+	// The device is recorded as the mount table names it, so that the
+	// volume's mounts are still found once the SDC gives it another
+	device := sdcMappedVol.SdcDevice
+	if dev, err := s.mounter.GetDevice(device); err == nil {
+		device = dev.RealDev
+	}
+	s.volStates.addTarget(ctx, s.privDir, id, device, req.GetTargetPath())
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -59,23 +121,87 @@ func (s *service) NodeUnpublishVolume(
 	req *csi.NodeUnpublishVolumeRequest) (
 	*csi.NodeUnpublishVolumeResponse, error) {
 
-	id := req.GetVolumeId()
+	target := req.GetTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"target path required")
+	}
+
+	// The private mount and state of the volume are named after its ScaleIO
+	// volume ID, as when it was published
+	var id string
+	if raw := req.GetVolumeId(); raw != "" {
+		h, err := parseHandle(raw)
+		if err != nil {
+			return nil, err
+		}
+		id = h.VolumeID
+	}
 
-	sdcMappedVol, err := getMappedVol(id)
+	// A target that is not mounted, or no longer exists, has already been
+	// unpublished, regardless of whether the volume is still mapped. The
+	// private mount may still have been left behind, if unmounting it failed
+	// after the target was unmounted, so it is removed if no longer in use.
+	mounted, err := isMounted(ctx, s.mounter, target)
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(codes.Internal,
+			"could not reliably determine existing mount status: %s",
+			err.Error())
+	}
+	if !mounted {
+		reqLog(ctx, id).WithField("target", target).Debug(
+			"target not mounted, volume already unpublished")
+		s.targets.remove(target)
+		if id == "" {
+			return &csi.NodeUnpublishVolumeResponse{}, nil
+		}
+		privTgt := getPrivateMountPoint(s.volPrivDir(ctx, id), id)
+		if err := unmountPrivMount(ctx, s.mounter, privTgt); err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"Error unmounting private mount: %s", err.Error())
+		}
+		s.volStates.removeTarget(ctx, s.privDir, id, target)
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	// The device the volume was published from is recorded, as the SDC
+	// gives volumes new devices when it restarts, and may no longer list
+	// the volume at all if it was unmapped while still mounted
+	var device, recorded string
+	if st := s.volStates.get(ctx, s.privDir, id); st != nil {
+		recorded = st.Device
+	}
+	sdcMappedVol, err := s.getMappedVol(id)
+	if err != nil {
+		if st, ok := status.FromError(err); recorded == "" ||
+			(ok && st.Code() == codes.InvalidArgument) {
+			return nil, err
+		}
+		reqLog(ctx, id).WithError(err).WithField("device", recorded).Warn(
+			"unpublishing volume from recorded device")
+	} else {
+		device = sdcMappedVol.SdcDevice
 	}
 
-	if err := unpublishVolume(req, s.privDir, sdcMappedVol.SdcDevice); err != nil {
+	if err := unpublishVolume(
+		ctx, s.mounter, req, id, s.volPrivDir(ctx, id),
+		device, recorded); err != nil {
 		return nil, err
 	}
+	s.targets.remove(target)
+	s.volStates.removeTarget(ctx, s.privDir, id, target)
 
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
-func getMappedVol(id string) (*goscaleio.SdcMappedVolume, error) {
+func (s *service) getMappedVol(id string) (*goscaleio.SdcMappedVolume, error) {
+	h, err := parseHandle(id)
+	if err != nil {
+		return nil, err
+	}
+
 	// get source path of volume/device
-	localVols, err := goscaleio.GetLocalVolumeMap()
+	localVols, err := s.localVolumes()
 	if err != nil {
 		return nil, status.Errorf(codes.Internal,
 			"unable to get locally mapped ScaleIO volumes: %s",
@@ -83,7 +209,7 @@ func getMappedVol(id string) (*goscaleio.SdcMappedVolume, error) {
 	}
 	var sdcMappedVol *goscaleio.SdcMappedVolume
 	for _, v := range localVols {
-		if v.VolumeID == id {
+		if v.VolumeID == h.VolumeID {
 			sdcMappedVol = v
 			break
 		}
@@ -95,12 +221,45 @@ func getMappedVol(id string) (*goscaleio.SdcMappedVolume, error) {
 	return sdcMappedVol, nil
 }
 
+// waitMappedVol returns the volume id as mapped to the local SDC, waiting
+// for as long as the device wait timeout for the SDC to list it
+func (s *service) waitMappedVol(
+	ctx context.Context, id string) (*goscaleio.SdcMappedVolume, error) {
+
+	start := time.Now()
+	deadline := time.NewTimer(deviceWaitTimeout)
+	defer deadline.Stop()
+	for waited := false; ; waited = true {
+		vol, err := s.getMappedVol(id)
+		if err == nil {
+			if waited {
+				reqLog(ctx, id).WithField("waited", time.Since(start)).Info(
+					"volume mapped to SDC")
+			}
+			return vol, nil
+		}
+		if st, _ := status.FromError(err); st.Code() != codes.Unavailable {
+			return nil, err
+		}
+		if !waited {
+			reqLog(ctx, id).Debug("waiting for volume to be mapped to SDC")
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-deadline.C:
+			return nil, err
+		case <-time.After(deviceWaitInterval):
+		}
+	}
+}
+
 func (s *service) NodeGetId(
 	ctx context.Context,
 	req *csi.NodeGetIdRequest) (
 	*csi.NodeGetIdResponse, error) {
 
-	if s.opts.SdcGUID == "" {
+	if s.opts.SdcGUID == "" && s.nodeID == "" {
 		if !s.opts.AutoProbe {
 			return nil, status.Error(codes.FailedPrecondition,
 				"Unable to get Node ID. Either it is not configured, "+
@@ -110,64 +269,111 @@ func (s *service) NodeGetId(
 			return nil, err
 		}
 	}
+	nodeID := s.opts.SdcGUID
+	if nodeID == "" {
+		nodeID = s.nodeID
+	} else if s.opts.NodeIDSdcID && s.nodeSdcID != "" {
+		nodeID = joinNodeID(nodeID, s.nodeSdcID)
+	}
 	return &csi.NodeGetIdResponse{
-		NodeId: s.opts.SdcGUID,
+		NodeId: nodeID,
 	}, nil
 }
 
 func (s *service) nodeProbe(ctx context.Context) error {
 
+	// The SDC may have stopped since the last probe, which would otherwise
+	// only show as volumes whose devices can't be found
+	if err := s.checkSDC(); err != nil {
+		return err
+	}
+
 	if s.opts.SdcGUID == "" {
-		// try to get GUID using `drv_cfg` binary
-		if _, err := os.Stat(drvCfg); os.IsNotExist(err) {
-			return status.Error(codes.FailedPrecondition,
-				"unable to get SDC GUID via config or drv_cfg binary")
+		guid, err := s.querySDCGUID(ctx)
+		if err != nil {
+			if s.opts.NodeIDFallback == "" {
+				return status.Errorf(codes.FailedPrecondition,
+					"unable to get SDC GUID via config or SDC: %s",
+					err.Error())
+			}
+			nodeID, ferr := fallbackNodeID(s.opts.NodeIDFallback)
+			if ferr != nil {
+				return status.Errorf(codes.FailedPrecondition,
+					"unable to get SDC GUID via config or SDC: %s, "+
+						"nor the node's %s: %s", err.Error(),
+					s.opts.NodeIDFallback, ferr.Error())
+			}
+			log.WithError(err).WithField("nodeID", nodeID).Warnf(
+				"unable to get SDC GUID, identifying node by %s",
+				s.opts.NodeIDFallback)
+			s.nodeID = nodeID
+		} else {
+			s.opts.SdcGUID = guid
+			log.WithField("guid", s.opts.SdcGUID).Info("set SDC GUID")
 		}
+	}
 
-		out, err := exec.Command(drvCfg, "--query_guid").CombinedOutput()
-		if err != nil {
+	nodeID := s.nodeID
+	if s.opts.SdcGUID != "" {
+		if !validSDCGUID(s.opts.SdcGUID) {
 			return status.Errorf(codes.FailedPrecondition,
-				"error getting SDC GUID: %s", err.Error())
+				"invalid SDC GUID: %s, expected format: %s",
+				s.opts.SdcGUID, sdcGUIDFormat)
 		}
-
-		s.opts.SdcGUID = strings.TrimSpace(string(out))
-		log.WithField("guid", s.opts.SdcGUID).Info("set SDC GUID")
+		nodeID = s.opts.SdcGUID
 	}
 
-	if !kmodLoaded() {
-		return status.Error(codes.FailedPrecondition,
-			"scini kernel module not loaded")
+	// When running alongside the controller service, make sure the SDC is
+	// actually known to the configured system
+	if s.controllerProbed() {
+		id, err := s.getSDCID(ctx, nodeID)
+		if err != nil {
+			return status.Errorf(codes.FailedPrecondition,
+				"SDC: %s not registered with ScaleIO system: %s: %s",
+				nodeID, s.opts.SystemName, err.Error())
+		}
+		s.nodeSdcID = id
 	}
 
-	// make sure privDir is pre-created
-	if _, err := mkdir(s.privDir); err != nil {
-		return status.Errorf(codes.Internal,
-			"plugin private dir: %s creation error: %s",
-			s.privDir, err.Error())
+	s.checkVolumeLimit()
+
+	// make sure privDir is pre-created, and usable
+	if err := checkPrivDir(s.privDir); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-func kmodLoaded() bool {
-	out, err := exec.Command("lsmod").CombinedOutput()
-	if err != nil {
-		log.WithError(err).Error("error from lsmod")
-		return false
+// checkVolumeLimit logs a warning when the number of volumes mapped to the
+// local SDC is approaching the configured maximum volumes per node. The
+// v0.2 spec has no NodeGetInfo to report the limit to the CO through, so it
+// is enforced only by ControllerPublishVolume refusing to map beyond it.
+func (s *service) checkVolumeLimit() {
+	max := s.opts.MaxVolumesPerNode
+	if max == 0 {
+		return
 	}
 
-	r := bytes.NewReader(out)
-	s := bufio.NewScanner(r)
+	localVols, err := s.localVolumes()
+	if err != nil {
+		log.WithError(err).Debug("unable to count locally mapped volumes")
+		return
+	}
 
-	for s.Scan() {
-		l := s.Text()
-		words := strings.Split(l, " ")
-		if words[0] == "scini" {
-			return true
-		}
+	n := int64(len(localVols))
+	if volumeLimitApproached(n, max) {
+		log.WithFields(log.Fields{
+			"mappedVolumes":  n,
+			"maxVolsPerNode": max,
+		}).Warn("number of mapped volumes approaching max volumes per node")
 	}
+}
 
-	return false
+// volumeLimitApproached returns a flag indicating whether n mapped volumes
+// is within volLimitWarnPercent of the limit max
+func volumeLimitApproached(n, max int64) bool {
+	return max > 0 && n*100 >= max*volLimitWarnPercent
 }
 
 func (s *service) NodeGetCapabilities(
@@ -175,5 +381,42 @@ func (s *service) NodeGetCapabilities(
 	req *csi.NodeGetCapabilitiesRequest) (
 	*csi.NodeGetCapabilitiesResponse, error) {
 
-	return &csi.NodeGetCapabilitiesResponse{}, nil
+	var caps []*csi.NodeServiceCapability
+	for _, rpc := range s.nodeRPCs() {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: rpc,
+				},
+			},
+		})
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: caps,
+	}, nil
+}
+
+// nodeRPCImplemented maps each optional node RPC to a flag indicating whether
+// the node service implements it. Advertising an RPC that returns
+// Unimplemented would make COs call into it regardless.
+var nodeRPCImplemented = map[csi.NodeServiceCapability_RPC_Type]bool{
+	// NodeStageVolume and NodeUnstageVolume are not implemented yet
+	csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME: false,
+}
+
+// nodeRPCs returns the optional node RPCs that the node service supports in
+// its current mode of operation
+func (s *service) nodeRPCs() []csi.NodeServiceCapability_RPC_Type {
+	if strings.EqualFold(s.mode, "controller") {
+		return nil
+	}
+
+	var rpcs []csi.NodeServiceCapability_RPC_Type
+	for rpc, ok := range nodeRPCImplemented {
+		if ok {
+			rpcs = append(rpcs, rpc)
+		}
+	}
+	return rpcs
 }
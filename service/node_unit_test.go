@@ -0,0 +1,844 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akutz/gofsutil"
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	sio "github.com/thecodeteam/goscaleio"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeLimitApproached(t *testing.T) {
+	tests := []struct {
+		n, max   int64
+		approach bool
+	}{
+		{0, 0, false},
+		{9000, 0, false},
+		{0, 10, false},
+		{8, 10, false},
+		{9, 10, true},
+		{10, 10, true},
+		{7372, 8192, false},
+		{7373, 8192, true},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.approach, volumeLimitApproached(tt.n, tt.max),
+			"n=%d max=%d", tt.n, tt.max)
+	}
+}
+
+func TestStalePrivateMounts(t *testing.T) {
+	mnts := []gofsutil.Info{
+		{Device: "/dev/scinia", Path: "/dev/disk/csi-scaleio/vol1"},
+		{Device: "/dev/scinib", Path: "/dev/disk/csi-scaleio/vol2"},
+		{Device: "devtmpfs", Source: "/dev/scinic",
+			Path: "/dev/disk/csi-scaleio/vol3"},
+		// mounts outside of privDir must never be considered
+		{Device: "/dev/scinib", Path: "/var/lib/kubelet/pods/x/vol2"},
+		{Device: "/dev/sdb", Path: "/dev/disk/csi-scaleio-other/vol4"},
+		{Device: "/dev/sdc", Path: "/dev/disk/csi-scaleio/nested/vol5"},
+		{Device: "/dev/sdd", Path: "/dev/disk/csi-scaleio"},
+	}
+	mapped := map[string]bool{"vol1": true}
+
+	stale := stalePrivateMounts(mnts, "/dev/disk/csi-scaleio/", mapped)
+
+	var paths []string
+	for _, m := range stale {
+		paths = append(paths, m.Path)
+	}
+	assert.Equal(t, []string{
+		"/dev/disk/csi-scaleio/vol2",
+		"/dev/disk/csi-scaleio/vol3",
+	}, paths)
+}
+
+func TestFilterDevMounts(t *testing.T) {
+	dev := &Device{
+		FullPath: "/dev/disk/by-id/emc-vol-1-2",
+		Name:     "emc-vol-1-2",
+		RealDev:  "/dev/scinia",
+	}
+	mnts := []gofsutil.Info{
+		{Device: "/dev/scinia", Path: "/priv/vol"},
+		{Device: "/dev/scinia", Path: "/target"},
+		{Device: "devtmpfs", Source: "/dev/scinia", Path: "/block"},
+		{Device: "devtmpfs", Source: "/dev/scinib", Path: "/other-block"},
+		{Device: "/dev/scinib", Path: "/other"},
+	}
+
+	var paths []string
+	for _, m := range filterDevMounts(mnts, dev) {
+		paths = append(paths, m.Path)
+	}
+	assert.Equal(t, []string{"/priv/vol", "/target", "/block"}, paths)
+}
+
+func TestPrivMountFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		flags     []string
+		fs        string
+		ro        bool
+		xfsNoUUID bool
+		exp       []string
+	}{
+		{"ext4", []string{"noatime"}, "ext4", false, true,
+			[]string{"noatime"}},
+		{"ext4 ro", nil, "ext4", true, true, []string{"ro"}},
+		{"xfs", []string{"noatime"}, "xfs", false, true,
+			[]string{"noatime", "nouuid"}},
+		{"xfs ro", nil, "xfs", true, true, []string{"ro", "nouuid"}},
+		{"xfs disabled", []string{"noatime"}, "xfs", false, false,
+			[]string{"noatime"}},
+		{"xfs requested", []string{"nouuid"}, "xfs", false, true,
+			[]string{"nouuid"}},
+		{"unknown fs", nil, "", false, true, []string{}},
+	}
+
+	for _, tt := range tests {
+		flags := append([]string(nil), tt.flags...)
+		assert.Equal(t, tt.exp,
+			privMountFlags(tt.flags, tt.fs, tt.ro, tt.xfsNoUUID), tt.name)
+		// the requested flags are also used for the bind mount, and
+		// must not be modified
+		assert.Equal(t, flags, tt.flags, tt.name)
+	}
+}
+
+// fakeMounter is an in-memory Mounter, tracking the filesystem on each
+// device and the resulting mounts
+type fakeMounter struct {
+	sync.Mutex
+	devices map[string]*Device
+	formats map[string]string
+	mkfs    map[string][]string
+	mounts  []gofsutil.Info
+	calls   map[string]int
+}
+
+func newFakeMounter(devs ...*Device) *fakeMounter {
+	m := &fakeMounter{
+		devices: map[string]*Device{},
+		formats: map[string]string{},
+		mkfs:    map[string][]string{},
+		calls:   map[string]int{},
+	}
+	for _, d := range devs {
+		m.devices[d.FullPath] = d
+	}
+	return m
+}
+
+func (m *fakeMounter) GetDevice(path string) (*Device, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["GetDevice"]++
+	if d, ok := m.devices[path]; ok {
+		return d, nil
+	}
+	return nil, errors.New(path + " is not a block device")
+}
+
+func (m *fakeMounter) GetMounts(ctx context.Context) ([]gofsutil.Info, error) {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["GetMounts"]++
+	return append([]gofsutil.Info(nil), m.mounts...), nil
+}
+
+func (m *fakeMounter) GetDiskFormat(
+	ctx context.Context, disk string) (string, error) {
+
+	m.Lock()
+	defer m.Unlock()
+	m.calls["GetDiskFormat"]++
+	return m.formats[disk], nil
+}
+
+// mountOpts returns the options reported for a mount with the given flags
+func mountOpts(opts []string) []string {
+	if contains(opts, "ro") {
+		return []string{"ro"}
+	}
+	return []string{"rw"}
+}
+
+func (m *fakeMounter) Mount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	m.calls["Mount"]++
+	return m.mount(source, target, opts)
+}
+
+// mount must be called with the lock held
+func (m *fakeMounter) mount(source, target string, opts []string) error {
+	if m.formats[source] == "" {
+		return errors.New("unformatted device: " + source)
+	}
+	m.mounts = append(m.mounts, gofsutil.Info{
+		Device: m.devices[source].RealDev,
+		Path:   target,
+		Type:   m.formats[source],
+		Opts:   mountOpts(opts),
+	})
+	return nil
+}
+
+func (m *fakeMounter) BindMount(
+	ctx context.Context, source, target string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	m.calls["BindMount"]++
+	if d, ok := m.devices[source]; ok {
+		m.mounts = append(m.mounts, gofsutil.Info{
+			Device: "devtmpfs",
+			Source: d.RealDev,
+			Path:   target,
+			Opts:   mountOpts(opts),
+		})
+		return nil
+	}
+	for _, mnt := range m.mounts {
+		if mnt.Path == source {
+			mnt.Path = target
+			mnt.Opts = mountOpts(opts)
+			m.mounts = append(m.mounts, mnt)
+			return nil
+		}
+	}
+	return errors.New("nothing mounted at " + source)
+}
+
+func (m *fakeMounter) FormatAndMount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	m.calls["FormatAndMount"]++
+	if m.formats[source] == "" {
+		if fsType == "" {
+			fsType = "ext4"
+		}
+		m.formats[source] = fsType
+	}
+	return m.mount(source, target, opts)
+}
+
+func (m *fakeMounter) Format(
+	ctx context.Context, source, fsType string, mkfsOpts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	m.calls["Format"]++
+	m.formats[source] = fsType
+	m.mkfs[source] = mkfsOpts
+	return nil
+}
+
+func (m *fakeMounter) Unmount(ctx context.Context, target string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.calls["Unmount"]++
+	for i, mnt := range m.mounts {
+		if mnt.Path == target {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not mounted: " + target)
+}
+
+func (m *fakeMounter) ResizeFS(
+	ctx context.Context, devicePath, mountPath, fsType string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	m.calls["ResizeFS"]++
+	return nil
+}
+
+// newFakeNode returns a node service with a single volume, vol1, mapped to
+// the local SDC, and the directory used for its targets
+func newFakeNode(t *testing.T) (*service, *fakeMounter, string) {
+	dir, err := ioutil.TempDir("", "csi-scaleio-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := &Device{
+		FullPath: "/dev/disk/by-id/emc-vol-1-vol1",
+		Name:     "emc-vol-1-vol1",
+		RealDev:  "/dev/scinia",
+	}
+	m := newFakeMounter(dev)
+
+	s := New().(*service)
+	s.privDir = filepath.Join(dir, "priv")
+	s.mounter = m
+	s.localVolumes = func() ([]*sio.SdcMappedVolume, error) {
+		return []*sio.SdcMappedVolume{
+			{VolumeID: "vol1", SdcDevice: dev.FullPath},
+		}, nil
+	}
+	return s, m, dir
+}
+
+func publishReq(
+	target string,
+	mode csi.VolumeCapability_AccessMode_Mode,
+	ro bool) *csi.NodePublishVolumeRequest {
+
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: target,
+		Readonly:   ro,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		},
+	}
+}
+
+func TestNewWithNodeHost(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "csi-scaleio-node")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	dev := filepath.Join(dir, "scini")
+	assert.NoError(t, ioutil.WriteFile(dev, nil, 0600))
+
+	m := newFakeMounter()
+	loaded := false
+	s := NewWithNodeHost(NodeHost{
+		Mounter: m,
+		LocalVolumes: func() ([]*sio.SdcMappedVolume, error) {
+			return nil, nil
+		},
+		SDCLoaded: func() bool { return loaded },
+		SDCDevice: dev,
+	}).(*service)
+	assert.Equal(t, m, s.mounter)
+	s.mode = "node"
+	s.privDir = filepath.Join(dir, "priv")
+	s.opts.SdcGUID = "1A2B3C4D-0000-0000-0000-000000000000"
+
+	// the node is probed with the host given
+	err = s.nodeProbe(ctx)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	loaded = true
+	assert.NoError(t, s.nodeProbe(ctx))
+
+	// and what isn't given is the host's own
+	s = NewWithNodeHost(NodeHost{}).(*service)
+	assert.Equal(t, osMounter{executor: osExecutor{}}, s.mounter)
+	assert.Equal(t, sdcDevice, s.sdcDevicePath)
+}
+
+func TestNodeProbeSDCUnavailable(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "csi-scaleio-node")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	dev := filepath.Join(dir, "scini")
+	assert.NoError(t, ioutil.WriteFile(dev, nil, 0600))
+
+	loaded := true
+	s := NewWithNodeHost(NodeHost{
+		Mounter: newFakeMounter(),
+		LocalVolumes: func() ([]*sio.SdcMappedVolume, error) {
+			return nil, nil
+		},
+		SDCLoaded: func() bool { return loaded },
+		SDCDevice: dev,
+	}).(*service)
+	s.mode = "node"
+	s.privDir = filepath.Join(dir, "priv")
+	s.opts.SdcGUID = "1A2B3C4D-0000-0000-0000-000000000000"
+
+	assertUnavailable := func(msg string) {
+		_, err := s.Probe(ctx, &csi.ProbeRequest{})
+		st, _ := status.FromError(err)
+		assert.Equal(t, codes.FailedPrecondition, st.Code())
+		assert.Contains(t, st.Message(), msg)
+	}
+
+	_, err = s.Probe(ctx, &csi.ProbeRequest{})
+	assert.NoError(t, err)
+
+	// the module unloading after the GUID is known still fails the probe
+	loaded = false
+	assertUnavailable("scini kernel module not loaded")
+	loaded = true
+	_, err = s.Probe(ctx, &csi.ProbeRequest{})
+	assert.NoError(t, err)
+
+	// as does the SDC no longer answering through its device
+	assert.NoError(t, os.Remove(dev))
+	assertUnavailable(dev + " not responding")
+}
+
+func TestNodePublishUnpublish(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+
+	_, err := s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "ext4", m.formats["/dev/disk/by-id/emc-vol-1-vol1"])
+	assert.Len(t, m.mounts, 2)
+
+	// publishing again finds everything in place
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Len(t, m.mounts, 2)
+	assert.Equal(t, 1, m.calls["FormatAndMount"])
+	assert.Equal(t, 1, m.calls["BindMount"])
+
+	unpub := &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: target,
+	}
+	_, err = s.NodeUnpublishVolume(ctx, unpub)
+	assert.NoError(t, err)
+	assert.Empty(t, m.mounts)
+
+	// unpublishing again is a no-op
+	_, err = s.NodeUnpublishVolume(ctx, unpub)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, m.calls["Unmount"])
+
+	// volumes not mapped to the SDC can't be published
+	defer func(d time.Duration) { deviceWaitTimeout = d }(deviceWaitTimeout)
+	deviceWaitTimeout = 0
+	req.VolumeId = "vol2"
+	_, err = s.NodePublishVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+}
+
+func TestNodePublishDeviceWait(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+	defer func(d time.Duration) { deviceWaitInterval = d }(deviceWaitInterval)
+	deviceWaitInterval = time.Millisecond
+
+	// the SDC lists the volume on its third listing
+	mapped := s.localVolumes
+	listings := 0
+	s.localVolumes = func() ([]*sio.SdcMappedVolume, error) {
+		if listings++; listings < 3 {
+			return nil, nil
+		}
+		return mapped()
+	}
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	_, err := s.NodePublishVolume(ctx, publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, listings)
+	assert.Len(t, m.mounts, 2)
+
+	// failing to list the volumes isn't waited out
+	listings = 0
+	s.localVolumes = func() ([]*sio.SdcMappedVolume, error) {
+		listings++
+		return nil, errors.New("drv_cfg failed")
+	}
+	_, err = s.NodePublishVolume(ctx, publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false))
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Equal(t, 1, listings)
+
+	// and the wait ends with the request
+	s.localVolumes = func() ([]*sio.SdcMappedVolume, error) { return nil, nil }
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = s.NodePublishVolume(cctx, publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false))
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+}
+
+func TestNodePublishCreatesTarget(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	// a missing target is created, and removed again when unpublished
+	target := filepath.Join(dir, "pods", "target")
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	_, err := s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	st, err := os.Stat(target)
+	if assert.NoError(t, err) {
+		assert.True(t, st.IsDir())
+		assert.Equal(t, os.FileMode(targetDirMode), st.Mode().Perm())
+	}
+	unpub := &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: target,
+	}
+	_, err = s.NodeUnpublishVolume(ctx, unpub)
+	assert.NoError(t, err)
+	assert.Empty(t, m.mounts)
+	_, err = os.Stat(target)
+	assert.True(t, os.IsNotExist(err))
+
+	// as is a block target, which is a file
+	block := filepath.Join(dir, "block")
+	req.TargetPath = block
+	req.VolumeCapability.AccessType = &csi.VolumeCapability_Block{
+		Block: &csi.VolumeCapability_BlockVolume{},
+	}
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	st, err = os.Stat(block)
+	if assert.NoError(t, err) {
+		assert.True(t, st.Mode().IsRegular())
+	}
+	unpub.TargetPath = block
+	_, err = s.NodeUnpublishVolume(ctx, unpub)
+	assert.NoError(t, err)
+	_, err = os.Stat(block)
+	assert.True(t, os.IsNotExist(err))
+
+	// targets the CO created are left in place
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req = publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	unpub.TargetPath = target
+	_, err = s.NodeUnpublishVolume(ctx, unpub)
+	assert.NoError(t, err)
+	_, err = os.Stat(target)
+	assert.NoError(t, err)
+
+	// an existing target of the wrong type is refused
+	req.VolumeCapability.AccessType = &csi.VolumeCapability_Block{
+		Block: &csi.VolumeCapability_BlockVolume{},
+	}
+	_, err = s.NodePublishVolume(ctx, req)
+	st2, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st2.Code())
+
+	// a target created for a publish that fails is removed, as when a
+	// read-only volume isn't formatted
+	delete(m.formats, "/dev/disk/by-id/emc-vol-1-vol1")
+	failed := filepath.Join(dir, "failed")
+	_, err = s.NodePublishVolume(ctx, publishReq(failed,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, true))
+	assert.Error(t, err)
+	assert.Empty(t, m.mounts)
+	_, err = os.Stat(failed)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNodePublishTargetDevice(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	m.devices["/dev/disk/by-id/emc-vol-1-old"] = &Device{
+		FullPath: "/dev/disk/by-id/emc-vol-1-old",
+		Name:     "emc-vol-1-old",
+		RealDev:  "/dev/scinib",
+	}
+	privTgt := getPrivateMountPoint(s.privDir, "vol1")
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+
+	tests := []struct {
+		name   string
+		device string
+		code   codes.Code
+	}{
+		{"device", "/dev/scinia", codes.OK},
+		{"symlink to device", "/dev/disk/by-id/emc-vol-1-vol1", codes.OK},
+		{"other device", "/dev/sdb", codes.AlreadyExists},
+		{"symlink to other device", "/dev/disk/by-id/emc-vol-1-old",
+			codes.AlreadyExists},
+		{"stale symlink", "/dev/disk/by-id/emc-vol-1-gone",
+			codes.AlreadyExists},
+	}
+	for _, tt := range tests {
+		// the target is found mounted, as after the node restarted
+		m.mounts = []gofsutil.Info{
+			{Device: "/dev/scinia", Path: privTgt, Opts: []string{"rw"}},
+			{Device: tt.device, Path: target, Opts: []string{"rw"}},
+		}
+		m.calls = map[string]int{}
+
+		_, err := s.NodePublishVolume(ctx, req)
+		st, _ := status.FromError(err)
+		assert.Equal(t, tt.code, st.Code(), tt.name)
+		assert.Len(t, m.mounts, 2, tt.name)
+		assert.Equal(t, 0, m.calls["BindMount"], tt.name)
+		assert.Equal(t, 0, m.calls["FormatAndMount"], tt.name)
+	}
+}
+
+func TestNodeUnpublishPrivMount(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	privTgt := getPrivateMountPoint(s.privDir, "vol1")
+	publish := func(target string) *csi.NodeUnpublishVolumeRequest {
+		assert.NoError(t, os.MkdirAll(target, 0755))
+		_, err := s.NodePublishVolume(ctx, publishReq(target,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false))
+		assert.NoError(t, err)
+		return &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   "vol1",
+			TargetPath: target,
+		}
+	}
+	unpublish := func(req *csi.NodeUnpublishVolumeRequest) {
+		_, err := s.NodeUnpublishVolume(ctx, req)
+		assert.NoError(t, err)
+	}
+
+	// the private mount is kept until its last target is unpublished
+	unpub1 := publish(filepath.Join(dir, "target1"))
+	unpub2 := publish(filepath.Join(dir, "target2"))
+	assert.Len(t, m.mounts, 3)
+	unpublish(unpub1)
+	assert.Len(t, m.mounts, 2)
+	isMnt, _ := isMounted(ctx, m, privTgt)
+	assert.True(t, isMnt)
+	unpublish(unpub2)
+	assert.Empty(t, m.mounts)
+	_, err := os.Stat(privTgt)
+	assert.True(t, os.IsNotExist(err))
+
+	// a private mount left behind by an earlier unpublish is removed
+	unpub1 = publish(filepath.Join(dir, "target1"))
+	assert.NoError(t, m.Unmount(ctx, unpub1.TargetPath))
+	unpublish(unpub1)
+	assert.Empty(t, m.mounts)
+	_, err = os.Stat(privTgt)
+	assert.True(t, os.IsNotExist(err))
+
+	// as is its mount point, while one already gone is not an error
+	assert.NoError(t, os.MkdirAll(privTgt, 0755))
+	unpublish(unpub1)
+	_, err = os.Stat(privTgt)
+	assert.True(t, os.IsNotExist(err))
+
+	unpub1 = publish(filepath.Join(dir, "target1"))
+	assert.NoError(t, os.Remove(privTgt))
+	unpublish(unpub1)
+	assert.Empty(t, m.mounts)
+}
+
+func TestNodeUnpublishRenamedDevice(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	unpub := &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: target,
+	}
+	statePath := volumeStatePath(s.privDir, "vol1")
+	link := "/dev/disk/by-id/emc-vol-1-vol1"
+
+	_, err := s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, &volumeState{
+		Device:  "/dev/scinia",
+		Targets: []string{target},
+	}, s.volStates.get(ctx, s.privDir, "vol1"))
+
+	// the SDC restarts and gives the volume another device, while the
+	// mount table still names the old one
+	m.devices[link] = &Device{
+		FullPath: link, Name: "emc-vol-1-vol1", RealDev: "/dev/scinib"}
+	_, err = s.NodeUnpublishVolume(ctx, unpub)
+	assert.NoError(t, err)
+	assert.Empty(t, m.mounts)
+	_, err = os.Stat(statePath)
+	assert.True(t, os.IsNotExist(err))
+
+	// the state survives a restart of the plug-in, and is used once the
+	// volume is no longer mapped
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	restarted, _, restartedDir := newFakeNode(t)
+	defer os.RemoveAll(restartedDir)
+	restarted.privDir = s.privDir
+	restarted.mounter = m
+	restarted.localVolumes = func() ([]*sio.SdcMappedVolume, error) {
+		return nil, nil
+	}
+	_, err = restarted.NodeUnpublishVolume(ctx, unpub)
+	assert.NoError(t, err)
+	assert.Empty(t, m.mounts)
+	_, err = os.Stat(statePath)
+	assert.True(t, os.IsNotExist(err))
+
+	// without it, an unmapped volume can't be unpublished
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(statePath))
+	_, err = restarted.NodeUnpublishVolume(ctx, unpub)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Unavailable, st.Code())
+	assert.Len(t, m.mounts, 2)
+}
+
+func TestNodePublishReadOnly(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, true)
+
+	// read-only volumes are never formatted
+	_, err := s.NodePublishVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Internal, st.Code())
+	assert.Empty(t, m.formats)
+	assert.Equal(t, 0, m.calls["FormatAndMount"])
+
+	m.formats["/dev/disk/by-id/emc-vol-1-vol1"] = "ext4"
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Len(t, m.mounts, 2)
+	for _, mnt := range m.mounts {
+		assert.Equal(t, []string{"ro"}, mnt.Opts, mnt.Path)
+	}
+
+	// read-only block volumes are refused
+	block := filepath.Join(dir, "block")
+	assert.NoError(t, ioutil.WriteFile(block, nil, 0644))
+	req = publishReq(block,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, true)
+	req.VolumeCapability.AccessType = &csi.VolumeCapability_Block{
+		Block: &csi.VolumeCapability_BlockVolume{},
+	}
+	_, err = s.NodePublishVolume(ctx, req)
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
+
+func TestNodePublishDefaultFsType(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	req.VolumeCapability.GetMount().FsType = ""
+	req.VolumeAttributes = map[string]string{KeyFsType: "ext3"}
+	req.PublishInfo = map[string]string{
+		KeyFsType:           "xfs",
+		KeyProvisioningType: thinProvisioned,
+	}
+
+	// the publish info from the controller takes precedence
+	_, err := s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "xfs", m.formats["/dev/disk/by-id/emc-vol-1-vol1"])
+}
+
+func TestNodePublishMkfsOptions(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	req := publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false)
+	req.VolumeCapability.GetMount().FsType = ""
+	req.PublishInfo = map[string]string{
+		KeyMkfsOptions: "-E lazy_itable_init=1 -m 1",
+	}
+
+	_, err := s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	dev := "/dev/disk/by-id/emc-vol-1-vol1"
+	assert.Equal(t, "ext4", m.formats[dev])
+	assert.Equal(t,
+		[]string{"-E", "lazy_itable_init=1", "-m", "1"}, m.mkfs[dev])
+	assert.Equal(t, 0, m.calls["FormatAndMount"])
+	assert.Len(t, m.mounts, 2)
+
+	// formatted volumes aren't formatted again
+	_, err = s.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: target,
+	})
+	assert.NoError(t, err)
+	_, err = s.NodePublishVolume(ctx, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, m.calls["Format"])
+
+	// options naming a device are refused
+	req.PublishInfo[KeyMkfsOptions] = "-m 1 /dev/sdb"
+	_, err = s.NodePublishVolume(ctx, req)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
+
+func TestNodeStageUnimplemented(t *testing.T) {
+	ctx := context.Background()
+	s, _, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+
+	_, err := s.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.Unimplemented, st.Code())
+
+	_, err = s.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.Unimplemented, st.Code())
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// defaultSlowOperationThreshold is how long an RPC runs, by default,
+// before a warning is logged
+const defaultSlowOperationThreshold = 5 * time.Minute
+
+// operationsPath is the path, on the metrics address, at which the RPCs in
+// flight are listed when enabled
+const operationsPath = "/debug/operations"
+
+// warnSlow logs a warning for op, which has been running longer than the
+// slow operation threshold
+func warnSlow(ctx context.Context, op operation) {
+	reqLog(ctx, op.volumeID).WithField("method", op.method).WithField(
+		"started", op.started).WithField(
+		"running", time.Since(op.started).Round(time.Second)).Warn(
+		"operation still running")
+}
+
+// operations returns the RPCs in flight, oldest first
+func (f *inflight) operations() []operation {
+	f.Lock()
+	ops := make([]operation, 0, len(f.ops))
+	for _, op := range f.ops {
+		ops = append(ops, op)
+	}
+	f.Unlock()
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].started.Before(ops[j].started)
+	})
+	return ops
+}
+
+// operationJSON is an RPC in flight as listed by the operations handler
+type operationJSON struct {
+	Method   string    `json:"method"`
+	VolumeID string    `json:"volumeId,omitempty"`
+	Started  time.Time `json:"started"`
+	Running  string    `json:"running"`
+}
+
+// ServeHTTP writes the RPCs in flight, oldest first, as a JSON array
+func (f *inflight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ops := f.operations()
+	list := make([]operationJSON, len(ops))
+	for i, op := range ops {
+		list[i] = operationJSON{
+			Method:   op.method,
+			VolumeID: op.volumeID,
+			Started:  op.started,
+			Running:  time.Since(op.started).String(),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// entryHook sends each log entry to a channel
+type entryHook chan *log.Entry
+
+func (h entryHook) Levels() []log.Level { return log.AllLevels }
+
+func (h entryHook) Fire(e *log.Entry) error {
+	h <- e
+	return nil
+}
+
+func TestOperations(t *testing.T) {
+	logger := log.StandardLogger()
+	defer func(hooks log.LevelHooks) { logger.Hooks = hooks }(logger.Hooks)
+	entries := make(entryHook, 10)
+	logger.Hooks = log.LevelHooks{}
+	logger.AddHook(entries)
+
+	f := &inflight{slowAfter: 20 * time.Millisecond}
+	m := newMetrics()
+	m.inflight = f
+	m.observeRPC("ControllerPublishVolume", time.Second, nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		f.interceptor(context.Background(),
+			&csi.DeleteVolumeRequest{VolumeId: "vol1"},
+			&grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/DeleteVolume"},
+			func(ctx context.Context, req interface{}) (interface{}, error) {
+				close(started)
+				<-release
+				return nil, nil
+			})
+		close(finished)
+	}()
+	<-started
+
+	// an operation running past the threshold is logged once
+	select {
+	case e := <-entries:
+		assert.Equal(t, log.WarnLevel, e.Level)
+		assert.Equal(t, "DeleteVolume", e.Data["method"])
+		assert.Equal(t, "vol1", e.Data["volumeID"])
+	case <-time.After(time.Second):
+		t.Fatal("slow operation not logged")
+	}
+
+	var b bytes.Buffer
+	m.write(&b)
+	out := b.String()
+	assert.Contains(t, out,
+		`csi_scaleio_rpc_in_flight{method="DeleteVolume"} 1`+"\n")
+	assert.Contains(t, out,
+		`csi_scaleio_rpc_in_flight{method="ControllerPublishVolume"} 0`+"\n")
+	assert.Contains(t, out,
+		`csi_scaleio_rpc_in_flight_oldest_seconds{method="ControllerPublishVolume"} 0`+"\n")
+	assert.NotContains(t, out, "vol1")
+
+	rec := httptest.NewRecorder()
+	f.ServeHTTP(rec, httptest.NewRequest("GET", operationsPath, nil))
+	var ops []operationJSON
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &ops))
+	if assert.Len(t, ops, 1) {
+		assert.Equal(t, "DeleteVolume", ops[0].Method)
+		assert.Equal(t, "vol1", ops[0].VolumeID)
+	}
+
+	close(release)
+	<-finished
+	assert.Empty(t, f.operations())
+	assert.Empty(t, entries)
+
+	// as in the server, where the metrics interceptor records the RPC
+	m.observeRPC("DeleteVolume", time.Second, nil)
+	b.Reset()
+	m.write(&b)
+	assert.Contains(t, b.String(),
+		`csi_scaleio_rpc_in_flight{method="DeleteVolume"} 0`+"\n")
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// orphan is the mapping of a volume to an SDC that no longer exists
+type orphan struct {
+	volumeID   string
+	volumeName string
+	sdcID      string
+}
+
+// scanOrphansEvery scans for orphaned mappings every interval until stop is
+// closed. Scans are skipped while the controller is not probed.
+func (s *service) scanOrphansEvery(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if !s.controllerProbed() {
+			continue
+		}
+		if _, err := s.scanOrphans(s.opts.OrphanCleanup); err != nil {
+			log.WithError(err).Warn("unable to scan for orphaned volumes")
+		}
+	}
+}
+
+// scanOrphans returns the mappings of volumes to SDCs that are no longer
+// registered with the system, logging each one. If cleanup is true, the
+// volumes are unmapped from those SDCs. The gateway calls are made one at
+// a time, so a scan never adds more than one concurrent request.
+func (s *service) scanOrphans(cleanup bool) ([]orphan, error) {
+	var sdcs []siotypes.Sdc
+	ctx := context.Background()
+	if err := s.withSystem(ctx, func(system *siotypes.System) error {
+		var err error
+		s.metrics.gatewayCall("GetSdcs")
+		sdcs, err = s.adminClient.GetSdcs(system)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(sdcs))
+	for _, sdc := range sdcs {
+		known[sdc.ID] = true
+	}
+
+	s.metrics.gatewayCall("GetVolume")
+	vols, err := s.adminClient.GetVolume("", "", "", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []orphan
+	for _, vol := range vols {
+		for _, m := range vol.MappedSdcInfo {
+			if known[m.SdcID] {
+				continue
+			}
+			o := orphan{volumeID: vol.ID, volumeName: vol.Name, sdcID: m.SdcID}
+			orphans = append(orphans, o)
+
+			f := log.Fields{
+				"volumeID":   o.volumeID,
+				"volumeName": o.volumeName,
+				"sdcID":      o.sdcID,
+			}
+			if !cleanup {
+				log.WithFields(f).Warn("volume mapped to missing SDC")
+				continue
+			}
+
+			s.metrics.gatewayCall("UnmapVolumeSdc")
+			err := s.adminClient.UnmapVolumeSdc(
+				&siotypes.Volume{ID: vol.ID},
+				&siotypes.UnmapVolumeSdcParam{SdcID: m.SdcID})
+			s.setRemapped(vol.ID)
+			if err != nil {
+				log.WithFields(f).WithError(err).Warn(
+					"unable to unmap volume from missing SDC")
+				continue
+			}
+			log.WithFields(f).Warn("unmapped volume from missing SDC")
+		}
+	}
+
+	return orphans, nil
+}
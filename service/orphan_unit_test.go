@@ -0,0 +1,71 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+func TestScanOrphans(t *testing.T) {
+	s, fake := newFakeService()
+	live := fake.AddSdc("SDC-LIVE")
+	gone := fake.AddSdc("SDC-GONE")
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	other := fake.AddVolume("other", "pool", 8*kiBytesInGiB)
+	for _, m := range []struct{ vol, sdc string }{
+		{id, live}, {id, gone}, {other, live},
+	} {
+		assert.NoError(t, fake.MapVolumeSdc(
+			&siotypes.Volume{ID: m.vol},
+			&siotypes.MapVolumeSdcParam{
+				SdcID:                 m.sdc,
+				AllowMultipleMappings: "true",
+			}))
+	}
+
+	// the host of an SDC is removed
+	delete(fake.SDCs, gone)
+
+	orphans, err := s.scanOrphans(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []orphan{{volumeID: id, volumeName: "vol", sdcID: gone}},
+		orphans)
+	assert.Len(t, fake.Volumes[id].MappedSdcInfo, 2)
+	assert.Equal(t, 0, fake.Calls["UnmapVolumeSdc"])
+
+	orphans, err = s.scanOrphans(true)
+	assert.NoError(t, err)
+	assert.Len(t, orphans, 1)
+	assert.Len(t, fake.Volumes[id].MappedSdcInfo, 1)
+	assert.Equal(t, live, fake.Volumes[id].MappedSdcInfo[0].SdcID)
+
+	orphans, err = s.scanOrphans(true)
+	assert.NoError(t, err)
+	assert.Empty(t, orphans)
+}
+
+func TestScanOrphansEvery(t *testing.T) {
+	s, fake := newFakeService()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.scanOrphansEvery(time.Millisecond, stop)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		fake.Lock()
+		n := fake.Calls["GetSdcs"]
+		fake.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-done
+	assert.NotZero(t, fake.Calls["GetSdcs"])
+}
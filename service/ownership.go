@@ -0,0 +1,58 @@
+package service
+
+import (
+	"strings"
+
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// With X_CSI_SCALEIO_ENFORCE_OWNERSHIP set, the volumes the plug-in creates
+// or imports are marked as its own by starting their names with
+// ownedVolumePrefix, as ScaleIO keeps no other metadata for volumes, and
+// DeleteVolume refuses volumes without the mark. A CO or admin passing the
+// ID of a volume the plug-in doesn't manage then can't delete it. Volumes
+// created before the setting was, and not imported since, lack the mark.
+
+// ownedVolumePrefix starts the names of the volumes marked as the
+// plug-in's own
+const ownedVolumePrefix = "csi-"
+
+// isOwned returns whether vol is marked as the plug-in's own
+func isOwned(vol *siotypes.Volume) bool {
+	return strings.HasPrefix(vol.Name, ownedVolumePrefix)
+}
+
+// stampedVolumeName returns the name that marks the volume named name as
+// the plug-in's own, shortened as sioVolumeName shortens names
+func stampedVolumeName(name string) string {
+	if strings.HasPrefix(name, ownedVolumePrefix) {
+		return name
+	}
+	return sioVolumeName(ownedVolumePrefix + name)
+}
+
+// volumeName returns the ScaleIO name of the volume the CO names name,
+// marked as the plug-in's own if ownership is enforced. Names the CO gives
+// with the mark are marked again, so that they can't collide with those
+// given without it.
+func (s *service) volumeName(name string) string {
+	if s.opts.EnforceOwnership {
+		return sioVolumeName(ownedVolumePrefix + name)
+	}
+	return sioVolumeName(name)
+}
+
+// checkOwned returns PermissionDenied if ownership is enforced and vol
+// isn't marked as the plug-in's own. Tombstones are only made of volumes
+// the plug-in deleted, so they are its own too.
+func (s *service) checkOwned(vol *siotypes.Volume) error {
+	if !s.opts.EnforceOwnership || isOwned(vol) || isTombstone(vol) {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied,
+		"volume %s (%s) was not created by this plug-in, its name lacks "+
+			"the %q prefix; import it to adopt it, or unset %s",
+		vol.ID, vol.Name, ownedVolumePrefix, EnvEnforceOwnership)
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeOwnership(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.EnforceOwnership = true
+	other := fake.AddVolume("other", "pool", 8*kiBytesInGiB)
+
+	// created volumes are marked, even those named with the mark already
+	rep, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:       "pvc-1",
+		Parameters: map[string]string{KeyStoragePool: "pool"},
+	})
+	assert.NoError(t, err)
+	owned := rep.Volume.Id
+	assert.Equal(t, "csi-pvc-1", fake.Volumes[owned].Name)
+	assert.Equal(t, "csi-csi-pvc-1", s.volumeName("csi-pvc-1"))
+
+	// only the plug-in's own volumes are listed, if asked
+	sorted := func(ids ...string) []string {
+		sort.Strings(ids)
+		return ids
+	}
+	list := func() []string {
+		rep, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		assert.NoError(t, err)
+		var ids []string
+		for _, e := range rep.Entries {
+			ids = append(ids, e.Volume.Id)
+		}
+		return sorted(ids...)
+	}
+	assert.Equal(t, sorted(owned, other), list())
+	s.opts.ListOwnedOnly = true
+	assert.Equal(t, []string{owned}, list())
+
+	// volumes without the mark aren't deleted
+	_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: other})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.PermissionDenied, st.Code())
+	assert.Contains(t, st.Message(), EnvEnforceOwnership)
+	assert.Equal(t, 0, fake.Calls["RemoveVolume"])
+
+	// importing a volume marks it, and importing it again finds it
+	for i := 0; i < 2; i++ {
+		rep, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       "pvc-2",
+			Parameters: map[string]string{KeyImportVolumeName: "other"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, other, rep.Volume.Id)
+		assert.Equal(t, "csi-other", fake.Volumes[other].Name)
+	}
+	assert.Equal(t, 1, fake.Calls["SetVolumeName"])
+	assert.Equal(t, sorted(owned, other), list())
+
+	renamed := fake.AddVolume("renamed", "pool", 8*kiBytesInGiB)
+	_, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "pvc-3",
+		Parameters: map[string]string{
+			KeyImportVolumeName: "renamed",
+			KeyImportRename:     "true",
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "csi-pvc-3", fake.Volumes[renamed].Name)
+
+	for _, id := range []string{owned, other, renamed} {
+		_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 3, fake.Calls["RemoveVolume"])
+
+	// nothing is refused unless ownership is enforced
+	s.opts.EnforceOwnership = false
+	id := fake.AddVolume("unowned", "pool", 8*kiBytesInGiB)
+	_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+	assert.NoError(t, err)
+	assert.Equal(t, "pvc-4", s.volumeName("pvc-4"))
+}
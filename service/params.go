@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateVolumeParameters are the keys of the parameters CreateVolume
+// accepts. Any other key is a mistake, rejected when EnvStrictParams is set
+// and logged otherwise.
+var CreateVolumeParameters = []string{
+	KeyStoragePool,
+	KeyThickProvisioning,
+	KeyFsType,
+	KeyMkfsOptions,
+	KeyGID,
+	KeyMode,
+	KeyRAMCache,
+	KeyIOPSLimit,
+	KeyBandwidthLimitKbps,
+	KeyImportVolumeName,
+	KeyImportRename,
+	KeyImportForce,
+	KeyValidateOnly,
+	KeyProfile,
+}
+
+// k8sParamPrefix is the prefix of the parameters Kubernetes reserves for
+// itself, which aren't the plug-in's to check
+const k8sParamPrefix = "csi.storage.k8s.io/"
+
+// checkParams returns InvalidArgument for the first, in order, parameter
+// that CreateVolume doesn't accept if strict parameters are enabled, and
+// otherwise logs a warning for each
+func (s *service) checkParams(
+	ctx context.Context, params map[string]string) error {
+
+	var unknown []string
+	for k := range params {
+		if !isCreateVolumeParameter(k) && !strings.HasPrefix(k, k8sParamPrefix) {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+
+	for _, k := range unknown {
+		if s.opts.StrictParams {
+			return status.Errorf(codes.InvalidArgument,
+				"unknown parameter %s, did you mean %s?", k, closestParam(k))
+		}
+		reqLog(ctx, "").WithField("parameter", k).WithField(
+			"closest", closestParam(k)).Warn("ignoring unknown parameter")
+	}
+	return nil
+}
+
+func isCreateVolumeParameter(k string) bool {
+	for _, p := range CreateVolumeParameters {
+		if k == p {
+			return true
+		}
+	}
+	return false
+}
+
+// closestParam returns the parameter CreateVolume accepts that k is the
+// fewest edits, ignoring case, from
+func closestParam(k string) string {
+	var (
+		closest string
+		min     = -1
+	)
+	for _, p := range CreateVolumeParameters {
+		d := editDistance(strings.ToLower(k), strings.ToLower(p))
+		if min < 0 || d < min {
+			closest, min = p, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			sub := 1
+			if a[i-1] == b[j-1] {
+				sub = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+sub)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(v ...int) int {
+	m := v[0]
+	for _, n := range v[1:] {
+		if n < m {
+			m = n
+		}
+	}
+	return m
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClosestParam(t *testing.T) {
+	for k, want := range map[string]string{
+		"storagePool":       KeyStoragePool,
+		"storage-pool":      KeyStoragePool,
+		"thickProvisioning": KeyThickProvisioning,
+		"fstype":            KeyFsType,
+		"iopslimit":         KeyIOPSLimit,
+		"bandwidthLimit":    KeyBandwidthLimitKbps,
+		"ImportVolumeName":  KeyImportVolumeName,
+	} {
+		assert.Equal(t, want, closestParam(k), k)
+	}
+	assert.Equal(t, 3, editDistance("kitten", "sitting"))
+	assert.Equal(t, 0, editDistance("", ""))
+}
+
+func TestParseMkfsOptions(t *testing.T) {
+	for _, opts := range []string{
+		"",
+		"-E lazy_itable_init=1,lazy_journal_init=1",
+		"-m 1 -E stride=16,stripe_width=64 -T largefile",
+		"-i size=512",
+	} {
+		_, err := parseMkfsOptions(opts)
+		assert.NoError(t, err, opts)
+	}
+	for _, opts := range []string{
+		"-t ext3",
+		"-text3",
+		"--type=xfs",
+		"-m 1 /dev/sdb",
+	} {
+		_, err := parseMkfsOptions(opts)
+		st, _ := status.FromError(err)
+		assert.Equal(t, codes.InvalidArgument, st.Code(), opts)
+	}
+
+	assert.Equal(t, []string{"-m", "1", "-F", "/dev/scinia"},
+		mkfsArgs("/dev/scinia", "ext4", []string{"-m", "1"}))
+	assert.Equal(t, []string{"-K", "/dev/scinia"},
+		mkfsArgs("/dev/scinia", "xfs", []string{"-K"}))
+}
+
+func TestStrictParams(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	create := func(params map[string]string) error {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       "vol",
+			Parameters: params,
+		})
+		return err
+	}
+
+	// unknown parameters are only logged by default
+	assert.NoError(t, create(map[string]string{
+		KeyStoragePool:      "pool",
+		"thickProvisioning": "true",
+	}))
+
+	s.opts.StrictParams = true
+	err := create(map[string]string{"storagePool": "pool"})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t,
+		"unknown parameter storagePool, did you mean storagepool?",
+		st.Message())
+	assert.Equal(t, 1, fake.Calls["CreateVolume"])
+
+	// the parameters Kubernetes reserves are left to it
+	assert.NoError(t, create(map[string]string{
+		KeyStoragePool:               "pool",
+		"csi.storage.k8s.io/pv/name": "pv",
+	}))
+}
+
+func TestCreateVolumeParametersDocumented(t *testing.T) {
+	readme, err := ioutil.ReadFile("../README.md")
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, k := range CreateVolumeParameters {
+		assert.Contains(t, string(readme), "`"+k+"`", k)
+	}
+}
@@ -0,0 +1,353 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// poolListTTL is how long the list of storage pools is cached. Pools are
+// rarely added or removed.
+var poolListTTL = 5 * time.Minute
+
+// maxPoolNames is the most storage pool names given in an error
+const maxPoolNames = 20
+
+// poolList is the cached list of storage pools
+type poolList struct {
+	names   []string
+	expires time.Time
+}
+
+// getPoolNames returns the names of the storage pools AllowedPools may
+// allow, ordered by name
+func (s *service) getPoolNames() ([]string, error) {
+	s.poolListMu.Lock()
+	defer s.poolListMu.Unlock()
+
+	if time.Now().Before(s.poolList.expires) {
+		return s.poolList.names, nil
+	}
+
+	s.metrics.gatewayCall("GetStoragePools")
+	pools, err := s.adminClient.GetStoragePools()
+	if err != nil {
+		return nil, err
+	}
+	// pools AllowedPools can't allow are left out, so that they are
+	// never suggested
+	names := make([]string, 0, len(pools))
+	for _, p := range pools {
+		if s.poolNameAllowed(p.Name) {
+			names = append(names, p.Name)
+		}
+	}
+	sort.Strings(names)
+
+	s.poolList = poolList{
+		names:   names,
+		expires: time.Now().Add(poolListTTL),
+	}
+	return names, nil
+}
+
+// isPoolNotFound returns a flag indicating whether err reports that a
+// storage pool does not exist
+func isPoolNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "storage pool") &&
+		(strings.Contains(msg, "not find") ||
+			strings.Contains(msg, "couldn't find") ||
+			strings.Contains(msg, "not found"))
+}
+
+// poolNotFoundErr returns the error for a storage pool that doesn't exist,
+// naming those that do, as the name is easily mistyped
+func (s *service) poolNotFoundErr(ctx context.Context, name string) error {
+	// the pool may have been added since the list was cached
+	s.poolListMu.Lock()
+	s.poolList = poolList{}
+	s.poolListMu.Unlock()
+
+	names, err := s.getPoolNames()
+	if err != nil {
+		reqLog(ctx, "").WithError(err).Debug("unable to list storage pools")
+		return status.Errorf(codes.InvalidArgument,
+			"storage pool %s not found", name)
+	}
+	return status.Errorf(codes.InvalidArgument,
+		"storage pool %s not found, available pools are: %s",
+		name, poolNames(names))
+}
+
+// poolNames returns names as a comma separated list of at most
+// maxPoolNames names
+func poolNames(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	if len(names) <= maxPoolNames {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more",
+		strings.Join(names[:maxPoolNames], ", "), len(names)-maxPoolNames)
+}
+
+// setPoolsManifest adds the names of the storage pools, as last listed, to
+// an identity manifest, so that they can be discovered by StorageClass
+// authors. Nothing is added if they haven't been listed.
+func (s *service) setPoolsManifest(manifest map[string]string) {
+	s.poolListMu.Lock()
+	defer s.poolListMu.Unlock()
+	if s.poolList.expires.IsZero() {
+		return
+	}
+	manifest["storagePools"] = strings.Join(s.poolList.names, ",")
+}
+
+// checkPoolSystem returns an InvalidArgument error if pool is in a system
+// other than system, as happens when one gateway manages several systems
+// with pools of the same name
+func (s *service) checkPoolSystem(
+	pool *siotypes.StoragePool, system *siotypes.System) error {
+
+	s.metrics.gatewayCall("GetProtectionDomain")
+	pd, err := s.adminClient.GetProtectionDomain(pool.ProtectionDomainID)
+	if err != nil {
+		return fmt.Errorf("unable to find protection domain of storage "+
+			"pool %s: %s", pool.Name, err.Error())
+	}
+	if pd.SystemID == "" || pd.SystemID == system.ID {
+		return nil
+	}
+
+	// name the other system, if it can be found by its ID
+	other := &siotypes.System{ID: pd.SystemID}
+	s.metrics.gatewayCall("FindSystem")
+	if sys, err := s.adminClient.FindSystem(
+		pd.SystemID, "", ""); err == nil && sys.ID == pd.SystemID {
+		other = sys
+	}
+	return status.Errorf(codes.InvalidArgument,
+		"storage pool %s is in system %s, not in the configured system %s",
+		pool.Name, systemLabel(other), systemLabel(system))
+}
+
+// systemLabel returns the name and ID of system, or just its ID if it has
+// no name
+func systemLabel(system *siotypes.System) string {
+	if system.Name == "" || system.Name == system.ID {
+		return system.ID
+	}
+	return fmt.Sprintf("%s (%s)", system.Name, system.ID)
+}
+
+// parsePoolProvisioning parses v, a comma separated list of pool:type
+// pairs, where type is thick or thin, into the volume type of each pool
+func parsePoolProvisioning(v string) (map[string]string, error) {
+	types := map[string]string{}
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid pool provisioning: %s", p)
+		}
+		switch strings.ToLower(strings.TrimSpace(kv[1])) {
+		case "thick":
+			types[strings.TrimSpace(kv[0])] = thickProvisioned
+		case "thin":
+			types[strings.TrimSpace(kv[0])] = thinProvisioned
+		default:
+			return nil, fmt.Errorf("invalid pool provisioning: %s, "+
+				"must be thick or thin", p)
+		}
+	}
+	return types, nil
+}
+
+// allowedPoolSep separates the protection domain from the storage pool in
+// the entries of AllowedPools that qualify the pool by its domain
+const allowedPoolSep = "/"
+
+// parseAllowedPools parses v, a comma separated list of storage pools, each
+// named alone or qualified by its protection domain as domain/pool
+func parseAllowedPools(v string) ([]string, error) {
+	var pools []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		parts := strings.Split(p, allowedPoolSep)
+		switch {
+		case len(parts) > 2:
+			return nil, fmt.Errorf("invalid storage pool: %s", p)
+		case len(parts) == 2 && (parts[0] == "" || parts[1] == ""):
+			return nil, fmt.Errorf("invalid storage pool: %s, "+
+				"must be pool or domain/pool", p)
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// splitAllowedPool returns the protection domain, if any, and the name of
+// the storage pool of an entry of AllowedPools
+func splitAllowedPool(entry string) (pd, pool string) {
+	if i := strings.Index(entry, allowedPoolSep); i >= 0 {
+		return entry[:i], entry[i+1:]
+	}
+	return "", entry
+}
+
+// poolNameAllowed returns whether an entry of AllowedPools names a storage
+// pool named name, in any protection domain, which is always the case if
+// none are listed
+func (s *service) poolNameAllowed(name string) bool {
+	if len(s.opts.AllowedPools) == 0 {
+		return true
+	}
+	for _, e := range s.opts.AllowedPools {
+		if _, pool := splitAllowedPool(e); pool == name {
+			return true
+		}
+	}
+	return false
+}
+
+// poolAllowed returns whether AllowedPools lists pool, or is empty. The
+// protection domain of the pool is only looked up if an entry qualifies
+// the pool's name by a domain, which may be given by name or by ID.
+func (s *service) poolAllowed(pool *siotypes.StoragePool) (bool, error) {
+	if len(s.opts.AllowedPools) == 0 {
+		return true, nil
+	}
+	var pdName *string
+	for _, e := range s.opts.AllowedPools {
+		pd, name := splitAllowedPool(e)
+		if name != pool.Name {
+			continue
+		}
+		if pd == "" || pd == pool.ProtectionDomainID {
+			return true, nil
+		}
+		if pdName == nil {
+			n, err := s.protectionDomainName(pool.ProtectionDomainID)
+			if err != nil {
+				return false, err
+			}
+			pdName = &n
+		}
+		if pd == *pdName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// allowedPools returns those of pools that AllowedPools lists
+func (s *service) allowedPools(
+	pools []*siotypes.StoragePool) ([]*siotypes.StoragePool, error) {
+
+	if len(s.opts.AllowedPools) == 0 {
+		return pools, nil
+	}
+	allowed := make([]*siotypes.StoragePool, 0, len(pools))
+	for _, p := range pools {
+		ok, err := s.poolAllowed(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			allowed = append(allowed, p)
+		}
+	}
+	return allowed, nil
+}
+
+// checkPoolAllowed returns PermissionDenied if AllowedPools is set and
+// doesn't list the storage pool named name. Pools no entry names are
+// refused without calling the gateway; the pool is only looked up if an
+// entry qualifies its name by a protection domain.
+func (s *service) checkPoolAllowed(ctx context.Context, name string) error {
+	if len(s.opts.AllowedPools) == 0 {
+		return nil
+	}
+	allowed := false
+	if s.poolNameAllowed(name) {
+		pool, err := s.getStoragePool(name)
+		if err != nil {
+			if _, ok := status.FromError(err); ok {
+				return err
+			}
+			if isPoolNotFound(err) {
+				return s.poolNotFoundErr(ctx, name)
+			}
+			return status.Errorf(codes.Internal,
+				"unable to look up storage pool: %s, err: %s",
+				name, err.Error())
+		}
+		if allowed, err = s.poolAllowed(pool); err != nil {
+			return status.Errorf(codes.Internal,
+				"unable to check storage pool %s is allowed: %s",
+				name, err.Error())
+		}
+	}
+	if !allowed {
+		return status.Errorf(codes.PermissionDenied,
+			"storage pool %s is not among those allowed by %s",
+			name, EnvAllowedPools)
+	}
+	return nil
+}
+
+// pdNameTTL is how long the names of protection domains are cached
+var pdNameTTL = 5 * time.Minute
+
+// cachedPDName is the cached name of a protection domain
+type cachedPDName struct {
+	name    string
+	expires time.Time
+}
+
+// protectionDomainName returns the name of the protection domain with the
+// given ID
+func (s *service) protectionDomainName(id string) (string, error) {
+	s.pdNamesMu.Lock()
+	defer s.pdNamesMu.Unlock()
+	if c, ok := s.pdNames[id]; ok && time.Now().Before(c.expires) {
+		return c.name, nil
+	}
+
+	s.metrics.gatewayCall("GetProtectionDomain")
+	pd, err := s.adminClient.GetProtectionDomain(id)
+	if err != nil {
+		return "", err
+	}
+	s.pdNames[id] = cachedPDName{
+		name:    pd.Name,
+		expires: time.Now().Add(pdNameTTL),
+	}
+	return pd.Name, nil
+}
+
+// withStoragePool returns params, naming the default storage pool if they
+// name none and one is configured
+func (s *service) withStoragePool(params map[string]string) map[string]string {
+	if _, ok := params[KeyStoragePool]; ok || s.opts.StoragePool == "" {
+		return params
+	}
+	withPool := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		withPool[k] = v
+	}
+	withPool[KeyStoragePool] = s.opts.StoragePool
+	return withPool
+}
@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+func TestPoolNames(t *testing.T) {
+	assert.Equal(t, "none", poolNames(nil))
+	assert.Equal(t, "a, b", poolNames([]string{"a", "b"}))
+
+	var names []string
+	for i := 0; i < maxPoolNames+5; i++ {
+		names = append(names, fmt.Sprintf("pool%02d", i))
+	}
+	s := poolNames(names)
+	assert.Contains(t, s, "pool19 and 5 more")
+	assert.NotContains(t, s, "pool20")
+
+	assert.True(t, isPoolNotFound(errors.New(testutil.ErrPoolNotFound)))
+	assert.False(t, isPoolNotFound(errors.New(testutil.ErrSdcNotFound)))
+}
+
+func TestPoolNotFound(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddStoragePool("other", 100*kiBytesInGiB)
+
+	_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:       "vol",
+		Parameters: map[string]string{KeyStoragePool: "poool"},
+	})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Contains(t, st.Message(), "available pools are: other, pool")
+
+	_, err = s.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{KeyStoragePool: "poool"},
+	})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Contains(t, st.Message(), "storage pool poool not found")
+
+	// the pools are listed again for each error, as one may have been added
+	assert.Equal(t, 2, fake.Calls["GetStoragePools"])
+
+	// the pool is still reported when they can't be listed
+	fake.Errors["GetStoragePools"] = errors.New("gateway down")
+	_, err = s.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{KeyStoragePool: "poool"},
+	})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, "storage pool poool not found", st.Message())
+}
+
+func TestPluginInfoPools(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddStoragePool("other", 100*kiBytesInGiB)
+
+	// the pools are only reported once listed, never by GetPluginInfo
+	info, err := s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.NoError(t, err)
+	assert.NotContains(t, info.GetManifest(), "storagePools")
+	assert.Equal(t, 0, fake.Calls["GetStoragePools"])
+
+	s.refreshManifest()
+	for i := 0; i < 2; i++ {
+		info, err = s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+		assert.NoError(t, err)
+		assert.Equal(t, "other,pool", info.GetManifest()["storagePools"])
+	}
+	assert.Equal(t, 1, fake.Calls["GetStoragePools"])
+
+	// an expired list is still reported until listed again
+	s.poolList.expires = time.Now().Add(-time.Second)
+	fake.Errors["GetStoragePools"] = errors.New("gateway down")
+	s.refreshManifest()
+	info, err = s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "other,pool", info.GetManifest()["storagePools"])
+	assert.Equal(t, 2, fake.Calls["GetStoragePools"])
+
+	// nodes don't list the pools
+	s, fake = newFakeService()
+	s.mode = "node"
+	s.refreshManifest()
+	info, err = s.GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+	assert.NoError(t, err)
+	assert.NotContains(t, info.GetManifest(), "storagePools")
+	assert.Equal(t, 0, fake.Calls["GetStoragePools"])
+}
+
+func TestParsePoolProvisioning(t *testing.T) {
+	types, err := parsePoolProvisioning(" ssd:thin, hdd:THICK ,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"ssd": thinProvisioned,
+		"hdd": thickProvisioned,
+	}, types)
+
+	types, err = parsePoolProvisioning("")
+	assert.NoError(t, err)
+	assert.Empty(t, types)
+
+	for _, v := range []string{"ssd", "ssd:thinner", ":thin", "ssd=thin"} {
+		_, err := parsePoolProvisioning(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestPoolOtherSystem(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.Systems["remote-sys"] = &siotypes.System{ID: "remote-sys", Name: "remote"}
+	fake.ProtectionDomains["remote-pd"] = &siotypes.ProtectionDomain{
+		ID:       "remote-pd",
+		SystemID: "remote-sys",
+	}
+	id := fake.AddStoragePool("remote-pool", 100*kiBytesInGiB)
+	fake.StoragePools[id].ProtectionDomainID = "remote-pd"
+
+	_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:       "vol",
+		Parameters: map[string]string{KeyStoragePool: "remote-pool"},
+	})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Equal(t, "storage pool remote-pool is in system remote "+
+		"(remote-sys), not in the configured system sys ("+
+		s.system.ID+")", st.Message())
+	assert.Equal(t, 0, fake.Calls["CreateVolume"])
+
+	// pools of the configured system are cached by its ID, and looked up
+	// again once the system changes
+	for i := 0; i < 2; i++ {
+		_, err = s.getStoragePool("pool")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, fake.Calls["GetProtectionDomain"])
+	s.system = fake.Systems["remote-sys"]
+	_, err = s.getStoragePool("pool")
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
+
+func TestParseAllowedPools(t *testing.T) {
+	pools, err := parseAllowedPools(" ssd, pd1/hdd ,")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssd", "pd1/hdd"}, pools)
+
+	pools, err = parseAllowedPools("")
+	assert.NoError(t, err)
+	assert.Empty(t, pools)
+
+	for _, v := range []string{"/ssd", "pd1/", "a/b/c"} {
+		_, err := parseAllowedPools(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestAllowedPools(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.ProtectionDomains[testutil.ProtectionDomainID].Name = "pd1"
+	fake.AddStoragePool("reserved", 100*kiBytesInGiB)
+	fake.AddStoragePool("hdd", 100*kiBytesInGiB)
+	fake.AddVolume("vol1", "pool", 8*kiBytesInGiB)
+	fake.AddVolume("vol2", "reserved", 8*kiBytesInGiB)
+	s.opts.AllowedPools = []string{"pool", "pd1/hdd", "pd2/reserved"}
+
+	create := func(pool string) error {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:       "vol-" + pool,
+			Parameters: map[string]string{KeyStoragePool: pool},
+		})
+		return err
+	}
+	creates := fake.Calls["CreateVolume"]
+	assert.NoError(t, create("pool"))
+	assert.NoError(t, create("hdd"))
+	assert.Equal(t, creates+2, fake.Calls["CreateVolume"])
+
+	// pools not listed, or listed in another protection domain, are
+	// refused before any volume is created, and those no entry names
+	// without even looking them up
+	calls := fake.Calls["FindStoragePool"]
+	for _, pool := range []string{"other", "reserved"} {
+		st, _ := status.FromError(create(pool))
+		assert.Equal(t, codes.PermissionDenied, st.Code(), pool)
+		st, _ = status.FromError(func() error {
+			_, err := s.GetCapacity(ctx, &csi.GetCapacityRequest{
+				Parameters: map[string]string{KeyStoragePool: pool},
+			})
+			return err
+		}())
+		assert.Equal(t, codes.PermissionDenied, st.Code(), pool)
+	}
+	assert.Equal(t, creates+2, fake.Calls["CreateVolume"])
+	assert.Equal(t, calls+1, fake.Calls["FindStoragePool"])
+
+	_, err := s.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{KeyStoragePool: "hdd"},
+	})
+	assert.NoError(t, err)
+
+	// only the volumes of allowed pools are listed
+	resp, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	var names []string
+	for _, e := range resp.Entries {
+		names = append(names, fake.Volumes[e.Volume.Id].Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"vol-hdd", "vol-pool", "vol1"}, names)
+
+	// the domain may be given by ID too
+	s.opts.AllowedPools = []string{testutil.ProtectionDomainID + "/reserved"}
+	assert.NoError(t, create("reserved"))
+	names, err = s.getPoolNames()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"reserved"}, names)
+}
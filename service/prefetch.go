@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// prefetchBudget is how long warming the caches after the controller is
+// first probed may take before it is abandoned
+var prefetchBudget = 30 * time.Second
+
+// startPrefetch starts warming the caches in the background, if enabled
+// and not already started. It must be called with probeMu held.
+func (s *service) startPrefetch() {
+	if !s.opts.Prefetch || s.prefetchCancel != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prefetchBudget)
+	s.prefetchCancel = cancel
+	go func() {
+		defer cancel()
+		s.prefetch(ctx)
+	}()
+}
+
+// stopPrefetch abandons warming the caches, if still under way
+func (s *service) stopPrefetch() {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+	if s.prefetchCancel != nil {
+		s.prefetchCancel()
+	}
+}
+
+// prefetch fills the cache of the storage pools, and of the IDs of the
+// SDCs registered with the system, so the first requests after a restart
+// don't each wait for the gateway. The gateway is called one call at a
+// time, and nothing more is fetched once ctx is done. The outcome is
+// logged once.
+func (s *service) prefetch(ctx context.Context) {
+	started := time.Now()
+	f := log.Fields{}
+	err := func() error {
+		pools, err := s.getPoolNames()
+		if err != nil {
+			return err
+		}
+		f["storagePools"] = len(pools)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var sdcs []siotypes.Sdc
+		if err := s.withSystem(ctx, func(system *siotypes.System) error {
+			var err error
+			s.metrics.gatewayCall("GetSdcs")
+			sdcs, err = adminContext(ctx, s.adminClient).GetSdcs(system)
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f["sdcs"] = s.cacheSDCs(sdcs)
+		return nil
+	}()
+	f["duration"] = time.Since(started).Round(time.Millisecond)
+	if err != nil {
+		log.WithFields(f).WithError(err).Info("unable to prefetch caches")
+		return
+	}
+	log.WithFields(f).Info("prefetched caches")
+}
+
+// cacheSDCs caches the IDs of sdcs by their GUIDs, unless already cached,
+// and returns the number cached
+func (s *service) cacheSDCs(sdcs []siotypes.Sdc) int {
+	s.sdcMapRWL.Lock()
+	defer s.sdcMapRWL.Unlock()
+
+	n := 0
+	expires := time.Now().Add(sdcCacheTTL)
+	for _, sdc := range sdcs {
+		key := normalizeSDCGUID(sdc.SdcGuid)
+		if sdc.ID == "" || !validSDCGUID(key) {
+			continue
+		}
+		if e, ok := s.sdcMap[key]; ok && time.Now().Before(e.expires) {
+			continue
+		}
+		s.sdcMap[key] = sdcEntry{id: sdc.ID, expires: expires}
+		n++
+	}
+	return n
+}
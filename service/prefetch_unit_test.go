@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrefetch(t *testing.T) {
+	s, fake := newFakeService()
+	guid := "271bad82-08ee-44f2-a2b1-7e2787c27be1"
+	sdc := fake.AddSdc(guid)
+	fake.AddSdc("not-a-guid")
+
+	s.prefetch(context.Background())
+	assert.Equal(t, 1, fake.Calls["GetStoragePools"])
+	assert.Equal(t, 1, fake.Calls["GetSdcs"])
+
+	// the first requests find what they need cached
+	names, err := s.getPoolNames()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pool"}, names)
+	id, err := s.getSDCID(context.Background(), guid)
+	assert.NoError(t, err)
+	assert.Equal(t, sdc, id)
+	assert.Equal(t, 1, fake.Calls["GetStoragePools"])
+	assert.Equal(t, 0, fake.Calls["FindSdc"])
+
+	// nothing more is fetched once canceled
+	s, fake = newFakeService()
+	fake.AddSdc(guid)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.prefetch(ctx)
+	assert.Equal(t, 1, fake.Calls["GetStoragePools"])
+	assert.Equal(t, 0, fake.Calls["GetSdcs"])
+	assert.Empty(t, s.sdcMap)
+
+	// or after a failure
+	s, fake = newFakeService()
+	fake.Errors["GetStoragePools"] = errors.New("gateway down")
+	s.prefetch(context.Background())
+	assert.Equal(t, 0, fake.Calls["GetSdcs"])
+}
+
+func TestStartPrefetch(t *testing.T) {
+	s, fake := newFakeService()
+	s.system = nil
+	s.opts.Endpoint = "https://gateway"
+	s.opts.Password = "password"
+	s.opts.User = "admin"
+	fake.AddSdc("271bad82-08ee-44f2-a2b1-7e2787c27be1")
+
+	// prefetching is off unless enabled
+	assert.NoError(t, s.controllerProbe(context.Background()))
+	assert.Nil(t, s.prefetchCancel)
+
+	s.system = nil
+	s.opts.Prefetch = true
+	assert.NoError(t, s.controllerProbe(context.Background()))
+	assert.NotNil(t, s.prefetchCancel)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.sdcMapRWL.RLock()
+		n := len(s.sdcMap)
+		s.sdcMapRWL.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.sdcMapRWL.RLock()
+	assert.Len(t, s.sdcMap, 1)
+	s.sdcMapRWL.RUnlock()
+
+	// it is started once
+	s.system = nil
+	assert.NoError(t, s.controllerProbe(context.Background()))
+	assert.NoError(t, s.Shutdown(context.Background()))
+	fake.Lock()
+	assert.Equal(t, 1, fake.Calls["GetSdcs"])
+	fake.Unlock()
+}
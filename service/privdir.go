@@ -0,0 +1,76 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// defaultPrivDir is the directory in which volumes are privately
+	// mounted on the node, unless EnvPrivateMountDir is set
+	defaultPrivDir = "/var/lib/csi-scaleio/private"
+
+	// legacyPrivDir is the directory in which volumes were privately
+	// mounted by default before defaultPrivDir. It is on the /dev tmpfs,
+	// which is lost on reboot, and can't be created from a read-only root
+	// filesystem.
+	legacyPrivDir = "/dev/disk/csi-scaleio"
+)
+
+// checkPrivDir creates the private mount directory if needed, and verifies
+// that it can be written to. Directories held in memory are only logged, as
+// they work until the node reboots.
+func checkPrivDir(dir string) error {
+	hostPath := fmt.Sprintf(
+		"mount a hostPath volume of the host's %s, with mountPropagation "+
+			"Bidirectional, at %s in the node plug-in's container, or set %s "+
+			"to such a directory", dir, dir, EnvPrivateMountDir)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return status.Errorf(codes.FailedPrecondition,
+			"unable to create private mount directory %s: %s; %s",
+			dir, err.Error(), hostPath)
+	}
+	f, err := ioutil.TempFile(dir, ".probe")
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition,
+			"private mount directory %s is not writable: %s; %s",
+			dir, err.Error(), hostPath)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	inMem, err := inMemoryFS(dir)
+	if err != nil {
+		log.WithField("privateMountDir", dir).WithError(err).Debug(
+			"unable to determine filesystem of private mount directory")
+	} else if inMem {
+		log.WithField("privateMountDir", dir).Warnf(
+			"private mount directory is held in memory and is lost on "+
+				"reboot; %s", hostPath)
+	}
+	return nil
+}
+
+// volPrivDir returns the directory holding the private mount of volume id,
+// which is the legacy default directory for volumes mounted there before
+// the default changed
+func (s *service) volPrivDir(ctx context.Context, id string) string {
+	if s.legacyPrivDir == "" || id == "" {
+		return s.privDir
+	}
+	privTgt := getPrivateMountPoint(s.legacyPrivDir, id)
+	mounted, err := isMounted(ctx, s.mounter, privTgt)
+	if err != nil || !mounted {
+		return s.privDir
+	}
+	reqLog(ctx, id).WithField("privateMount", privTgt).Info(
+		"using private mount in legacy directory")
+	return s.legacyPrivDir
+}
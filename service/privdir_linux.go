@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package service
+
+import "golang.org/x/sys/unix"
+
+const (
+	// tmpfsMagic and ramfsMagic identify filesystems held in memory, from
+	// linux/magic.h
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+)
+
+// inMemoryFS returns a flag indicating whether path is on a filesystem held
+// in memory, such as the tmpfs /dev usually is, whose contents are lost on
+// reboot
+func inMemoryFS(path string) (bool, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	t := int64(st.Type)
+	return t == tmpfsMagic || t == ramfsMagic, nil
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckPrivDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-scaleio-privdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// missing parents are created
+	priv := filepath.Join(dir, "var", "lib", "private")
+	assert.NoError(t, checkPrivDir(priv))
+	files, err := ioutil.ReadDir(priv)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	// a directory that can't be created explains how to provide it
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	err = checkPrivDir(filepath.Join(file, "private"))
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Contains(t, st.Message(), "hostPath")
+	assert.Contains(t, st.Message(), EnvPrivateMountDir)
+}
+
+func TestNodePublishLegacyPrivDir(t *testing.T) {
+	ctx := context.Background()
+	s, m, dir := newFakeNode(t)
+	defer os.RemoveAll(dir)
+	s.legacyPrivDir = filepath.Join(dir, "legacy")
+
+	// a volume privately mounted in the legacy directory keeps using it
+	legacyTgt := getPrivateMountPoint(s.legacyPrivDir, "vol1")
+	assert.NoError(t, os.MkdirAll(legacyTgt, 0755))
+	m.formats["/dev/disk/by-id/emc-vol-1-vol1"] = "ext4"
+	assert.NoError(t, m.Mount(ctx,
+		"/dev/disk/by-id/emc-vol-1-vol1", legacyTgt, "ext4"))
+
+	target := filepath.Join(dir, "target")
+	assert.NoError(t, os.Mkdir(target, 0755))
+	_, err := s.NodePublishVolume(ctx, publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false))
+	assert.NoError(t, err)
+	assert.Len(t, m.mounts, 2)
+	_, err = os.Stat(getPrivateMountPoint(s.privDir, "vol1"))
+	assert.True(t, os.IsNotExist(err))
+
+	// and is cleaned up from there
+	_, err = s.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "vol1",
+		TargetPath: target,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, m.mounts)
+	_, err = os.Stat(legacyTgt)
+	assert.True(t, os.IsNotExist(err))
+
+	// once gone, the volume is mounted in the new directory
+	_, err = s.NodePublishVolume(ctx, publishReq(target,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, false))
+	assert.NoError(t, err)
+	isMnt, _ := isMounted(ctx, m, getPrivateMountPoint(s.privDir, "vol1"))
+	assert.True(t, isMnt)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+// inMemoryFS is only checked on Linux, where the node service runs
+func inMemoryFS(path string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// KeyProfile is the key used to get, from the volume create parameters
+// map, the name of a profile whose parameters are used where the request
+// doesn't give its own
+const KeyProfile = "profile"
+
+// perRequestParams are the CreateVolume parameters a profile may not set,
+// as they only make sense for a single request
+var perRequestParams = []string{
+	KeyProfile,
+	KeyValidateOnly,
+	KeyImportVolumeName,
+	KeyImportRename,
+	KeyImportForce,
+}
+
+// loadProfiles reads the profiles file at path
+func loadProfiles(path string) (map[string]map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := parseProfiles(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return profiles, nil
+}
+
+// parseProfiles parses a profiles file, in either JSON or YAML, into the
+// CreateVolume parameters of each profile, by name. Only YAML documents of
+// unindented "name:" lines, each followed by indented "key: value" lines,
+// are supported.
+func parseProfiles(data []byte) (map[string]map[string]string, error) {
+	profiles := map[string]map[string]string{}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		var raw map[string]map[string]interface{}
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+		for name, params := range raw {
+			profiles[name] = map[string]string{}
+			for k, v := range params {
+				switch tv := v.(type) {
+				case string:
+					profiles[name][k] = tv
+				case bool:
+					profiles[name][k] = strconv.FormatBool(tv)
+				case float64:
+					profiles[name][k] = strconv.FormatFloat(tv, 'f', -1, 64)
+				default:
+					return nil, fmt.Errorf(
+						"invalid value for key: %s of profile: %s", k, name)
+				}
+			}
+		}
+	} else {
+		var cur map[string]string
+		s := bufio.NewScanner(bytes.NewReader(data))
+		for n := 1; s.Scan(); n++ {
+			raw := s.Text()
+			line := strings.TrimSpace(raw)
+			if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			kv := strings.SplitN(line, ":", 2)
+			if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+				return nil, fmt.Errorf("invalid line %d: %s", n, line)
+			}
+			k, v := strings.TrimSpace(kv[0]), unquote(strings.TrimSpace(kv[1]))
+
+			indented := raw[0] == ' ' || raw[0] == '\t'
+			switch {
+			case !indented && v == "":
+				cur = map[string]string{}
+				profiles[unquote(k)] = cur
+			case indented && cur != nil:
+				cur[k] = v
+			default:
+				return nil, fmt.Errorf("invalid line %d: %s", n, line)
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	for name, params := range profiles {
+		for k := range params {
+			if !isCreateVolumeParameter(k) || isPerRequestParam(k) {
+				return nil, fmt.Errorf(
+					"invalid key: %s of profile: %s", k, name)
+			}
+		}
+	}
+	return profiles, nil
+}
+
+func isPerRequestParam(k string) bool {
+	for _, p := range perRequestParams {
+		if k == p {
+			return true
+		}
+	}
+	return false
+}
+
+// applyProfile returns params with the parameters of the profile they
+// name, if any, added where params doesn't give its own. It returns
+// InvalidArgument if the profile doesn't exist.
+func (s *service) applyProfile(
+	ctx context.Context, params map[string]string) (map[string]string, error) {
+
+	name, ok := params[KeyProfile]
+	if !ok {
+		return params, nil
+	}
+	profile, ok := s.opts.Profiles[name]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"unknown profile %s, available profiles are: %s",
+			name, profileNames(s.opts.Profiles))
+	}
+
+	effective := make(map[string]string, len(params)+len(profile))
+	for k, v := range profile {
+		effective[k] = v
+	}
+	for k, v := range params {
+		effective[k] = v
+	}
+	reqLog(ctx, "").WithField("profile", name).WithField(
+		"parameters", effective).Debug("applied profile")
+	return effective, nil
+}
+
+// profileNames returns the names of profiles as an ordered, comma
+// separated, list
+func profileNames(profiles map[string]map[string]string) string {
+	if len(profiles) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
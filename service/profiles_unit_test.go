@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseProfiles(t *testing.T) {
+	want := map[string]map[string]string{
+		"gold": {
+			KeyStoragePool:       "pool",
+			KeyThickProvisioning: "true",
+			KeyIOPSLimit:         "10000",
+		},
+		"bronze": {
+			KeyBandwidthLimitKbps: "102400",
+		},
+	}
+
+	profiles, err := parseProfiles([]byte(`{
+		"gold": {"storagepool": "pool", "thickprovisioning": true,
+			"iopsLimit": 10000},
+		"bronze": {"bandwidthLimitKbps": "102400"}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, want, profiles)
+
+	profiles, err = parseProfiles([]byte(`# profiles
+gold:
+  storagepool: pool
+  thickprovisioning: true
+  iopsLimit: 10000
+"bronze":
+  bandwidthLimitKbps: '102400'
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, want, profiles)
+
+	for _, data := range []string{
+		`{"gold": {"storagepol": "pool"}}`,
+		`{"gold": {"profile": "silver"}}`,
+		`{"gold": {"iopsLimit": [1]}}`,
+		"gold:\n  validateOnly: true\n",
+		"gold:\n  importVolumeName: vol\n",
+		"  storagepool: pool\n",
+		"gold: pool\n",
+		"gold:\n  storagepool\n",
+	} {
+		_, err := parseProfiles([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.Profiles = map[string]map[string]string{
+		"gold": {
+			KeyStoragePool:       "pool",
+			KeyThickProvisioning: "true",
+			KeyIOPSLimit:         "10000",
+		},
+		"bronze": {KeyStoragePool: "pool"},
+	}
+
+	// the request's own parameters override the profile's
+	params := map[string]string{KeyProfile: "gold", KeyIOPSLimit: "500"}
+	effective, err := s.applyProfile(ctx, params)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		KeyProfile:           "gold",
+		KeyStoragePool:       "pool",
+		KeyThickProvisioning: "true",
+		KeyIOPSLimit:         "500",
+	}, effective)
+	assert.Len(t, params, 2)
+
+	params = map[string]string{KeyStoragePool: "pool"}
+	effective, err = s.applyProfile(ctx, params)
+	assert.NoError(t, err)
+	assert.Equal(t, params, effective)
+
+	_, err = s.applyProfile(ctx, map[string]string{KeyProfile: "silver"})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+	assert.Contains(t, st.Message(), "bronze, gold")
+
+	resp, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 8 * bytesInGiB,
+		},
+		Parameters: map[string]string{KeyProfile: "gold"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	attrs := resp.GetVolume().GetAttributes()
+	assert.Equal(t, "pool", attrs[KeyStoragePoolName])
+	assert.Equal(t, "10000", attrs[KeyIOPSLimit])
+	assert.Equal(t, thickProvisioned,
+		fake.Volumes[resp.GetVolume().GetId()].VolumeType)
+
+	_, err = s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol2",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 8 * bytesInGiB,
+		},
+		Parameters: map[string]string{KeyProfile: "silver"},
+	})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.InvalidArgument, st.Code())
+}
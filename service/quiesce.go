@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// defaultUnpublishCheckTimeout is how long ControllerUnpublishVolume
+// delays, by default, unmapping a volume that is still written to
+const defaultUnpublishCheckTimeout = 30 * time.Second
+
+// unpublishCheckInterval is how often the writes to a volume are read again
+// while delaying its unmapping
+var unpublishCheckInterval = 2 * time.Second
+
+// awaitQuiesced delays unmapping vol from the SDC with the given ID while
+// the gateway reports writes to it, as the node may still be unmounting
+// it, for as long as the unpublish check timeout. The volume is unmapped
+// regardless once the timeout passes, or if its writes can't be read.
+func (s *service) awaitQuiesced(
+	ctx context.Context, vol *siotypes.Volume, sdcID string) error {
+
+	if !s.opts.UnpublishCheck {
+		return nil
+	}
+	l := reqLog(ctx, vol.ID).WithField("sdcID", sdcID)
+
+	// the writes of a volume aren't reported by SDC, so those of another
+	// SDC it is mapped to would delay every unmap
+	if len(vol.MappedSdcInfo) > 1 {
+		l.Debug("not checking writes to volume mapped to several SDCs")
+		return nil
+	}
+
+	start, delayed := time.Now(), false
+	deadline := time.NewTimer(s.opts.UnpublishCheckTimeout)
+	defer deadline.Stop()
+	for {
+		s.metrics.gatewayCall("GetVolumeStatistics")
+		bwc, err := s.adminClient.GetVolumeWriteBwc(vol)
+		if err != nil {
+			l.WithError(err).Warn(
+				"unable to read writes to volume, unmapping it anyway")
+			return nil
+		}
+		l := l.WithFields(log.Fields{
+			"writes":        bwc.NumOccured,
+			"writtenKiB":    bwc.TotalWeightInKb,
+			"windowSeconds": bwc.NumSeconds,
+			"delayed":       time.Since(start),
+		})
+		if bwc.NumOccured == 0 {
+			if delayed {
+				l.Info("volume no longer written to, unmapping it")
+			} else {
+				l.Debug("volume not written to, unmapping it")
+			}
+			return nil
+		}
+		if !delayed {
+			l.Info("volume still written to, delaying unmap")
+			delayed = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return canceledErr(ctx, "waiting for volume to stop being written to")
+		case <-deadline.C:
+			l.WithField("delayed", time.Since(start)).Warnf(
+				"volume still written to after %s, unmapping it anyway",
+				s.opts.UnpublishCheckTimeout)
+			return nil
+		case <-time.After(unpublishCheckInterval):
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUnpublishCheck(t *testing.T) {
+	defer func(d time.Duration) {
+		unpublishCheckInterval = d
+	}(unpublishCheckInterval)
+	unpublishCheckInterval = 10 * time.Millisecond
+
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.UnpublishCheck = true
+	s.opts.UnpublishCheckTimeout = time.Second
+	fake.AddSdc("SDC-1")
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+
+	setWrites := func(n int) {
+		fake.Lock()
+		defer fake.Unlock()
+		fake.WriteBwc[id] = &siotypes.BWC{
+			NumOccured: n, TotalWeightInKb: 4 * n, NumSeconds: 5,
+		}
+	}
+	unpublish := func(ctx context.Context) error {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   "sdc-1",
+				VolumeCapability: mountCap(
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+		assert.NoError(t, err)
+		_, err = s.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+		return err
+	}
+	mapped := func() bool {
+		fake.Lock()
+		defer fake.Unlock()
+		return len(fake.Volumes[id].MappedSdcInfo) > 0
+	}
+
+	// a volume that isn't written to is unmapped at once
+	assert.NoError(t, unpublish(ctx))
+	assert.False(t, mapped())
+	assert.Equal(t, 1, fake.Calls["GetVolumeWriteBwc"])
+
+	// unmapping waits for writes to stop
+	setWrites(10)
+	time.AfterFunc(50*time.Millisecond, func() { setWrites(0) })
+	start := time.Now()
+	assert.NoError(t, unpublish(ctx))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.False(t, mapped())
+
+	// the volume is unmapped anyway after the timeout
+	s.opts.UnpublishCheckTimeout = 100 * time.Millisecond
+	setWrites(10)
+	start = time.Now()
+	assert.NoError(t, unpublish(ctx))
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+	assert.False(t, mapped())
+
+	// waiting ends with the request, leaving the volume mapped
+	s.opts.UnpublishCheckTimeout = time.Minute
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	st, _ := status.FromError(unpublish(cctx))
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+	assert.True(t, mapped())
+
+	// writes that can't be read don't prevent unmapping
+	fake.Errors["GetVolumeWriteBwc"] = errors.New("gateway down")
+	assert.NoError(t, unpublish(ctx))
+	assert.False(t, mapped())
+	delete(fake.Errors, "GetVolumeWriteBwc")
+
+	// the check is off by default
+	s.opts.UnpublishCheck = false
+	fake.Calls["GetVolumeWriteBwc"] = 0
+	assert.NoError(t, unpublish(ctx))
+	assert.Equal(t, 0, fake.Calls["GetVolumeWriteBwc"])
+}
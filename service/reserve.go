@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// poolStatsTTL is how long the statistics of a storage pool are cached.
+// They are shared by GetCapacity and the reserve check of CreateVolume,
+// which may each be called for every volume provisioned.
+var poolStatsTTL = 10 * time.Second
+
+// cachedPoolStats are the statistics of a storage pool, as last retrieved
+type cachedPoolStats struct {
+	stats   *siotypes.Statistics
+	expires time.Time
+}
+
+// getCachedPoolStats returns the statistics of the storage pool with the
+// given ID, retrieving them if they aren't cached
+func (s *service) getCachedPoolStats(id string) (*siotypes.Statistics, error) {
+	s.poolStatsMu.Lock()
+	defer s.poolStatsMu.Unlock()
+
+	if c, ok := s.poolStats[id]; ok && time.Now().Before(c.expires) {
+		return c.stats, nil
+	}
+
+	stats, err := s.getPoolStats(id)
+	if err != nil {
+		return nil, err
+	}
+	s.poolStats[id] = cachedPoolStats{
+		stats:   stats,
+		expires: time.Now().Add(poolStatsTTL),
+	}
+	return stats, nil
+}
+
+// invalidatePoolStats drops the cached statistics of the pool with the
+// given ID, which are out of date once a volume has been created in it
+func (s *service) invalidatePoolStats(poolID string) {
+	s.poolStatsMu.Lock()
+	defer s.poolStatsMu.Unlock()
+	delete(s.poolStats, poolID)
+}
+
+// checkPoolReserve returns ResourceExhausted if creating a volume of
+// sizeInKiB in the named storage pool would raise the pool's utilization
+// into the reserve set by PoolReservedPercentage. The check is skipped,
+// with a warning, if the pool's statistics can't be retrieved, so that the
+// gateway has the final say.
+func (s *service) checkPoolReserve(
+	ctx context.Context, name string, sizeInKiB int64, volType string) error {
+
+	reserved := s.opts.PoolReservedPercentage
+	if reserved == 0 {
+		return nil
+	}
+
+	pool, err := s.getStoragePool(name)
+	if err != nil {
+		// let creating the volume report a pool that can't be found
+		return nil
+	}
+	stats, err := s.getCachedPoolStats(pool.ID)
+	if err != nil {
+		reqLog(ctx, "").WithError(err).WithField("storagePool", name).Warn(
+			"unable to get storage pool statistics, not checking reserve")
+		return nil
+	}
+
+	cur, proj, ok := projectedUtilization(
+		stats, sizeInKiB, volType == thickProvisioned)
+	if !ok {
+		reqLog(ctx, "").WithField("storagePool", name).Warn(
+			"storage pool capacity not reported, not checking reserve")
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"storagePool": name,
+		"current":     cur,
+		"projected":   proj,
+	}).Debug("storage pool utilization")
+
+	if limit := 100 - reserved; proj > limit {
+		return status.Errorf(codes.ResourceExhausted,
+			"creating volume would raise utilization of storage pool %s "+
+				"from %.1f%% to %.1f%%, above the %g%% allowed by %s",
+			name, cur, proj, limit, EnvPoolReservedPercentage)
+	}
+	return nil
+}
+
+// projectedUtilization returns the percentage of the raw capacity of a
+// pool in use, currently and once a volume of sizeInKiB is created in it,
+// or false if the pool's capacity isn't reported.
+//
+// The raw capacity a volume consumes, which includes its protection, is
+// estimated from the raw capacity still free and the capacity available
+// for volume allocation. Thin volumes consume capacity only as they are
+// written, so only their pool's current utilization is checked.
+func projectedUtilization(
+	stats *siotypes.Statistics,
+	sizeInKiB int64,
+	thick bool) (cur, proj float64, ok bool) {
+
+	max := float64(stats.MaxCapacityInKb)
+	if max <= 0 {
+		return 0, 0, false
+	}
+	inUse := float64(stats.CapacityInUseInKb)
+
+	var add float64
+	if thick {
+		avail := float64(stats.CapacityAvailableForVolumeAllocationInKb)
+		if avail > 0 {
+			add = float64(sizeInKiB) * (max - inUse) / avail
+		} else {
+			add = max
+		}
+	}
+	return inUse / max * 100, (inUse + add) / max * 100, true
+}
+
+// checkThickCapacity returns ResourceExhausted if the named storage pool
+// doesn't have the capacity available to allocate a thick volume of
+// sizeInKiB, which its spare policy and protection are accounted for in.
+// As with the reserve check, it is skipped if the pool's statistics can't
+// be retrieved or don't report its capacity.
+func (s *service) checkThickCapacity(
+	ctx context.Context, name string, sizeInKiB int64) error {
+
+	pool, err := s.getStoragePool(name)
+	if err != nil {
+		return nil
+	}
+	stats, err := s.getCachedPoolStats(pool.ID)
+	if err != nil {
+		reqLog(ctx, "").WithError(err).WithField("storagePool", name).Warn(
+			"unable to get storage pool statistics, " +
+				"not checking thick capacity")
+		return nil
+	}
+	if stats.MaxCapacityInKb <= 0 {
+		return nil
+	}
+
+	avail := int64(stats.CapacityAvailableForVolumeAllocationInKb)
+	if sizeInKiB > avail {
+		return status.Errorf(codes.ResourceExhausted,
+			"storage pool %s has %d KiB available for thick volumes, "+
+				"%d KiB requested", name, avail, sizeInKiB)
+	}
+	return nil
+}
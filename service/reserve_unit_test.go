@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestProjectedUtilization(t *testing.T) {
+	// 1000 KiB raw, 400 in use, with the rest good for 300 KiB of volumes
+	stats := &siotypes.Statistics{
+		MaxCapacityInKb:                          1000,
+		CapacityInUseInKb:                        400,
+		CapacityAvailableForVolumeAllocationInKb: 300,
+	}
+
+	cur, proj, ok := projectedUtilization(stats, 150, true)
+	assert.True(t, ok)
+	assert.Equal(t, 40.0, cur)
+	assert.Equal(t, 70.0, proj)
+
+	// thin volumes don't consume capacity until written
+	_, proj, _ = projectedUtilization(stats, 150, false)
+	assert.Equal(t, 40.0, proj)
+
+	stats.CapacityAvailableForVolumeAllocationInKb = 0
+	_, proj, _ = projectedUtilization(stats, 1, true)
+	assert.True(t, proj > 100)
+
+	_, _, ok = projectedUtilization(&siotypes.Statistics{}, 1, true)
+	assert.False(t, ok)
+}
+
+func TestPoolReserve(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.PoolReservedPercentage = 10
+
+	var poolID string
+	for id, p := range fake.StoragePools {
+		if p.Name == "pool" {
+			poolID = id
+		}
+	}
+	stats := fake.Stats[poolID]
+	stats.MaxCapacityInKb = 100 * kiBytesInGiB
+	stats.CapacityInUseInKb = 60 * kiBytesInGiB
+	stats.CapacityAvailableForVolumeAllocationInKb = 20 * kiBytesInGiB
+
+	create := func(name string, gib int64, thick bool) error {
+		_, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: gib * kiBytesInGiB * bytesInKiB,
+			},
+			Parameters: map[string]string{
+				KeyStoragePool:       "pool",
+				KeyThickProvisioning: strconv.FormatBool(thick),
+			},
+		})
+		return err
+	}
+
+	// each thick GiB takes 2 GiB raw, so 16 GiB reaches 92%
+	err := create("big", 16, true)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Contains(t, st.Message(), "from 60.0% to 92.0%, above the 90%")
+	assert.NoError(t, create("small", 8, true))
+
+	// the statistics are shared with GetCapacity, until a volume is created
+	calls := fake.Calls["GetStoragePoolStatistics"]
+	_, err = s.GetCapacity(ctx, &csi.GetCapacityRequest{
+		Parameters: map[string]string{KeyStoragePool: "pool"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, calls+1, fake.Calls["GetStoragePoolStatistics"])
+	assert.NoError(t, create("thin", 16, false))
+	assert.Equal(t, calls+1, fake.Calls["GetStoragePoolStatistics"])
+
+	// thin volumes are refused once the pool is into its reserve
+	stats.CapacityInUseInKb = 95 * kiBytesInGiB
+	s.invalidatePoolStats(poolID)
+	st, _ = status.FromError(create("thin2", 8, false))
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+
+	// the gateway has the final say when the statistics can't be had
+	s.invalidatePoolStats(poolID)
+	fake.Errors["GetStoragePoolStatistics"] = errors.New("gateway down")
+	assert.NoError(t, create("thin2", 8, false))
+}
+
+func TestThickCapacity(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+
+	var poolID string
+	for id, p := range fake.StoragePools {
+		if p.Name == "pool" {
+			poolID = id
+		}
+	}
+	stats := fake.Stats[poolID]
+	stats.MaxCapacityInKb = 100 * kiBytesInGiB
+	stats.CapacityAvailableForVolumeAllocationInKb = 8 * kiBytesInGiB
+
+	create := func(name string, gib int64, validateOnly bool) (
+		*csi.CreateVolumeResponse, error) {
+		params := map[string]string{
+			KeyStoragePool:       "pool",
+			KeyThickProvisioning: "true",
+		}
+		if validateOnly {
+			params[KeyValidateOnly] = "true"
+		}
+		return s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: gib * kiBytesInGiB * bytesInKiB,
+			},
+			Parameters: params,
+		})
+	}
+
+	_, err := create("big", 16, false)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Equal(t, 0, fake.Calls["CreateVolume"])
+
+	resp, err := create("small", 8, false)
+	if assert.NoError(t, err) {
+		attrs := resp.Volume.Attributes
+		assert.Equal(t, thickProvisioned, attrs[KeyProvisioningType])
+		assert.NotContains(t, attrs, KeyProvisioning)
+	}
+
+	// with the fallback, the volume is created thin, and says so
+	s.opts.ThickFallback = true
+	s.opts.AllowValidateOnly = true
+	resp, err = create("big", 16, true)
+	if assert.NoError(t, err) {
+		attrs := resp.Volume.Attributes
+		assert.Equal(t, thinProvisioned, attrs[KeyProvisioningType])
+		assert.Equal(t, provisioningFallback, attrs[KeyProvisioning])
+	}
+	resp, err = create("big", 16, false)
+	if assert.NoError(t, err) {
+		attrs := resp.Volume.Attributes
+		assert.Equal(t, thinProvisioned, attrs[KeyProvisioningType])
+		assert.Equal(t, provisioningFallback, attrs[KeyProvisioning])
+	}
+
+	// as it does when returned again, once the pool could allocate it
+	stats.CapacityAvailableForVolumeAllocationInKb = 100 * kiBytesInGiB
+	s.invalidatePoolStats(poolID)
+	resp, err = create("big", 16, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, provisioningFallback,
+			resp.Volume.Attributes[KeyProvisioning])
+	}
+}
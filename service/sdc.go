@@ -0,0 +1,223 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// sdcModule is the name of the SDC kernel module
+	sdcModule = "scini"
+
+	// sdcDevice is the device node exposed by the SDC kernel module, which
+	// answers queries via ioctl
+	sdcDevice = "/dev/scini"
+
+	// procModules is the file listing the currently loaded kernel modules
+	procModules = "/proc/modules"
+
+	// sysModuleDir is the directory in which each loaded kernel module has
+	// an entry
+	sysModuleDir = "/sys/module"
+
+	// sdcGUIDFormat describes the format of an SDC GUID
+	sdcGUIDFormat = "XXXXXXXX-XXXX-XXXX-XXXX-XXXXXXXXXXXX"
+)
+
+var sdcGUIDRX = regexp.MustCompile(
+	`^[[:xdigit:]]{8}-[[:xdigit:]]{4}-[[:xdigit:]]{4}-` +
+		`[[:xdigit:]]{4}-[[:xdigit:]]{12}$`)
+
+// validSDCGUID returns a flag indicating whether the given GUID is in the
+// UUID format used by the SDC. Hex digits of either case are accepted.
+func validSDCGUID(guid string) bool {
+	return sdcGUIDRX.MatchString(guid)
+}
+
+// normalizeSDCGUID returns guid upper-cased, and without the whitespace or
+// braces it may be padded with. Every GUID is normalized before it is
+// compared, or used as a key, as SDCs may be registered with either case.
+func normalizeSDCGUID(guid string) string {
+	return strings.ToUpper(strings.Trim(strings.TrimSpace(guid), "{}"))
+}
+
+// sameSDCGUID returns whether a and b are the same GUID once normalized
+func sameSDCGUID(a, b string) bool {
+	return normalizeSDCGUID(a) == normalizeSDCGUID(b)
+}
+
+// nodeIDSep separates the SDC GUID from the SDC ID in a node ID that
+// carries both
+const nodeIDSep = "/"
+
+// sdcIDRX matches the ID the system assigns an SDC
+var sdcIDRX = regexp.MustCompile(`^[[:xdigit:]]{1,16}$`)
+
+// joinNodeID returns the node ID carrying both the GUID of an SDC and its
+// ID, which spares the controller looking the SDC up by GUID
+func joinNodeID(guid, sdcID string) string {
+	return guid + nodeIDSep + sdcID
+}
+
+// splitNodeID returns the SDC GUID and SDC ID carried by nodeID. Any other
+// node ID, such as the plain GUID reported by older nodes, is returned as
+// is, with an empty SDC ID.
+func splitNodeID(nodeID string) (string, string) {
+	i := strings.LastIndex(nodeID, nodeIDSep)
+	if i < 0 {
+		return nodeID, ""
+	}
+	guid, id := nodeID[:i], nodeID[i+len(nodeIDSep):]
+	if !validSDCGUID(normalizeSDCGUID(guid)) || !sdcIDRX.MatchString(id) {
+		return nodeID, ""
+	}
+	return guid, id
+}
+
+// Executor invokes external binaries on behalf of the node service. It
+// exists so that tests can replace the host's binaries with fakes.
+type Executor interface {
+	// CombinedOutput runs the named binary with the given args and
+	// returns its combined stdout and stderr. The binary is killed if
+	// ctx is done before it exits.
+	CombinedOutput(
+		ctx context.Context, name string, args ...string) ([]byte, error)
+}
+
+type osExecutor struct{}
+
+func (osExecutor) CombinedOutput(
+	ctx context.Context, name string, args ...string) ([]byte, error) {
+
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// querySDCGUID returns the GUID of the local SDC. The SDC kernel module is
+// queried directly, and the drv_cfg binary is only consulted if the query
+// fails and a path to drv_cfg has been configured.
+func (s *service) querySDCGUID(ctx context.Context) (string, error) {
+	guid, err := queryGUIDIoctl(sdcDevice)
+	if err == nil {
+		return guid, nil
+	}
+
+	if s.opts.DrvCfgPath == "" {
+		return "", fmt.Errorf("unable to query %s: %s", sdcDevice, err.Error())
+	}
+
+	log.WithError(err).WithField("drvCfg", s.opts.DrvCfgPath).Debug(
+		"unable to query SDC GUID via ioctl, falling back to drv_cfg")
+
+	out, err := s.executor.CombinedOutput(
+		ctx, s.opts.DrvCfgPath, "--query_guid")
+	if err != nil {
+		return "", stageErr(ctx, "querying SDC GUID", fmt.Errorf(
+			"error from %s: %s", s.opts.DrvCfgPath, err.Error()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+const (
+	// nodeIDIP and nodeIDHostname are the node IDs reported, when the SDC
+	// GUID can't be determined, if so configured
+	nodeIDIP       = "ip"
+	nodeIDHostname = "hostname"
+)
+
+// interfaceAddrs returns the host's addresses, and may be replaced by tests
+var interfaceAddrs = net.InterfaceAddrs
+
+// fallbackNodeID returns the node ID of the given kind, nodeIDIP or
+// nodeIDHostname, which the controller service looks the SDC up by
+func fallbackNodeID(kind string) (string, error) {
+	switch kind {
+	case nodeIDHostname:
+		return os.Hostname()
+	case nodeIDIP:
+		addrs, err := interfaceAddrs()
+		if err != nil {
+			return "", err
+		}
+		if ip := firstUnicastIP(addrs); ip != "" {
+			return ip, nil
+		}
+		return "", fmt.Errorf("no global unicast address found")
+	}
+	return "", fmt.Errorf("unknown node ID kind: %s", kind)
+}
+
+// firstUnicastIP returns the first global unicast IPv4 address in addrs,
+// or else the first IPv6 one, which is the address the SDC most likely
+// registered with
+func firstUnicastIP(addrs []net.Addr) string {
+	var ip6 string
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || !n.IP.IsGlobalUnicast() {
+			continue
+		}
+		if n.IP.To4() != nil {
+			return n.IP.String()
+		}
+		if ip6 == "" {
+			ip6 = n.IP.String()
+		}
+	}
+	return ip6
+}
+
+// checkSDC returns FailedPrecondition, naming what is missing, unless the
+// SDC is running: its kernel module loaded, and the device node it answers
+// queries through present. Both are cheap to check on every probe.
+func (s *service) checkSDC() error {
+	if !s.sdcLoaded() {
+		return status.Errorf(codes.FailedPrecondition,
+			"SDC unavailable: %s kernel module not loaded", sdcModule)
+	}
+	if _, err := os.Stat(s.sdcDevicePath); err != nil {
+		return status.Errorf(codes.FailedPrecondition,
+			"SDC unavailable: %s not responding: %s",
+			s.sdcDevicePath, err.Error())
+	}
+	return nil
+}
+
+// kmodLoaded returns a flag indicating whether the SDC kernel module is
+// loaded
+func kmodLoaded() bool {
+	return moduleLoaded(procModules, sysModuleDir, sdcModule)
+}
+
+// moduleLoaded checks the modules file (in /proc/modules format) for the
+// named module. If the modules file cannot be read, the module's entry in
+// sysDir is checked for instead.
+func moduleLoaded(modulesFile, sysDir, name string) bool {
+	f, err := os.Open(modulesFile)
+	if err != nil {
+		log.WithError(err).Debug(
+			"unable to read loaded modules, checking sysfs")
+		_, err := os.Stat(fmt.Sprintf("%s/%s", sysDir, name))
+		return err == nil
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		words := strings.Fields(s.Text())
+		if len(words) > 0 && words[0] == name {
+			return true
+		}
+	}
+
+	return false
+}
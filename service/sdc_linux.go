@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sdcIoctlType is the ioctl type used by the SDC kernel module
+	sdcIoctlType = 'a'
+
+	// sdcIoctlQueryGUID is the ioctl number used to query the SDC GUID
+	sdcIoctlQueryGUID = 14
+
+	// sdcIoctlSuccess is the return code set by the SDC on success
+	sdcIoctlSuccess = 65
+)
+
+// sdcGUIDQuery is the buffer filled in by the SDC when queried for its GUID
+type sdcGUIDQuery struct {
+	rc         [8]uint8
+	guid       [16]uint8
+	netIDMagic uint32
+	netIDTime  uint32
+}
+
+// queryGUIDIoctl queries the SDC kernel module for its GUID via the given
+// device node
+func queryGUIDIoctl(device string) (string, error) {
+	f, err := os.Open(device)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// _IO(type, nr), as the query carries no size/direction bits
+	op := uintptr(sdcIoctlType<<8 | sdcIoctlQueryGUID)
+
+	var q sdcGUIDQuery
+	_, _, errno := unix.Syscall(
+		unix.SYS_IOCTL, f.Fd(), op, uintptr(unsafe.Pointer(&q)))
+	if errno != 0 {
+		return "", errno
+	}
+	if q.rc[0] != sdcIoctlSuccess {
+		return "", fmt.Errorf("SDC GUID query failed with rc: %d", q.rc[0])
+	}
+
+	g := q.guid
+	return fmt.Sprintf(
+		"%X-%X-%X-%X-%X", g[0:4], g[4:6], g[6:8], g[8:10], g[10:16]), nil
+}
@@ -0,0 +1,367 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+type fakeExecutor struct {
+	out   string
+	err   error
+	calls [][]string
+}
+
+func (e *fakeExecutor) CombinedOutput(
+	ctx context.Context, name string, args ...string) ([]byte, error) {
+
+	e.calls = append(e.calls, append([]string{name}, args...))
+	return []byte(e.out), e.err
+}
+
+func TestModuleLoaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-scaleio-modules")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	modules := filepath.Join(dir, "modules")
+	assert.NoError(t, ioutil.WriteFile(modules, []byte(
+		"xfs 1212416 2 - Live 0x0000000000000000\n"+
+			"scini 884736 4 - Live 0x0000000000000000 (POE)\n"), 0644))
+
+	assert.True(t, moduleLoaded(modules, dir, "scini"))
+	assert.False(t, moduleLoaded(modules, dir, "scin"))
+
+	// fall back to sysfs when the modules file cannot be read
+	missing := filepath.Join(dir, "missing")
+	assert.False(t, moduleLoaded(missing, dir, "scini"))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "scini"), 0755))
+	assert.True(t, moduleLoaded(missing, dir, "scini"))
+}
+
+func TestQuerySDCGUIDDrvCfg(t *testing.T) {
+	if _, err := os.Stat(sdcDevice); err == nil {
+		t.Skipf("%s present, drv_cfg fallback not exercised", sdcDevice)
+	}
+
+	// without drv_cfg configured there is no fallback
+	e := &fakeExecutor{out: "guid"}
+	s := &service{executor: e}
+	_, err := s.querySDCGUID(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, e.calls)
+
+	e = &fakeExecutor{out: "271bad82-08ee-44f2-a2b1-7e2787c27be1\n"}
+	s = &service{
+		opts:     Opts{DrvCfgPath: "/bin/drv_cfg"},
+		executor: e,
+	}
+	guid, err := s.querySDCGUID(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "271bad82-08ee-44f2-a2b1-7e2787c27be1", guid)
+	assert.Equal(t, [][]string{{"/bin/drv_cfg", "--query_guid"}}, e.calls)
+
+	e = &fakeExecutor{err: errors.New("exit status 1")}
+	s.executor = e
+	_, err = s.querySDCGUID(context.Background())
+	assert.Error(t, err)
+}
+
+func TestValidSDCGUID(t *testing.T) {
+	tests := []struct {
+		guid  string
+		valid bool
+	}{
+		{"271BAD82-08EE-44F2-A2B1-7E2787C27BE1", true},
+		{"271bad82-08ee-44f2-a2b1-7e2787c27be1", true},
+		{"271bad82-08EE-44f2-A2B1-7e2787c27be1", true},
+		{"", false},
+		{"271bad82", false},
+		{"271bad8208ee44f2a2b17e2787c27be1", false},
+		{"271bad82-08ee-44f2-a2b1-7e2787c27be1\n", false},
+		{" 271bad82-08ee-44f2-a2b1-7e2787c27be1", false},
+		{"271bad82-08ee-44f2-a2b1-7e2787c27bg1", false},
+		{"271bad82-08ee-44f2-a2b1-7e2787c27be", false},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.guid, func(st *testing.T) {
+			st.Parallel()
+			assert.Equal(st, tt.valid, validSDCGUID(tt.guid))
+		})
+	}
+}
+
+func TestGetSDCIDCaseInsensitive(t *testing.T) {
+	// getSDCID normalizes GUIDs to upper case, without padding, so GUIDs
+	// reported by a node either way must resolve to the same cached SDC
+	s := &service{
+		sdcMap: map[string]sdcEntry{
+			"271BAD82-08EE-44F2-A2B1-7E2787C27BE1": {
+				id:      "d0f055a700000000",
+				expires: time.Now().Add(time.Hour),
+			},
+		},
+	}
+
+	for _, guid := range []string{
+		"271BAD82-08EE-44F2-A2B1-7E2787C27BE1",
+		"271bad82-08ee-44f2-a2b1-7e2787c27be1",
+		" {271bad82-08EE-44f2-a2b1-7e2787c27be1}\n",
+	} {
+		id, err := s.getSDCID(context.Background(), guid)
+		assert.NoError(t, err)
+		assert.Equal(t, "d0f055a700000000", id)
+	}
+}
+
+func TestGetSDCIDByField(t *testing.T) {
+	s, fake := newFakeService()
+	guid := "271BAD82-08EE-44F2-A2B1-7E2787C27BE1"
+	id := fake.AddSdc(guid)
+	fake.SDCs[id].SdcIp = "10.0.0.5"
+	fake.SDCs[id].Name = "node-1"
+
+	// the node ID may be the SDC's GUID, IP address or name
+	for _, nodeID := range []string{guid, "10.0.0.5", "node-1"} {
+		sdcID, err := s.getSDCID(context.Background(), nodeID)
+		assert.NoError(t, err, nodeID)
+		assert.Equal(t, id, sdcID, nodeID)
+		assert.Equal(t, id, s.cachedSDCID(nodeID), nodeID)
+	}
+	// names are looked up after GUIDs, which they may also be
+	assert.Equal(t, 4, fake.Calls["FindSdc"])
+
+	// each form is cached separately
+	_, err := s.getSDCID(context.Background(), "10.0.0.5")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, fake.Calls["FindSdc"])
+	s.invalidateSDC("10.0.0.5")
+	assert.Empty(t, s.cachedSDCID("10.0.0.5"))
+	assert.Equal(t, id, s.cachedSDCID("node-1"))
+
+	_, err = s.getSDCID(context.Background(), "10.0.0.6")
+	assert.EqualError(t, err,
+		"error finding SDC from IP: 10.0.0.6, err: "+testutil.ErrSdcNotFound)
+	_, err = s.getSDCID(context.Background(), "node-2")
+	assert.EqualError(t, err, "error finding SDC from GUID or name: "+
+		"node-2, err: "+testutil.ErrSdcNotFound)
+}
+
+func TestSplitNodeID(t *testing.T) {
+	guid := "271bad82-08ee-44f2-a2b1-7e2787c27be1"
+	tests := []struct {
+		nodeID, guid, sdcID string
+	}{
+		{guid, guid, ""},
+		{guid + "/d0f055a700000000", guid, "d0f055a700000000"},
+		{" {" + guid + "}/d0f055a7", " {" + guid + "}", "d0f055a7"},
+		{guid + "/", guid + "/", ""},
+		{guid + "/not-an-id", guid + "/not-an-id", ""},
+		{"node-1/d0f055a700000000", "node-1/d0f055a700000000", ""},
+		{"fd00::5", "fd00::5", ""},
+	}
+	for _, tt := range tests {
+		g, id := splitNodeID(tt.nodeID)
+		assert.Equal(t, tt.guid, g, tt.nodeID)
+		assert.Equal(t, tt.sdcID, id, tt.nodeID)
+	}
+	assert.Equal(t, guid+"/d0f055a7", joinNodeID(guid, "d0f055a7"))
+}
+
+func TestGetSDCIDEmbedded(t *testing.T) {
+	s, fake := newFakeService()
+	guid := "271BAD82-08EE-44F2-A2B1-7E2787C27BE1"
+	id := fake.AddSdc(guid)
+	nodeID := joinNodeID(guid, "d0f055a700000000")
+
+	// the SDC ID the node ID carries is used without a lookup, and cached
+	// by GUID
+	sdcID, err := s.getSDCID(context.Background(), nodeID)
+	assert.NoError(t, err)
+	assert.Equal(t, "d0f055a700000000", sdcID)
+	assert.Equal(t, "d0f055a700000000", s.cachedSDCID(guid))
+	assert.Equal(t, 0, fake.Calls["FindSdc"])
+
+	// once found stale, the SDC is looked up by GUID, even after the
+	// result has expired
+	s.invalidateSDC(nodeID)
+	for i := 0; i < 2; i++ {
+		sdcID, err = s.getSDCID(context.Background(), nodeID)
+		assert.NoError(t, err)
+		assert.Equal(t, id, sdcID)
+		s.sdcMap[guid] = sdcEntry{stale: s.sdcMap[guid].stale}
+	}
+	assert.Equal(t, 2, fake.Calls["FindSdc"])
+
+	// node IDs of just the GUID are still looked up
+	delete(s.sdcMap, guid)
+	sdcID, err = s.getSDCID(context.Background(), guid)
+	assert.NoError(t, err)
+	assert.Equal(t, id, sdcID)
+	assert.Equal(t, 3, fake.Calls["FindSdc"])
+}
+
+func TestPublishEmbeddedSDCID(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	vol := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	guid := "271BAD82-08EE-44F2-A2B1-7E2787C27BE1"
+	old := fake.AddSdc(guid)
+	nodeID := joinNodeID(guid, old)
+
+	pub := func() error {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: vol,
+				NodeId:   nodeID,
+				VolumeCapability: mountCap(
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+		return err
+	}
+	unpub := func() error {
+		_, err := s.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{
+				VolumeId: vol,
+				NodeId:   nodeID,
+			})
+		return err
+	}
+	assert.NoError(t, pub())
+	assert.NoError(t, unpub())
+	assert.Equal(t, 0, fake.Calls["FindSdc"])
+
+	// the SDC re-registers under a new ID, and the stale one the node still
+	// reports is looked up again by GUID
+	delete(fake.SDCs, old)
+	sdc := fake.AddSdc(guid)
+	assert.NoError(t, pub())
+	if assert.Len(t, fake.Volumes[vol].MappedSdcInfo, 1) {
+		assert.Equal(t, sdc, fake.Volumes[vol].MappedSdcInfo[0].SdcID)
+	}
+	assert.Equal(t, 1, fake.Calls["FindSdc"])
+}
+
+func TestNodeGetIdSdcID(t *testing.T) {
+	ctx := context.Background()
+	guid := "271BAD82-08EE-44F2-A2B1-7E2787C27BE1"
+	s := &service{opts: Opts{SdcGUID: guid}, nodeSdcID: "d0f055a700000000"}
+
+	resp, err := s.NodeGetId(ctx, &csi.NodeGetIdRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, guid, resp.GetNodeId())
+
+	s.opts.NodeIDSdcID = true
+	resp, err = s.NodeGetId(ctx, &csi.NodeGetIdRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, guid+"/d0f055a700000000", resp.GetNodeId())
+
+	// node IDs other than GUIDs are reported as is
+	s = &service{opts: Opts{NodeIDSdcID: true}, nodeID: "node-1",
+		nodeSdcID: "d0f055a700000000"}
+	resp, err = s.NodeGetId(ctx, &csi.NodeGetIdRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", resp.GetNodeId())
+}
+
+func TestGetSDCIDBeforeProbe(t *testing.T) {
+	s, fake := newFakeService()
+	guid := "271BAD82-08EE-44F2-A2B1-7E2787C27BE1"
+	id := fake.AddSdc(guid)
+
+	// a node service running alongside the controller may look up its SDC
+	// before any controller request probed
+	s.system = nil
+	finds := fake.Calls["FindSystem"]
+	s.opts.Endpoint = "https://gw/api"
+	s.opts.Password = "password"
+	s.opts.User = "admin"
+	s.opts.SystemName = ""
+	_, err := s.getSDCID(context.Background(), guid)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Equal(t, 0, fake.Calls["FindSdc"])
+
+	// failing to find the system isn't cached
+	s.opts.SystemName = "sys"
+	sdcID, err := s.getSDCID(context.Background(), guid)
+	assert.NoError(t, err)
+	assert.Equal(t, id, sdcID)
+	assert.True(t, s.controllerProbed())
+	assert.Equal(t, finds+1, fake.Calls["FindSystem"])
+	assert.Equal(t, 1, fake.Calls["Authenticate"])
+}
+
+func TestSDCLookups(t *testing.T) {
+	tests := []struct {
+		nodeID string
+		exp    []sdcLookup
+	}{
+		{"271bad82-08ee-44f2-a2b1-7e2787c27be1", []sdcLookup{
+			{"SdcGuid", "271BAD82-08EE-44F2-A2B1-7E2787C27BE1"}}},
+		{"{271bad82-08ee-44f2-a2b1-7e2787c27be1} ", []sdcLookup{
+			{"SdcGuid", "271BAD82-08EE-44F2-A2B1-7E2787C27BE1"}}},
+		{"10.0.0.5", []sdcLookup{{"SdcIp", "10.0.0.5"}}},
+		{"fd00::5", []sdcLookup{{"SdcIp", "fd00::5"}}},
+		{"node-1.example.com", []sdcLookup{
+			{"SdcGuid", "NODE-1.EXAMPLE.COM"},
+			{"Name", "node-1.example.com"}}},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.exp, sdcLookups(tt.nodeID), tt.nodeID)
+	}
+}
+
+func TestFallbackNodeID(t *testing.T) {
+	defer func(f func() ([]net.Addr, error)) {
+		interfaceAddrs = f
+	}(interfaceAddrs)
+
+	ipNet := func(s string) net.Addr {
+		return &net.IPNet{IP: net.ParseIP(s), Mask: net.CIDRMask(24, 32)}
+	}
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			ipNet("127.0.0.1"),
+			ipNet("fe80::1"),
+			ipNet("fd00::5"),
+			ipNet("10.0.0.5"),
+		}, nil
+	}
+	id, err := fallbackNodeID(nodeIDIP)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.5", id)
+
+	// IPv6 addresses are used if there is no IPv4 one
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{ipNet("127.0.0.1"), ipNet("fd00::5")}, nil
+	}
+	id, err = fallbackNodeID(nodeIDIP)
+	assert.NoError(t, err)
+	assert.Equal(t, "fd00::5", id)
+
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{ipNet("127.0.0.1")}, nil
+	}
+	_, err = fallbackNodeID(nodeIDIP)
+	assert.Error(t, err)
+
+	host, _ := os.Hostname()
+	id, err = fallbackNodeID(nodeIDHostname)
+	assert.NoError(t, err)
+	assert.Equal(t, host, id)
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package service
+
+import "errors"
+
+// queryGUIDIoctl is only supported on Linux, where the SDC runs
+func queryGUIDIoctl(device string) (string, error) {
+	return "", errors.New("SDC ioctl interface only supported on linux")
+}
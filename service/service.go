@@ -2,8 +2,13 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,9 +17,13 @@ import (
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
 	"github.com/rexray/gocsi"
 	csictx "github.com/rexray/gocsi/context"
+	"github.com/rexray/gocsi/middleware/requestid"
 	log "github.com/sirupsen/logrus"
 	sio "github.com/thecodeteam/goscaleio"
 	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/thecodeteam/csi-scaleio/core"
 )
@@ -29,15 +38,23 @@ const (
 
 	thinProvisioned  = "ThinProvisioned"
 	thickProvisioned = "ThickProvisioned"
-	defaultPrivDir   = "/dev/disk/csi-scaleio"
+
+	// defaultMaxVolumesPerNode is the number of volumes ScaleIO allows to be
+	// mapped to a single SDC
+	defaultMaxVolumesPerNode = 8192
 )
 
-// Manifest is the SP's manifest.
+// goscaleioRevision is the revision of goscaleio in Gopkg.lock
+const goscaleioRevision = "30be8284b32e1a53e2ac473e95275b24e6d583de"
+
+// Manifest is the SP's manifest. GetPluginInfo adds the mode, system name,
+// and, once the controller is probed, the gateway and MDM versions.
 var Manifest = map[string]string{
-	"url":    "https://github.com/thecodeteam/csi-scaleio",
-	"semver": core.SemVer,
-	"commit": core.CommitSha32,
-	"formed": core.CommitTime.Format(time.RFC1123),
+	"url":       "https://github.com/thecodeteam/csi-scaleio",
+	"semver":    core.SemVer,
+	"commit":    core.CommitSha32,
+	"formed":    core.CommitTime.Format(time.RFC1123),
+	"goscaleio": goscaleioRevision,
 }
 
 // Service is the CSI Mock service provider.
@@ -46,6 +63,13 @@ type Service interface {
 	csi.IdentityServer
 	csi.NodeServer
 	BeforeServe(context.Context, *gocsi.StoragePlugin, net.Listener) error
+
+	// Drain stops new requests from being accepted, and waits for those
+	// in flight to finish. It returns false if requests were abandoned.
+	Drain(context.Context) bool
+
+	// Shutdown stops the servers started alongside the gRPC server
+	Shutdown(context.Context) error
 }
 
 // Opts defines service configuration options.
@@ -55,60 +79,657 @@ type Opts struct {
 	Password   string
 	SystemName string
 	SdcGUID    string
+	DrvCfgPath string
 	Insecure   bool
 	Thick      bool
 	AutoProbe  bool
+
+	// CleanupOnStart indicates that stale private mounts should be
+	// removed when the node service starts
+	CleanupOnStart bool
+
+	// FSCheck indicates that a filesystem should be checked for
+	// corruption before it is first mounted on the node
+	FSCheck bool
+
+	// XFSNoUUID indicates that xfs filesystems should be mounted with the
+	// nouuid option, allowing clones to be mounted alongside their parent
+	XFSNoUUID bool
+
+	// MetricsAddr is the address on which metrics are served, if set
+	MetricsAddr string
+
+	// ShutdownTimeout is how long a graceful stop waits for in-flight
+	// requests to finish
+	ShutdownTimeout time.Duration
+
+	// RPCTimeouts are the deadlines applied to RPCs that arrive without one
+	RPCTimeouts rpcTimeouts
+
+	// HealthAddr is the address on which the liveness and readiness
+	// endpoints are served, if set
+	HealthAddr string
+
+	// ProbeCacheTTL is how long Probe reuses the result of a successful
+	// probe, or 0 to always probe
+	ProbeCacheTTL time.Duration
+
+	// SockPerms and SockOwner are applied to the unix socket the plug-in
+	// listens on, if set. SockStrict makes failing to apply them fatal.
+	SockPerms  string
+	SockOwner  string
+	SockStrict bool
+
+	// MaxVolumesPerNode is the maximum number of volumes that may be
+	// mapped to a single SDC, or 0 for no limit
+	MaxVolumesPerNode int64
+
+	// OrphanScanInterval is how often the controller looks for volumes
+	// mapped to SDCs that no longer exist, or 0 to never look.
+	// OrphanCleanup unmaps the volumes it finds.
+	OrphanScanInterval time.Duration
+	OrphanCleanup      bool
+
+	// CleanupDisconnected unmaps a volume being deleted from the SDCs it
+	// is mapped to if every one of them is disconnected from the system
+	CleanupDisconnected bool
+
+	// GatewayDebug logs each call made to the gateway
+	GatewayDebug bool
+
+	// KeepaliveInterval is how often the gateway is pinged to keep the
+	// session alive, or 0 to never ping it
+	KeepaliveInterval time.Duration
+
+	// Prefetch warms the caches of storage pools and SDC IDs in the
+	// background once the controller is first probed
+	Prefetch bool
+
+	// AuditLog is the file, or stdout, to which volume lifecycle
+	// operations are recorded, if set. The file is rotated once it reaches
+	// AuditLogMaxSize bytes, unless that is 0.
+	AuditLog        string
+	AuditLogMaxSize int64
+
+	// UnmapSettleTimeout is how long DeleteVolume waits for the mappings
+	// of a volume that was just unpublished to go away, or 0 to not wait
+	UnmapSettleTimeout time.Duration
+
+	// MappingCacheTTL is how long ControllerUnpublishVolume trusts that a
+	// volume read, mapped or unmapped since is not mapped to the node,
+	// without reading it again, or 0 to always read it
+	MappingCacheTTL time.Duration
+
+	// StrictParams rejects CreateVolume parameters that aren't accepted,
+	// rather than only logging them
+	StrictParams bool
+
+	// PoolReservedPercentage is the percentage of the raw capacity of each
+	// storage pool that CreateVolume leaves free, or 0 for none
+	PoolReservedPercentage float64
+
+	// ThickFallback creates thin volumes when the storage pool can't
+	// allocate the thick volume requested, rather than failing
+	ThickFallback bool
+
+	// StatsAddr is the address on which the statistics of volumes are
+	// served, if set, to callers presenting StatsToken
+	StatsAddr  string
+	StatsToken string
+
+	// SnapshotGroups takes snapshot groups on StatsAddr too
+	SnapshotGroups bool
+
+	// DefaultVolumeSizeKiB is the size of volumes created without a
+	// required size, a multiple of VolSizeMultipleGiB
+	DefaultVolumeSizeKiB int64
+
+	// EnforceOwnership marks the volumes created or imported as the
+	// plug-in's own, and refuses to delete volumes without the mark.
+	// ListOwnedOnly leaves volumes without it out of ListVolumes.
+	EnforceOwnership bool
+	ListOwnedOnly    bool
+
+	// ListExcludeIncomplete leaves the volumes the gateway reports without
+	// their size or storage pool out of ListVolumes
+	ListExcludeIncomplete bool
+
+	// NodeIDFallback is the node ID, nodeIDIP or nodeIDHostname, reported
+	// when the SDC GUID can't be determined, if set
+	NodeIDFallback string
+
+	// NodeIDSdcID reports the SDC ID in the node ID, after the SDC GUID,
+	// when it has been resolved
+	NodeIDSdcID bool
+
+	// SlowOperationThreshold is how long an RPC runs before a warning is
+	// logged, or 0 to never warn
+	SlowOperationThreshold time.Duration
+
+	// DebugOperations lists the RPCs in flight, as JSON, on the metrics
+	// address
+	DebugOperations bool
+
+	// DebugConfig serves the configuration, with secrets masked, as JSON
+	// on the metrics address
+	DebugConfig bool
+
+	// UnpublishCheck delays unmapping a volume that is still written to,
+	// for as long as UnpublishCheckTimeout
+	UnpublishCheck        bool
+	UnpublishCheckTimeout time.Duration
+
+	// AllowValidateOnly accepts the KeyValidateOnly CreateVolume parameter
+	AllowValidateOnly bool
+
+	// TraceAddr is the address on which traces of the RPCs, and of the
+	// gateway calls they make, are served, if set
+	TraceAddr string
+
+	// Profiles are the CreateVolume parameters of each profile, by name
+	Profiles map[string]map[string]string
+
+	// SkipPrivilegeCheck skips checking, when probing the controller, that
+	// the user may manage volumes
+	SkipPrivilegeCheck bool
+
+	// SDCRoot is where the host's /dev, in which the volumes mapped to the
+	// SDC are found, is mounted, if not at /
+	SDCRoot string
+
+	// PoolProvisioning is the provisioning type of volumes created in
+	// each storage pool, by name, unless their parameters give one
+	PoolProvisioning map[string]string
+
+	// StoragePool is the storage pool volumes are created in when their
+	// parameters name none
+	StoragePool string
+
+	// AllowedPools are the storage pools volumes may be created in, each
+	// named alone or as domain/pool, or empty to allow every pool
+	AllowedPools []string
+
+	// DeleteRetention is how long deleted volumes are retained, renamed
+	// to a tombstone, before they are removed. Zero removes them at once.
+	DeleteRetention time.Duration
+
+	// AllowHTTP accepts gateway endpoints that use http rather than https
+	AllowHTTP bool
 }
 
 type service struct {
-	opts        Opts
-	mode        string
-	adminClient *sio.Client
-	system      *sio.System
-	volCache    []*siotypes.Volume
-	volCacheRWL sync.RWMutex
-	sdcMap      map[string]string
-	sdcMapRWL   sync.RWMutex
-	spCache     map[string]string
-	spCacheRWL  sync.RWMutex
-	privDir     string
+	opts          Opts
+	mode          string
+	adminClient   ScaleIOAdmin
+	gateways      *failoverAdmin
+	probeMu       sync.Mutex
+	reconnecting  bool
+	metrics       *metrics
+	metricsSrv    *http.Server
+	traceSrv      *http.Server
+	statsSrv      *http.Server
+	audit         *auditLog
+	readiness     readiness
+	inflight      inflight
+	healthSrv     *http.Server
+	orphanStop    chan struct{}
+	sweepStop     chan struct{}
+	keepaliveStop chan struct{}
+
+	// prefetchCancel abandons warming the caches, once started
+	prefetchCancel context.CancelFunc
+
+	// system is the ScaleIO system found by the last controller probe. It
+	// is guarded by its own lock, as probeMu guards the client and the
+	// background tasks probing starts, and the system is looked up through
+	// systemFlight, with no lock held across the calls to the gateway.
+	system       *siotypes.System
+	systemMu     sync.RWMutex
+	systemFlight systemFlight
+
+	// poolStats is the statistics of each storage pool, as last retrieved
+	poolStats   map[string]cachedPoolStats
+	poolStatsMu sync.Mutex
+
+	// poolList is the names of the storage pools, as last listed
+	poolList   poolList
+	poolListMu sync.Mutex
+
+	// gatewayVersion is looked up by the probe, until it is found
+	gatewayVersion   string
+	gatewayVersionMu sync.Mutex
+
+	// creates are the CreateVolume requests in flight
+	creates createFlights
+
+	// targets are the target paths created by NodePublishVolume
+	targets createdTargets
+
+	// volStates guards the state recorded of each volume published
+	volStates volumeStates
+
+	// granted is the capability each volume was published with, so later
+	// publishes can be checked against it
+	granted    map[string]grantedCap
+	grantedRWL sync.RWMutex
+
+	// mappingModes is the access mode each volume was published to each
+	// SDC with, guarded by grantedRWL
+	mappingModes map[mappingKey]csi.VolumeCapability_AccessMode_Mode
+
+	// generations are the generations of the SDCs each block volume
+	// published MULTI_NODE_MULTI_WRITER is mapped to, guarded by grantedRWL
+	generations map[string]mappingGeneration
+
+	// unmapped is when each recently unpublished volume was unmapped
+	unmapped   map[string]time.Time
+	unmappedMu sync.Mutex
+
+	// mappings are the volumes mapped to each SDC, as recently listed when
+	// unpublishing, and remapped is when the mappings of each volume were
+	// recently changed. volMappings are the SDCs each volume was recently
+	// read, mapped or unmapped to be mapped to.
+	mappings    map[string]*sdcMappings
+	remapped    map[string]time.Time
+	volMappings map[string]volMappings
+	mappingsMu  sync.Mutex
+
+	// sdcVols is the number of volumes mapped to each SDC, as last counted
+	// before publishing to it
+	sdcVols   map[string]sdcVolCount
+	sdcVolsMu sync.Mutex
+
+	// nodeID is the node ID reported when the SDC GUID couldn't be
+	// determined, as configured by NodeIDFallback
+	nodeID string
+
+	// nodeSdcID is the ID of the local SDC, once the node service has
+	// resolved it
+	nodeSdcID string
+
+	// legacyPrivDir, if set, is a directory that may still hold private
+	// mounts of volumes published before privDir became the default
+	legacyPrivDir string
+
+	sdcMap       map[string]sdcEntry
+	sdcMapRWL    sync.RWMutex
+	spCache      map[spCacheKey]*siotypes.StoragePool
+	spCacheRWL   sync.RWMutex
+	pdNames      map[string]cachedPDName
+	pdNamesMu    sync.Mutex
+	privDir      string
+	executor     Executor
+	mounter      Mounter
+	localVolumes func() ([]*sio.SdcMappedVolume, error)
+	sdcLoaded    func() bool
+
+	// sdcDevicePath is where the node probe expects the SDC's device node
+	sdcDevicePath string
 }
 
 // New returns a new Service.
 func New() Service {
 	return &service{
-		sdcMap:  map[string]string{},
-		spCache: map[string]string{},
+		sdcMap:       map[string]sdcEntry{},
+		spCache:      map[spCacheKey]*siotypes.StoragePool{},
+		pdNames:      map[string]cachedPDName{},
+		poolStats:    map[string]cachedPoolStats{},
+		granted:      map[string]grantedCap{},
+		mappingModes: map[mappingKey]csi.VolumeCapability_AccessMode_Mode{},
+		generations:  map[string]mappingGeneration{},
+		sdcVols:      map[string]sdcVolCount{},
+		executor:     osExecutor{},
+		mounter:      osMounter{executor: osExecutor{}},
+		localVolumes: sio.GetLocalVolumeMap,
+		sdcLoaded:    kmodLoaded,
+
+		sdcDevicePath: sdcDevice,
+	}
+}
+
+// NodeHost is how the node service reaches the local SDC and the host's
+// filesystems. Fields left nil are the host's own.
+type NodeHost struct {
+	// Mounter mounts the devices of published volumes
+	Mounter Mounter
+
+	// LocalVolumes returns the volumes mapped to the local SDC
+	LocalVolumes func() ([]*sio.SdcMappedVolume, error)
+
+	// SDCLoaded returns whether the SDC kernel module is loaded
+	SDCLoaded func() bool
+
+	// SDCDevice is the path of the device node of the SDC, which the node
+	// probe checks is present
+	SDCDevice string
+}
+
+// NewWithNodeHost returns a Service like New, whose node service reaches
+// the SDC and filesystems through host instead, such as the fakes the
+// sanity tests run against.
+func NewWithNodeHost(host NodeHost) Service {
+	s := New().(*service)
+	if host.Mounter != nil {
+		s.mounter = host.Mounter
+	}
+	if host.LocalVolumes != nil {
+		s.localVolumes = host.LocalVolumes
+	}
+	if host.SDCLoaded != nil {
+		s.sdcLoaded = host.SDCLoaded
+	}
+	if host.SDCDevice != "" {
+		s.sdcDevicePath = host.SDCDevice
+	}
+	return s
+}
+
+// NewWithOpts returns a Service configured by opts, rather than by the
+// environment, whose controller service has already been probed, so that
+// its handlers may be called directly instead of being served with gRPC.
+//
+// The gateway is reached with client, if not nil, whose session is renewed
+// with the credentials in opts when it expires. Otherwise a client is made
+// for opts.Endpoint. Options left zero disable what they configure, rather
+// than taking the defaults of their environment variables, and none of the
+// servers BeforeServe starts are started. The node service's handlers
+// still need the SDC, and aren't meant to be called this way.
+func NewWithOpts(
+	ctx context.Context, opts Opts, client *sio.Client) (Service, error) {
+
+	s := New().(*service)
+	s.opts = opts
+	s.mode = "controller"
+
+	if client != nil {
+		admin, err := newSIOAdminWithClient(
+			client, opts.Endpoint, opts.Insecure)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create ScaleIO client: %s",
+				err.Error())
+		}
+		// client may already be logged in, and so never be logged in by
+		// the probe
+		admin.login.configConnect = &sio.ConfigConnect{
+			Endpoint: opts.Endpoint,
+			Username: opts.User,
+			Password: opts.Password,
+		}
+		s.adminClient = s.traceAdmin(admin)
+	}
+
+	if err := s.controllerProbe(ctx); err != nil {
+		return nil, err
 	}
+	return s, nil
 }
 
 func (s *service) BeforeServe(
 	ctx context.Context, sp *gocsi.StoragePlugin, lis net.Listener) error {
 
 	defer func() {
-		fields := map[string]interface{}{
-			"endpoint":       s.opts.Endpoint,
-			"user":           s.opts.User,
-			"password":       "",
-			"systemname":     s.opts.SystemName,
-			"sdcGUID":        s.opts.SdcGUID,
-			"insecure":       s.opts.Insecure,
-			"thickprovision": s.opts.Thick,
-			"privatedir":     s.privDir,
-			"autoprobe":      s.opts.AutoProbe,
-			"mode":           s.mode,
+		log.WithFields(s.configFields()).Infof("configured %s", Name)
+	}()
+
+	// Settings from the config file are made available through the
+	// context, so they are read below just like environment variables
+	sources, err := loadConfigFile(ctx, csictx.Getenv(ctx, EnvConfigFile))
+	if err != nil {
+		return fmt.Errorf("unable to load config file: %s", err.Error())
+	}
+
+	if err := setLogFormat(csictx.Getenv(ctx, EnvLogFormat)); err != nil {
+		return err
+	}
+	debug, err := setLogLevel(ctx)
+	if err != nil {
+		return err
+	}
+	// gocsi only injects request IDs when it logs requests or responses,
+	// but they are logged with, and sent to the gateway for, every request
+	sp.Interceptors = append(sp.Interceptors,
+		requestid.NewServerRequestIDInjector())
+	if debug {
+		sp.Interceptors = append(sp.Interceptors, debugInterceptors(ctx)...)
+	}
+	logConfigSources(sources)
+
+	if err := s.configure(ctx); err != nil {
+		return err
+	}
+
+	if err := s.initSock(lis); err != nil {
+		return err
+	}
+
+	s.inflight.slowAfter = s.opts.SlowOperationThreshold
+
+	if s.opts.MetricsAddr != "" {
+		s.metrics = newMetrics()
+		s.metrics.inflight = &s.inflight
+		debug := map[string]http.Handler{}
+		if s.opts.DebugOperations {
+			debug[operationsPath] = &s.inflight
+		}
+		if s.opts.DebugConfig {
+			debug[configPath] = http.HandlerFunc(s.serveConfig)
 		}
+		srv, err := serveMetrics(s.opts.MetricsAddr, s.metrics, debug)
+		if err != nil {
+			return fmt.Errorf("unable to serve metrics on %s: %s",
+				s.opts.MetricsAddr, err.Error())
+		}
+		s.metricsSrv = srv
 
-		if s.opts.Password != "" {
-			fields["password"] = "******"
+		// Record metrics before any other interceptor, so that requests
+		// they reject are counted too
+		sp.Interceptors = append(
+			[]grpc.UnaryServerInterceptor{s.metrics.interceptor},
+			sp.Interceptors...)
+	} else {
+		if s.opts.DebugOperations {
+			log.Warnf("%s has no effect without %s",
+				EnvDebugOperations, EnvMetricsAddr)
+		}
+		if s.opts.DebugConfig {
+			log.Warnf("%s has no effect without %s",
+				EnvDebugConfig, EnvMetricsAddr)
 		}
+	}
 
-		log.WithFields(fields).Infof("configured %s", Name)
-	}()
+	if s.opts.TraceAddr != "" {
+		srv, err := serveTraces(s.opts.TraceAddr)
+		if err != nil {
+			return fmt.Errorf("unable to serve traces on %s: %s",
+				s.opts.TraceAddr, err.Error())
+		}
+		s.traceSrv = srv
+		sp.Interceptors = append(sp.Interceptors, traceInterceptor)
+	}
+
+	sp.Interceptors = append(sp.Interceptors,
+		s.inflight.interceptor, s.opts.RPCTimeouts.interceptor)
+
+	if s.opts.AuditLog != "" && !strings.EqualFold(s.mode, "node") {
+		audit, err := newAuditLog(s.opts.AuditLog, s.opts.AuditLogMaxSize)
+		if err != nil {
+			return fmt.Errorf("unable to open audit log %s: %s",
+				s.opts.AuditLog, err.Error())
+		}
+		s.audit = audit
+		sp.Interceptors = append(sp.Interceptors, s.auditInterceptor)
+	}
+
+	if s.opts.HealthAddr != "" {
+		srv, err := s.serveHealth(s.opts.HealthAddr)
+		if err != nil {
+			return fmt.Errorf("unable to serve health checks on %s: %s",
+				s.opts.HealthAddr, err.Error())
+		}
+		s.healthSrv = srv
+	}
+
+	if s.opts.StatsAddr != "" {
+		if strings.EqualFold(s.mode, "node") {
+			log.Warnf("%s has no effect on the node service", EnvStatsAddr)
+		} else {
+			srv, err := s.serveVolumeStats(
+				s.opts.StatsAddr, s.opts.StatsToken)
+			if err != nil {
+				return fmt.Errorf("unable to serve volume statistics "+
+					"on %s: %s", s.opts.StatsAddr, err.Error())
+			}
+			s.statsSrv = srv
+		}
+	}
+
+	if _, ok := csictx.LookupEnv(ctx, "X_CSI_SCALEIO_NO_PROBE_ON_START"); !ok {
+		// Do a controller probe
+		if !strings.EqualFold(s.mode, "node") {
+			if err := s.controllerProbe(ctx); err != nil {
+				return err
+			}
+		}
+
+		// Do a node probe
+		if !strings.EqualFold(s.mode, "controller") {
+			if err := s.nodeProbe(ctx); err != nil {
+				return err
+			}
+
+			// Only reconcile private mounts once the SDC is known to be
+			// running, otherwise every mount would look stale
+			if s.opts.CleanupOnStart {
+				for _, dir := range []string{s.privDir, s.legacyPrivDir} {
+					if dir == "" {
+						continue
+					}
+					if err := cleanupPrivateMounts(ctx, s.mounter,
+						s.localVolumes, s.sdcLoaded, dir); err != nil {
+						log.WithError(err).WithField("privateMountDir", dir).Warn(
+							"unable to clean up stale private mounts")
+					}
+				}
+			}
+		}
+	}
+
+	if s.opts.OrphanScanInterval > 0 && !strings.EqualFold(s.mode, "node") {
+		s.orphanStop = make(chan struct{})
+		go s.scanOrphansEvery(s.opts.OrphanScanInterval, s.orphanStop)
+	}
+	if s.opts.DeleteRetention > 0 && !strings.EqualFold(s.mode, "node") {
+		s.sweepStop = make(chan struct{})
+		go s.sweepTombstonesEvery(s.opts.DeleteRetention, s.sweepStop)
+	}
 
+	return nil
+}
+
+// configure sets the service's mode and options from the environment
+// variables, and the configuration file's settings made available through
+// ctx
+func (s *service) configure(ctx context.Context) error {
 	// Get the SP's operating mode.
 	s.mode = csictx.Getenv(ctx, gocsi.EnvVarMode)
 
+	opts, err := loadOpts(ctx)
+	if err != nil {
+		return err
+	}
+	if pd, ok := csictx.LookupEnv(ctx, EnvPrivateMountDir); ok {
+		s.privDir = pd
+	}
+	if s.privDir == "" {
+		s.privDir = defaultPrivDir
+		s.legacyPrivDir = legacyPrivDir
+	}
+
+	s.opts = opts
+	if s.opts.SDCRoot != "" {
+		s.localVolumes = sdcDeviceMap{root: s.opts.SDCRoot}.GetLocalVolumeMap
+		s.sdcDevicePath = filepath.Join(s.opts.SDCRoot, sdcDevice)
+	}
+	return nil
+}
+
+// configFields returns the service's configuration, with the password
+// masked, as it is logged once the service is configured. It is also what
+// the config command prints, what is served at configPath, and what
+// GetPluginInfo summarizes.
+func (s *service) configFields() log.Fields {
+	fields := log.Fields{
+		"endpoint":              s.opts.Endpoint,
+		"user":                  s.opts.User,
+		"password":              "",
+		"systemname":            s.opts.SystemName,
+		"sdcGUID":               s.opts.SdcGUID,
+		"drvCfgPath":            s.opts.DrvCfgPath,
+		"insecure":              s.opts.Insecure,
+		"thickprovision":        s.opts.Thick,
+		"privatedir":            s.privDir,
+		"autoprobe":             s.opts.AutoProbe,
+		"maxVolsPerNode":        s.opts.MaxVolumesPerNode,
+		"cleanupOnStart":        s.opts.CleanupOnStart,
+		"fsCheck":               s.opts.FSCheck,
+		"xfsNoUUID":             s.opts.XFSNoUUID,
+		"sockPerms":             s.opts.SockPerms,
+		"sockOwner":             s.opts.SockOwner,
+		"metricsAddr":           s.opts.MetricsAddr,
+		"healthAddr":            s.opts.HealthAddr,
+		"probeCacheTTL":         s.opts.ProbeCacheTTL,
+		"shutdownTimeout":       s.opts.ShutdownTimeout,
+		"orphanScan":            s.opts.OrphanScanInterval,
+		"orphanCleanup":         s.opts.OrphanCleanup,
+		"cleanupDisconnected":   s.opts.CleanupDisconnected,
+		"keepalive":             s.opts.KeepaliveInterval,
+		"prefetch":              s.opts.Prefetch,
+		"gatewayDebug":          s.opts.GatewayDebug,
+		"auditLog":              s.opts.AuditLog,
+		"auditLogMaxSize":       s.opts.AuditLogMaxSize,
+		"unmapSettle":           s.opts.UnmapSettleTimeout,
+		"mappingCacheTTL":       s.opts.MappingCacheTTL,
+		"strictParams":          s.opts.StrictParams,
+		"nodeIDFallback":        s.opts.NodeIDFallback,
+		"nodeIDSdcID":           s.opts.NodeIDSdcID,
+		"poolReserved":          s.opts.PoolReservedPercentage,
+		"thickFallback":         s.opts.ThickFallback,
+		"statsAddr":             s.opts.StatsAddr,
+		"snapshotGroups":        s.opts.SnapshotGroups,
+		"defaultVolumeSizeGiB":  s.defaultVolumeSizeKiB() / kiBytesInGiB,
+		"enforceOwnership":      s.opts.EnforceOwnership,
+		"listOwnedOnly":         s.opts.ListOwnedOnly,
+		"listExcludeIncomplete": s.opts.ListExcludeIncomplete,
+		"slowOperation":         s.opts.SlowOperationThreshold,
+		"debugOperations":       s.opts.DebugOperations,
+		"debugConfig":           s.opts.DebugConfig,
+		"unpublishCheck":        s.opts.UnpublishCheck,
+		"unpublishCheckTimeout": s.opts.UnpublishCheckTimeout,
+		"allowValidateOnly":     s.opts.AllowValidateOnly,
+		"traceAddr":             s.opts.TraceAddr,
+		"profiles":              profileNames(s.opts.Profiles),
+		"skipPrivilegeCheck":    s.opts.SkipPrivilegeCheck,
+		"sdcRoot":               s.opts.SDCRoot,
+		"poolProvisioning":      s.opts.PoolProvisioning,
+		"storagePool":           s.opts.StoragePool,
+		"allowedPools":          s.opts.AllowedPools,
+		"deleteRetention":       s.opts.DeleteRetention,
+		"allowHTTP":             s.opts.AllowHTTP,
+		"mode":                  s.mode,
+	}
+
+	if s.opts.Password != "" {
+		fields["password"] = "******"
+	}
+	if s.opts.StatsToken != "" {
+		fields["statsToken"] = "******"
+	}
+	return fields
+}
+
+// loadOpts returns the options configured by the environment variables, and
+// the configuration file's settings made available through ctx
+func loadOpts(ctx context.Context) (Opts, error) {
 	opts := Opts{}
 
 	if ep, ok := csictx.LookupEnv(ctx, EnvEndpoint); ok {
@@ -129,13 +750,24 @@ func (s *service) BeforeServe(
 	if guid, ok := csictx.LookupEnv(ctx, EnvSDCGUID); ok {
 		opts.SdcGUID = guid
 	}
-	if pd, ok := csictx.LookupEnv(ctx, "X_CSI_PRIVATE_MOUNT_DIR"); ok {
-		s.privDir = pd
+	if dc, ok := csictx.LookupEnv(ctx, EnvDrvCfgPath); ok {
+		opts.DrvCfgPath = dc
 	}
-	if s.privDir == "" {
-		s.privDir = defaultPrivDir
+	if root, ok := csictx.LookupEnv(ctx, EnvSDCRoot); ok {
+		opts.SDCRoot = root
+	}
+	if sp, ok := csictx.LookupEnv(ctx, EnvStoragePool); ok {
+		opts.StoragePool = sp
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvNodeIDFallback); ok {
+		switch v = strings.ToLower(v); v {
+		case "", nodeIDIP, nodeIDHostname:
+			opts.NodeIDFallback = v
+		default:
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, must be %s or %s",
+				EnvNodeIDFallback, v, nodeIDIP, nodeIDHostname)
+		}
 	}
-
 	// pb parses an environment variable into a boolean value. If an error
 	// is encountered, default is set to false, and error is logged
 	pb := func(n string) bool {
@@ -151,132 +783,691 @@ func (s *service) BeforeServe(
 		return false
 	}
 
+	opts.MaxVolumesPerNode = defaultMaxVolumesPerNode
+	if v, ok := csictx.LookupEnv(ctx, EnvMaxVolumesPerNode); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || i < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative integer", EnvMaxVolumesPerNode, v)
+		}
+		opts.MaxVolumesPerNode = i
+	}
+
+	opts.DefaultVolumeSizeKiB = DefaultVolumeSizeKiB
+	if v, ok := csictx.LookupEnv(ctx, EnvDefaultVolumeSizeGiB); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || i <= 0 || i%VolSizeMultipleGiB != 0 ||
+			i > maxVolumeSizeGiB {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, must be a "+
+				"positive multiple of %d", EnvDefaultVolumeSizeGiB, v,
+				VolSizeMultipleGiB)
+		}
+		opts.DefaultVolumeSizeKiB = i * kiBytesInGiB
+	}
+
+	// The endpoint is checked here, rather than when first used, since
+	// goscaleio fails obscurely with one that is malformed
+	opts.AllowHTTP = pb(EnvAllowHTTP)
+	if opts.Endpoint != "" {
+		ep, err := normalizeEndpoints(opts.Endpoint, opts.AllowHTTP)
+		if err != nil {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s",
+				EnvEndpoint, err.Error())
+		}
+		if ep != opts.Endpoint {
+			log.WithFields(log.Fields{
+				"configured": opts.Endpoint,
+				"endpoint":   ep,
+			}).Info("normalized gateway endpoint")
+		}
+		opts.Endpoint = ep
+	}
+
 	opts.Insecure = pb(EnvInsecure)
 	opts.Thick = pb(EnvThick)
 	opts.AutoProbe = pb(EnvAutoProbe)
+	opts.FSCheck = pb(EnvFSCheck)
+	opts.XFSNoUUID = true
+	if _, ok := csictx.LookupEnv(ctx, EnvXFSNoUUID); ok {
+		opts.XFSNoUUID = pb(EnvXFSNoUUID)
+	}
+	opts.CleanupOnStart = true
+	if _, ok := csictx.LookupEnv(ctx, EnvCleanupOnStart); ok {
+		opts.CleanupOnStart = pb(EnvCleanupOnStart)
+	}
 
-	s.opts = opts
+	if perms, ok := csictx.LookupEnv(ctx, EnvSockPerms); ok {
+		opts.SockPerms = perms
+	}
+	if owner, ok := csictx.LookupEnv(ctx, EnvSockOwner); ok {
+		opts.SockOwner = owner
+	}
+	opts.SockStrict = pb(EnvSockStrict)
+	if addr, ok := csictx.LookupEnv(ctx, EnvMetricsAddr); ok {
+		opts.MetricsAddr = addr
+	}
+	if addr, ok := csictx.LookupEnv(ctx, EnvHealthAddr); ok {
+		opts.HealthAddr = addr
+	}
+	if addr, ok := csictx.LookupEnv(ctx, EnvTraceAddr); ok {
+		opts.TraceAddr = addr
+	}
+	if addr, ok := csictx.LookupEnv(ctx, EnvStatsAddr); ok {
+		opts.StatsAddr = addr
+	}
+	if token, ok := csictx.LookupEnv(ctx, EnvStatsToken); ok {
+		opts.StatsToken = token
+	}
+	if opts.StatsAddr != "" && opts.StatsToken == "" {
+		return Opts{}, fmt.Errorf("%s requires %s",
+			EnvStatsAddr, EnvStatsToken)
+	}
+	opts.SnapshotGroups = pb(EnvSnapshotGroups)
+	if opts.SnapshotGroups && opts.StatsAddr == "" {
+		return Opts{}, fmt.Errorf("%s requires %s",
+			EnvSnapshotGroups, EnvStatsAddr)
+	}
+	timeouts, err := parseRPCTimeouts(csictx.Getenv(ctx, EnvRPCTimeouts))
+	if err != nil {
+		return Opts{}, fmt.Errorf("invalid value for %s: %s",
+			EnvRPCTimeouts, err.Error())
+	}
+	opts.RPCTimeouts = timeouts
 
-	if _, ok := csictx.LookupEnv(ctx, "X_CSI_SCALEIO_NO_PROBE_ON_START"); !ok {
-		// Do a controller probe
-		if !strings.EqualFold(s.mode, "node") {
-			if err := s.controllerProbe(ctx); err != nil {
-				return err
-			}
+	opts.ShutdownTimeout = defaultShutdownTimeout
+	if v, ok := csictx.LookupEnv(ctx, EnvShutdownTimeout); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvShutdownTimeout, v)
 		}
+		opts.ShutdownTimeout = d
+	}
 
-		// Do a node probe
-		if !strings.EqualFold(s.mode, "controller") {
-			if err := s.nodeProbe(ctx); err != nil {
-				return err
-			}
+	opts.ProbeCacheTTL = defaultProbeCacheTTL
+	if v, ok := csictx.LookupEnv(ctx, EnvProbeCacheTTL); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvProbeCacheTTL, v)
 		}
+		opts.ProbeCacheTTL = d
 	}
 
-	return nil
+	if v, ok := csictx.LookupEnv(ctx, EnvOrphanScanInterval); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvOrphanScanInterval, v)
+		}
+		opts.OrphanScanInterval = d
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvDeleteRetention); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvDeleteRetention, v)
+		}
+		opts.DeleteRetention = d
+	}
+	opts.OrphanCleanup = pb(EnvOrphanCleanup)
+	opts.CleanupDisconnected = pb(EnvCleanupDisconnected)
+	opts.NodeIDSdcID = pb(EnvNodeIDSdcID)
+	opts.GatewayDebug = pb(EnvGatewayDebug)
+	opts.Prefetch = pb(EnvPrefetch)
+	opts.StrictParams = pb(EnvStrictParams)
+	opts.ThickFallback = pb(EnvThickFallback)
+	opts.EnforceOwnership = pb(EnvEnforceOwnership)
+	opts.ListOwnedOnly = pb(EnvListOwnedOnly)
+	opts.ListExcludeIncomplete = pb(EnvListExcludeIncomplete)
+	opts.UnpublishCheck = pb(EnvUnpublishCheck)
+	opts.AllowValidateOnly = pb(EnvAllowValidateOnly)
+	opts.SkipPrivilegeCheck = pb(EnvSkipPrivilegeCheck)
+	opts.DebugOperations = pb(EnvDebugOperations)
+	opts.DebugConfig = pb(EnvDebugConfig)
+	opts.SlowOperationThreshold = defaultSlowOperationThreshold
+	if v, ok := csictx.LookupEnv(ctx, EnvSlowOperationThreshold); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, must be a "+
+				"non-negative duration", EnvSlowOperationThreshold, v)
+		}
+		opts.SlowOperationThreshold = d
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvKeepaliveInterval); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvKeepaliveInterval, v)
+		}
+		opts.KeepaliveInterval = d
+	}
+	if p, ok := csictx.LookupEnv(ctx, EnvAuditLog); ok {
+		opts.AuditLog = p
+	}
+	if p, ok := csictx.LookupEnv(ctx, EnvProfiles); ok && p != "" {
+		profiles, err := loadProfiles(p)
+		if err != nil {
+			return Opts{}, fmt.Errorf("unable to load profiles: %s", err.Error())
+		}
+		opts.Profiles = profiles
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvAuditLogMaxSize); ok {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || i < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative integer", EnvAuditLogMaxSize, v)
+		}
+		opts.AuditLogMaxSize = i
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvPoolReservedPercentage); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f >= 100 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, must be a "+
+				"percentage from 0 up to 100", EnvPoolReservedPercentage, v)
+		}
+		opts.PoolReservedPercentage = f
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvPoolProvisioning); ok {
+		types, err := parsePoolProvisioning(v)
+		if err != nil {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s",
+				EnvPoolProvisioning, err.Error())
+		}
+		opts.PoolProvisioning = types
+	}
+	if v, ok := csictx.LookupEnv(ctx, EnvAllowedPools); ok {
+		pools, err := parseAllowedPools(v)
+		if err != nil {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s",
+				EnvAllowedPools, err.Error())
+		}
+		opts.AllowedPools = pools
+	}
+	opts.UnmapSettleTimeout = defaultUnmapSettleTimeout
+	if v, ok := csictx.LookupEnv(ctx, EnvUnmapSettleTimeout); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvUnmapSettleTimeout, v)
+		}
+		opts.UnmapSettleTimeout = d
+	}
+	opts.MappingCacheTTL = defaultMappingCacheTTL
+	if v, ok := csictx.LookupEnv(ctx, EnvMappingCacheTTL); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvMappingCacheTTL, v)
+		}
+		opts.MappingCacheTTL = d
+	}
+	opts.UnpublishCheckTimeout = defaultUnpublishCheckTimeout
+	if v, ok := csictx.LookupEnv(ctx, EnvUnpublishCheckTimeout); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return Opts{}, fmt.Errorf("invalid value for %s: %s, "+
+				"must be a non-negative duration", EnvUnpublishCheckTimeout, v)
+		}
+		opts.UnpublishCheckTimeout = d
+	}
+
+	return opts, nil
 }
 
 // getVolProvisionType returns a string indicating thin or thick provisioning
 // If the type is specified in the params map, that value is used, if not, defer
 // to the service config
 func (s *service) getVolProvisionType(params map[string]string) string {
-	volType := thinProvisioned
-	if s.opts.Thick {
-		volType = thickProvisioned
-	}
+	volType, _ := s.volProvisionType(params)
+	return volType
+}
 
+// The sources of a volume's provisioning type, as logged when creating it
+const (
+	provisionFromParam    = "parameter"
+	provisionFromPool     = "pool"
+	provisionFromDefault  = "default"
+	provisionFromFallback = "thick-fallback"
+)
+
+// volProvisionType returns the provisioning type of a volume created with
+// params, and where it came from: the params themselves, the default type
+// of the storage pool they name, or the service config
+func (s *service) volProvisionType(params map[string]string) (string, string) {
 	if tp, ok := params[KeyThickProvisioning]; ok {
 		tpb, err := strconv.ParseBool(tp)
 		if err != nil {
 			log.Warnf("invalid boolean received `%s`=(%v) in params",
 				KeyThickProvisioning, tp)
 		} else if tpb {
-			volType = thickProvisioned
+			return thickProvisioned, provisionFromParam
 		} else {
-			volType = thinProvisioned
+			return thinProvisioned, provisionFromParam
 		}
 	}
 
-	return volType
+	if volType, ok := s.opts.PoolProvisioning[params[KeyStoragePool]]; ok {
+		return volType, provisionFromPool
+	}
+
+	if s.opts.Thick {
+		return thickProvisioned, provisionFromDefault
+	}
+	return thinProvisioned, provisionFromDefault
 }
 
-func (s *service) getVolByID(id string) (*siotypes.Volume, error) {
+func (s *service) getVolByID(
+	ctx context.Context, id string) (*siotypes.Volume, error) {
 
 	// The `GetVolume` API returns a slice of volumes, but when only passing
 	// in a volume ID, the response will be just the one volume
-	vols, err := s.adminClient.GetVolume("", id, "", "", false)
+	s.metrics.gatewayCall("GetVolume")
+	read := time.Now()
+	vols, err := adminContext(ctx, s.adminClient).GetVolume(
+		"", id, "", "", false)
 	if err != nil {
 		return nil, err
 	}
+	s.cacheMappings(vols[0], read)
 	return vols[0], nil
 }
 
-func (s *service) getSDCID(sdcGUID string) (string, error) {
-	sdcGUID = strings.ToUpper(sdcGUID)
+// findVolumeID returns the ID of the volume named name, failing with the
+// gateway's "Not found" if there is none. The gateway's own lookup by name
+// returns any one of the volumes with the name, which ScaleIO may not keep
+// unique, as for volumes renamed by an admin. So the volumes of the pool of
+// the one it returns are listed too, and FailedPrecondition is returned
+// rather than picking one of several. Volumes with the name in other pools
+// aren't looked for, as listing every volume of a large system takes
+// minutes.
+func (s *service) findVolumeID(ctx context.Context, name string) (string, error) {
+	admin := adminContext(ctx, s.adminClient)
+	s.metrics.gatewayCall("GetVolume")
+	found, err := admin.GetVolume("", "", "", name, false)
+	if err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", errors.New(sioGatewayNotFound)
+	}
+
+	s.metrics.gatewayCall("GetStoragePoolVolumes")
+	vols, err := admin.GetStoragePoolVolumes(
+		storagePoolRef(found[0].StoragePoolID))
+	if err != nil {
+		return "", err
+	}
+	ids := []string{found[0].ID}
+	for _, vol := range vols {
+		if vol.Name == name && vol.ID != found[0].ID {
+			ids = append(ids, vol.ID)
+		}
+	}
+	if len(ids) == 1 {
+		return ids[0], nil
+	}
+	sort.Strings(ids)
+	reqLog(ctx, "").WithFields(log.Fields{
+		"name":      name,
+		"volumeIDs": ids,
+	}).Warn("volume name is ambiguous")
+	return "", status.Errorf(codes.FailedPrecondition,
+		"%d volumes are named %s, with IDs %s, rename all but one of them",
+		len(ids), name, strings.Join(ids, ", "))
+}
+
+// storagePoolRef returns the storage pool with id, with the link to its
+// volumes that listing them follows
+func storagePoolRef(id string) *siotypes.StoragePool {
+	return &siotypes.StoragePool{
+		ID: id,
+		Links: []*siotypes.Link{{
+			Rel: "/api/StoragePool/relationship/Volume",
+			HREF: fmt.Sprintf(
+				"/api/instances/StoragePool::%s/relationships/Volume", id),
+		}},
+	}
+}
+
+var (
+	// sdcCacheTTL is how long a resolved SDC ID is cached. SDCs are
+	// re-registered with new IDs when their hosts are reinstalled.
+	sdcCacheTTL = 10 * time.Minute
+
+	// sdcNegativeTTL is how long a failed SDC lookup is cached, so a burst
+	// of requests for an unknown SDC doesn't each query the gateway
+	sdcNegativeTTL = 10 * time.Second
+
+	// sdcVolCountTTL is how long the number of volumes mapped to an SDC is
+	// cached. Volumes may be mapped other than through the plugin.
+	sdcVolCountTTL = 30 * time.Second
+)
+
+// sdcEntry is the cached result of looking up an SDC by node ID
+type sdcEntry struct {
+	id      string
+	err     error
+	expires time.Time
+
+	// stale is the SDC ID carried by the node ID that was found to be
+	// stale, as happens when the SDC is re-registered, and isn't used again
+	stale string
+}
+
+// sdcLookup is a field of an SDC, and the value to look for
+type sdcLookup struct {
+	field, value string
+}
+
+// sdcLookups returns the fields of an SDC that nodeID may give, in the
+// order they are looked up, along with the values to look for. A node ID
+// is the SDC's GUID, or, for orchestrators that can't learn the GUID, its
+// IP address or name. Node IDs not in the GUID format were always looked
+// up as GUIDs, so they still are before being looked up as names.
+func sdcLookups(nodeID string) []sdcLookup {
+	guid := sdcLookup{"SdcGuid", normalizeSDCGUID(nodeID)}
+	switch {
+	case validSDCGUID(guid.value):
+		return []sdcLookup{guid}
+	case net.ParseIP(nodeID) != nil:
+		return []sdcLookup{{"SdcIp", nodeID}}
+	default:
+		return []sdcLookup{guid, {"Name", nodeID}}
+	}
+}
+
+// sdcKey returns the key under which the SDC that nodeID gives is cached
+func sdcKey(nodeID string) string {
+	nodeID, _ = splitNodeID(nodeID)
+	if guid := normalizeSDCGUID(nodeID); validSDCGUID(guid) {
+		return guid
+	}
+	return nodeID
+}
+
+// sdcFieldNames are the names of the SDC fields a node ID may give, as
+// used in errors
+var sdcFieldNames = map[string]string{
+	"SdcGuid": "GUID",
+	"SdcIp":   "IP",
+	"Name":    "name",
+}
+
+func (s *service) getSDCID(
+	ctx context.Context, nodeID string) (string, error) {
+
+	nodeID, embedded := splitNodeID(nodeID)
+	key := sdcKey(nodeID)
 
 	// check if ID is already in cache
-	f := func() string {
+	f := func() (sdcEntry, bool) {
 		s.sdcMapRWL.RLock()
 		defer s.sdcMapRWL.RUnlock()
 
-		if id, ok := s.sdcMap[sdcGUID]; ok {
-			return id
+		e, ok := s.sdcMap[key]
+		return e, ok && time.Now().Before(e.expires)
+	}
+	prev, ok := f()
+	if ok {
+		return prev.id, prev.err
+	}
+
+	// A node may report the ID of its SDC along with its GUID, which is
+	// used as is unless it has been found to be stale
+	if embedded != "" && embedded != prev.stale {
+		s.sdcMapRWL.Lock()
+		defer s.sdcMapRWL.Unlock()
+		s.sdcMap[key] = sdcEntry{
+			id:      embedded,
+			expires: time.Now().Add(sdcCacheTTL),
 		}
-		return ""
+		return embedded, nil
 	}
-	if id := f(); id != "" {
-		return id, nil
+
+	// The node service may need the SDC before the controller is probed.
+	// Failing to find the system isn't cached, as it says nothing of the
+	// SDC.
+	if !s.controllerProbed() {
+		if _, err := s.ensureSystem(ctx); err != nil {
+			return "", err
+		}
 	}
 
-	// Need to translate sdcGUID to sdcID
-	id, err := s.system.FindSdc("SdcGuid", sdcGUID)
+	// Need to translate the node ID to sdcID
+	var (
+		e      = sdcEntry{stale: prev.stale}
+		sdc    *siotypes.Sdc
+		err    error
+		fields []string
+	)
+	for _, l := range sdcLookups(nodeID) {
+		err = s.withSystem(ctx, func(system *siotypes.System) (err error) {
+			s.metrics.gatewayCall("FindSdc")
+			sdc, err = adminContext(ctx, s.adminClient).FindSdc(
+				system, l.field, l.value)
+			return err
+		})
+		fields = append(fields, sdcFieldNames[l.field])
+		if err == nil || !isSDCNotFound(err) {
+			break
+		}
+	}
 	if err != nil {
-		return "", fmt.Errorf("error finding SDC from GUID: %s, err: %s",
-			sdcGUID, err.Error())
+		e.err = fmt.Errorf("error finding SDC from %s: %s, err: %s",
+			strings.Join(fields, " or "), nodeID, err.Error())
+		e.expires = time.Now().Add(sdcNegativeTTL)
+	} else {
+		e.id = sdc.ID
+		e.expires = time.Now().Add(sdcCacheTTL)
 	}
 
 	s.sdcMapRWL.Lock()
 	defer s.sdcMapRWL.Unlock()
 
-	s.sdcMap[sdcGUID] = id.Sdc.ID
+	s.sdcMap[key] = e
 
-	return id.Sdc.ID, nil
+	return e.id, e.err
 }
 
-func (s *service) getStoragePoolID(name string) (string, error) {
-	// check if ID is already in cache
-	f := func() string {
-		s.spCacheRWL.RLock()
-		defer s.spCacheRWL.RUnlock()
+// invalidateSDC drops the cached ID of the SDC with the given node ID, so
+// that it is looked up again. An SDC ID the node ID carries is no longer
+// used once dropped, as the SDC may have been re-registered since.
+func (s *service) invalidateSDC(nodeID string) {
+	s.sdcMapRWL.Lock()
+	defer s.sdcMapRWL.Unlock()
 
-		if id, ok := s.spCache[name]; ok {
-			return id
-		}
-		return ""
+	key := sdcKey(nodeID)
+	if _, embedded := splitNodeID(nodeID); embedded != "" {
+		s.sdcMap[key] = sdcEntry{stale: embedded}
+		return
+	}
+	delete(s.sdcMap, key)
+}
+
+// cachedSDCID returns the cached ID of the SDC with the given node ID, or
+// an empty string if it isn't cached
+func (s *service) cachedSDCID(nodeID string) string {
+	s.sdcMapRWL.RLock()
+	defer s.sdcMapRWL.RUnlock()
+	return s.sdcMap[sdcKey(nodeID)].id
+}
+
+// isSDCNotFound returns a flag indicating whether err reports that an SDC
+// does not exist, as happens when a cached SDC ID has gone stale
+func isSDCNotFound(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "sdc") &&
+		(strings.Contains(msg, "not find") ||
+			strings.Contains(msg, "couldn't find") ||
+			strings.Contains(msg, "not found"))
+}
+
+// sdcVolCount is the cached number of volumes mapped to an SDC
+type sdcVolCount struct {
+	n       int64
+	expires time.Time
+}
+
+// getSdcVolCount returns the number of volumes mapped to the SDC with the
+// given ID
+func (s *service) getSdcVolCount(sdcID string) (int64, error) {
+	s.sdcVolsMu.Lock()
+	c, ok := s.sdcVols[sdcID]
+	s.sdcVolsMu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return c.n, nil
 	}
-	if id := f(); id != "" {
-		return id, nil
+
+	m, err := s.sdcListing(context.Background(), sdcID, true)
+	if err != nil {
+		return 0, err
+	}
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	c = sdcVolCount{
+		n:       int64(len(m.vols)),
+		expires: time.Now().Add(sdcVolCountTTL),
+	}
+	s.sdcVolsMu.Lock()
+	defer s.sdcVolsMu.Unlock()
+	s.sdcVols[sdcID] = c
+
+	return c.n, nil
+}
+
+// addSdcVolCount adds n to the cached number of volumes mapped to the SDC
+// with the given ID, if it is cached
+func (s *service) addSdcVolCount(sdcID string, n int64) {
+	s.sdcVolsMu.Lock()
+	defer s.sdcVolsMu.Unlock()
+	if c, ok := s.sdcVols[sdcID]; ok {
+		c.n += n
+		s.sdcVols[sdcID] = c
 	}
+}
+
+// getStoragePool returns the named storage pool, which is cached after it
+// is first looked up. A pool in a system other than the configured one is
+// not returned, as its volumes can't be reached by this system's SDCs.
+func (s *service) getStoragePool(name string) (*siotypes.StoragePool, error) {
+	var pool *siotypes.StoragePool
+	ctx := context.Background()
+	err := s.withSystem(ctx, func(system *siotypes.System) error {
+		key := spCacheKey{systemID: system.ID, name: name}
+
+		// check if pool is already in cache
+		s.spCacheRWL.RLock()
+		pool = s.spCache[key]
+		s.spCacheRWL.RUnlock()
+		if pool != nil {
+			return nil
+		}
+
+		// Need to lookup pool from the gateway
+		s.metrics.gatewayCall("FindStoragePool")
+		p, err := s.adminClient.FindStoragePool("", name, "")
+		if err != nil {
+			return err
+		}
+		if err := s.checkPoolSystem(p, system); err != nil {
+			return err
+		}
 
-	// Need to lookup ID from the gateway
-	pool, err := s.adminClient.FindStoragePool("", name, "")
+		s.spCacheRWL.Lock()
+		defer s.spCacheRWL.Unlock()
+		s.spCache[key] = p
+		pool = p
+		return nil
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	return pool, nil
+}
 
+// spCacheKey is the key of a storage pool in the cache of storage pools.
+// Pools are cached by the system they were found in, as well as by name,
+// so that one found before the system is changed isn't used after.
+type spCacheKey struct {
+	systemID string
+	name     string
+}
+
+// invalidateStoragePool removes the named storage pool from the cache, so
+// that it is looked up again
+func (s *service) invalidateStoragePool(name string) {
 	s.spCacheRWL.Lock()
 	defer s.spCacheRWL.Unlock()
-	s.spCache[name] = pool.ID
+	for key := range s.spCache {
+		if key.name == name {
+			delete(s.spCache, key)
+		}
+	}
+}
+
+func (s *service) Shutdown(ctx context.Context) error {
+	s.readiness.Lock()
+	s.readiness.stopping = true
+	s.readiness.Unlock()
+
+	if s.orphanStop != nil {
+		close(s.orphanStop)
+		s.orphanStop = nil
+	}
+	if s.sweepStop != nil {
+		close(s.sweepStop)
+		s.sweepStop = nil
+	}
+	s.stopKeepalive()
+	s.stopPrefetch()
 
-	return pool.ID, nil
+	var err error
+	for _, srv := range []*http.Server{
+		s.healthSrv, s.metricsSrv, s.traceSrv, s.statsSrv} {
+		if srv == nil {
+			continue
+		}
+		if serr := srv.Shutdown(ctx); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if aerr := s.audit.close(); aerr != nil && err == nil {
+		err = aerr
+	}
+	return err
 }
 
 func getCSIVolume(vol *siotypes.Volume) *csi.Volume {
 
 	vi := &csi.Volume{
-		Id:            vol.ID,
-		CapacityBytes: int64(vol.SizeInKb * bytesInKiB),
+		Id: vol.ID,
+	}
+	// volumes being deleted may be reported without a size
+	if vol.SizeInKb > 0 {
+		vi.CapacityBytes = kiBToBytes(int64(vol.SizeInKb),
+			log.Fields{"volumeID": vol.ID})
+	}
+	if vol.ConsistencyGroupID != "" {
+		vi.Attributes = map[string]string{
+			KeySnapshotGroupID: vol.ConsistencyGroupID,
+		}
 	}
 
 	return vi
 }
+
+// kiBToBytes returns kib, a size the gateway reports in KiB, in bytes. A
+// size too large to be given in bytes is logged, with f, as a warning, and
+// given as the largest size that can be.
+func kiBToBytes(kib int64, f log.Fields) int64 {
+	if kib > math.MaxInt64/bytesInKiB {
+		log.WithFields(f).WithField("sizeInKiB", kib).Warn(
+			"size reported by gateway too large to give in bytes, " +
+				"giving the largest size instead")
+		return math.MaxInt64
+	}
+	return kib * bytesInKiB
+}
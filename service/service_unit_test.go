@@ -1,11 +1,16 @@
 package service
 
 import (
+	"context"
+	"math"
 	"testing"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	csictx "github.com/rexray/gocsi/context"
 	"github.com/stretchr/testify/assert"
 	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestGetVolSize(t *testing.T) {
@@ -55,7 +60,7 @@ func TestGetVolSize(t *testing.T) {
 		tt := tt
 		t.Run("", func(st *testing.T) {
 			st.Parallel()
-			size, err := validateVolSize(tt.cr)
+			size, err := validateVolSize(tt.cr, DefaultVolumeSizeKiB)
 			if tt.sizeKiB == 0 {
 				// error is expected
 				assert.Error(st, err)
@@ -66,11 +71,91 @@ func TestGetVolSize(t *testing.T) {
 	}
 }
 
+func TestVolSizeBounds(t *testing.T) {
+	maxBytes := int64(maxVolumeSizeGiB * bytesInGiB)
+	tests := []struct {
+		required, limit int64
+		sizeGiB         int64
+		code            codes.Code
+	}{
+		{1 << 31, 0, 8, codes.OK},
+		{1 << 32, 0, 8, codes.OK},
+		{1<<31 + 1, 1 << 32, 0, codes.OutOfRange},
+		{1 << 32, math.MaxInt64, 8, codes.OK},
+		{8*bytesInGiB + 1, 0, 16, codes.OK},
+		{maxBytes, 0, maxVolumeSizeGiB, codes.OK},
+		{maxBytes + 1, 0, 0, codes.OutOfRange},
+		{math.MaxInt64, 0, 0, codes.OutOfRange},
+		{math.MaxInt64, math.MaxInt64, 0, codes.OutOfRange},
+		{-1 << 31, 0, 0, codes.OutOfRange},
+		{0, math.MinInt64, 0, codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		size, err := validateVolSize(&csi.CapacityRange{
+			RequiredBytes: tt.required,
+			LimitBytes:    tt.limit,
+		}, DefaultVolumeSizeKiB)
+		st, _ := status.FromError(err)
+		assert.Equal(t, tt.code, st.Code(), "%d/%d", tt.required, tt.limit)
+		assert.Equal(t, tt.sizeGiB*kiBytesInGiB, size,
+			"%d/%d", tt.required, tt.limit)
+	}
+
+	// sizes the gateway reports too large for bytes are given as the
+	// largest
+	assert.Equal(t, int64(math.MaxInt64),
+		getCSIVolume(&siotypes.Volume{SizeInKb: math.MaxInt64}).CapacityBytes)
+	assert.Equal(t, int64(1<<32)*bytesInKiB,
+		getCSIVolume(&siotypes.Volume{SizeInKb: 1 << 32}).CapacityBytes)
+}
+
+func TestDefaultVolumeSize(t *testing.T) {
+	load := func(env map[string]string) (Opts, error) {
+		ctx := csictx.WithLookupEnv(context.Background(),
+			func(k string) (string, bool) {
+				v, ok := env[k]
+				return v, ok
+			})
+		return loadOpts(ctx)
+	}
+
+	opts, err := load(map[string]string{EnvDefaultVolumeSizeGiB: "24"})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 24*kiBytesInGiB, opts.DefaultVolumeSizeKiB)
+	s := &service{opts: opts}
+	assert.EqualValues(t, 24, s.configFields()["defaultVolumeSizeGiB"])
+
+	// volumes without a required size get the default
+	size, err := validateVolSize(&csi.CapacityRange{}, s.defaultVolumeSizeKiB())
+	assert.NoError(t, err)
+	assert.EqualValues(t, 24*kiBytesInGiB, size)
+	_, err = validateVolSize(&csi.CapacityRange{LimitBytes: 16 * bytesInGiB},
+		s.defaultVolumeSizeKiB())
+	assert.Error(t, err)
+
+	for _, v := range []string{"12", "0", "-8", "8GiB", "",
+		"9223372036854775800"} {
+		_, err := load(map[string]string{EnvDefaultVolumeSizeGiB: v})
+		assert.Error(t, err, v)
+		if err != nil {
+			assert.Contains(t, err.Error(), EnvDefaultVolumeSizeGiB)
+		}
+	}
+
+	// unset, it is the built-in default
+	opts, err = load(nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, DefaultVolumeSizeKiB, opts.DefaultVolumeSizeKiB)
+	s = &service{}
+	assert.EqualValues(t, DefaultVolumeSizeKiB, s.defaultVolumeSizeKiB())
+}
+
 func TestGetProvisionType(t *testing.T) {
 	tests := []struct {
 		opts    Opts
 		params  map[string]string
 		volType string
+		source  string
 	}{
 		{
 			// no opts and no params should default to thin
@@ -100,6 +185,50 @@ func TestGetProvisionType(t *testing.T) {
 			},
 			volType: thickProvisioned,
 		},
+		{
+			// a thick pool overrides opts with thin
+			opts: Opts{PoolProvisioning: map[string]string{
+				"hdd": thickProvisioned,
+			}},
+			params: map[string]string{
+				KeyStoragePool: "hdd",
+			},
+			volType: thickProvisioned,
+			source:  provisionFromPool,
+		},
+		{
+			// a thin pool overrides opts with thick
+			opts: Opts{Thick: true, PoolProvisioning: map[string]string{
+				"ssd": thinProvisioned,
+			}},
+			params: map[string]string{
+				KeyStoragePool: "ssd",
+			},
+			volType: thinProvisioned,
+			source:  provisionFromPool,
+		},
+		{
+			// params to thin override a thick pool
+			opts: Opts{PoolProvisioning: map[string]string{
+				"hdd": thickProvisioned,
+			}},
+			params: map[string]string{
+				KeyStoragePool:       "hdd",
+				KeyThickProvisioning: "false",
+			},
+			volType: thinProvisioned,
+			source:  provisionFromParam,
+		},
+		{
+			// pools that aren't listed use opts
+			opts: Opts{Thick: true, PoolProvisioning: map[string]string{
+				"ssd": thinProvisioned,
+			}},
+			params: map[string]string{
+				KeyStoragePool: "hdd",
+			},
+			volType: thickProvisioned,
+		},
 	}
 
 	for _, tt := range tests {
@@ -110,6 +239,11 @@ func TestGetProvisionType(t *testing.T) {
 
 			volType := s.getVolProvisionType(tt.params)
 			assert.Equal(st, tt.volType, volType)
+
+			if tt.source != "" {
+				_, source := s.volProvisionType(tt.params)
+				assert.Equal(st, tt.source, source)
+			}
 		})
 	}
 }
@@ -346,7 +480,7 @@ func TestVolumeCaps(t *testing.T) {
 		tt := tt
 		t.Run("", func(st *testing.T) {
 			st.Parallel()
-			s, _ := valVolumeCaps(tt.caps, tt.vol)
+			s, _ := valVolumeCaps(tt.caps, tt.vol, nil)
 
 			assert.Equal(st, tt.supported, s)
 		})
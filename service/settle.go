@@ -0,0 +1,88 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultUnmapSettleTimeout is how long DeleteVolume waits, by default, for
+// the mapping of a volume that was just unpublished to go away
+const defaultUnmapSettleTimeout = 10 * time.Second
+
+// unmapSettleInterval is how often a volume is read again while waiting for
+// its mappings to go away
+var unmapSettleInterval = 500 * time.Millisecond
+
+// setUnmapped records that a volume was unmapped from an SDC. The gateway
+// can report the mapping for a few seconds after it was removed.
+func (s *service) setUnmapped(volID string) {
+	timeout := s.opts.UnmapSettleTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	s.unmappedMu.Lock()
+	defer s.unmappedMu.Unlock()
+
+	if s.unmapped == nil {
+		s.unmapped = map[string]time.Time{}
+	}
+	now := time.Now()
+	for id, t := range s.unmapped {
+		if now.Sub(t) > timeout {
+			delete(s.unmapped, id)
+		}
+	}
+	s.unmapped[volID] = now
+}
+
+// recentlyUnmapped returns whether a volume was unmapped from an SDC within
+// the unmap settle timeout
+func (s *service) recentlyUnmapped(volID string) bool {
+	s.unmappedMu.Lock()
+	defer s.unmappedMu.Unlock()
+
+	t, ok := s.unmapped[volID]
+	return ok && time.Since(t) <= s.opts.UnmapSettleTimeout
+}
+
+// awaitUnmapped reads vol again until it is no longer mapped to any SDC,
+// for as long as the unmap settle timeout, if it was recently unmapped. It
+// returns the volume as last read, or nil if it no longer exists.
+func (s *service) awaitUnmapped(
+	ctx context.Context, vol *siotypes.Volume) (*siotypes.Volume, error) {
+
+	if len(vol.MappedSdcInfo) == 0 || !s.recentlyUnmapped(vol.ID) {
+		return vol, nil
+	}
+	reqLog(ctx, vol.ID).Debug("waiting for recent unmap to settle")
+
+	deadline := time.NewTimer(s.opts.UnmapSettleTimeout)
+	defer deadline.Stop()
+	for len(vol.MappedSdcInfo) > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, canceledErr(ctx, "waiting for volume to be unmapped")
+		case <-deadline.C:
+			return vol, nil
+		case <-time.After(unmapSettleInterval):
+		}
+
+		v, err := s.getVolByID(ctx, vol.ID)
+		if err != nil {
+			if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
+				return nil, nil
+			}
+			return nil, status.Errorf(codes.Internal,
+				"failure checking volume status before deletion: %s",
+				err.Error())
+		}
+		vol = v
+	}
+	return vol, nil
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeleteAfterUnpublish(t *testing.T) {
+	defer func(d time.Duration) { unmapSettleInterval = d }(unmapSettleInterval)
+	unmapSettleInterval = 10 * time.Millisecond
+
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.UnmapSettleTimeout = time.Second
+	sdc := fake.AddSdc("SDC-1")
+
+	// setStale publishes and unpublishes the volume, after which the
+	// gateway still reports it mapped until unstale is called
+	setStale := func(id string) (unstale func()) {
+		_, err := s.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId: id,
+				NodeId:   "sdc-1",
+				VolumeCapability: mountCap(
+					csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			})
+		assert.NoError(t, err)
+		_, err = s.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{VolumeId: id, NodeId: "sdc-1"})
+		assert.NoError(t, err)
+
+		fake.Lock()
+		defer fake.Unlock()
+		fake.Volumes[id].MappedSdcInfo = []*siotypes.MappedSdcInfo{
+			{SdcID: sdc},
+		}
+		return func() {
+			fake.Lock()
+			defer fake.Unlock()
+			fake.Volumes[id].MappedSdcInfo = nil
+		}
+	}
+	del := func(ctx context.Context, id string) error {
+		_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+		return err
+	}
+
+	// a mapping that goes away within the timeout is waited for
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	unstale := setStale(id)
+	time.AfterFunc(50*time.Millisecond, unstale)
+	assert.NoError(t, del(ctx, id))
+	assert.NotContains(t, fake.Volumes, id)
+
+	// volumes that weren't unpublished aren't waited for
+	id = fake.AddVolume("mapped", "pool", 8*kiBytesInGiB)
+	fake.Volumes[id].MappedSdcInfo = []*siotypes.MappedSdcInfo{{SdcID: sdc}}
+	fake.Calls["GetVolume"] = 0
+	st, _ := status.FromError(del(ctx, id))
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.Equal(t, 1, fake.Calls["GetVolume"])
+	fake.Volumes[id].MappedSdcInfo = nil
+
+	// a mapping still reported after the timeout fails as before
+	s.opts.UnmapSettleTimeout = 100 * time.Millisecond
+	setStale(id)
+	start := time.Now()
+	st, _ = status.FromError(del(ctx, id))
+	assert.Equal(t, codes.FailedPrecondition, st.Code())
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	// waiting ends with the request
+	s.opts.UnmapSettleTimeout = time.Minute
+	setStale(id)
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	st, _ = status.FromError(del(cctx, id))
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+
+	// a volume removed while waiting is deleted
+	time.AfterFunc(50*time.Millisecond, func() {
+		fake.Lock()
+		defer fake.Unlock()
+		delete(fake.Volumes, id)
+	})
+	assert.NoError(t, del(ctx, id))
+}
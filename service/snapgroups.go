@@ -0,0 +1,265 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The CSI spec this plug-in implements has no snapshot RPCs, so with
+// X_CSI_SCALEIO_SNAPSHOT_GROUPS set the controller serves snapshot groups
+// on the volume statistics address instead, to the same bearer token, sent
+// in the clear as that address serves plain HTTP. A group is taken by a
+// single call to the gateway, so the snapshots of all of its volumes are
+// consistent with one another, as an application spreading its data over
+// several volumes needs. ScaleIO records the group as the consistency
+// group of each snapshot. The snapshots are volumes like any other, and
+// are deleted one at a time by DeleteVolume.
+
+// snapshotGroupsPath is the path at which snapshot groups are taken, and
+// under which each is served by ID
+const snapshotGroupsPath = "/snapshot-groups"
+
+// KeySnapshotGroupID is the volume attribute giving the ID of the snapshot
+// group a snapshot was taken in, so that the snapshots of a group can be
+// found from ListVolumes
+const KeySnapshotGroupID = "snapshotGroupId"
+
+// snapshotGroupRequest is the body of a request to take a snapshot group.
+// The snapshots are named after the group, numbered in the order of the
+// volumes.
+type snapshotGroupRequest struct {
+	Name      string   `json:"name"`
+	VolumeIDs []string `json:"volumeIds"`
+}
+
+// snapshotGroup is the response describing a snapshot group
+type snapshotGroup struct {
+	SnapshotGroupID string          `json:"snapshotGroupId"`
+	Snapshots       []groupSnapshot `json:"snapshots"`
+}
+
+// groupSnapshot is a snapshot of a snapshot group, by CSI volume ID
+type groupSnapshot struct {
+	SourceVolumeID string `json:"sourceVolumeId"`
+	SnapshotID     string `json:"snapshotId"`
+	Name           string `json:"name"`
+}
+
+// snapshotGroupsHandler takes and describes snapshot groups for callers
+// presenting the token as a bearer token
+type snapshotGroupsHandler struct {
+	s     *service
+	token string
+
+	// mu serializes the snapshot groups taken, as for the volume statistics
+	mu sync.Mutex
+}
+
+func (h *snapshotGroupsHandler) ServeHTTP(
+	w http.ResponseWriter, r *http.Request) {
+
+	if !bearerAuthorized(r, h.token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeStatsError(w, http.StatusUnauthorized,
+			errors.New("missing or invalid bearer token"))
+		return
+	}
+
+	var (
+		group *snapshotGroup
+		err   error
+		code  = http.StatusOK
+	)
+	switch {
+	case r.URL.Path == snapshotGroupsPath:
+		if r.Method != http.MethodPost {
+			writeStatsError(w, http.StatusMethodNotAllowed,
+				errors.New("only POST is allowed"))
+			return
+		}
+		var req snapshotGroupRequest
+		if derr := json.NewDecoder(r.Body).Decode(&req); derr != nil {
+			writeStatsError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid request: %s", derr.Error()))
+			return
+		}
+		group, err = h.snapshotGroup(r.Context(), req)
+		code = http.StatusCreated
+	case strings.HasPrefix(r.URL.Path, snapshotGroupsPath+"/"):
+		id := strings.TrimPrefix(r.URL.Path, snapshotGroupsPath+"/")
+		if id == "" || strings.Contains(id, "/") {
+			writeStatsError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeStatsError(w, http.StatusMethodNotAllowed,
+				errors.New("only GET is allowed"))
+			return
+		}
+		group, err = h.getSnapshotGroup(r.Context(), id)
+	default:
+		writeStatsError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(group)
+}
+
+// snapshotGroup snapshots the volumes of req in a single gateway call. It
+// fails with Unavailable until the controller has probed.
+func (h *snapshotGroupsHandler) snapshotGroup(
+	ctx context.Context, req snapshotGroupRequest) (*snapshotGroup, error) {
+
+	s := h.s
+	if !s.controllerProbed() {
+		return nil, status.Error(codes.Unavailable,
+			"controller service not probed")
+	}
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument,
+			"name of the snapshot group required")
+	}
+	if len(req.VolumeIDs) == 0 {
+		return nil, status.Error(codes.InvalidArgument,
+			"volume IDs required")
+	}
+
+	param := &siotypes.SnapshotVolumesParam{}
+	seen := make(map[string]bool, len(req.VolumeIDs))
+	for i, volID := range req.VolumeIDs {
+		id, err := s.volumeID(volID)
+		if err != nil {
+			return nil, err
+		}
+		if seen[id] {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"volume %s given more than once", volID)
+		}
+		seen[id] = true
+		param.SnapshotDefs = append(param.SnapshotDefs,
+			&siotypes.SnapshotDef{
+				VolumeID:     id,
+				SnapshotName: s.volumeName(fmt.Sprintf("%s-%d", req.Name, i)),
+			})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var resp *siotypes.SnapshotVolumesResp
+	if err := s.withSystem(ctx, func(system *siotypes.System) error {
+		var err error
+		s.metrics.gatewayCall("SnapshotVolumes")
+		resp, err = s.adminClient.SnapshotVolumes(system, param)
+		return err
+	}); err != nil {
+		if st, ok := status.FromError(err); ok {
+			return nil, st.Err()
+		}
+		switch {
+		case strings.EqualFold(err.Error(), sioGatewayVolumeNotFound):
+			return nil, status.Error(codes.NotFound,
+				"a volume of the snapshot group was not found")
+		case strings.EqualFold(err.Error(), sioGatewayVolumeNameInUse):
+			return nil, status.Errorf(codes.AlreadyExists,
+				"snapshots named after %s already exist", req.Name)
+		}
+		return nil, status.Errorf(codes.Internal,
+			"unable to take snapshot group: %s", err.Error())
+	}
+	if len(resp.VolumeIDList) != len(param.SnapshotDefs) {
+		return nil, status.Errorf(codes.Internal,
+			"gateway returned %d snapshots for %d volumes",
+			len(resp.VolumeIDList), len(param.SnapshotDefs))
+	}
+
+	group := &snapshotGroup{SnapshotGroupID: resp.SnapshotGroupID}
+	for i, def := range param.SnapshotDefs {
+		group.Snapshots = append(group.Snapshots, groupSnapshot{
+			SourceVolumeID: def.VolumeID,
+			SnapshotID:     resp.VolumeIDList[i],
+			Name:           def.SnapshotName,
+		})
+	}
+	log.WithFields(log.Fields{
+		"snapshotGroupID": group.SnapshotGroupID,
+		"snapshots":       len(group.Snapshots),
+	}).Info("took snapshot group")
+	return group, nil
+}
+
+// getSnapshotGroup returns the snapshots of the group id that still exist,
+// failing with NotFound if none does. ScaleIO records the group as the
+// consistency group of each snapshot, so every controller finds them, even
+// after a restart, by listing the volumes a storage pool at a time as
+// ListVolumes does. The handler's mutex isn't held meanwhile, so that
+// snapshot groups can still be taken.
+func (h *snapshotGroupsHandler) getSnapshotGroup(
+	ctx context.Context, id string) (*snapshotGroup, error) {
+
+	s := h.s
+	if !s.controllerProbed() {
+		return nil, status.Error(codes.Unavailable,
+			"controller service not probed")
+	}
+
+	s.metrics.gatewayCall("GetStoragePools")
+	pools, err := s.adminClient.GetStoragePools()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal,
+			"unable to list storage pools: %s", err.Error())
+	}
+	group := &snapshotGroup{SnapshotGroupID: id}
+	for _, pool := range pools {
+		if cerr := canceledErr(ctx, "listing snapshot group"); cerr != nil {
+			return nil, cerr
+		}
+		s.metrics.gatewayCall("GetStoragePoolVolumes")
+		vols, err := s.adminClient.GetStoragePoolVolumes(pool)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal,
+				"unable to list volumes: %s", err.Error())
+		}
+		for _, vol := range vols {
+			if vol == nil || vol.ConsistencyGroupID != id || isTombstone(vol) {
+				continue
+			}
+			group.Snapshots = append(group.Snapshots, groupSnapshot{
+				SourceVolumeID: vol.AncestorVolumeID,
+				SnapshotID:     vol.ID,
+				Name:           vol.Name,
+			})
+		}
+	}
+	if len(group.Snapshots) == 0 {
+		return nil, status.Errorf(codes.NotFound,
+			"snapshot group %s not found", id)
+	}
+
+	// the snapshots are named after the group, numbered in the order of the
+	// volumes, so ordering their names by length first orders them by
+	// number
+	sort.Slice(group.Snapshots, func(i, j int) bool {
+		a, b := group.Snapshots[i].Name, group.Snapshots[j].Name
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	})
+	return group, nil
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+func TestSnapshotGroups(t *testing.T) {
+	s, fake := newFakeService()
+	s.opts.EnforceOwnership = true
+	id1 := fake.AddVolume("csi-data", "pool", 8*kiBytesInGiB)
+	id2 := fake.AddVolume("csi-log", "pool", 8*kiBytesInGiB)
+
+	srv := httptest.NewServer(&snapshotGroupsHandler{s: s, token: "secret"})
+	defer srv.Close()
+	do := func(method, path, token, body string) (int, snapshotGroup) {
+		req, err := http.NewRequest(method, srv.URL+path,
+			strings.NewReader(body))
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rep, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, snapshotGroup{}
+		}
+		defer rep.Body.Close()
+		var group snapshotGroup
+		if rep.StatusCode < 300 {
+			assert.NoError(t, json.NewDecoder(rep.Body).Decode(&group))
+		}
+		return rep.StatusCode, group
+	}
+	post := func(body string) (int, snapshotGroup) {
+		return do(http.MethodPost, snapshotGroupsPath, "secret", body)
+	}
+
+	code, group := post(
+		`{"name":"db","volumeIds":["` + id1 + `","` + id2 + `"]}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.NotEmpty(t, group.SnapshotGroupID)
+	if !assert.Len(t, group.Snapshots, 2) {
+		return
+	}
+	assert.Equal(t, 1, fake.Calls["SnapshotVolumes"])
+	for i, src := range []string{id1, id2} {
+		snap := group.Snapshots[i]
+		assert.Equal(t, src, snap.SourceVolumeID)
+		v := fake.Volumes[snap.SnapshotID]
+		if assert.NotNil(t, v) {
+			assert.Equal(t, src, v.AncestorVolumeID)
+			assert.Equal(t, group.SnapshotGroupID, v.ConsistencyGroupID)
+			assert.True(t, isOwned(v), v.Name)
+			assert.Equal(t, v.Name, snap.Name)
+		}
+	}
+
+	path := snapshotGroupsPath + "/" + group.SnapshotGroupID
+	code, got := do(http.MethodGet, path, "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, group, got)
+
+	// the group is recorded by the gateway, so it is found by another
+	// controller, or after a restart
+	other := httptest.NewServer(&snapshotGroupsHandler{s: s, token: "secret"})
+	req, err := http.NewRequest(http.MethodGet, other.URL+path, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	rep, err := http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		var found snapshotGroup
+		assert.Equal(t, http.StatusOK, rep.StatusCode)
+		assert.NoError(t, json.NewDecoder(rep.Body).Decode(&found))
+		rep.Body.Close()
+		assert.Equal(t, group, found)
+	}
+	other.Close()
+
+	// and given by ListVolumes, for the snapshots to be reassembled
+	ctx := context.Background()
+	list, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	inGroup := map[string]bool{}
+	for _, e := range list.GetEntries() {
+		v := e.GetVolume()
+		if v.GetAttributes()[KeySnapshotGroupID] == group.SnapshotGroupID {
+			inGroup[v.GetId()] = true
+		}
+	}
+	assert.Equal(t, map[string]bool{
+		group.Snapshots[0].SnapshotID: true,
+		group.Snapshots[1].SnapshotID: true,
+	}, inGroup)
+
+	// the snapshots of a group are deleted one at a time
+	_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: group.Snapshots[0].SnapshotID})
+	assert.NoError(t, err)
+	code, got = do(http.MethodGet, path, "secret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, group.Snapshots[1:], got.Snapshots)
+	assert.Contains(t, fake.Volumes, id1)
+	_, err = s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: group.Snapshots[1].SnapshotID})
+	assert.NoError(t, err)
+	code, _ = do(http.MethodGet, path, "secret", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// taking a group again under the same name collides with the snapshots
+	// left from the first
+	code, _ = post(`{"name":"db","volumeIds":["` + id1 + `"]}`)
+	assert.Equal(t, http.StatusCreated, code)
+	code, _ = post(`{"name":"db","volumeIds":["` + id1 + `"]}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	calls := fake.Calls["SnapshotVolumes"]
+	for _, body := range []string{
+		`{"volumeIds":["` + id1 + `"]}`,
+		`{"name":"db2"}`,
+		`{"name":"db2","volumeIds":["` + id1 + `","` + id1 + `"]}`,
+		`{"name":"db2","volumeIds":["bad!id"]}`,
+		`not json`,
+	} {
+		code, _ = post(body)
+		assert.Equal(t, http.StatusBadRequest, code, body)
+	}
+	for _, token := range []string{"", "wrong"} {
+		code, _ = do(http.MethodPost, snapshotGroupsPath, token,
+			`{"name":"db2","volumeIds":["`+id1+`"]}`)
+		assert.Equal(t, http.StatusUnauthorized, code, token)
+	}
+	code, _ = do(http.MethodGet, snapshotGroupsPath, "secret", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	assert.Equal(t, calls, fake.Calls["SnapshotVolumes"])
+
+	// no snapshot is taken unless every volume exists
+	code, _ = post(`{"name":"db2","volumeIds":["` + id1 + `","123"]}`)
+	assert.Equal(t, http.StatusNotFound, code)
+	fake.Errors["SnapshotVolumes"] = errors.New("gateway down")
+	code, _ = post(`{"name":"db2","volumeIds":["` + id1 + `"]}`)
+	assert.Equal(t, http.StatusBadGateway, code)
+	delete(fake.Errors, "SnapshotVolumes")
+
+	// nothing is served before the controller has probed
+	s.system = nil
+	calls = fake.Calls["SnapshotVolumes"]
+	code, _ = post(`{"name":"db2","volumeIds":["` + id1 + `"]}`)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, calls, fake.Calls["SnapshotVolumes"])
+}
+
+func TestSnapshotVolumes(t *testing.T) {
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+	id1 := fake.AddVolume("vol1", "pool", 8*kiBytesInGiB)
+	id2 := fake.AddVolume("vol2", "pool", 8*kiBytesInGiB)
+	gw := testutil.NewFakeGateway(fake, "admin", "password")
+	defer gw.Close()
+
+	a, err := newSIOAdmin(gw.Endpoint(), true)
+	assert.NoError(t, err)
+	_, err = a.Authenticate(&sio.ConfigConnect{
+		Endpoint: gw.Endpoint(),
+		Username: "admin",
+		Password: "password",
+	})
+	assert.NoError(t, err)
+
+	system, err := a.FindSystem("", "sys", "")
+	assert.NoError(t, err)
+	resp, err := a.SnapshotVolumes(system, &siotypes.SnapshotVolumesParam{
+		SnapshotDefs: []*siotypes.SnapshotDef{
+			{VolumeID: id1, SnapshotName: "snap1"},
+			{VolumeID: id2, SnapshotName: "snap2"},
+		},
+	})
+	if assert.NoError(t, err) && assert.Len(t, resp.VolumeIDList, 2) {
+		assert.NotEmpty(t, resp.SnapshotGroupID)
+		assert.Equal(t, id2, fake.Volumes[resp.VolumeIDList[1]].AncestorVolumeID)
+	}
+}
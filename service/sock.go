@@ -0,0 +1,101 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// initSock applies the configured permissions and ownership to the unix
+// socket the plug-in listens on. Failures are only logged, unless strict
+// socket handling is enabled.
+func (s *service) initSock(lis net.Listener) error {
+	if lis.Addr().Network() != "unix" {
+		return nil
+	}
+	if s.opts.SockPerms == "" && s.opts.SockOwner == "" {
+		return nil
+	}
+
+	path := lis.Addr().String()
+	err := applySockOpts(path, s.opts.SockPerms, s.opts.SockOwner)
+	if err == nil {
+		return nil
+	}
+	if s.opts.SockStrict {
+		return err
+	}
+	log.WithError(err).WithField("path", path).Warn(
+		"unable to apply socket permissions")
+	return nil
+}
+
+// applySockOpts sets the permissions, given in octal, and owner of the
+// socket at path. Either may be empty, in which case it is left unchanged.
+func applySockOpts(path, perms, owner string) error {
+	if perms != "" {
+		m, err := strconv.ParseUint(perms, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket permissions: %s", perms)
+		}
+		if err := os.Chmod(path, os.FileMode(m)); err != nil {
+			return err
+		}
+		log.WithField("path", path).WithField("mode", os.FileMode(m)).Info(
+			"changed socket permissions")
+	}
+
+	if owner != "" {
+		uid, gid, err := parseSockOwner(owner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+		log.WithField("path", path).WithField("owner", owner).Info(
+			"changed socket owner")
+	}
+
+	return nil
+}
+
+// parseSockOwner parses an owner in the form user[:group], where either
+// may be a name or a numeric ID and user may be empty. An ID of -1 is
+// returned for a part that is not given, leaving it unchanged.
+func parseSockOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+
+	parts := strings.SplitN(owner, ":", 2)
+	if name := parts[0]; name != "" {
+		id := name
+		if _, err := strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return 0, 0, err
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+
+	if len(parts) == 2 && parts[1] != "" {
+		name := parts[1]
+		id := name
+		if _, err := strconv.Atoi(name); err != nil {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return 0, 0, err
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+
+	return uid, gid, nil
+}
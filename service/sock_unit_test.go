@@ -0,0 +1,56 @@
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSockOwner(t *testing.T) {
+	tests := []struct {
+		owner string
+		uid   int
+		gid   int
+	}{
+		{"1000", 1000, -1},
+		{"1000:2000", 1000, 2000},
+		{":2000", -1, 2000},
+		{"1000:", 1000, -1},
+		{"root:root", 0, 0},
+	}
+	for _, tt := range tests {
+		uid, gid, err := parseSockOwner(tt.owner)
+		assert.NoError(t, err, tt.owner)
+		assert.Equal(t, tt.uid, uid, tt.owner)
+		assert.Equal(t, tt.gid, gid, tt.owner)
+	}
+
+	_, _, err := parseSockOwner("no-such-user-csi-scaleio")
+	assert.Error(t, err)
+}
+
+func TestInitSock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-scaleio-sock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	lis, err := net.Listen("unix", filepath.Join(dir, "csi.sock"))
+	assert.NoError(t, err)
+	defer lis.Close()
+
+	s := &service{opts: Opts{SockPerms: "0660"}}
+	assert.NoError(t, s.initSock(lis))
+	fi, err := os.Stat(lis.Addr().String())
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0660), fi.Mode().Perm())
+
+	// failures are only fatal in strict mode
+	s.opts.SockPerms = "rw-rw----"
+	assert.NoError(t, s.initSock(lis))
+	s.opts.SockStrict = true
+	assert.Error(t, s.initSock(lis))
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// targetDirMode and targetFileMode are the modes of the target paths
+// created for mount and block volumes respectively
+const (
+	targetDirMode  = 0750
+	targetFileMode = 0640
+)
+
+// createdTargets are the target paths created when publishing, rather than
+// by the CO, which are removed when unpublished. Targets created before the
+// plug-in was restarted are left to the CO.
+type createdTargets struct {
+	sync.Mutex
+	paths map[string]bool
+}
+
+// ensure makes sure there is a directory at target, or a file for a block
+// volume, creating it if missing. It returns whether target was created.
+func (t *createdTargets) ensure(target string, isBlock bool) (bool, error) {
+	st, err := os.Stat(target)
+	if err == nil {
+		if st.IsDir() == isBlock {
+			return false, status.Errorf(codes.InvalidArgument,
+				"target: %s wrong type (file vs dir) Access Type", target)
+		}
+		return false, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, status.Errorf(codes.Internal,
+			"failed to stat target, err: %s", err.Error())
+	}
+
+	if isBlock {
+		err = os.MkdirAll(filepath.Dir(target), targetDirMode)
+		if err == nil {
+			var f *os.File
+			f, err = os.OpenFile(target,
+				os.O_CREATE|os.O_EXCL|os.O_WRONLY, targetFileMode)
+			if err == nil {
+				f.Close()
+			}
+		}
+	} else {
+		err = os.MkdirAll(target, targetDirMode)
+	}
+	if err != nil {
+		return false, status.Errorf(codes.Internal,
+			"unable to create target %s: %s", target, err.Error())
+	}
+	log.WithField("target", target).Debug("created target")
+
+	t.Lock()
+	defer t.Unlock()
+	if t.paths == nil {
+		t.paths = map[string]bool{}
+	}
+	t.paths[target] = true
+	return true, nil
+}
+
+// remove removes target if it was created when publishing and is empty
+func (t *createdTargets) remove(target string) {
+	t.Lock()
+	defer t.Unlock()
+	if !t.paths[target] {
+		return
+	}
+	delete(t.paths, target)
+
+	st, err := os.Stat(target)
+	if err != nil || (!st.IsDir() && st.Size() > 0) {
+		return
+	}
+	// a directory that isn't empty is left in place by Remove
+	if err := os.Remove(target); err != nil {
+		log.WithField("target", target).WithError(err).Debug(
+			"created target not removed")
+		return
+	}
+	log.WithField("target", target).Debug("removed created target")
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultRPCTimeout is the deadline applied to RPCs without a more specific
+// default
+const defaultRPCTimeout = time.Minute
+
+// defaultRPCTimeouts are the deadlines applied to RPCs that arrive without
+// one. Creating a volume, and formatting one when it is first published,
+// can take several minutes, while probes and capability queries should
+// return almost immediately.
+var defaultRPCTimeouts = map[string]time.Duration{
+	"CreateVolume":              5 * time.Minute,
+	"DeleteVolume":              2 * time.Minute,
+	"ControllerPublishVolume":   2 * time.Minute,
+	"ControllerUnpublishVolume": 2 * time.Minute,
+	"NodePublishVolume":         5 * time.Minute,
+	"NodeUnpublishVolume":       2 * time.Minute,
+	"Probe":                     30 * time.Second,
+	"GetPluginInfo":             30 * time.Second,
+	"GetPluginCapabilities":     30 * time.Second,
+	"ControllerGetCapabilities": 30 * time.Second,
+	"NodeGetCapabilities":       30 * time.Second,
+	"NodeGetId":                 30 * time.Second,
+}
+
+// rpcTimeouts holds the deadline applied to each RPC that arrives without
+// one, keyed by method name, and the deadline for all other RPCs
+type rpcTimeouts struct {
+	methods map[string]time.Duration
+	def     time.Duration
+}
+
+// parseRPCTimeouts overrides the default deadlines with those in v, given
+// as a comma separated list of Method=duration pairs. The method "default"
+// sets the deadline for RPCs not otherwise listed, and a duration of 0
+// disables the deadline.
+func parseRPCTimeouts(v string) (rpcTimeouts, error) {
+	t := rpcTimeouts{
+		methods: map[string]time.Duration{},
+		def:     defaultRPCTimeout,
+	}
+	for k, d := range defaultRPCTimeouts {
+		t.methods[k] = d
+	}
+
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return t, fmt.Errorf("invalid RPC timeout: %s", p)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(kv[1]))
+		if err != nil || d < 0 {
+			return t, fmt.Errorf("invalid RPC timeout: %s", p)
+		}
+		if k := strings.TrimSpace(kv[0]); k == "default" {
+			t.def = d
+		} else {
+			t.methods[k] = d
+		}
+	}
+	return t, nil
+}
+
+func (t rpcTimeouts) timeout(method string) time.Duration {
+	if d, ok := t.methods[method]; ok {
+		return d
+	}
+	return t.def
+}
+
+// interceptor applies a deadline to RPCs that arrive without one. If the
+// handler fails after the deadline passed, DeadlineExceeded is returned
+// instead, unless the handler already named the stage that timed out.
+func (t rpcTimeouts) interceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	if _, ok := ctx.Deadline(); ok {
+		return handler(ctx, req)
+	}
+	method := path.Base(info.FullMethod)
+	d := t.timeout(method)
+	if d == 0 {
+		return handler(ctx, req)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	rep, err := handler(ctx, req)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		if st, ok := status.FromError(err); !ok ||
+			st.Code() != codes.DeadlineExceeded {
+			return nil, status.Errorf(codes.DeadlineExceeded,
+				"%s timed out after %s: %s", method, d, err.Error())
+		}
+	}
+	return rep, err
+}
+
+// stageErr returns a DeadlineExceeded error naming the stage that failed
+// if ctx expired, otherwise err is returned
+func stageErr(ctx context.Context, stage string, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return status.Errorf(codes.DeadlineExceeded,
+			"timed out %s: %s", stage, err.Error())
+	}
+	return err
+}
+
+// canceledErr returns Canceled, or DeadlineExceeded, naming the stage that
+// was about to start or was interrupted if ctx is done, otherwise nil.
+// Handlers that make several gateway calls check it between them, so a
+// request the CO gave up on does not carry on and race its retry.
+func canceledErr(ctx context.Context, stage string) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return status.Errorf(codes.Canceled, "canceled %s", stage)
+	case context.DeadlineExceeded:
+		return status.Errorf(codes.DeadlineExceeded, "timed out %s", stage)
+	}
+	return nil
+}
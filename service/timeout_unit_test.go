@@ -0,0 +1,167 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseRPCTimeouts(t *testing.T) {
+	to, err := parseRPCTimeouts("")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, to.timeout("CreateVolume"))
+	assert.Equal(t, 30*time.Second, to.timeout("Probe"))
+	assert.Equal(t, defaultRPCTimeout, to.timeout("ListVolumes"))
+
+	to, err = parseRPCTimeouts("CreateVolume=10m, Probe=0,default=2m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, to.timeout("CreateVolume"))
+	assert.Equal(t, time.Duration(0), to.timeout("Probe"))
+	assert.Equal(t, 2*time.Minute, to.timeout("ListVolumes"))
+	assert.Equal(t, 2*time.Minute, to.timeout("DeleteVolume"))
+
+	for _, v := range []string{"CreateVolume", "CreateVolume=soon",
+		"CreateVolume=-1s"} {
+		_, err = parseRPCTimeouts(v)
+		assert.Error(t, err, v)
+	}
+}
+
+func TestTimeoutInterceptor(t *testing.T) {
+	to, err := parseRPCTimeouts("CreateVolume=10ms,Probe=0")
+	assert.NoError(t, err)
+
+	info := func(m string) *grpc.UnaryServerInfo {
+		return &grpc.UnaryServerInfo{FullMethod: "/csi.v0.Controller/" + m}
+	}
+
+	// a deadline is applied when the request has none
+	_, err = to.interceptor(context.Background(), nil, info("CreateVolume"),
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, ok := ctx.Deadline()
+			assert.True(t, ok)
+			<-ctx.Done()
+			return nil, errors.New("gateway did not respond")
+		})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+	assert.Contains(t, st.Message(), "CreateVolume")
+
+	// a stage that reported its own timeout is left alone
+	_, err = to.interceptor(context.Background(), nil, info("CreateVolume"),
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			<-ctx.Done()
+			return nil, stageErr(ctx, "mounting target", errors.New("killed"))
+		})
+	st, _ = status.FromError(err)
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+	assert.Equal(t, "timed out mounting target: killed", st.Message())
+
+	// disabled, and existing, deadlines are not replaced
+	_, err = to.interceptor(context.Background(), nil, info("Probe"),
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			_, ok := ctx.Deadline()
+			assert.False(t, ok)
+			return nil, nil
+		})
+	assert.NoError(t, err)
+
+	dl := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), dl)
+	defer cancel()
+	_, err = to.interceptor(ctx, nil, info("CreateVolume"),
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			d, _ := ctx.Deadline()
+			assert.Equal(t, dl, d)
+			return nil, nil
+		})
+	assert.NoError(t, err)
+}
+
+func TestCanceledErr(t *testing.T) {
+	assert.NoError(t, canceledErr(context.Background(), "mapping volume"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st, _ := status.FromError(canceledErr(ctx, "mapping volume"))
+	assert.Equal(t, codes.Canceled, st.Code())
+	assert.Equal(t, "canceled mapping volume", st.Message())
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	st, _ = status.FromError(canceledErr(ctx, "mapping volume"))
+	assert.Equal(t, codes.DeadlineExceeded, st.Code())
+	assert.Equal(t, "timed out mapping volume", st.Message())
+}
+
+// hungExecutor runs sleep in place of each command, as a mount or mkfs
+// hung on an unresponsive device would
+type hungExecutor struct {
+	calls []string
+}
+
+func (e *hungExecutor) CombinedOutput(
+	ctx context.Context, name string, args ...string) ([]byte, error) {
+
+	e.calls = append(e.calls, name)
+	return osExecutor{}.CombinedOutput(ctx, "sleep", "60")
+}
+
+func TestOSMounterKilled(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		calls []string
+		run   func(context.Context, osMounter) error
+	}{
+		{"FormatAndMount", []string{"mount"},
+			func(ctx context.Context, m osMounter) error {
+				return m.FormatAndMount(ctx, "/dev/scinia", "/priv/vol1", "ext4")
+			}},
+		{"Format", []string{"mkfs.ext4"},
+			func(ctx context.Context, m osMounter) error {
+				return m.Format(ctx, "/dev/scinia", "ext4")
+			}},
+		{"BindMount", []string{"mount"},
+			func(ctx context.Context, m osMounter) error {
+				return m.BindMount(ctx, "/priv/vol1", "/target")
+			}},
+		{"Unmount", []string{"umount"},
+			func(ctx context.Context, m osMounter) error {
+				return m.Unmount(ctx, "/target")
+			}},
+		{"GetDiskFormat", []string{"lsblk"},
+			func(ctx context.Context, m osMounter) error {
+				_, err := m.GetDiskFormat(ctx, "/dev/scinia")
+				return err
+			}},
+	} {
+		e := &hungExecutor{}
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := tt.run(ctx, osMounter{executor: e})
+		cancel()
+		assert.Error(t, err, tt.name)
+		assert.True(t, time.Since(start) < 10*time.Second, tt.name)
+
+		// nothing more is run once the command is killed
+		assert.Equal(t, tt.calls, e.calls, tt.name)
+	}
+}
+
+func TestOSMounterBindMount(t *testing.T) {
+	e := &fakeExecutor{}
+	m := osMounter{executor: e}
+	assert.NoError(t, m.Mount(context.Background(),
+		"/priv/vol1", "/target", "", "bind", "ro"))
+	assert.Equal(t, [][]string{
+		{"mount", "-o", "bind", "/priv/vol1", "/target"},
+		{"mount", "-o", "remount,ro", "/priv/vol1", "/target"},
+	}, e.calls)
+}
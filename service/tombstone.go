@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// Volumes deleted while a retention period is configured are renamed to a
+// tombstone, del-<deleted at, in hex Unix seconds>-<volume ID>, and only
+// removed once the period has passed, so a volume deleted by mistake can
+// be imported again until then. The volume ID keeps tombstones unique, and
+// a volume is only taken for a tombstone if it is its own ID, so volumes
+// that merely have a similar name are never removed.
+
+// tombstonePrefix starts the names of the tombstones of deleted volumes
+const tombstonePrefix = "del-"
+
+// tombstoneRx matches the name of a tombstone
+var tombstoneRx = regexp.MustCompile(
+	"^" + tombstonePrefix + `([0-9a-f]{8})-(\w+)$`)
+
+// tombstoneSweepInterval is the longest time between sweeps for tombstones
+// whose retention period is over
+var tombstoneSweepInterval = 10 * time.Minute
+
+// tombstoneName returns the name of the tombstone of the volume id, deleted
+// at t
+func tombstoneName(id string, t time.Time) string {
+	return fmt.Sprintf("%s%08x-%s", tombstonePrefix, t.Unix(), id)
+}
+
+// tombstoned returns when vol was deleted, if it is a tombstone
+func tombstoned(vol *siotypes.Volume) (time.Time, bool) {
+	m := tombstoneRx.FindStringSubmatch(vol.Name)
+	if m == nil || m[2] != vol.ID {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(m[1], 16, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+// isTombstone returns whether vol was deleted, and is only retained
+func isTombstone(vol *siotypes.Volume) bool {
+	_, ok := tombstoned(vol)
+	return ok
+}
+
+// tombstone renames vol, which is being deleted, to its tombstone
+func (s *service) tombstone(ctx context.Context, vol *siotypes.Volume) error {
+	name := tombstoneName(vol.ID, time.Now())
+	s.metrics.gatewayCall("SetVolumeName")
+	if err := adminContext(ctx, s.adminClient).SetVolumeName(
+		vol, name); err != nil {
+		return err
+	}
+	reqLog(ctx, vol.ID).WithFields(log.Fields{
+		"name":      vol.Name,
+		"tombstone": name,
+		"retention": s.opts.DeleteRetention,
+	}).Info("retaining deleted volume, import the tombstone to recover it")
+	return nil
+}
+
+// sweepTombstonesEvery removes the tombstones whose retention period is
+// over until stop is closed. Sweeps are skipped while the controller is
+// not probed.
+func (s *service) sweepTombstonesEvery(
+	retention time.Duration, stop chan struct{}) {
+
+	interval := tombstoneSweepInterval
+	if retention < interval {
+		interval = retention
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if !s.controllerProbed() {
+			continue
+		}
+		if _, err := s.sweepTombstones(retention); err != nil {
+			log.WithError(err).Warn("unable to sweep deleted volumes")
+		}
+	}
+}
+
+// sweepTombstones removes the tombstones deleted longer than retention ago,
+// returning their names. Tombstones that are mapped, as when imported and
+// published without being renamed, are left in place.
+func (s *service) sweepTombstones(retention time.Duration) ([]string, error) {
+	s.metrics.gatewayCall("GetVolume")
+	vols, err := s.adminClient.GetVolume("", "", "", "", false)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, vol := range vols {
+		deleted, ok := tombstoned(vol)
+		if !ok || time.Since(deleted) < retention {
+			continue
+		}
+		f := log.Fields{"volumeID": vol.ID, "tombstone": vol.Name}
+		if len(vol.MappedSdcInfo) > 0 {
+			log.WithFields(f).Warn("deleted volume is mapped, not removing it")
+			continue
+		}
+		s.metrics.gatewayCall("RemoveVolume")
+		err := s.adminClient.RemoveVolume(vol, removeModeOnlyMe)
+		s.forgetMappings(vol.ID)
+		if err != nil {
+			log.WithFields(f).WithError(err).Warn(
+				"unable to remove deleted volume")
+			continue
+		}
+		log.WithFields(f).Info("removed deleted volume after retention")
+		removed = append(removed, vol.Name)
+	}
+	return removed, nil
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTombstoneName(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	name := tombstoneName("7a3f00b200000012", at)
+	assert.Equal(t, "del-6553f100-7a3f00b200000012", name)
+	assert.True(t, len(name) <= maxVolumeNameLength)
+
+	deleted, ok := tombstoned(&siotypes.Volume{
+		ID: "7a3f00b200000012", Name: name})
+	assert.True(t, ok)
+	assert.Equal(t, at, deleted)
+
+	// only a volume's own tombstone counts
+	assert.False(t, isTombstone(&siotypes.Volume{
+		ID: "7a3f00b200000013", Name: name}))
+	assert.False(t, isTombstone(&siotypes.Volume{
+		ID: "7a3f00b200000012", Name: "del-volume"}))
+}
+
+func TestDeleteVolumeRetention(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	s.opts.DeleteRetention = time.Hour
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+
+	// deleted volumes are only renamed, however often they are deleted
+	for i := 0; i < 2; i++ {
+		_, err := s.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 0, fake.Calls["RemoveVolume"])
+	assert.Equal(t, 1, fake.Calls["SetVolumeName"])
+	tombstone := fake.Volumes[id].Name
+	assert.True(t, isTombstone(fake.Volumes[id]), tombstone)
+
+	// and are otherwise gone
+	_, err := s.ValidateVolumeCapabilities(ctx,
+		&csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId: id,
+			VolumeCapabilities: []*csi.VolumeCapability{
+				mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+			},
+		})
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.NotFound, st.Code())
+	list, err := s.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, list.GetEntries())
+
+	// the name may be used again at once
+	created, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "vol",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: bytesInGiB},
+		Parameters:    map[string]string{KeyStoragePool: "pool"},
+	})
+	assert.NoError(t, err)
+	assert.NotEqual(t, id, created.GetVolume().GetId())
+
+	// importing the tombstone recovers the volume, renaming it
+	imported, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:       "recovered",
+		Parameters: map[string]string{KeyImportVolumeName: tombstone},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, id, imported.GetVolume().GetId())
+	assert.Equal(t, "recovered", fake.Volumes[id].Name)
+}
+
+func TestSweepTombstones(t *testing.T) {
+	s, fake := newFakeService()
+	old := fake.AddVolume("old", "pool", 8*kiBytesInGiB)
+	recent := fake.AddVolume("recent", "pool", 8*kiBytesInGiB)
+	mapped := fake.AddVolume("mapped", "pool", 8*kiBytesInGiB)
+	fake.AddVolume("live", "pool", 8*kiBytesInGiB)
+
+	now := time.Now()
+	for id, at := range map[string]time.Time{
+		old:    now.Add(-2 * time.Hour),
+		recent: now.Add(-time.Minute),
+		mapped: now.Add(-2 * time.Hour),
+	} {
+		assert.NoError(t, fake.SetVolumeName(
+			&siotypes.Volume{ID: id}, tombstoneName(id, at)))
+	}
+	sdcID := fake.AddSdc("SDC-1")
+	assert.NoError(t, fake.MapVolumeSdc(&siotypes.Volume{ID: mapped},
+		&siotypes.MapVolumeSdcParam{SdcID: sdcID}))
+
+	removed, err := s.sweepTombstones(time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{tombstoneName(old, now.Add(-2*time.Hour))},
+		removed)
+	assert.NotContains(t, fake.Volumes, old)
+	assert.Contains(t, fake.Volumes, recent)
+	assert.Contains(t, fake.Volumes, mapped)
+	assert.Len(t, fake.Volumes, 3)
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"golang.org/x/net/trace"
+)
+
+// tracedAdmin wraps a ScaleIOAdmin, recording the latency and failures of
+// each call in the metrics, logging each call if debug is set, and adding
+// each call to the trace of the request it is made for, if any.
+//
+// goscaleio builds its own HTTP client without exposing its transport, so
+// calls are traced at this interface rather than per HTTP request. Only
+// the IDs and names that identify what a call acts upon are logged, never
+// request or response bodies.
+type tracedAdmin struct {
+	ScaleIOAdmin
+	metrics *metrics
+	debug   bool
+
+	// ctx is the context of the request calls are made for, if known
+	ctx context.Context
+}
+
+// traceAdmin returns admin wrapped in a tracedAdmin, unless there is
+// nothing to record
+func (s *service) traceAdmin(admin ScaleIOAdmin) ScaleIOAdmin {
+	if s.metrics == nil && !s.opts.GatewayDebug && s.opts.TraceAddr == "" {
+		return admin
+	}
+	return &tracedAdmin{
+		ScaleIOAdmin: admin,
+		metrics:      s.metrics,
+		debug:        s.opts.GatewayDebug,
+	}
+}
+
+// observe records a call to op that started at start and failed with
+// *err, if not nil. It is deferred by each method.
+func (a *tracedAdmin) observe(
+	op string, start time.Time, err *error, fields log.Fields) {
+
+	d := time.Since(start)
+	a.metrics.observeGateway(op, d, *err)
+	if a.ctx != nil {
+		if tr, ok := trace.FromContext(a.ctx); ok {
+			traceGateway(tr, op, d, *err, fields)
+		}
+	}
+	if !a.debug {
+		return
+	}
+
+	l := log.WithFields(fields)
+	if a.ctx != nil {
+		l = l.WithFields(logFields(a.ctx, ""))
+	}
+	l = l.WithFields(log.Fields{
+		"operation": op,
+		"duration":  d,
+	})
+	if *err != nil {
+		l = l.WithError(*err)
+	}
+	l.Info("ScaleIO Gateway call")
+}
+
+func (a *tracedAdmin) withContext(ctx context.Context) ScaleIOAdmin {
+	return &tracedAdmin{
+		ScaleIOAdmin: adminContext(ctx, a.ScaleIOAdmin),
+		metrics:      a.metrics,
+		debug:        a.debug,
+		ctx:          ctx,
+	}
+}
+
+func (a *tracedAdmin) Authenticate(
+	configConnect *sio.ConfigConnect) (c sio.Cluster, err error) {
+
+	defer a.observe("Authenticate", time.Now(), &err, log.Fields{
+		"endpoint": configConnect.Endpoint,
+		"user":     configConnect.Username,
+	})
+	return a.ScaleIOAdmin.Authenticate(configConnect)
+}
+
+func (a *tracedAdmin) GetVersion() (version string, err error) {
+	defer a.observe("GetVersion", time.Now(), &err, nil)
+	return a.ScaleIOAdmin.GetVersion()
+}
+
+func (a *tracedAdmin) FindSystem(
+	instanceID, name, href string) (system *siotypes.System, err error) {
+
+	defer a.observe("FindSystem", time.Now(), &err, log.Fields{
+		"systemID":   instanceID,
+		"systemName": name,
+	})
+	return a.ScaleIOAdmin.FindSystem(instanceID, name, href)
+}
+
+func (a *tracedAdmin) GetSystemStatistics(
+	system *siotypes.System) (stats *siotypes.Statistics, err error) {
+
+	defer a.observe("GetSystemStatistics", time.Now(), &err, log.Fields{
+		"systemID": system.ID,
+	})
+	return a.ScaleIOAdmin.GetSystemStatistics(system)
+}
+
+func (a *tracedAdmin) FindSdc(
+	system *siotypes.System, field, value string) (
+	sdc *siotypes.Sdc, err error) {
+
+	defer a.observe("FindSdc", time.Now(), &err, log.Fields{
+		"systemID": system.ID,
+		field:      value,
+	})
+	return a.ScaleIOAdmin.FindSdc(system, field, value)
+}
+
+func (a *tracedAdmin) GetSdcs(
+	system *siotypes.System) (sdcs []siotypes.Sdc, err error) {
+
+	defer a.observe("GetSdcs", time.Now(), &err, log.Fields{
+		"systemID": system.ID,
+	})
+	return a.ScaleIOAdmin.GetSdcs(system)
+}
+
+func (a *tracedAdmin) GetSdcVolumes(
+	sdcID string) (vols []*siotypes.Volume, err error) {
+
+	defer a.observe("GetSdcVolumes", time.Now(), &err, log.Fields{
+		"sdcID": sdcID,
+	})
+	return a.ScaleIOAdmin.GetSdcVolumes(sdcID)
+}
+
+func (a *tracedAdmin) CreateVolume(
+	volume *siotypes.VolumeParam,
+	storagePoolName string) (rep *siotypes.VolumeResp, err error) {
+
+	defer a.observe("CreateVolume", time.Now(), &err, log.Fields{
+		"volumeName":  volume.Name,
+		"storagePool": storagePoolName,
+	})
+	return a.ScaleIOAdmin.CreateVolume(volume, storagePoolName)
+}
+
+func (a *tracedAdmin) GetVolume(
+	volumehref, volumeid, ancestorvolumeid, volumename string,
+	getSnapshots bool) (vols []*siotypes.Volume, err error) {
+
+	defer a.observe("GetVolume", time.Now(), &err, log.Fields{
+		"volumeID":   volumeid,
+		"volumeName": volumename,
+	})
+	return a.ScaleIOAdmin.GetVolume(
+		volumehref, volumeid, ancestorvolumeid, volumename, getSnapshots)
+}
+
+func (a *tracedAdmin) FindVolumeID(volumename string) (id string, err error) {
+	defer a.observe("FindVolumeID", time.Now(), &err, log.Fields{
+		"volumeName": volumename,
+	})
+	return a.ScaleIOAdmin.FindVolumeID(volumename)
+}
+
+func (a *tracedAdmin) RemoveVolume(
+	volume *siotypes.Volume, removeMode string) (err error) {
+
+	defer a.observe("RemoveVolume", time.Now(), &err, log.Fields{
+		"volumeID": volume.ID,
+	})
+	return a.ScaleIOAdmin.RemoveVolume(volume, removeMode)
+}
+
+func (a *tracedAdmin) MapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.MapVolumeSdcParam) (err error) {
+
+	defer a.observe("MapVolumeSdc", time.Now(), &err, log.Fields{
+		"volumeID": volume.ID,
+		"sdcID":    param.SdcID,
+	})
+	return a.ScaleIOAdmin.MapVolumeSdc(volume, param)
+}
+
+func (a *tracedAdmin) UnmapVolumeSdc(
+	volume *siotypes.Volume,
+	param *siotypes.UnmapVolumeSdcParam) (err error) {
+
+	defer a.observe("UnmapVolumeSdc", time.Now(), &err, log.Fields{
+		"volumeID": volume.ID,
+		"sdcID":    param.SdcID,
+	})
+	return a.ScaleIOAdmin.UnmapVolumeSdc(volume, param)
+}
+
+func (a *tracedAdmin) SetMappedSdcLimits(
+	volume *siotypes.Volume,
+	param *siotypes.SetMappedSdcLimitsParam) (err error) {
+
+	defer a.observe("SetMappedSdcLimits", time.Now(), &err, log.Fields{
+		"volumeID": volume.ID,
+		"sdcID":    param.SdcID,
+	})
+	return a.ScaleIOAdmin.SetMappedSdcLimits(volume, param)
+}
+
+func (a *tracedAdmin) SetVolumeName(
+	volume *siotypes.Volume, newName string) (err error) {
+
+	defer a.observe("SetVolumeName", time.Now(), &err, log.Fields{
+		"volumeID":   volume.ID,
+		"volumeName": newName,
+	})
+	return a.ScaleIOAdmin.SetVolumeName(volume, newName)
+}
+
+func (a *tracedAdmin) SetVolumeUseRmcache(
+	volume *siotypes.Volume, useRmcache bool) (err error) {
+
+	defer a.observe("SetVolumeUseRmcache", time.Now(), &err, log.Fields{
+		"volumeID": volume.ID,
+	})
+	return a.ScaleIOAdmin.SetVolumeUseRmcache(volume, useRmcache)
+}
+
+func (a *tracedAdmin) FindStoragePool(
+	id, name, href string) (pool *siotypes.StoragePool, err error) {
+
+	defer a.observe("FindStoragePool", time.Now(), &err, log.Fields{
+		"storagePoolID": id,
+		"storagePool":   name,
+	})
+	return a.ScaleIOAdmin.FindStoragePool(id, name, href)
+}
+
+func (a *tracedAdmin) SnapshotVolumes(
+	system *siotypes.System,
+	param *siotypes.SnapshotVolumesParam) (
+	resp *siotypes.SnapshotVolumesResp, err error) {
+
+	defer a.observe("SnapshotVolumes", time.Now(), &err, log.Fields{
+		"systemID":  system.ID,
+		"snapshots": len(param.SnapshotDefs),
+	})
+	return a.ScaleIOAdmin.SnapshotVolumes(system, param)
+}
+
+func (a *tracedAdmin) GetProtectionDomain(
+	id string) (pd *siotypes.ProtectionDomain, err error) {
+
+	defer a.observe("GetProtectionDomain", time.Now(), &err, log.Fields{
+		"protectionDomainID": id,
+	})
+	return a.ScaleIOAdmin.GetProtectionDomain(id)
+}
+
+func (a *tracedAdmin) GetStoragePools() (
+	pools []*siotypes.StoragePool, err error) {
+
+	defer a.observe("GetStoragePools", time.Now(), &err, nil)
+	return a.ScaleIOAdmin.GetStoragePools()
+}
+
+func (a *tracedAdmin) GetStoragePoolVolumes(
+	pool *siotypes.StoragePool) (vols []*siotypes.Volume, err error) {
+
+	defer a.observe("GetStoragePoolVolumes", time.Now(), &err, log.Fields{
+		"storagePoolID": pool.ID,
+	})
+	return a.ScaleIOAdmin.GetStoragePoolVolumes(pool)
+}
+
+func (a *tracedAdmin) GetStoragePoolStatistics(
+	pool *siotypes.StoragePool) (stats *siotypes.Statistics, err error) {
+
+	defer a.observe("GetStoragePoolStatistics", time.Now(), &err, log.Fields{
+		"storagePoolID": pool.ID,
+	})
+	return a.ScaleIOAdmin.GetStoragePoolStatistics(pool)
+}
+
+func (a *tracedAdmin) GetVolumeWriteBwc(
+	volume *siotypes.Volume) (bwc *siotypes.BWC, err error) {
+
+	defer a.observe("GetVolumeWriteBwc", time.Now(), &err, log.Fields{
+		"volumeID": volume.ID,
+	})
+	return a.ScaleIOAdmin.GetVolumeWriteBwc(volume)
+}
+
+func (a *tracedAdmin) GetVolumeBwcs(
+	volume *siotypes.Volume) (bwcs map[string]siotypes.BWC, err error) {
+
+	defer a.observe("GetVolumeBwcs", time.Now(), &err, log.Fields{
+		"volumeID": volume.ID,
+	})
+	return a.ScaleIOAdmin.GetVolumeBwcs(volume)
+}
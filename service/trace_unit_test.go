@@ -0,0 +1,63 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+var _ ScaleIOAdmin = &tracedAdmin{}
+
+func TestTraceAdmin(t *testing.T) {
+	fake := testutil.NewFakeAdmin("sys")
+	s := &service{}
+	assert.Equal(t, fake, s.traceAdmin(fake))
+
+	s.metrics = newMetrics()
+	s.opts.GatewayDebug = true
+	admin := s.traceAdmin(fake)
+
+	var buf bytes.Buffer
+	logger := log.StandardLogger()
+	defer func(out io.Writer) { logger.Out = out }(logger.Out)
+	logger.Out = &buf
+
+	_, err := admin.Authenticate(&sio.ConfigConnect{
+		Endpoint: "https://gw/api",
+		Username: "admin",
+		Password: "secret",
+	})
+	assert.NoError(t, err)
+	_, err = admin.GetVolume("", "0123456789abcdef", "", "", false)
+	assert.Error(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], "operation=Authenticate")
+		assert.Contains(t, lines[0], "user=admin")
+		assert.NotContains(t, lines[0], "secret")
+		assert.Contains(t, lines[1], "operation=GetVolume")
+		assert.Contains(t, lines[1], "volumeID=0123456789abcdef")
+		assert.Contains(t, lines[1], "error=")
+	}
+
+	assert.Equal(t, uint64(1), s.metrics.gatewayErrs["GetVolume"])
+	assert.Equal(t, uint64(1), s.metrics.gatewayLatency["Authenticate"].count)
+
+	// without debug, calls are only recorded
+	buf.Reset()
+	s.opts.GatewayDebug = false
+	_, err = s.traceAdmin(fake).FindSdc(
+		&siotypes.System{ID: "missing"}, "SdcGuid", "guid")
+	assert.Error(t, err)
+	assert.Empty(t, buf.String())
+	assert.Equal(t, uint64(1), s.metrics.gatewayErrs["FindSdc"])
+}
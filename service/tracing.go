@@ -0,0 +1,147 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The paths at which traces are served
+const (
+	tracesPath      = "/debug/requests"
+	traceEventsPath = "/debug/events"
+)
+
+// The metadata keys from which the trace of a CO's request is read, W3C
+// Trace Context's and Jaeger's
+const (
+	traceparentKey = "traceparent"
+	uberTraceIDKey = "uber-trace-id"
+)
+
+// traceInterceptor records a trace of each RPC, whose family is the RPC's
+// method, to which the gateway calls it makes are added. Only the volume
+// ID and the outcome are recorded, never parameters or secrets.
+func traceInterceptor(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	method := path.Base(info.FullMethod)
+	tr := trace.New("csi."+method, method)
+	defer tr.Finish()
+
+	if r, ok := req.(volumeIDer); ok && r.GetVolumeId() != "" {
+		tr.LazyPrintf("volumeID=%s", r.GetVolumeId())
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		setParentTrace(tr, md)
+	}
+
+	rep, err := handler(trace.NewContext(ctx, tr), req)
+	if err != nil {
+		st, _ := status.FromError(err)
+		tr.LazyPrintf("failed: %s: %s", st.Code(), st.Message())
+		tr.SetError()
+	}
+	return rep, err
+}
+
+// traceGateway adds a gateway call to op, that took d and failed with err,
+// if not nil, to tr. fields are the IDs and names the call acts upon.
+func traceGateway(
+	tr trace.Trace, op string, d time.Duration, err error, fields log.Fields) {
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]string, len(keys))
+	for i, k := range keys {
+		args[i] = fmt.Sprintf("%s=%v", k, fields[k])
+	}
+
+	if err != nil {
+		tr.LazyPrintf("gateway %s(%s) failed after %s: %s",
+			op, strings.Join(args, " "), d, err)
+		return
+	}
+	tr.LazyPrintf("gateway %s(%s) took %s", op, strings.Join(args, " "), d)
+}
+
+// setParentTrace records the trace of the CO's request, if its metadata
+// carries one, so the two can be matched
+func setParentTrace(tr trace.Trace, md metadata.MD) {
+	if v := md[traceparentKey]; len(v) > 0 {
+		// version-traceid-spanid-flags
+		if p := strings.Split(v[0], "-"); len(p) == 4 && len(p[1]) == 32 {
+			setTraceInfo(tr, traceparentKey, v[0], p[1][16:], p[2])
+		}
+		return
+	}
+	if v := md[uberTraceIDKey]; len(v) > 0 {
+		// traceid:spanid:parentid:flags
+		if p := strings.Split(v[0], ":"); len(p) == 4 {
+			id := p[0]
+			if len(id) > 16 {
+				id = id[len(id)-16:]
+			}
+			setTraceInfo(tr, uberTraceIDKey, v[0], id, p[1])
+		}
+	}
+}
+
+// setTraceInfo sets the trace and span IDs, in hex, of tr, recording the
+// header they were read from
+func setTraceInfo(tr trace.Trace, key, header, traceID, spanID string) {
+	t, err := strconv.ParseUint(traceID, 16, 64)
+	if err != nil {
+		return
+	}
+	sp, err := strconv.ParseUint(spanID, 16, 64)
+	if err != nil {
+		return
+	}
+	tr.SetTraceInfo(t, sp)
+	tr.LazyPrintf("%s=%s", key, header)
+}
+
+// serveTraces starts serving the traces on addr. The listener is created
+// before returning, so that an invalid address is reported immediately.
+// The traces record the IDs of volumes and the errors of the gateway, so
+// they are only served to requests from localhost, as x/net/trace does by
+// default.
+func serveTraces(addr string) (*http.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(tracesPath, trace.Traces)
+	mux.HandleFunc(traceEventsPath, trace.Events)
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("trace server failed")
+		}
+	}()
+	log.WithField("addr", lis.Addr().String()).Info("serving traces")
+
+	return srv, nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+// recordedTrace is a trace.Trace that keeps what is recorded
+type recordedTrace struct {
+	events          []string
+	traceID, spanID uint64
+	isError         bool
+}
+
+func (r *recordedTrace) LazyLog(x fmt.Stringer, sensitive bool) {
+	r.events = append(r.events, x.String())
+}
+
+func (r *recordedTrace) LazyPrintf(format string, a ...interface{}) {
+	r.events = append(r.events, fmt.Sprintf(format, a...))
+}
+
+func (r *recordedTrace) SetTraceInfo(traceID, spanID uint64) {
+	r.traceID, r.spanID = traceID, spanID
+}
+
+func (r *recordedTrace) SetError()                       { r.isError = true }
+func (r *recordedTrace) SetRecycler(f func(interface{})) {}
+func (r *recordedTrace) SetMaxEvents(m int)              {}
+func (r *recordedTrace) Finish()                         {}
+
+func TestSetParentTrace(t *testing.T) {
+	tr := &recordedTrace{}
+	setParentTrace(tr, metadata.Pairs(traceparentKey,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	assert.Equal(t, uint64(0xa3ce929d0e0e4736), tr.traceID)
+	assert.Equal(t, uint64(0x00f067aa0ba902b7), tr.spanID)
+	assert.Len(t, tr.events, 1)
+
+	tr = &recordedTrace{}
+	setParentTrace(tr, metadata.Pairs(uberTraceIDKey,
+		"4bf92f3577b34da6a3ce929d0e0e4736:00f067aa0ba902b7:0:1"))
+	assert.Equal(t, uint64(0xa3ce929d0e0e4736), tr.traceID)
+	assert.Equal(t, uint64(0x00f067aa0ba902b7), tr.spanID)
+
+	for _, md := range []metadata.MD{
+		metadata.Pairs(traceparentKey, "00-nothex-00f067aa0ba902b7-01"),
+		metadata.Pairs(uberTraceIDKey, "4bf92f3577b34da6"),
+		metadata.Pairs("other", "value"),
+	} {
+		tr = &recordedTrace{}
+		setParentTrace(tr, md)
+		assert.Zero(t, tr.traceID, "%v", md)
+		assert.Empty(t, tr.events, "%v", md)
+	}
+}
+
+func TestTraceInterceptor(t *testing.T) {
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	s := &service{}
+	s.opts.TraceAddr = "127.0.0.1:0"
+	s.adminClient = s.traceAdmin(fake)
+
+	info := &grpc.UnaryServerInfo{
+		FullMethod: "/csi.v0.Controller/ControllerPublishVolume",
+	}
+	req := &csi.ControllerPublishVolumeRequest{VolumeId: id}
+
+	// the request's trace is passed on to the handler, and gateway calls
+	// made for it are added to it
+	var tr *recordedTrace
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		itr, ok := trace.FromContext(ctx)
+		if !assert.True(t, ok) {
+			return nil, nil
+		}
+		tr = &recordedTrace{}
+		ctx = trace.NewContext(ctx, tr)
+		if _, err := s.getVolByID(ctx, id); err != nil {
+			return nil, err
+		}
+		_, err := s.getVolByID(ctx, "0123456789abcdef")
+		itr.LazyPrintf("handled")
+		return nil, err
+	}
+	_, err := traceInterceptor(context.Background(), req, info, handler)
+	assert.Error(t, err)
+	if assert.Len(t, tr.events, 2) {
+		assert.Contains(t, tr.events[0], "gateway GetVolume(volumeID="+id)
+		assert.Contains(t, tr.events[0], "took")
+		assert.Contains(t, tr.events[1], "failed after")
+	}
+
+	handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "volume not found")
+	}
+	_, err = traceInterceptor(context.Background(), req, info, handler)
+	st, _ := status.FromError(err)
+	assert.Equal(t, codes.NotFound, st.Code())
+}
+
+func TestTraceGateway(t *testing.T) {
+	tr := &recordedTrace{}
+	traceGateway(tr, "MapVolumeSdc", 0, nil,
+		map[string]interface{}{"volumeID": "v", "sdcID": "s"})
+	assert.Equal(t, []string{"gateway MapVolumeSdc(sdcID=s volumeID=v) took 0s"},
+		tr.events)
+
+	tr = &recordedTrace{}
+	traceGateway(tr, "GetVersion", 0, fmt.Errorf("down"), nil)
+	assert.Equal(t, []string{"gateway GetVersion() failed after 0s: down"},
+		tr.events)
+}
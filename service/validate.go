@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// getValidateOnly returns whether CreateVolume only checks params, failing
+// with InvalidArgument if that was asked for but isn't allowed
+func (s *service) getValidateOnly(params map[string]string) (bool, error) {
+	validateOnly, err := getBoolParam(params, KeyValidateOnly)
+	if err != nil {
+		return false, err
+	}
+	if validateOnly && !s.opts.AllowValidateOnly {
+		return false, status.Errorf(codes.InvalidArgument,
+			"`%s` is not allowed unless %s is set",
+			KeyValidateOnly, EnvAllowValidateOnly)
+	}
+	return validateOnly, nil
+}
+
+// validateCreate returns what CreateVolume would for a volume of sizeInKiB
+// named name in the storage pool sp, without creating it, failing as
+// creating it would. The volume returned has no ID. Failures only the
+// gateway's create endpoint reports, such as a pool without enough free
+// capacity when no capacity is reserved, can't be found this way.
+func (s *service) validateCreate(
+	ctx context.Context,
+	name, sp string,
+	sizeInKiB int64,
+	cr *csi.CapacityRange,
+	volType string,
+	params map[string]string,
+	limits *siotypes.SetMappedSdcLimitsParam) (
+	*csi.CreateVolumeResponse, error) {
+
+	pool, err := s.getStoragePool(sp)
+	if err != nil {
+		if isPoolNotFound(err) {
+			return nil, s.poolNotFoundErr(ctx, sp)
+		}
+		return nil, status.Errorf(codes.Internal,
+			"error when creating volume: %s", err.Error())
+	}
+
+	// a volume of the same name is returned by CreateVolume if it matches
+	id, err := s.findVolumeID(ctx, name)
+	if err != nil && !strings.EqualFold(err.Error(), sioGatewayNotFound) {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	vol := &siotypes.Volume{
+		Name:          name,
+		SizeInKb:      int(sizeInKiB),
+		StoragePoolID: pool.ID,
+		VolumeType:    volType,
+	}
+	if err == nil {
+		if vol, err = s.getVolByID(ctx, id); err != nil {
+			return nil, status.Errorf(codes.Unavailable,
+				"error retrieving volume details: %s", err.Error())
+		}
+		if err := checkExistingVolume(vol, pool, sizeInKiB, cr); err != nil {
+			return nil, err
+		}
+	}
+
+	reqLog(ctx, id).WithField("name", name).WithField(
+		"storagePool", sp).Info("validated volume parameters")
+
+	vi := getCSIVolume(vol)
+	vi.Id = ""
+	vi.Attributes = s.volumeAttributes(vol, pool, params, limits)
+	vi.Attributes[KeyValidateOnly] = "true"
+	return &csi.CreateVolumeResponse{Volume: vi}, nil
+}
+
+// checkExistingVolume returns AlreadyExists if vol, which already has the
+// name of a volume being created, isn't in pool or doesn't satisfy the
+// capacity range cr: it is smaller than sizeInKiB, the size the volume
+// would be created at, or larger than the range's limit
+func checkExistingVolume(
+	vol *siotypes.Volume,
+	pool *siotypes.StoragePool,
+	sizeInKiB int64,
+	cr *csi.CapacityRange) error {
+
+	if vol.StoragePoolID != pool.ID {
+		return status.Errorf(codes.AlreadyExists,
+			"volume exists, but in different storage pool than requested")
+	}
+	size := int64(vol.SizeInKb)
+	sizeB := kiBToBytes(size, log.Fields{"volumeID": vol.ID})
+	if size < sizeInKiB ||
+		(cr.GetLimitBytes() != 0 && sizeB > cr.GetLimitBytes()) {
+		return status.Errorf(codes.AlreadyExists,
+			"volume exists, but its size of %d bytes is outside of the "+
+				"capacity range requested", sizeB)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateOnly(t *testing.T) {
+	ctx := context.Background()
+	s, fake := newFakeService()
+	fake.AddStoragePool("other", 100*kiBytesInGiB)
+	fake.AddVolume("existing", "pool", 8*kiBytesInGiB)
+	fake.Calls["CreateVolume"] = 0
+
+	validate := func(name string, gib int64, params map[string]string) (
+		*csi.CreateVolumeResponse, codes.Code) {
+
+		p := map[string]string{
+			KeyStoragePool:  "pool",
+			KeyValidateOnly: "true",
+		}
+		for k, v := range params {
+			p[k] = v
+		}
+		resp, err := s.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: gib * kiBytesInGiB * bytesInKiB,
+			},
+			Parameters: p,
+		})
+		st, _ := status.FromError(err)
+		return resp, st.Code()
+	}
+
+	// ordinary users can't validate
+	_, code := validate("vol", 8, nil)
+	assert.Equal(t, codes.InvalidArgument, code)
+
+	s.opts.AllowValidateOnly = true
+	resp, code := validate("vol", 8, map[string]string{
+		KeyIOPSLimit: "100",
+		KeyRAMCache:  "false",
+	})
+	if !assert.Equal(t, codes.OK, code) {
+		return
+	}
+	vol := resp.GetVolume()
+	assert.Empty(t, vol.GetId())
+	assert.Equal(t, int64(8*bytesInGiB), vol.GetCapacityBytes())
+	assert.Equal(t, "true", vol.GetAttributes()[KeyValidateOnly])
+	assert.Equal(t, "pool", vol.GetAttributes()[KeyStoragePoolName])
+	assert.Equal(t, "100", vol.GetAttributes()[KeyIOPSLimit])
+	assert.Equal(t, "false", vol.GetAttributes()[KeyRAMCache])
+	assert.Equal(t, 0, fake.Calls["CreateVolume"])
+	assert.Equal(t, 0, fake.Calls["SetVolumeUseRmcache"])
+
+	// failures have the codes creating the volume would
+	for _, tc := range []struct {
+		name   string
+		gib    int64
+		params map[string]string
+		code   codes.Code
+	}{
+		{"vol", 8, map[string]string{KeyStoragePool: "poool"},
+			codes.InvalidArgument},
+		{"vol", 8, map[string]string{KeyIOPSLimit: "5"},
+			codes.InvalidArgument},
+		{"vol", 8, map[string]string{KeyValidateOnly: "maybe"},
+			codes.InvalidArgument},
+		{strings.Repeat("v", maxVolumeNameLength+1), 8, nil, codes.OK},
+		{"vol", 8, map[string]string{KeyImportVolumeName: "vol"},
+			codes.InvalidArgument},
+		{"existing", 16, nil, codes.AlreadyExists},
+		{"existing", 8, map[string]string{KeyStoragePool: "other"},
+			codes.AlreadyExists},
+		{"existing", 8, nil, codes.OK},
+	} {
+		_, code := validate(tc.name, tc.gib, tc.params)
+		assert.Equal(t, tc.code, code, "%s %v", tc.name, tc.params)
+	}
+
+	// even a volume of the same name is returned without an ID
+	resp, _ = validate("existing", 8, nil)
+	assert.Empty(t, resp.GetVolume().GetId())
+	assert.Equal(t, 0, fake.Calls["CreateVolume"])
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// volumeStateDir is the directory, within the private mount directory,
+// holding the state recorded for each volume published on the node
+const volumeStateDir = ".state"
+
+// volumeState is what the node records of a volume it publishes, so that
+// unpublishing it doesn't depend on the SDC still giving it the same
+// device, which changes when the SDC restarts
+type volumeState struct {
+	// Device is the block device the volume was mounted from, as the
+	// mount table names it
+	Device string `json:"device"`
+
+	// Targets are the target paths the volume is published to
+	Targets []string `json:"targets"`
+}
+
+// volumeStates reads and writes the state of volumes, kept as a file per
+// volume within a private mount directory so that it survives restarts of
+// the plug-in
+type volumeStates struct {
+	sync.Mutex
+}
+
+// volumeStatePath returns the path of the state file of the volume id,
+// within the private mount directory privDir
+func volumeStatePath(privDir, id string) string {
+	return filepath.Join(privDir, volumeStateDir, id+".json")
+}
+
+// get returns the state of the volume id, or nil if none is recorded or it
+// can't be read
+func (v *volumeStates) get(
+	ctx context.Context, privDir, id string) *volumeState {
+
+	v.Lock()
+	defer v.Unlock()
+	return v.read(ctx, privDir, id)
+}
+
+// read must be called with the lock held
+func (v *volumeStates) read(
+	ctx context.Context, privDir, id string) *volumeState {
+
+	if privDir == "" || id == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(volumeStatePath(privDir, id))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			reqLog(ctx, id).WithError(err).Warn(
+				"unable to read volume state")
+		}
+		return nil
+	}
+	st := &volumeState{}
+	if err := json.Unmarshal(buf, st); err != nil {
+		reqLog(ctx, id).WithError(err).Warn("ignoring invalid volume state")
+		return nil
+	}
+	return st
+}
+
+// addTarget records that the volume id is published to target from
+// device. Failing to record it is only logged, as unpublishing falls back
+// to the device the SDC gives the volume.
+func (v *volumeStates) addTarget(
+	ctx context.Context, privDir, id, device, target string) {
+
+	v.Lock()
+	defer v.Unlock()
+	st := v.read(ctx, privDir, id)
+	if st == nil {
+		st = &volumeState{}
+	}
+	if st.Device == device && contains(st.Targets, target) {
+		return
+	}
+	st.Device = device
+	if !contains(st.Targets, target) {
+		st.Targets = append(st.Targets, target)
+	}
+	v.write(ctx, privDir, id, st)
+}
+
+// removeTarget records that the volume id is no longer published to
+// target, removing its state once it is published to no target
+func (v *volumeStates) removeTarget(
+	ctx context.Context, privDir, id, target string) {
+
+	v.Lock()
+	defer v.Unlock()
+	st := v.read(ctx, privDir, id)
+	if st == nil {
+		return
+	}
+	targets := st.Targets[:0]
+	for _, t := range st.Targets {
+		if t != target {
+			targets = append(targets, t)
+		}
+	}
+	st.Targets = targets
+	if len(st.Targets) > 0 {
+		v.write(ctx, privDir, id, st)
+		return
+	}
+	err := os.Remove(volumeStatePath(privDir, id))
+	if err != nil && !os.IsNotExist(err) {
+		reqLog(ctx, id).WithError(err).Warn("unable to remove volume state")
+	}
+}
+
+// write replaces the state of the volume id, through a temporary file so
+// that a crash never leaves it half written. Must be called with the lock
+// held.
+func (v *volumeStates) write(
+	ctx context.Context, privDir, id string, st *volumeState) {
+
+	if privDir == "" || id == "" {
+		return
+	}
+	path := volumeStatePath(privDir, id)
+	l := reqLog(ctx, id).WithFields(log.Fields{
+		"device":  st.Device,
+		"targets": st.Targets,
+	})
+	buf, err := json.Marshal(st)
+	if err != nil {
+		l.WithError(err).Warn("unable to record volume state")
+		return
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		l.WithError(err).Warn("unable to record volume state")
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".tmp")
+	if err != nil {
+		l.WithError(err).Warn("unable to record volume state")
+		return
+	}
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		l.WithError(err).Warn("unable to record volume state")
+		return
+	}
+	l.Debug("recorded volume state")
+}
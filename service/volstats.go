@@ -0,0 +1,221 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// volumeStatsPrefix and volumeStatsSuffix enclose the CSI volume ID
+	// in the path the statistics of a volume are served at
+	volumeStatsPrefix = "/volumes/"
+	volumeStatsSuffix = "/statistics"
+)
+
+// volumeStats is the response of the volume statistics endpoint. The rates
+// are averaged over the window the gateway reports them for. Latencies are
+// only given if the gateway reports them, which older versions don't.
+type volumeStats struct {
+	VolumeID          string   `json:"volumeId"`
+	ScaleIOVolumeID   string   `json:"scaleioVolumeId"`
+	WindowSeconds     int      `json:"windowSeconds"`
+	ReadIOPS          float64  `json:"readIops"`
+	WriteIOPS         float64  `json:"writeIops"`
+	ReadKiBPerSecond  float64  `json:"readKiBPerSecond"`
+	WriteKiBPerSecond float64  `json:"writeKiBPerSecond"`
+	ReadLatencyUsec   *float64 `json:"readLatencyUsec,omitempty"`
+	WriteLatencyUsec  *float64 `json:"writeLatencyUsec,omitempty"`
+}
+
+// statsError is the body of a failed volume statistics request
+type statsError struct {
+	Error string `json:"error"`
+}
+
+// newVolumeStats returns the statistics of the volume, given the
+// bandwidth counters the gateway reports for it
+func newVolumeStats(
+	volID, sioID string, bwcs map[string]siotypes.BWC) volumeStats {
+
+	read, write := bwcs["userDataReadBwc"], bwcs["userDataWriteBwc"]
+	stats := volumeStats{
+		VolumeID:        volID,
+		ScaleIOVolumeID: sioID,
+		WindowSeconds:   write.NumSeconds,
+	}
+	if read.NumSeconds > 0 {
+		stats.ReadIOPS = float64(read.NumOccured) / float64(read.NumSeconds)
+		stats.ReadKiBPerSecond =
+			float64(read.TotalWeightInKb) / float64(read.NumSeconds)
+	}
+	if write.NumSeconds > 0 {
+		stats.WriteIOPS = float64(write.NumOccured) / float64(write.NumSeconds)
+		stats.WriteKiBPerSecond =
+			float64(write.TotalWeightInKb) / float64(write.NumSeconds)
+	}
+
+	// the weights of the latency counters are in microseconds
+	latency := func(name string) *float64 {
+		bwc, ok := bwcs[name]
+		if !ok {
+			return nil
+		}
+		var usec float64
+		if bwc.NumOccured > 0 {
+			usec = float64(bwc.TotalWeightInKb) / float64(bwc.NumOccured)
+		}
+		return &usec
+	}
+	stats.ReadLatencyUsec = latency("userDataSdcReadLatency")
+	stats.WriteLatencyUsec = latency("userDataSdcWriteLatency")
+	return stats
+}
+
+// volumeStatsHandler serves the statistics of volumes, by CSI volume ID,
+// to callers presenting the token as a bearer token
+type volumeStatsHandler struct {
+	s     *service
+	token string
+
+	// mu serializes the requests made to the gateway, so that a
+	// monitoring system polling many volumes adds a single request at a
+	// time to those of the CO
+	mu sync.Mutex
+}
+
+func (h *volumeStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeStatsError(w, http.StatusMethodNotAllowed,
+			errors.New("only GET is allowed"))
+		return
+	}
+	if !bearerAuthorized(r, h.token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeStatsError(w, http.StatusUnauthorized,
+			errors.New("missing or invalid bearer token"))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, volumeStatsPrefix) ||
+		!strings.HasSuffix(r.URL.Path, volumeStatsSuffix) {
+		writeStatsError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	volID := strings.TrimSuffix(
+		strings.TrimPrefix(r.URL.Path, volumeStatsPrefix), volumeStatsSuffix)
+	if volID == "" || strings.Contains(volID, "/") {
+		writeStatsError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	stats, err := h.volumeStats(volID)
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// bearerAuthorized returns whether r carries token as its bearer token,
+// compared in constant time
+func bearerAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare(
+		[]byte(auth[len(prefix):]), []byte(token)) == 1
+}
+
+// volumeStats returns the statistics of the volume with the CSI volume ID
+// volID. It fails with Unavailable until the controller has probed, so
+// that it never logs in to the gateway on its own.
+func (h *volumeStatsHandler) volumeStats(volID string) (volumeStats, error) {
+	s := h.s
+	if !s.controllerProbed() {
+		return volumeStats{}, status.Error(codes.Unavailable,
+			"controller service not probed")
+	}
+	id, err := s.volumeID(volID)
+	if err != nil {
+		return volumeStats{}, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.metrics.gatewayCall("GetVolumeStatistics")
+	bwcs, err := s.adminClient.GetVolumeBwcs(&siotypes.Volume{ID: id})
+	if err != nil {
+		if strings.EqualFold(err.Error(), sioGatewayVolumeNotFound) {
+			return volumeStats{}, status.Errorf(codes.NotFound,
+				"volume %s not found", volID)
+		}
+		return volumeStats{}, status.Errorf(codes.Internal,
+			"unable to get statistics of volume %s: %s", volID, err.Error())
+	}
+	return newVolumeStats(volID, id, bwcs), nil
+}
+
+// writeStatusError writes err, a gRPC status if the gateway wasn't at
+// fault, with the HTTP status code matching its code
+func writeStatusError(w http.ResponseWriter, err error) {
+	code := http.StatusBadGateway
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.InvalidArgument:
+			code = http.StatusBadRequest
+		case codes.NotFound:
+			code = http.StatusNotFound
+		case codes.AlreadyExists:
+			code = http.StatusConflict
+		case codes.Unavailable:
+			code = http.StatusServiceUnavailable
+		}
+		err = errors.New(st.Message())
+	}
+	writeStatsError(w, code, err)
+}
+
+func writeStatsError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statsError{Error: err.Error()})
+}
+
+// serveVolumeStats starts serving the statistics of volumes on addr
+func (s *service) serveVolumeStats(addr, token string) (*http.Server, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(volumeStatsPrefix, &volumeStatsHandler{s: s, token: token})
+	if s.opts.SnapshotGroups {
+		sgh := &snapshotGroupsHandler{s: s, token: token}
+		mux.Handle(snapshotGroupsPath, sgh)
+		mux.Handle(snapshotGroupsPath+"/", sgh)
+	}
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("volume statistics server failed")
+		}
+	}()
+	log.WithField("addr", lis.Addr().String()).Info(
+		"serving volume statistics")
+
+	return srv, nil
+}
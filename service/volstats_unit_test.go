@@ -0,0 +1,120 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+func TestVolumeStats(t *testing.T) {
+	s, fake := newFakeService()
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	fake.WriteBwc[id] = &siotypes.BWC{
+		TotalWeightInKb: 500, NumOccured: 50, NumSeconds: 5}
+	fake.VolumeBwcs[id] = map[string]siotypes.BWC{
+		"userDataReadBwc":         {TotalWeightInKb: 1000, NumOccured: 200, NumSeconds: 5},
+		"userDataSdcReadLatency":  {TotalWeightInKb: 40000, NumOccured: 200},
+		"userDataSdcWriteLatency": {},
+	}
+
+	srv := httptest.NewServer(&volumeStatsHandler{s: s, token: "secret"})
+	defer srv.Close()
+	get := func(path, token string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		assert.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rep, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer rep.Body.Close()
+		body := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(rep.Body).Decode(&body))
+		return rep.StatusCode, body
+	}
+	path := volumeStatsPrefix + id + volumeStatsSuffix
+
+	code, body := get(path, "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"volumeId":          id,
+		"scaleioVolumeId":   id,
+		"windowSeconds":     5.0,
+		"readIops":          40.0,
+		"writeIops":         10.0,
+		"readKiBPerSecond":  200.0,
+		"writeKiBPerSecond": 100.0,
+		"readLatencyUsec":   200.0,
+		"writeLatencyUsec":  0.0,
+	}, body)
+
+	// composite handles are accepted too
+	system := s.currentSystem()
+	code, body = get(volumeStatsPrefix+system.ID+"-"+id+volumeStatsSuffix,
+		"secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, id, body["scaleioVolumeId"])
+
+	calls := fake.Calls["GetVolumeBwcs"]
+	for _, token := range []string{"", "wrong", "secret2"} {
+		code, _ = get(path, token)
+		assert.Equal(t, http.StatusUnauthorized, code, token)
+	}
+	code, _ = get(volumeStatsPrefix+"bad!id"+volumeStatsSuffix, "secret")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get(volumeStatsPrefix+id, "secret")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, calls, fake.Calls["GetVolumeBwcs"])
+
+	code, _ = get(volumeStatsPrefix+"123"+volumeStatsSuffix, "secret")
+	assert.Equal(t, http.StatusNotFound, code)
+	fake.Errors["GetVolumeBwcs"] = errors.New("gateway down")
+	code, body = get(path, "secret")
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Contains(t, body["error"], "gateway down")
+	delete(fake.Errors, "GetVolumeBwcs")
+
+	// nothing is served before the controller has probed
+	s.system = nil
+	calls = fake.Calls["GetVolumeBwcs"]
+	code, _ = get(path, "secret")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, calls, fake.Calls["GetVolumeBwcs"])
+}
+
+func TestGetVolumeBwcs(t *testing.T) {
+	fake := testutil.NewFakeAdmin("sys")
+	fake.AddStoragePool("pool", 100*kiBytesInGiB)
+	id := fake.AddVolume("vol", "pool", 8*kiBytesInGiB)
+	read := siotypes.BWC{TotalWeightInKb: 1000, NumOccured: 200, NumSeconds: 5}
+	fake.VolumeBwcs[id] = map[string]siotypes.BWC{"userDataReadBwc": read}
+	gw := testutil.NewFakeGateway(fake, "admin", "password")
+	defer gw.Close()
+
+	a, err := newSIOAdmin(gw.Endpoint(), true)
+	assert.NoError(t, err)
+	_, err = a.Authenticate(&sio.ConfigConnect{
+		Endpoint: gw.Endpoint(),
+		Username: "admin",
+		Password: "password",
+	})
+	assert.NoError(t, err)
+
+	// counts among the statistics are left out
+	bwcs, err := a.GetVolumeBwcs(&siotypes.Volume{ID: id})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]siotypes.BWC{
+		"userDataReadBwc":  read,
+		"userDataWriteBwc": {},
+	}, bwcs)
+}
@@ -0,0 +1,178 @@
+//go:build integration
+// +build integration
+
+// Package e2e runs the plug-in's volume lifecycle against a real ScaleIO
+// Gateway, serving its controller and node services in-process. The node
+// service stands in for the SDC named by X_CSI_SCALEIO_SDCGUID, with a fake
+// mounter, so that the tests need no SDC on the host running them.
+//
+// The gateway is configured by the plug-in's own environment variables,
+// and the tests are skipped unless X_CSI_SCALEIO_ENDPOINT, _USER, _PASSWORD,
+// _SYSTEMNAME, _STORAGE_POOL, and _SDCGUID are all set.
+package e2e
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"google.golang.org/grpc"
+
+	"github.com/thecodeteam/csi-scaleio/provider"
+	"github.com/thecodeteam/csi-scaleio/service"
+)
+
+const (
+	// deviceDelay is how long the fake SDC takes to list a volume once it
+	// is mapped, which NodePublishVolume must wait out
+	deviceDelay = 2 * time.Second
+
+	// rpcBudget is how long each RPC may take, generous enough for a busy
+	// gateway, but short enough to catch one stuck retrying
+	rpcBudget = 30 * time.Second
+)
+
+func TestVolumeLifecycle(t *testing.T) {
+	cfg := loadConfig(t)
+	gw := newGateway(t, cfg)
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "csi-scaleio-e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv(service.EnvPrivateMountDir, filepath.Join(dir, "priv"))
+	defer os.Unsetenv(service.EnvPrivateMountDir)
+
+	dev := filepath.Join(dir, "scini")
+	if err := ioutil.WriteFile(dev, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	svc := service.NewWithNodeHost(service.NodeHost{
+		Mounter:      newFakeMounter(),
+		LocalVolumes: localVolumes(gw, deviceDelay),
+		SDCLoaded:    func() bool { return true },
+		SDCDevice:    dev,
+	})
+	sp := provider.NewWithService(svc)
+
+	sock := filepath.Join(dir, "csi.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sp.Serve(ctx, lis)
+	defer sp.GracefulStop(ctx)
+
+	conn, err := grpc.DialContext(ctx, sock, grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, d time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, d)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	controller := csi.NewControllerClient(conn)
+	node := csi.NewNodeClient(conn)
+
+	name := uniqueName(t)
+	defer gw.removeVolume(t, name)
+
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "ext4"},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+
+	var nodeID string
+	timed(t, "NodeGetId", rpcBudget, func() error {
+		rep, err := node.NodeGetId(ctx, &csi.NodeGetIdRequest{})
+		nodeID = rep.GetNodeId()
+		return err
+	})
+
+	var vol *csi.Volume
+	timed(t, "CreateVolume", rpcBudget, func() error {
+		rep, err := controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			CapacityRange: &csi.CapacityRange{
+				RequiredBytes: 8 * 1024 * 1024 * 1024,
+			},
+			VolumeCapabilities: []*csi.VolumeCapability{volCap},
+			Parameters: map[string]string{
+				"storagepool": cfg.storagePool,
+			},
+		})
+		vol = rep.GetVolume()
+		return err
+	})
+
+	var publishInfo map[string]string
+	timed(t, "ControllerPublishVolume", rpcBudget, func() error {
+		rep, err := controller.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId:         vol.Id,
+				NodeId:           nodeID,
+				VolumeCapability: volCap,
+			})
+		publishInfo = rep.GetPublishInfo()
+		return err
+	})
+
+	// the volume's device appears after it was mapped, which publishing
+	// must wait for rather than fail
+	target := filepath.Join(dir, "target")
+	took := timed(t, "NodePublishVolume", rpcBudget, func() error {
+		_, err := node.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:         vol.Id,
+			PublishInfo:      publishInfo,
+			TargetPath:       target,
+			VolumeCapability: volCap,
+			VolumeAttributes: vol.Attributes,
+		})
+		return err
+	})
+	if took < deviceDelay {
+		t.Errorf("NodePublishVolume took %s, before the device appeared "+
+			"after %s", took, deviceDelay)
+	}
+
+	timed(t, "NodeUnpublishVolume", rpcBudget, func() error {
+		_, err := node.NodeUnpublishVolume(ctx,
+			&csi.NodeUnpublishVolumeRequest{
+				VolumeId:   vol.Id,
+				TargetPath: target,
+			})
+		return err
+	})
+
+	timed(t, "ControllerUnpublishVolume", rpcBudget, func() error {
+		_, err := controller.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{
+				VolumeId: vol.Id,
+				NodeId:   nodeID,
+			})
+		return err
+	})
+
+	timed(t, "DeleteVolume", rpcBudget, func() error {
+		_, err := controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+			VolumeId: vol.Id,
+		})
+		return err
+	})
+
+	if id := gw.volumeID(t, name); id != "" {
+		t.Errorf("volume %s (%s) still exists after DeleteVolume", name, id)
+	}
+}
@@ -0,0 +1,339 @@
+//go:build integration
+// +build integration
+
+package e2e
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/akutz/gofsutil"
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+
+	"github.com/thecodeteam/csi-scaleio/service"
+)
+
+// diskIDDir is where the fake SDC's volumes appear to be linked
+const diskIDDir = "/dev/disk/by-id"
+
+// config is the gateway the tests run against, read from the environment
+// variables that configure the plug-in itself
+type config struct {
+	endpoint    string
+	user        string
+	password    string
+	systemName  string
+	storagePool string
+	sdcGUID     string
+	insecure    bool
+}
+
+// loadConfig returns the gateway to test against, skipping the test if
+// it isn't fully configured
+func loadConfig(t *testing.T) config {
+	cfg := config{
+		endpoint:    os.Getenv(service.EnvEndpoint),
+		user:        os.Getenv(service.EnvUser),
+		password:    os.Getenv(service.EnvPassword),
+		systemName:  os.Getenv(service.EnvSystemName),
+		storagePool: os.Getenv(service.EnvStoragePool),
+		sdcGUID:     os.Getenv(service.EnvSDCGUID),
+	}
+	var missing []string
+	for env, v := range map[string]string{
+		service.EnvEndpoint:    cfg.endpoint,
+		service.EnvUser:        cfg.user,
+		service.EnvPassword:    cfg.password,
+		service.EnvSystemName:  cfg.systemName,
+		service.EnvStoragePool: cfg.storagePool,
+		service.EnvSDCGUID:     cfg.sdcGUID,
+	} {
+		if v == "" {
+			missing = append(missing, env)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		t.Skipf("no gateway to test against: %s not set",
+			strings.Join(missing, ", "))
+	}
+	cfg.insecure, _ = strconv.ParseBool(os.Getenv(service.EnvInsecure))
+	return cfg
+}
+
+// gateway is the gateway the tests run against, reached independently of
+// the plug-in to inspect and clean up after it
+type gateway struct {
+	service.ScaleIOAdmin
+	system *siotypes.System
+	sdc    *siotypes.Sdc
+}
+
+// newGateway logs in to the gateway of cfg, and finds its system and the
+// SDC the node service stands in for
+func newGateway(t *testing.T, cfg config) *gateway {
+	admin, err := service.NewScaleIOAdmin(cfg.endpoint, cfg.insecure)
+	if err != nil {
+		t.Fatalf("unable to create gateway client: %v", err)
+	}
+	if _, err := admin.Authenticate(&sio.ConfigConnect{
+		Endpoint: cfg.endpoint,
+		Username: cfg.user,
+		Password: cfg.password,
+	}); err != nil {
+		t.Fatalf("unable to log in to gateway: %v", err)
+	}
+	system, err := admin.FindSystem("", cfg.systemName, "")
+	if err != nil {
+		t.Fatalf("unable to find system %s: %v", cfg.systemName, err)
+	}
+	sdc, err := admin.FindSdc(system, "SdcGuid", cfg.sdcGUID)
+	if err != nil {
+		t.Fatalf("unable to find SDC %s: %v", cfg.sdcGUID, err)
+	}
+	return &gateway{ScaleIOAdmin: admin, system: system, sdc: sdc}
+}
+
+// volumeID returns the ID of the named volume, or an empty string if there
+// is none
+func (g *gateway) volumeID(t *testing.T, name string) string {
+	vols, err := g.GetVolume("", "", "", "", false)
+	if err != nil {
+		t.Errorf("unable to list volumes: %v", err)
+		return ""
+	}
+	for _, v := range vols {
+		if v.Name == name {
+			return v.ID
+		}
+	}
+	return ""
+}
+
+// removeVolume removes the named volume, if it exists, unmapping it from
+// every SDC first, so that a failed test leaves nothing behind
+func (g *gateway) removeVolume(t *testing.T, name string) {
+	id := g.volumeID(t, name)
+	if id == "" {
+		return
+	}
+	vol := &siotypes.Volume{ID: id}
+	if err := g.UnmapVolumeSdc(vol, &siotypes.UnmapVolumeSdcParam{
+		AllSdcs: "true",
+	}); err != nil {
+		t.Logf("unable to unmap volume %s (%s): %v", name, id, err)
+	}
+	if err := g.RemoveVolume(vol, "ONLY_ME"); err != nil {
+		t.Errorf("unable to remove volume %s (%s), remove it by hand: %v",
+			name, id, err)
+		return
+	}
+	t.Logf("removed volume %s (%s) left behind", name, id)
+}
+
+// uniqueName returns a volume name no other run uses, short enough that
+// ScaleIO accepts it unchanged, so that it can be cleaned up by name
+func uniqueName(t *testing.T) string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return "csi-e2e-" + hex.EncodeToString(b)
+}
+
+// timed calls f, failing the test if it fails or takes longer than max,
+// and returns how long it took
+func timed(
+	t *testing.T, op string, max time.Duration, f func() error) time.Duration {
+
+	start := time.Now()
+	err := f()
+	took := time.Since(start)
+	if err != nil {
+		t.Fatalf("%s failed after %s: %v", op, took, err)
+	}
+	if took > max {
+		t.Fatalf("%s took %s, longer than %s", op, took, max)
+	}
+	t.Logf("%s took %s", op, took)
+	return took
+}
+
+// localVolumes returns the volumes the gateway has mapped to the SDC, as
+// the local SDC would list them. Each is only listed delay after it was
+// first found mapped, as the SDC's devices appear some time after the
+// gateway maps their volumes.
+func localVolumes(
+	g *gateway, delay time.Duration) func() ([]*sio.SdcMappedVolume, error) {
+
+	var (
+		mu   sync.Mutex
+		seen = map[string]time.Time{}
+	)
+	return func() ([]*sio.SdcMappedVolume, error) {
+		vols, err := g.GetSdcVolumes(g.sdc.ID)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		var mapped []*sio.SdcMappedVolume
+		for _, v := range vols {
+			first, ok := seen[v.ID]
+			if !ok {
+				seen[v.ID] = time.Now()
+				continue
+			}
+			if time.Since(first) < delay {
+				continue
+			}
+			mapped = append(mapped, &sio.SdcMappedVolume{
+				MdmID:     g.system.ID,
+				VolumeID:  v.ID,
+				SdcDevice: path.Join(diskIDDir, "emc-vol-"+v.ID),
+			})
+		}
+		return mapped, nil
+	}
+}
+
+// fakeMounter implements service.Mounter without touching the host. The
+// devices of all volumes exist, and filesystems are only recorded.
+type fakeMounter struct {
+	sync.Mutex
+	formats map[string]string
+	mounts  []gofsutil.Info
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{formats: map[string]string{}}
+}
+
+func (m *fakeMounter) GetDevice(p string) (*service.Device, error) {
+	if path.Dir(p) != diskIDDir {
+		return nil, errors.New(p + " is not a block device")
+	}
+	name := path.Base(p)
+	return &service.Device{
+		FullPath: p,
+		Name:     name,
+		RealDev:  "/dev/scini-" + name[strings.LastIndex(name, "-")+1:],
+	}, nil
+}
+
+func (m *fakeMounter) GetMounts(ctx context.Context) ([]gofsutil.Info, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]gofsutil.Info(nil), m.mounts...), nil
+}
+
+func (m *fakeMounter) GetDiskFormat(
+	ctx context.Context, disk string) (string, error) {
+
+	m.Lock()
+	defer m.Unlock()
+	return m.formats[disk], nil
+}
+
+func (m *fakeMounter) Mount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	return m.mount(source, target, opts)
+}
+
+// mount must be called with the lock held
+func (m *fakeMounter) mount(source, target string, opts []string) error {
+	if m.formats[source] == "" {
+		return errors.New("unformatted device: " + source)
+	}
+	dev, err := m.GetDevice(source)
+	if err != nil {
+		return err
+	}
+	m.mounts = append(m.mounts, gofsutil.Info{
+		Device: dev.RealDev,
+		Path:   target,
+		Type:   m.formats[source],
+		Opts:   opts,
+	})
+	return nil
+}
+
+func (m *fakeMounter) BindMount(
+	ctx context.Context, source, target string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	if dev, err := m.GetDevice(source); err == nil {
+		m.mounts = append(m.mounts, gofsutil.Info{
+			Device: "devtmpfs",
+			Source: dev.RealDev,
+			Path:   target,
+			Opts:   opts,
+		})
+		return nil
+	}
+	for _, mnt := range m.mounts {
+		if mnt.Path == source {
+			mnt.Path = target
+			mnt.Opts = opts
+			m.mounts = append(m.mounts, mnt)
+			return nil
+		}
+	}
+	return errors.New("nothing mounted at " + source)
+}
+
+func (m *fakeMounter) FormatAndMount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	if m.formats[source] == "" {
+		if fsType == "" {
+			fsType = "ext4"
+		}
+		m.formats[source] = fsType
+	}
+	return m.mount(source, target, opts)
+}
+
+func (m *fakeMounter) Format(
+	ctx context.Context, source, fsType string, mkfsOpts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	m.formats[source] = fsType
+	return nil
+}
+
+func (m *fakeMounter) Unmount(ctx context.Context, target string) error {
+	m.Lock()
+	defer m.Unlock()
+	for i, mnt := range m.mounts {
+		if mnt.Path == target {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not mounted: " + target)
+}
+
+func (m *fakeMounter) ResizeFS(
+	ctx context.Context, devicePath, mountPath, fsType string) error {
+
+	return nil
+}
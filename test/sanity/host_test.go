@@ -0,0 +1,182 @@
+package sanity
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/akutz/gofsutil"
+	sio "github.com/thecodeteam/goscaleio"
+
+	"github.com/thecodeteam/csi-scaleio/service"
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+// diskIDDir is where the fake SDC's volumes appear to be linked
+const diskIDDir = "/dev/disk/by-id"
+
+// localVolumes returns the volumes mapped to the SDC sdcID of admin, as
+// the local SDC would find them
+func localVolumes(
+	admin *testutil.FakeAdmin,
+	sdcID string) func() ([]*sio.SdcMappedVolume, error) {
+
+	return func() ([]*sio.SdcMappedVolume, error) {
+		vols, err := admin.GetSdcVolumes(sdcID)
+		if err != nil {
+			return nil, err
+		}
+		mapped := make([]*sio.SdcMappedVolume, len(vols))
+		for i, v := range vols {
+			mapped[i] = &sio.SdcMappedVolume{
+				MdmID:    "mdm",
+				VolumeID: v.ID,
+				SdcDevice: path.Join(diskIDDir,
+					"emc-vol-mdm-"+v.ID),
+			}
+		}
+		return mapped, nil
+	}
+}
+
+// fakeMounter implements service.Mounter without touching the host. The
+// devices of all volumes exist, and filesystems are only recorded.
+type fakeMounter struct {
+	sync.Mutex
+	formats map[string]string
+	mounts  []gofsutil.Info
+}
+
+func newFakeMounter() *fakeMounter {
+	return &fakeMounter{formats: map[string]string{}}
+}
+
+func (m *fakeMounter) GetDevice(p string) (*service.Device, error) {
+	if path.Dir(p) != diskIDDir {
+		return nil, errors.New(p + " is not a block device")
+	}
+	name := path.Base(p)
+	return &service.Device{
+		FullPath: p,
+		Name:     name,
+		RealDev:  "/dev/scini-" + name[strings.LastIndex(name, "-")+1:],
+	}, nil
+}
+
+func (m *fakeMounter) GetMounts(ctx context.Context) ([]gofsutil.Info, error) {
+	m.Lock()
+	defer m.Unlock()
+	return append([]gofsutil.Info(nil), m.mounts...), nil
+}
+
+func (m *fakeMounter) GetDiskFormat(
+	ctx context.Context, disk string) (string, error) {
+
+	m.Lock()
+	defer m.Unlock()
+	return m.formats[disk], nil
+}
+
+// mountOpts returns the options reported for a mount with the given flags
+func mountOpts(opts []string) []string {
+	for _, o := range opts {
+		if o == "ro" {
+			return []string{"ro"}
+		}
+	}
+	return []string{"rw"}
+}
+
+func (m *fakeMounter) Mount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	return m.mount(source, target, opts)
+}
+
+// mount must be called with the lock held
+func (m *fakeMounter) mount(source, target string, opts []string) error {
+	if m.formats[source] == "" {
+		return errors.New("unformatted device: " + source)
+	}
+	dev, err := m.GetDevice(source)
+	if err != nil {
+		return err
+	}
+	m.mounts = append(m.mounts, gofsutil.Info{
+		Device: dev.RealDev,
+		Path:   target,
+		Type:   m.formats[source],
+		Opts:   mountOpts(opts),
+	})
+	return nil
+}
+
+func (m *fakeMounter) BindMount(
+	ctx context.Context, source, target string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	if dev, err := m.GetDevice(source); err == nil {
+		m.mounts = append(m.mounts, gofsutil.Info{
+			Device: "devtmpfs",
+			Source: dev.RealDev,
+			Path:   target,
+			Opts:   mountOpts(opts),
+		})
+		return nil
+	}
+	for _, mnt := range m.mounts {
+		if mnt.Path == source {
+			mnt.Path = target
+			mnt.Opts = mountOpts(opts)
+			m.mounts = append(m.mounts, mnt)
+			return nil
+		}
+	}
+	return errors.New("nothing mounted at " + source)
+}
+
+func (m *fakeMounter) FormatAndMount(
+	ctx context.Context, source, target, fsType string, opts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	if m.formats[source] == "" {
+		if fsType == "" {
+			fsType = "ext4"
+		}
+		m.formats[source] = fsType
+	}
+	return m.mount(source, target, opts)
+}
+
+func (m *fakeMounter) Format(
+	ctx context.Context, source, fsType string, mkfsOpts ...string) error {
+
+	m.Lock()
+	defer m.Unlock()
+	m.formats[source] = fsType
+	return nil
+}
+
+func (m *fakeMounter) Unmount(ctx context.Context, target string) error {
+	m.Lock()
+	defer m.Unlock()
+	for i, mnt := range m.mounts {
+		if mnt.Path == target {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("not mounted: " + target)
+}
+
+func (m *fakeMounter) ResizeFS(
+	ctx context.Context, devicePath, mountPath, fsType string) error {
+
+	return nil
+}
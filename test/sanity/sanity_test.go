@@ -0,0 +1,385 @@
+// Package sanity checks the plug-in against the CSI spec, serving both its
+// controller and node services in-process over gRPC, with a fake ScaleIO
+// Gateway, SDC and mounter in place of the real ones.
+//
+// The checks are those of the CSI sanity tests that apply to the v0.2 spec
+// and the capabilities the plug-in advertises. The sanity tests themselves
+// aren't run, as csi-test v0.2 and the Ginkgo packages it needs aren't
+// vendored.
+package sanity
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/thecodeteam/csi-scaleio/provider"
+	"github.com/thecodeteam/csi-scaleio/service"
+	"github.com/thecodeteam/csi-scaleio/testutil"
+)
+
+// sdcGUID is the GUID of the fake SDC the node service runs on
+const sdcGUID = "1A2B3C4D-0000-0000-0000-000000000000"
+
+// gib is the number of bytes in a GiB
+const gib = 1024 * 1024 * 1024
+
+var (
+	mountCap = &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	blockCap = &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+)
+
+// clients are the CSI clients of the plug-in under test
+type clients struct {
+	identity   csi.IdentityClient
+	controller csi.ControllerClient
+	node       csi.NodeClient
+	dir        string
+}
+
+// serve serves the plug-in on a unix socket in a new temporary directory,
+// returning its clients and a func that stops it
+func serve(t *testing.T) (*clients, func()) {
+	ctx := context.Background()
+
+	admin := testutil.NewFakeAdmin("sys")
+	admin.AddStoragePool("pool", 1024*1024*1024)
+	sdcID := admin.AddSdc(sdcGUID)
+	gw := testutil.NewFakeGateway(admin, "admin", "password")
+
+	dir, err := ioutil.TempDir("", "csi-scaleio-sanity")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		service.EnvEndpoint:        gw.Endpoint(),
+		service.EnvAllowHTTP:       "true",
+		service.EnvUser:            "admin",
+		service.EnvPassword:        "password",
+		service.EnvSystemName:      "sys",
+		service.EnvSDCGUID:         sdcGUID,
+		service.EnvStoragePool:     "pool",
+		service.EnvPrivateMountDir: filepath.Join(dir, "priv"),
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+	}
+
+	dev := filepath.Join(dir, "scini")
+	if err := ioutil.WriteFile(dev, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := service.NewWithNodeHost(service.NodeHost{
+		Mounter:      newFakeMounter(),
+		LocalVolumes: localVolumes(admin, sdcID),
+		SDCLoaded:    func() bool { return true },
+		SDCDevice:    dev,
+	})
+	sp := provider.NewWithService(svc)
+
+	sock := filepath.Join(dir, "csi.sock")
+	lis, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sp.Serve(ctx, lis)
+
+	conn, err := grpc.DialContext(ctx, sock, grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, d time.Duration) (net.Conn, error) {
+			return net.DialTimeout("unix", addr, d)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &clients{
+		identity:   csi.NewIdentityClient(conn),
+		controller: csi.NewControllerClient(conn),
+		node:       csi.NewNodeClient(conn),
+		dir:        dir,
+	}
+	return c, func() {
+		conn.Close()
+		sp.GracefulStop(ctx)
+		gw.Close()
+		for k := range env {
+			os.Unsetenv(k)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// assertCode fails t unless err has the gRPC code want
+func assertCode(t *testing.T, what string, err error, want codes.Code) {
+	t.Helper()
+	st, _ := status.FromError(err)
+	if st.Code() != want {
+		t.Errorf("%s: got %v, want %v", what, err, want)
+	}
+}
+
+func TestSanity(t *testing.T) {
+	ctx := context.Background()
+	c, stop := serve(t)
+	defer stop()
+
+	t.Run("Identity", func(t *testing.T) {
+		info, err := c.identity.GetPluginInfo(ctx,
+			&csi.GetPluginInfoRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name == "" || info.VendorVersion == "" {
+			t.Errorf("incomplete plug-in info: %v", info)
+		}
+		if _, err := c.identity.Probe(ctx, &csi.ProbeRequest{}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("NodeGetCapabilities", func(t *testing.T) {
+		rep, err := c.node.NodeGetCapabilities(ctx,
+			&csi.NodeGetCapabilitiesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// staging isn't implemented, and so mustn't be advertised
+		for _, cap := range rep.Capabilities {
+			if cap.GetRpc().GetType() ==
+				csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME {
+				t.Error("STAGE_UNSTAGE_VOLUME advertised")
+			}
+		}
+	})
+
+	t.Run("CreateVolume", func(t *testing.T) {
+		_, err := c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+		})
+		assertCode(t, "no name", err, codes.InvalidArgument)
+
+		_, err = c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: "sanity-nocaps",
+		})
+		assertCode(t, "no capabilities", err, codes.InvalidArgument)
+
+		// creating a volume again with the same arguments is idempotent
+		req := &csi.CreateVolumeRequest{
+			Name:               "sanity-idempotent",
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 8 * gib},
+			VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+		}
+		first, err := c.controller.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := c.controller.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Volume.Id != again.Volume.Id {
+			t.Errorf("created %s, then %s", first.Volume.Id, again.Volume.Id)
+		}
+
+		// but not with a size the volume doesn't have
+		req.CapacityRange = &csi.CapacityRange{
+			RequiredBytes: 16 * gib,
+			LimitBytes:    16 * gib,
+		}
+		_, err = c.controller.CreateVolume(ctx, req)
+		assertCode(t, "other size", err, codes.AlreadyExists)
+
+		// a name too long for ScaleIO is still accepted
+		long, err := c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "sanity-a-volume-name-longer-than-scaleio-allows",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, id := range []string{first.Volume.Id, long.Volume.Id} {
+			if _, err := c.controller.DeleteVolume(ctx,
+				&csi.DeleteVolumeRequest{VolumeId: id}); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("DeleteVolume", func(t *testing.T) {
+		_, err := c.controller.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+		assertCode(t, "no ID", err, codes.InvalidArgument)
+
+		// deleting a volume that doesn't exist succeeds
+		_, err = c.controller.DeleteVolume(ctx,
+			&csi.DeleteVolumeRequest{VolumeId: "0123456789abcdef"})
+		assertCode(t, "unknown ID", err, codes.OK)
+	})
+
+	t.Run("ValidateVolumeCapabilities", func(t *testing.T) {
+		vol, err := c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "sanity-validate",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.controller.DeleteVolume(ctx,
+			&csi.DeleteVolumeRequest{VolumeId: vol.Volume.Id})
+
+		rep, err := c.controller.ValidateVolumeCapabilities(ctx,
+			&csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           vol.Volume.Id,
+				VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rep.Supported {
+			t.Errorf("mount capability not supported: %s", rep.Message)
+		}
+
+		_, err = c.controller.ValidateVolumeCapabilities(ctx,
+			&csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "0123456789abcdef",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+			})
+		assertCode(t, "unknown ID", err, codes.NotFound)
+	})
+
+	t.Run("ListVolumes", func(t *testing.T) {
+		vol, err := c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               "sanity-list",
+			VolumeCapabilities: []*csi.VolumeCapability{mountCap},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.controller.DeleteVolume(ctx,
+			&csi.DeleteVolumeRequest{VolumeId: vol.Volume.Id})
+
+		rep, err := c.controller.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, e := range rep.Entries {
+			found = found || e.Volume.Id == vol.Volume.Id
+		}
+		if !found {
+			t.Errorf("volume %s not listed", vol.Volume.Id)
+		}
+	})
+
+	for name, volCap := range map[string]*csi.VolumeCapability{
+		"PublishMount": mountCap,
+		"PublishBlock": blockCap,
+	} {
+		volCap := volCap
+		t.Run(name, func(t *testing.T) {
+			testPublish(ctx, t, c, "sanity-"+name, volCap)
+		})
+	}
+}
+
+// testPublish runs a volume with the capability volCap through its whole
+// lifecycle, publishing it twice at each step to check that publishing is
+// idempotent
+func testPublish(
+	ctx context.Context, t *testing.T, c *clients,
+	name string, volCap *csi.VolumeCapability) {
+
+	nodeID, err := c.node.NodeGetId(ctx, &csi.NodeGetIdRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vol, err := c.controller.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		VolumeCapabilities: []*csi.VolumeCapability{volCap},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volID := vol.Volume.Id
+
+	var pub *csi.ControllerPublishVolumeResponse
+	for i := 0; i < 2; i++ {
+		pub, err = c.controller.ControllerPublishVolume(ctx,
+			&csi.ControllerPublishVolumeRequest{
+				VolumeId:         volID,
+				NodeId:           nodeID.NodeId,
+				VolumeCapability: volCap,
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	target := filepath.Join(c.dir, name)
+	if volCap.GetMount() != nil {
+		if err := os.Mkdir(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+	} else if err := ioutil.WriteFile(target, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.node.NodePublishVolume(ctx,
+			&csi.NodePublishVolumeRequest{
+				VolumeId:         volID,
+				PublishInfo:      pub.PublishInfo,
+				TargetPath:       target,
+				VolumeCapability: volCap,
+				VolumeAttributes: vol.Volume.Attributes,
+			}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.node.NodeUnpublishVolume(ctx,
+			&csi.NodeUnpublishVolumeRequest{
+				VolumeId:   volID,
+				TargetPath: target,
+			}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.controller.ControllerUnpublishVolume(ctx,
+			&csi.ControllerUnpublishVolumeRequest{
+				VolumeId: volID,
+				NodeId:   nodeID.NodeId,
+			}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.controller.DeleteVolume(ctx,
+		&csi.DeleteVolumeRequest{VolumeId: volID}); err != nil {
+		t.Fatal(err)
+	}
+}
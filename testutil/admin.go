@@ -0,0 +1,745 @@
+// Package testutil provides fakes of the ScaleIO Gateway for use by tests.
+package testutil
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	sio "github.com/thecodeteam/goscaleio"
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// The errors returned by the gateway that callers match on
+const (
+	ErrNotFound          = "Not found"
+	ErrVolumeNotFound    = "Could not find the volume"
+	ErrVolumeNameInUse   = "Volume name already in use. Please use a different name."
+	ErrSdcNotFound       = "Couldn't find SDC"
+	ErrSystemNotFound    = "err: systemid or systemname not found"
+	ErrNoSuchSystem      = "Could not find the System"
+	ErrPoolNotFound      = "Couldn't find storage pool"
+	ErrAlreadyMapped     = "The volume is already mapped to this SDC"
+	ErrSingleMapping     = "Only a single SDC may be mapped to this volume at a time"
+	ErrNotAuthenticated  = "Unauthorized"
+	ErrVolumeMappedToSdc = "The volume is mapped to an SDC"
+	ErrSdcNotMapped      = "The volume is not mapped to this SDC"
+	ErrPDNotFound        = "Couldn't find protection domain"
+)
+
+// ProtectionDomainID is the ID of the protection domain every fake storage
+// pool is in, which is in the system NewFakeAdmin creates
+const ProtectionDomainID = "d0a0000000000001"
+
+// FakeAdmin is an in-memory ScaleIO system, implementing the ScaleIOAdmin
+// interface of the service package. It tracks systems, SDCs, storage
+// pools, volumes, and the mappings between volumes and SDCs.
+type FakeAdmin struct {
+	sync.Mutex
+
+	// Systems, ProtectionDomains, SDCs, StoragePools, and Volumes are
+	// keyed by ID
+	Systems           map[string]*siotypes.System
+	ProtectionDomains map[string]*siotypes.ProtectionDomain
+	SDCs              map[string]*siotypes.Sdc
+	StoragePools      map[string]*siotypes.StoragePool
+	Volumes           map[string]*siotypes.Volume
+
+	// Stats are the statistics of systems and storage pools, keyed by ID
+	Stats map[string]*siotypes.Statistics
+
+	// WriteBwc are the recent writes to volumes, keyed by volume ID. A
+	// volume without any has had none.
+	WriteBwc map[string]*siotypes.BWC
+
+	// VolumeBwcs are the other bandwidth counters of volumes, keyed by
+	// volume ID and then by the counter's name, such as userDataReadBwc
+	VolumeBwcs map[string]map[string]siotypes.BWC
+
+	// Errors are returned by the method of the same name, if set, to
+	// simulate a failing gateway
+	Errors map[string]error
+
+	// Calls counts the calls made to each method
+	Calls map[string]int
+
+	// Password is required by Authenticate, if set
+	Password string
+
+	// Version is the version of the gateway
+	Version string
+
+	token  string
+	nextID int
+}
+
+// NewFakeAdmin returns a FakeAdmin with a single system of the given name
+func NewFakeAdmin(systemName string) *FakeAdmin {
+	f := &FakeAdmin{
+		Systems:           map[string]*siotypes.System{},
+		ProtectionDomains: map[string]*siotypes.ProtectionDomain{},
+		SDCs:              map[string]*siotypes.Sdc{},
+		StoragePools:      map[string]*siotypes.StoragePool{},
+		Volumes:           map[string]*siotypes.Volume{},
+		Stats:             map[string]*siotypes.Statistics{},
+		WriteBwc:          map[string]*siotypes.BWC{},
+		VolumeBwcs:        map[string]map[string]siotypes.BWC{},
+		Errors:            map[string]error{},
+		Calls:             map[string]int{},
+		Version:           "2.0",
+	}
+	id := f.newID()
+	f.Systems[id] = &siotypes.System{ID: id, Name: systemName}
+	f.ProtectionDomains[ProtectionDomainID] = &siotypes.ProtectionDomain{
+		ID:       ProtectionDomainID,
+		SystemID: id,
+	}
+	return f
+}
+
+// newID returns a new, unique, object ID. Must be called with the lock
+// held.
+func (f *FakeAdmin) newID() string {
+	f.nextID++
+	return fmt.Sprintf("%016x", f.nextID)
+}
+
+// call records a call to the named method and returns the error injected
+// for it, if any. Must be called with the lock held.
+func (f *FakeAdmin) call(method string) error {
+	f.Calls[method]++
+	return f.Errors[method]
+}
+
+// AddSdc registers an SDC with the given GUID, returning its ID
+func (f *FakeAdmin) AddSdc(guid string) string {
+	f.Lock()
+	defer f.Unlock()
+	id := f.newID()
+	f.SDCs[id] = &siotypes.Sdc{ID: id, SdcGuid: guid}
+	return id
+}
+
+// AddStoragePool creates a storage pool with the given name, returning its
+// ID. The pool has zero padding enabled, and reports the given available
+// capacity.
+func (f *FakeAdmin) AddStoragePool(name string, availableKiB int) string {
+	f.Lock()
+	defer f.Unlock()
+	id := f.newID()
+	f.StoragePools[id] = &siotypes.StoragePool{
+		ID:                 id,
+		Name:               name,
+		ProtectionDomainID: ProtectionDomainID,
+		ZeroPaddingEnabled: true,
+	}
+	f.Stats[id] = &siotypes.Statistics{
+		CapacityAvailableForVolumeAllocationInKb: availableKiB,
+	}
+	return id
+}
+
+// AddVolume creates a volume of the given size in the named storage pool,
+// returning its ID
+func (f *FakeAdmin) AddVolume(name, pool string, sizeInKiB int) string {
+	rep, err := f.CreateVolume(&siotypes.VolumeParam{
+		Name:           name,
+		VolumeSizeInKb: strconv.Itoa(sizeInKiB),
+	}, pool)
+	if err != nil {
+		panic(err)
+	}
+	return rep.ID
+}
+
+// Authenticate starts a session
+func (f *FakeAdmin) Authenticate(
+	configConnect *sio.ConfigConnect) (sio.Cluster, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("Authenticate"); err != nil {
+		return sio.Cluster{}, err
+	}
+	if f.Password != "" && configConnect.Password != f.Password {
+		return sio.Cluster{}, errors.New(ErrNotAuthenticated)
+	}
+	f.token = "token"
+	return sio.Cluster{}, nil
+}
+
+// GetVersion returns the version of the gateway
+func (f *FakeAdmin) GetVersion() (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetVersion"); err != nil {
+		return "", err
+	}
+	return f.Version, nil
+}
+
+// GetToken returns the token of the current session, if any
+func (f *FakeAdmin) GetToken() string {
+	f.Lock()
+	defer f.Unlock()
+	return f.token
+}
+
+// FindSystem returns the system matching the given ID or name
+func (f *FakeAdmin) FindSystem(
+	instanceID, name, href string) (*siotypes.System, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("FindSystem"); err != nil {
+		return nil, err
+	}
+	for _, s := range f.Systems {
+		if s.ID == instanceID || s.Name == name || href != "" {
+			return s, nil
+		}
+	}
+	return nil, errors.New(ErrSystemNotFound)
+}
+
+// GetSystemStatistics returns the statistics of a system. Unless set
+// explicitly, the available capacity is that of all storage pools.
+func (f *FakeAdmin) GetSystemStatistics(
+	system *siotypes.System) (*siotypes.Statistics, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetSystemStatistics"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Systems[system.ID]; !ok {
+		return nil, errors.New(ErrNoSuchSystem)
+	}
+	if stats, ok := f.Stats[system.ID]; ok {
+		return stats, nil
+	}
+	stats := &siotypes.Statistics{}
+	for id := range f.StoragePools {
+		if ps, ok := f.Stats[id]; ok {
+			stats.CapacityAvailableForVolumeAllocationInKb +=
+				ps.CapacityAvailableForVolumeAllocationInKb
+		}
+	}
+	return stats, nil
+}
+
+// FindSdc returns the SDC whose GUID, IP, name or ID has the given value.
+// GUIDs match whatever their case, or padding.
+func (f *FakeAdmin) FindSdc(
+	system *siotypes.System, field, value string) (*siotypes.Sdc, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("FindSdc"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Systems[system.ID]; !ok {
+		return nil, errors.New(ErrNoSuchSystem)
+	}
+	for _, sdc := range f.SDCs {
+		if (field == "SdcGuid" && sameGUID(sdc.SdcGuid, value)) ||
+			(field == "SdcIp" && sdc.SdcIp == value) ||
+			(field == "Name" && sdc.Name == value) ||
+			(field == "ID" && sdc.ID == value) {
+			return sdc, nil
+		}
+	}
+	return nil, errors.New(ErrSdcNotFound)
+}
+
+// sameGUID returns whether a and b are the same SDC GUID, whatever their
+// case, or padding
+func sameGUID(a, b string) bool {
+	norm := func(s string) string {
+		return strings.ToUpper(strings.Trim(strings.TrimSpace(s), "{}"))
+	}
+	return norm(a) == norm(b)
+}
+
+// GetSdcs returns the SDCs of a system
+func (f *FakeAdmin) GetSdcs(system *siotypes.System) ([]siotypes.Sdc, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetSdcs"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Systems[system.ID]; !ok {
+		return nil, errors.New(ErrNoSuchSystem)
+	}
+	sdcs := make([]siotypes.Sdc, 0, len(f.SDCs))
+	for _, sdc := range f.SDCs {
+		sdcs = append(sdcs, *sdc)
+	}
+	sort.Slice(sdcs, func(i, j int) bool { return sdcs[i].ID < sdcs[j].ID })
+	return sdcs, nil
+}
+
+// GetSdcVolumes returns the volumes mapped to an SDC, ordered by ID
+func (f *FakeAdmin) GetSdcVolumes(sdcID string) ([]*siotypes.Volume, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetSdcVolumes"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.SDCs[sdcID]; !ok {
+		return nil, errors.New(ErrSdcNotFound)
+	}
+	var vols []*siotypes.Volume
+	for _, v := range f.Volumes {
+		for _, m := range v.MappedSdcInfo {
+			if m.SdcID == sdcID {
+				vols = append(vols, copyVolume(v))
+				break
+			}
+		}
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].ID < vols[j].ID })
+	return vols, nil
+}
+
+// CreateVolume creates a volume in the named storage pool
+func (f *FakeAdmin) CreateVolume(
+	volume *siotypes.VolumeParam,
+	storagePoolName string) (*siotypes.VolumeResp, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("CreateVolume"); err != nil {
+		return nil, err
+	}
+	pool := f.findStoragePool("", storagePoolName)
+	if pool == nil {
+		return nil, errors.New(ErrPoolNotFound)
+	}
+	for _, v := range f.Volumes {
+		if v.Name == volume.Name {
+			return nil, errors.New(ErrVolumeNameInUse)
+		}
+	}
+	size, err := strconv.Atoi(volume.VolumeSizeInKb)
+	if err != nil {
+		return nil, err
+	}
+
+	id := f.newID()
+	f.Volumes[id] = &siotypes.Volume{
+		ID:            id,
+		Name:          volume.Name,
+		SizeInKb:      size,
+		VolumeType:    volume.VolumeType,
+		StoragePoolID: pool.ID,
+		Links: []*siotypes.Link{{
+			Rel:  "self",
+			HREF: "/api/instances/Volume::" + id,
+		}},
+	}
+	return &siotypes.VolumeResp{ID: id}, nil
+}
+
+// GetVolume returns the volume with the given ID or name, or every volume,
+// ordered by ID, if neither is given. Copies are returned, so callers can't
+// modify the fake's state.
+func (f *FakeAdmin) GetVolume(
+	volumehref, volumeid, ancestorvolumeid, volumename string,
+	getSnapshots bool) ([]*siotypes.Volume, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetVolume"); err != nil {
+		return nil, err
+	}
+
+	if volumename != "" {
+		for _, v := range f.Volumes {
+			if v.Name == volumename {
+				return []*siotypes.Volume{copyVolume(v)}, nil
+			}
+		}
+		return nil, nil
+	}
+	if volumeid != "" {
+		v, ok := f.Volumes[volumeid]
+		if !ok {
+			return nil, errors.New(ErrVolumeNotFound)
+		}
+		return []*siotypes.Volume{copyVolume(v)}, nil
+	}
+
+	// volumes are listed without their snapshots, or else only snapshots
+	ids := make([]string, 0, len(f.Volumes))
+	for id, v := range f.Volumes {
+		if (v.AncestorVolumeID != "") == getSnapshots {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	vols := make([]*siotypes.Volume, 0, len(ids))
+	for _, id := range ids {
+		vols = append(vols, copyVolume(f.Volumes[id]))
+	}
+	return vols, nil
+}
+
+func copyVolume(v *siotypes.Volume) *siotypes.Volume {
+	c := *v
+	c.MappedSdcInfo = make([]*siotypes.MappedSdcInfo, len(v.MappedSdcInfo))
+	for i, m := range v.MappedSdcInfo {
+		mc := *m
+		c.MappedSdcInfo[i] = &mc
+	}
+	return &c
+}
+
+// FindVolumeID returns the ID of the named volume
+func (f *FakeAdmin) FindVolumeID(volumename string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("FindVolumeID"); err != nil {
+		return "", err
+	}
+	for _, v := range f.Volumes {
+		if v.Name == volumename {
+			return v.ID, nil
+		}
+	}
+	return "", errors.New(ErrNotFound)
+}
+
+// RemoveVolume removes a volume. Like the gateway, volumes that are still
+// mapped can't be removed.
+func (f *FakeAdmin) RemoveVolume(
+	volume *siotypes.Volume, removeMode string) error {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("RemoveVolume"); err != nil {
+		return err
+	}
+	v, ok := f.Volumes[volume.ID]
+	if !ok {
+		return errors.New(ErrVolumeNotFound)
+	}
+	if len(v.MappedSdcInfo) > 0 {
+		return errors.New(ErrVolumeMappedToSdc)
+	}
+	delete(f.Volumes, volume.ID)
+	return nil
+}
+
+// MapVolumeSdc maps a volume to an SDC
+func (f *FakeAdmin) MapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.MapVolumeSdcParam) error {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("MapVolumeSdc"); err != nil {
+		return err
+	}
+	v, ok := f.Volumes[volume.ID]
+	if !ok {
+		return errors.New(ErrVolumeNotFound)
+	}
+	if _, ok := f.SDCs[param.SdcID]; !ok {
+		return errors.New(ErrSdcNotFound)
+	}
+	for _, m := range v.MappedSdcInfo {
+		if m.SdcID == param.SdcID {
+			return errors.New(ErrAlreadyMapped)
+		}
+	}
+	if len(v.MappedSdcInfo) > 0 && param.AllowMultipleMappings != "true" {
+		return errors.New(ErrSingleMapping)
+	}
+	v.MappedSdcInfo = append(v.MappedSdcInfo,
+		&siotypes.MappedSdcInfo{SdcID: param.SdcID})
+	return nil
+}
+
+// UnmapVolumeSdc unmaps a volume from an SDC
+func (f *FakeAdmin) UnmapVolumeSdc(
+	volume *siotypes.Volume, param *siotypes.UnmapVolumeSdcParam) error {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("UnmapVolumeSdc"); err != nil {
+		return err
+	}
+	v, ok := f.Volumes[volume.ID]
+	if !ok {
+		return errors.New(ErrVolumeNotFound)
+	}
+	for i, m := range v.MappedSdcInfo {
+		if m.SdcID == param.SdcID {
+			v.MappedSdcInfo = append(
+				v.MappedSdcInfo[:i], v.MappedSdcInfo[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New(ErrSdcNotFound)
+}
+
+// SetMappedSdcLimits sets the IOPS and bandwidth limits of the mapping of a
+// volume to an SDC
+func (f *FakeAdmin) SetMappedSdcLimits(
+	volume *siotypes.Volume, param *siotypes.SetMappedSdcLimitsParam) error {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("SetMappedSdcLimits"); err != nil {
+		return err
+	}
+	v, ok := f.Volumes[volume.ID]
+	if !ok {
+		return errors.New(ErrVolumeNotFound)
+	}
+	iops, err := strconv.Atoi(param.IopsLimit)
+	if err != nil && param.IopsLimit != "" {
+		return err
+	}
+	bw, err := strconv.Atoi(param.BandwidthLimitInKbps)
+	if err != nil && param.BandwidthLimitInKbps != "" {
+		return err
+	}
+	for _, m := range v.MappedSdcInfo {
+		if m.SdcID == param.SdcID {
+			m.LimitIops = iops
+			m.LimitBwInMbps = bw / 1024
+			return nil
+		}
+	}
+	return errors.New(ErrSdcNotMapped)
+}
+
+// SetVolumeName renames a volume
+func (f *FakeAdmin) SetVolumeName(
+	volume *siotypes.Volume, newName string) error {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("SetVolumeName"); err != nil {
+		return err
+	}
+	v, ok := f.Volumes[volume.ID]
+	if !ok {
+		return errors.New(ErrVolumeNotFound)
+	}
+	for _, o := range f.Volumes {
+		if o.Name == newName && o.ID != v.ID {
+			return errors.New(ErrVolumeNameInUse)
+		}
+	}
+	v.Name = newName
+	return nil
+}
+
+// SetVolumeUseRmcache enables or disables the RAM read cache of a volume
+func (f *FakeAdmin) SetVolumeUseRmcache(
+	volume *siotypes.Volume, useRmcache bool) error {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("SetVolumeUseRmcache"); err != nil {
+		return err
+	}
+	v, ok := f.Volumes[volume.ID]
+	if !ok {
+		return errors.New(ErrVolumeNotFound)
+	}
+	v.UseRmCache = useRmcache
+	return nil
+}
+
+// FindStoragePool returns the storage pool with the given ID or name
+func (f *FakeAdmin) FindStoragePool(
+	id, name, href string) (*siotypes.StoragePool, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("FindStoragePool"); err != nil {
+		return nil, err
+	}
+	if pool := f.findStoragePool(id, name); pool != nil {
+		p := *pool
+		return &p, nil
+	}
+	return nil, errors.New(ErrPoolNotFound)
+}
+
+// SnapshotVolumes snapshots the volumes param gives, returning the IDs of
+// the snapshots, in the same order, and of their consistency group. No
+// snapshot is taken unless every volume exists.
+func (f *FakeAdmin) SnapshotVolumes(
+	system *siotypes.System,
+	param *siotypes.SnapshotVolumesParam) (*siotypes.SnapshotVolumesResp, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("SnapshotVolumes"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Systems[system.ID]; !ok {
+		return nil, errors.New(ErrNoSuchSystem)
+	}
+	for _, def := range param.SnapshotDefs {
+		if _, ok := f.Volumes[def.VolumeID]; !ok {
+			return nil, errors.New(ErrVolumeNotFound)
+		}
+		for _, v := range f.Volumes {
+			if def.SnapshotName != "" && v.Name == def.SnapshotName {
+				return nil, errors.New(ErrVolumeNameInUse)
+			}
+		}
+	}
+
+	resp := &siotypes.SnapshotVolumesResp{SnapshotGroupID: f.newID()}
+	for _, def := range param.SnapshotDefs {
+		src := f.Volumes[def.VolumeID]
+		id := f.newID()
+		f.Volumes[id] = &siotypes.Volume{
+			ID:                 id,
+			Name:               def.SnapshotName,
+			SizeInKb:           src.SizeInKb,
+			VolumeType:         "Snapshot",
+			StoragePoolID:      src.StoragePoolID,
+			AncestorVolumeID:   src.ID,
+			ConsistencyGroupID: resp.SnapshotGroupID,
+			Links: []*siotypes.Link{{
+				Rel:  "self",
+				HREF: "/api/instances/Volume::" + id,
+			}},
+		}
+		resp.VolumeIDList = append(resp.VolumeIDList, id)
+	}
+	return resp, nil
+}
+
+// GetProtectionDomain returns the protection domain with the given ID
+func (f *FakeAdmin) GetProtectionDomain(
+	id string) (*siotypes.ProtectionDomain, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetProtectionDomain"); err != nil {
+		return nil, err
+	}
+	if pd, ok := f.ProtectionDomains[id]; ok {
+		p := *pd
+		return &p, nil
+	}
+	return nil, errors.New(ErrPDNotFound)
+}
+
+// GetStoragePools returns every storage pool, ordered by ID
+func (f *FakeAdmin) GetStoragePools() ([]*siotypes.StoragePool, error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetStoragePools"); err != nil {
+		return nil, err
+	}
+	pools := make([]*siotypes.StoragePool, 0, len(f.StoragePools))
+	for _, pool := range f.StoragePools {
+		p := *pool
+		pools = append(pools, &p)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+	return pools, nil
+}
+
+// GetStoragePoolVolumes returns the volumes of a storage pool, ordered by
+// ID
+func (f *FakeAdmin) GetStoragePoolVolumes(
+	pool *siotypes.StoragePool) ([]*siotypes.Volume, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetStoragePoolVolumes"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.StoragePools[pool.ID]; !ok {
+		return nil, errors.New(ErrPoolNotFound)
+	}
+	var vols []*siotypes.Volume
+	for _, v := range f.Volumes {
+		if v.StoragePoolID == pool.ID {
+			vols = append(vols, copyVolume(v))
+		}
+	}
+	sort.Slice(vols, func(i, j int) bool { return vols[i].ID < vols[j].ID })
+	return vols, nil
+}
+
+// findStoragePool must be called with the lock held
+func (f *FakeAdmin) findStoragePool(id, name string) *siotypes.StoragePool {
+	for _, pool := range f.StoragePools {
+		if (id != "" && pool.ID == id) || (name != "" && pool.Name == name) {
+			return pool
+		}
+	}
+	return nil
+}
+
+// GetStoragePoolStatistics returns the statistics of a storage pool
+func (f *FakeAdmin) GetStoragePoolStatistics(
+	pool *siotypes.StoragePool) (*siotypes.Statistics, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetStoragePoolStatistics"); err != nil {
+		return nil, err
+	}
+	stats, ok := f.Stats[pool.ID]
+	if !ok {
+		return nil, errors.New(ErrNotFound)
+	}
+	return stats, nil
+}
+
+// GetVolumeWriteBwc returns the recent writes to a volume
+func (f *FakeAdmin) GetVolumeWriteBwc(
+	volume *siotypes.Volume) (*siotypes.BWC, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetVolumeWriteBwc"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Volumes[volume.ID]; !ok {
+		return nil, errors.New(ErrVolumeNotFound)
+	}
+	bwc := siotypes.BWC{}
+	if b, ok := f.WriteBwc[volume.ID]; ok {
+		bwc = *b
+	}
+	return &bwc, nil
+}
+
+// GetVolumeBwcs returns the bandwidth counters of a volume, its recent
+// writes among them
+func (f *FakeAdmin) GetVolumeBwcs(
+	volume *siotypes.Volume) (map[string]siotypes.BWC, error) {
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.call("GetVolumeBwcs"); err != nil {
+		return nil, err
+	}
+	if _, ok := f.Volumes[volume.ID]; !ok {
+		return nil, errors.New(ErrVolumeNotFound)
+	}
+	bwcs := map[string]siotypes.BWC{"userDataWriteBwc": {}}
+	for name, bwc := range f.VolumeBwcs[volume.ID] {
+		bwcs[name] = bwc
+	}
+	if b, ok := f.WriteBwc[volume.ID]; ok {
+		bwcs["userDataWriteBwc"] = *b
+	}
+	return bwcs, nil
+}
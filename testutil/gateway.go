@@ -0,0 +1,596 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	siotypes "github.com/thecodeteam/goscaleio/types/v1"
+)
+
+// The routes served by FakeGateway, used to inject failures
+const (
+	RouteLogin                    = "Login"
+	RouteVersion                  = "Version"
+	RouteGetSystems               = "GetSystems"
+	RouteGetSystemStatistics      = "GetSystemStatistics"
+	RouteGetSdcs                  = "GetSdcs"
+	RouteSnapshotVolumes          = "SnapshotVolumes"
+	RouteGetSdcVolumes            = "GetSdcVolumes"
+	RouteGetProtectionDomain      = "GetProtectionDomain"
+	RouteGetStoragePools          = "GetStoragePools"
+	RouteGetStoragePoolStatistics = "GetStoragePoolStatistics"
+	RouteGetStoragePoolVolumes    = "GetStoragePoolVolumes"
+	RouteGetVolumes               = "GetVolumes"
+	RouteGetVolume                = "GetVolume"
+	RouteGetVolumeStatistics      = "GetVolumeStatistics"
+	RouteCreateVolume             = "CreateVolume"
+	RouteQueryVolumeID            = "QueryVolumeID"
+	RouteRemoveVolume             = "RemoveVolume"
+	RouteMapVolumeSdc             = "MapVolumeSdc"
+	RouteUnmapVolumeSdc           = "UnmapVolumeSdc"
+	RouteSetVolumeUseRmcache      = "SetVolumeUseRmcache"
+	RouteSetMappedSdcLimits       = "SetMappedSdcLimits"
+	RouteSetVolumeName            = "SetVolumeName"
+)
+
+// gatewayRoute matches the path of a request to the route serving it
+type gatewayRoute struct {
+	method string
+	rx     *regexp.Regexp
+	name   string
+	serve  func(w http.ResponseWriter, r *http.Request, id string)
+}
+
+// injected is a response returned in place of the real one
+type injected struct {
+	code  int
+	body  string
+	times int
+}
+
+// FakeGateway serves the subset of the ScaleIO Gateway REST API used by
+// goscaleio, backed by a FakeAdmin. Failures may be injected into any
+// route, requests may be delayed, and the session token may be expired to
+// exercise re-authentication.
+type FakeGateway struct {
+	*httptest.Server
+
+	// Admin holds the state of the fake ScaleIO system
+	Admin *FakeAdmin
+
+	// User and Password are the credentials accepted by the login route
+	User     string
+	Password string
+
+	mu       sync.Mutex
+	token    string
+	logins   int
+	requests map[string]int
+	reqIDs   map[string][]string
+	inject   map[string]*injected
+	delays   map[string]time.Duration
+	routes   []gatewayRoute
+}
+
+// NewFakeGateway starts a FakeGateway serving admin. It must be closed
+// when no longer needed.
+func NewFakeGateway(admin *FakeAdmin, user, password string) *FakeGateway {
+	g := &FakeGateway{
+		Admin:    admin,
+		User:     user,
+		Password: password,
+		requests: map[string]int{},
+		reqIDs:   map[string][]string{},
+		inject:   map[string]*injected{},
+		delays:   map[string]time.Duration{},
+	}
+
+	id := `([^/]+)`
+	get, post := http.MethodGet, http.MethodPost
+	add := func(method, pattern, name string,
+		serve func(http.ResponseWriter, *http.Request, string)) {
+		g.routes = append(g.routes, gatewayRoute{
+			method: method,
+			rx:     regexp.MustCompile("^" + pattern + "$"),
+			name:   name,
+			serve:  serve,
+		})
+	}
+	add(get, "/api/login", RouteLogin, g.login)
+	add(get, "/api/version", RouteVersion, g.version)
+	add(get, "/api/types/System/instances", RouteGetSystems, g.getSystems)
+	add(get, "/api/instances/System::"+id+"/relationships/Statistics",
+		RouteGetSystemStatistics, g.getSystemStatistics)
+	add(get, "/api/instances/System::"+id+"/relationships/Sdc",
+		RouteGetSdcs, g.getSdcs)
+	add(post, "/api/instances/System::"+id+"/action/snapshotVolumes",
+		RouteSnapshotVolumes, g.snapshotVolumes)
+	add(get, "/api/instances/Sdc::"+id+"/relationships/Volume",
+		RouteGetSdcVolumes, g.getSdcVolumes)
+	add(get, "/api/instances/ProtectionDomain::"+id,
+		RouteGetProtectionDomain, g.getProtectionDomain)
+	add(get, "/api/types/StoragePool/instances",
+		RouteGetStoragePools, g.getStoragePools)
+	add(get, "/api/instances/StoragePool::"+id+"/relationships/Statistics",
+		RouteGetStoragePoolStatistics, g.getStoragePoolStatistics)
+	add(get, "/api/instances/StoragePool::"+id+"/relationships/Volume",
+		RouteGetStoragePoolVolumes, g.getStoragePoolVolumes)
+	add(get, "/api/types/Volume/instances", RouteGetVolumes, g.getVolumes)
+	add(post, "/api/types/Volume/instances",
+		RouteCreateVolume, g.createVolume)
+	add(post, "/api/types/Volume/instances/action/queryIdByKey",
+		RouteQueryVolumeID, g.queryVolumeID)
+	add(get, "/api/instances/Volume::"+id, RouteGetVolume, g.getVolume)
+	add(get, "/api/instances/Volume::"+id+"/relationships/Statistics",
+		RouteGetVolumeStatistics, g.getVolumeStatistics)
+	add(post, "/api/instances/Volume::"+id+"/action/removeVolume",
+		RouteRemoveVolume, g.removeVolume)
+	add(post, "/api/instances/Volume::"+id+"/action/addMappedSdc",
+		RouteMapVolumeSdc, g.mapVolumeSdc)
+	add(post, "/api/instances/Volume::"+id+"/action/removeMappedSdc",
+		RouteUnmapVolumeSdc, g.unmapVolumeSdc)
+	add(post, "/api/instances/Volume::"+id+"/action/setMappedSdcLimits",
+		RouteSetMappedSdcLimits, g.setMappedSdcLimits)
+	add(post, "/api/instances/Volume::"+id+"/action/setVolumeName",
+		RouteSetVolumeName, g.setVolumeName)
+	add(post, "/api/instances/Volume::"+id+"/action/setVolumeUseRmcache",
+		RouteSetVolumeUseRmcache, g.setVolumeUseRmcache)
+
+	g.Server = httptest.NewServer(g)
+	return g
+}
+
+// Endpoint returns the endpoint clients should be configured with
+func (g *FakeGateway) Endpoint() string {
+	return g.URL + "/api"
+}
+
+// Inject causes the next times requests to the named route to be answered
+// with the given status code and body. If times is negative every request
+// is answered this way until Inject is called again.
+func (g *FakeGateway) Inject(route string, times, code int, body string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inject[route] = &injected{code: code, body: body, times: times}
+}
+
+// Fail causes the next times requests to the named route to fail with the
+// given status code
+func (g *FakeGateway) Fail(route string, times, code int) {
+	g.Inject(route, times, code, errorBody(code, http.StatusText(code)))
+}
+
+// Delay causes requests to the named route to wait d before they are
+// served. A request whose client gives up while waiting is dropped without
+// being served, as though it never reached the gateway.
+func (g *FakeGateway) Delay(route string, d time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.delays[route] = d
+}
+
+// ExpireToken invalidates the current session, so the next request is
+// refused until the client logs in again
+func (g *FakeGateway) ExpireToken() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.token = ""
+}
+
+// Logins returns the number of successful logins
+func (g *FakeGateway) Logins() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.logins
+}
+
+// RequestIDs returns the X-Request-ID headers of the requests made to the
+// named route, in the order they were made, empty for those without one
+func (g *FakeGateway) RequestIDs(route string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.reqIDs[route]...)
+}
+
+// Requests returns the number of requests made to the named route
+func (g *FakeGateway) Requests(route string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.requests[route]
+}
+
+func errorBody(code int, msg string) string {
+	b, _ := json.Marshal(&siotypes.Error{
+		Message:        msg,
+		HTTPStatusCode: code,
+	})
+	return string(b)
+}
+
+func (g *FakeGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, rt := range g.routes {
+		if rt.method != r.Method {
+			continue
+		}
+		m := rt.rx.FindStringSubmatch(r.URL.Path)
+		if m == nil {
+			continue
+		}
+		var id string
+		if len(m) > 1 {
+			id = m[1]
+		}
+
+		g.mu.Lock()
+		g.requests[rt.name]++
+		g.reqIDs[rt.name] = append(
+			g.reqIDs[rt.name], r.Header.Get("X-Request-ID"))
+		inj := g.inject[rt.name]
+		if inj != nil && inj.times != 0 {
+			if inj.times > 0 {
+				inj.times--
+			}
+		} else {
+			inj = nil
+		}
+		token := g.token
+		delay := g.delays[rt.name]
+		g.mu.Unlock()
+
+		if delay > 0 {
+			// the server only notices the client going away once the
+			// body has been read
+			body, _ := ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		if inj != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(inj.code)
+			fmt.Fprint(w, inj.body)
+			return
+		}
+
+		if rt.name != RouteLogin && rt.name != RouteVersion {
+			if _, pass, ok := r.BasicAuth(); !ok || token == "" ||
+				pass != token {
+				writeError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		rt.serve(w, r, id)
+		return
+	}
+	writeError(w, http.StatusNotFound, "Not found")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeString writes s as the gateway writes strings, quoted without a
+// trailing newline, which goscaleio depends on
+func writeString(w http.ResponseWriter, s string) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "%q", s)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprint(w, errorBody(code, msg))
+}
+
+// writeResult writes v, or err as the gateway reports failed operations.
+// A *siotypes.Error is written with its own status code.
+func writeResult(w http.ResponseWriter, v interface{}, err error) {
+	if e, ok := err.(*siotypes.Error); ok && e.HTTPStatusCode != 0 {
+		writeError(w, e.HTTPStatusCode, e.Message)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, v)
+}
+
+func (g *FakeGateway) login(w http.ResponseWriter, r *http.Request, _ string) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != g.User || pass != g.Password {
+		writeError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	g.mu.Lock()
+	g.logins++
+	g.token = "token-" + strconv.Itoa(g.logins)
+	token := g.token
+	g.mu.Unlock()
+
+	writeString(w, token)
+}
+
+func (g *FakeGateway) version(w http.ResponseWriter, r *http.Request, _ string) {
+	g.Admin.Lock()
+	version := g.Admin.Version
+	g.Admin.Unlock()
+	writeString(w, version)
+}
+
+func systemLinks(s *siotypes.System) *siotypes.System {
+	c := *s
+	c.Links = []*siotypes.Link{
+		{Rel: "self", HREF: "/api/instances/System::" + s.ID},
+		{
+			Rel:  "/api/System/relationship/Statistics",
+			HREF: "/api/instances/System::" + s.ID + "/relationships/Statistics",
+		},
+	}
+	return &c
+}
+
+func poolLinks(p *siotypes.StoragePool) *siotypes.StoragePool {
+	c := *p
+	c.Links = []*siotypes.Link{
+		{Rel: "self", HREF: "/api/instances/StoragePool::" + p.ID},
+		{
+			Rel: "/api/StoragePool/relationship/Statistics",
+			HREF: "/api/instances/StoragePool::" + p.ID +
+				"/relationships/Statistics",
+		},
+		{
+			Rel: "/api/StoragePool/relationship/Volume",
+			HREF: "/api/instances/StoragePool::" + p.ID +
+				"/relationships/Volume",
+		},
+	}
+	return &c
+}
+
+func (g *FakeGateway) getSystems(w http.ResponseWriter, r *http.Request, _ string) {
+	g.Admin.Lock()
+	systems := make([]*siotypes.System, 0, len(g.Admin.Systems))
+	for _, s := range g.Admin.Systems {
+		systems = append(systems, systemLinks(s))
+	}
+	g.Admin.Unlock()
+	writeJSON(w, systems)
+}
+
+func (g *FakeGateway) getSystemStatistics(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	stats, err := g.Admin.GetSystemStatistics(&siotypes.System{ID: id})
+	writeResult(w, stats, err)
+}
+
+func (g *FakeGateway) getSdcs(w http.ResponseWriter, r *http.Request, id string) {
+	g.Admin.Lock()
+	sdcs := make([]*siotypes.Sdc, 0, len(g.Admin.SDCs))
+	for _, sdc := range g.Admin.SDCs {
+		c := *sdc
+		c.SystemID = id
+		sdcs = append(sdcs, &c)
+	}
+	g.Admin.Unlock()
+	writeJSON(w, sdcs)
+}
+
+func (g *FakeGateway) getSdcVolumes(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	vols, err := g.Admin.GetSdcVolumes(id)
+	if err == nil && vols == nil {
+		vols = []*siotypes.Volume{}
+	}
+	writeResult(w, vols, err)
+}
+
+func (g *FakeGateway) getProtectionDomain(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	pd, err := g.Admin.GetProtectionDomain(id)
+	writeResult(w, pd, err)
+}
+
+func (g *FakeGateway) getStoragePools(
+	w http.ResponseWriter, r *http.Request, _ string) {
+
+	pools, err := g.Admin.GetStoragePools()
+	for i, p := range pools {
+		pools[i] = poolLinks(p)
+	}
+	writeResult(w, pools, err)
+}
+
+func (g *FakeGateway) getStoragePoolStatistics(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	stats, err := g.Admin.GetStoragePoolStatistics(
+		&siotypes.StoragePool{ID: id})
+	writeResult(w, stats, err)
+}
+
+func (g *FakeGateway) getStoragePoolVolumes(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	vols, err := g.Admin.GetStoragePoolVolumes(&siotypes.StoragePool{ID: id})
+	if err == nil && vols == nil {
+		vols = []*siotypes.Volume{}
+	}
+	writeResult(w, vols, err)
+}
+
+func (g *FakeGateway) getVolumes(w http.ResponseWriter, r *http.Request, _ string) {
+	vols, err := g.Admin.GetVolume("", "", "", "", false)
+	writeResult(w, vols, err)
+}
+
+func (g *FakeGateway) getVolume(w http.ResponseWriter, r *http.Request, id string) {
+	vols, err := g.Admin.GetVolume("", id, "", "", false)
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	writeJSON(w, vols[0])
+}
+
+func (g *FakeGateway) getVolumeStatistics(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	bwcs, err := g.Admin.GetVolumeBwcs(&siotypes.Volume{ID: id})
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	stats := map[string]interface{}{"numOfMappedSdcs": 0}
+	for name, bwc := range bwcs {
+		stats[name] = bwc
+	}
+	writeJSON(w, stats)
+}
+
+// decode reads the JSON body of r into v, writing an error if it can't
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func (g *FakeGateway) createVolume(
+	w http.ResponseWriter, r *http.Request, _ string) {
+
+	var param siotypes.VolumeParam
+	if !decode(w, r, &param) {
+		return
+	}
+
+	// clients name the pool by ID, while FakeAdmin expects its name
+	g.Admin.Lock()
+	pool := g.Admin.findStoragePool(param.StoragePoolID, "")
+	g.Admin.Unlock()
+	if pool == nil {
+		writeError(w, http.StatusInternalServerError, ErrPoolNotFound)
+		return
+	}
+	rep, err := g.Admin.CreateVolume(&param, pool.Name)
+	writeResult(w, rep, err)
+}
+
+func (g *FakeGateway) snapshotVolumes(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	var param siotypes.SnapshotVolumesParam
+	if !decode(w, r, &param) {
+		return
+	}
+	rep, err := g.Admin.SnapshotVolumes(&siotypes.System{ID: id}, &param)
+	writeResult(w, rep, err)
+}
+
+func (g *FakeGateway) queryVolumeID(
+	w http.ResponseWriter, r *http.Request, _ string) {
+
+	var param siotypes.VolumeQeryIdByKeyParam
+	if !decode(w, r, &param) {
+		return
+	}
+	id, err := g.Admin.FindVolumeID(param.Name)
+	if err != nil {
+		writeResult(w, nil, err)
+		return
+	}
+	writeString(w, id)
+}
+
+func (g *FakeGateway) removeVolume(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	var param siotypes.RemoveVolumeParam
+	if !decode(w, r, &param) {
+		return
+	}
+	err := g.Admin.RemoveVolume(&siotypes.Volume{ID: id}, param.RemoveMode)
+	writeResult(w, struct{}{}, err)
+}
+
+func (g *FakeGateway) mapVolumeSdc(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	var param siotypes.MapVolumeSdcParam
+	if !decode(w, r, &param) {
+		return
+	}
+	err := g.Admin.MapVolumeSdc(&siotypes.Volume{ID: id}, &param)
+	writeResult(w, struct{}{}, err)
+}
+
+func (g *FakeGateway) unmapVolumeSdc(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	var param siotypes.UnmapVolumeSdcParam
+	if !decode(w, r, &param) {
+		return
+	}
+	err := g.Admin.UnmapVolumeSdc(&siotypes.Volume{ID: id}, &param)
+	writeResult(w, struct{}{}, err)
+}
+
+func (g *FakeGateway) setMappedSdcLimits(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	var param siotypes.SetMappedSdcLimitsParam
+	if !decode(w, r, &param) {
+		return
+	}
+	err := g.Admin.SetMappedSdcLimits(&siotypes.Volume{ID: id}, &param)
+	writeResult(w, struct{}{}, err)
+}
+
+func (g *FakeGateway) setVolumeName(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	var param struct {
+		NewName string `json:"newName"`
+	}
+	if !decode(w, r, &param) {
+		return
+	}
+	err := g.Admin.SetVolumeName(&siotypes.Volume{ID: id}, param.NewName)
+	writeResult(w, struct{}{}, err)
+}
+
+func (g *FakeGateway) setVolumeUseRmcache(
+	w http.ResponseWriter, r *http.Request, id string) {
+
+	var param struct {
+		UseRmcache string `json:"useRmcache"`
+	}
+	if !decode(w, r, &param) {
+		return
+	}
+	useRmcache, err := strconv.ParseBool(param.UseRmcache)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = g.Admin.SetVolumeUseRmcache(&siotypes.Volume{ID: id}, useRmcache)
+	writeResult(w, struct{}{}, err)
+}